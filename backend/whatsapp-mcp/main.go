@@ -1,71 +1,482 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
 	"math"
 	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 	"github.com/mdp/qrterminal"
 	"github.com/skip2/go-qrcode"
 
 	"bytes"
 
 	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/socket"
 	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
+	"go.mau.fi/whatsmeow/util/cbcutil"
+	"go.mau.fi/whatsmeow/util/gcmutil"
+	"go.mau.fi/whatsmeow/util/hkdfutil"
 	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
 
 // Global QR code storage for API access
-var currentQRCode string
+var currentQRCode string         // Base64 PNG at the default size and error correction
+var currentQRRaw string          // Raw pairing string, rendered on demand for custom parameters
+var currentQRExpiresAt time.Time // When WhatsApp rotates to the next code
 var qrCodeMutex sync.RWMutex
 
+// QR code rendering defaults and bounds for /api/qr-code
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+// storeQRCode publishes a new pairing code for API access
+func storeQRCode(code string, timeout time.Duration) error {
+	qrPNG, err := qrcode.Encode(code, qrcode.Medium, defaultQRSize)
+	if err != nil {
+		return err
+	}
+	qrCodeMutex.Lock()
+	currentQRCode = base64.StdEncoding.EncodeToString(qrPNG)
+	currentQRRaw = code
+	currentQRExpiresAt = time.Now().Add(timeout)
+	qrCodeMutex.Unlock()
+	return nil
+}
+
+// publishQRGenerated emits a qr_generated event so onboarding UIs can render the code without polling
+func publishQRGenerated(messageStore *MessageStore, code string, timeout time.Duration) {
+	go dispatchEventWebhooks(messageStore, "qr_generated", map[string]interface{}{
+		"code":        code,
+		"timeout_sec": int64(timeout.Seconds()),
+		"expires_at":  time.Now().Add(timeout).UTC().Format(time.RFC3339),
+	})
+}
+
+// WhatsApp closes the login websocket once its QR codes run out, which also ends a linking code
+const phonePairingTTL = 160 * time.Second
+
+// PhonePairing tracks the linking code issued through /api/pair-phone
+type PhonePairing struct {
+	mutex     sync.RWMutex
+	phone     string
+	code      string
+	issuedAt  time.Time
+	expiresAt time.Time
+}
+
+var phonePairing = &PhonePairing{}
+
+func (pairing *PhonePairing) set(phone, code string) {
+	pairing.mutex.Lock()
+	pairing.phone = phone
+	pairing.code = code
+	pairing.issuedAt = time.Now()
+	pairing.expiresAt = pairing.issuedAt.Add(phonePairingTTL)
+	pairing.mutex.Unlock()
+}
+
+// clear drops the linking code (paired, or a new code was requested)
+func (pairing *PhonePairing) clear() {
+	pairing.mutex.Lock()
+	pairing.phone = ""
+	pairing.code = ""
+	pairing.issuedAt = time.Time{}
+	pairing.expiresAt = time.Time{}
+	pairing.mutex.Unlock()
+}
+
+// snapshot reports the pending linking code, if it is still valid
+func (pairing *PhonePairing) snapshot() map[string]interface{} {
+	pairing.mutex.RLock()
+	defer pairing.mutex.RUnlock()
+	if pairing.code == "" || time.Now().After(pairing.expiresAt) {
+		return map[string]interface{}{"pending": false}
+	}
+	return map[string]interface{}{
+		"pending":    true,
+		"phone":      pairing.phone,
+		"code":       pairing.code,
+		"issued_at":  pairing.issuedAt.UTC().Format(time.RFC3339),
+		"expires_at": pairing.expiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// phonePairingFor returns the linking code state of the session owning messageStore
+func phonePairingFor(messageStore *MessageStore) *PhonePairing {
+	if account := accounts.byStore(messageStore); account != nil {
+		return account.pairing
+	}
+	return phonePairing
+}
+
+// clearQRCode drops the current pairing code (paired or logged out)
+func clearQRCode() {
+	qrCodeMutex.Lock()
+	currentQRCode = ""
+	currentQRRaw = ""
+	currentQRExpiresAt = time.Time{}
+	qrCodeMutex.Unlock()
+}
+
+// parseQRLevel maps an error-correction level name to the encoder's recovery level
+func parseQRLevel(value string) (qrcode.RecoveryLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "m", "medium":
+		return qrcode.Medium, nil
+	case "l", "low":
+		return qrcode.Low, nil
+	case "q", "high":
+		return qrcode.High, nil
+	case "h", "highest":
+		return qrcode.Highest, nil
+	}
+	return qrcode.Medium, fmt.Errorf("invalid level %q (use low, medium, high or highest)", value)
+}
+
+// renderQRSVG draws the code as an SVG document of roughly size pixels square
+func renderQRSVG(code string, level qrcode.RecoveryLevel, size int) (string, error) {
+	qr, err := qrcode.New(code, level)
+	if err != nil {
+		return "", err
+	}
+	bitmap := qr.Bitmap()
+	modules := len(bitmap)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, modules, modules)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#ffffff"/><path fill="#000000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String(), nil
+}
+
 // API authentication secret (Phase Security-1: SSRF Prevention)
 // Read from MCP_API_SECRET environment variable
 var apiSecret string
 
+// Tokens whose /api/send requests are held for supervisor approval (MCP_MODERATED_TOKENS,
+// comma-separated). They authenticate like MCP_API_SECRET but may only call what
+// moderatedAllowed lets through.
+var moderatedTokens = map[string]bool{}
+
+// Endpoints moderated tokens may read (GET/HEAD). A trailing "/" covers the subtree.
+var moderatedReadPaths = []string{
+	"/api/messages", "/api/messages/latest", "/api/message-status", "/api/message-members", "/api/search",
+	"/api/chats", "/api/chats/", "/api/chat-metadata", "/api/chat-assignment", "/api/contacts", "/api/contact-attributes",
+	"/api/events", "/api/events/responses", "/api/pins", "/api/avatar", "/api/broadcast-lists",
+	"/api/groups", "/api/groups/info", "/api/group/invite-info", "/api/newsletters/analytics",
+	"/api/media/stream", "/api/media/thumbnail", "/api/download/batch", "/api/download/status",
+}
+
+// Endpoints moderated tokens may call with any method. /api/send queues their sends for
+// approval; uploads and downloads only stage media. Typing indicators (/api/chat-state) and read
+// receipts (/api/mark-read) carry no content, and a moderated bot working its inbox needs them.
+var moderatedActionPaths = []string{
+	"/api/send", "/api/upload/initiate", "/api/upload/chunk", "/api/upload/complete", "/api/upload/status",
+	"/api/download", "/api/download/chat", "/api/check-numbers", "/api/phone/normalize", "/api/preview",
+	"/api/chat-state", "/api/mark-read",
+}
+
+// moderatedAllowed reports whether a moderated token may make a request. Anything not listed,
+// including endpoints added later, is refused.
+func moderatedAllowed(r *http.Request) bool {
+	matches := func(paths []string) bool {
+		return slices.ContainsFunc(paths, func(path string) bool {
+			return r.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path))
+		})
+	}
+	if matches(moderatedActionPaths) {
+		return true
+	}
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && matches(moderatedReadPaths)
+}
+
+type moderationContextKey struct{}
+
+// SessionState is the lifecycle state of the WhatsApp session
+type SessionState string
+
+const (
+	SessionUnpaired  SessionState = "UNPAIRED"   // No device credentials stored
+	SessionPairing   SessionState = "PAIRING"    // QR or linking code issued, waiting for the phone
+	SessionConnected SessionState = "CONNECTED"  // Connected and authenticated
+	SessionDegraded  SessionState = "DEGRADED"   // Credentials present but the connection is down or recovering
+	SessionBanned    SessionState = "BANNED"     // Temporarily banned by WhatsApp
+	SessionLoggedOut SessionState = "LOGGED_OUT" // Unlinked from the phone or replaced; re-pairing required
+)
+
+// sessionTransitions lists the states reachable from each state; anything else is ignored
+var sessionTransitions = map[SessionState][]SessionState{
+	SessionUnpaired:  {SessionPairing, SessionConnected, SessionLoggedOut},
+	SessionPairing:   {SessionConnected, SessionUnpaired, SessionLoggedOut},
+	SessionConnected: {SessionDegraded, SessionBanned, SessionLoggedOut},
+	SessionDegraded:  {SessionConnected, SessionBanned, SessionLoggedOut},
+	SessionBanned:    {SessionConnected, SessionLoggedOut, SessionUnpaired},
+	SessionLoggedOut: {SessionUnpaired, SessionPairing, SessionConnected},
+}
+
 // Reconnection state management
 type ReconnectionState struct {
 	mutex                sync.RWMutex
+	state                SessionState
+	stateReason          string
+	stateChangedAt       time.Time
 	reconnectAttempts    int
 	maxReconnectAttempts int
 	lastReconnectTime    time.Time
 	lastActivityTime     time.Time
 	sessionStartTime     time.Time
-	isReconnecting       bool
 	reconnectLoopActive  bool
-	needsReauth          bool
+	onTransition         func(from, to SessionState, reason string)
 }
 
 var reconnectState = &ReconnectionState{
+	state:                SessionUnpaired,
 	maxReconnectAttempts: 10,
 	sessionStartTime:     time.Time{},
 }
 
+// transition moves the session to a new state if the transition is defined,
+// reporting whether the state changed
+func (r *ReconnectionState) transition(to SessionState, reason string) bool {
+	r.mutex.Lock()
+	from := r.state
+	if from == to || !slices.Contains(sessionTransitions[from], to) {
+		r.mutex.Unlock()
+		return false
+	}
+	r.state = to
+	r.stateReason = reason
+	r.stateChangedAt = time.Now()
+	onTransition := r.onTransition
+	r.mutex.Unlock()
+
+	fmt.Printf("🔀 Session state %s -> %s (%s)\n", from, to, reason)
+	if onTransition != nil {
+		onTransition(from, to, reason)
+	}
+	return true
+}
+
+// current returns the session state
+func (r *ReconnectionState) current() SessionState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.state
+}
+
+// needsReauthLocked reports whether a QR scan is required to recover; caller holds the mutex
+func (r *ReconnectionState) needsReauthLocked() bool {
+	switch r.state {
+	case SessionUnpaired, SessionPairing, SessionLoggedOut:
+		return true
+	case SessionDegraded:
+		return r.reconnectAttempts >= r.maxReconnectAttempts
+	}
+	return false
+}
+
+// EndpointTimeouts bounds how long requests wait on WhatsApp and the database.
+// Each is configurable in seconds; handlers derive their contexts from the request
+// so a client disconnect cancels the work as well.
+type EndpointTimeouts struct {
+	Send     time.Duration // MCP_SEND_TIMEOUT_SEC (default 60): message sends
+	Upload   time.Duration // MCP_UPLOAD_TIMEOUT_SEC (default 60): media upload base, plus 1s per MB
+	Download time.Duration // MCP_DOWNLOAD_TIMEOUT_SEC (default 600, 0 = none): media downloads
+	Query    time.Duration // MCP_QUERY_TIMEOUT_SEC (default 30): database queries behind API endpoints
+}
+
+var endpointTimeouts = EndpointTimeouts{
+	Send:     60 * time.Second,
+	Upload:   60 * time.Second,
+	Download: 10 * time.Minute,
+	Query:    30 * time.Second,
+}
+
+// loadEndpointTimeouts reads endpoint timeouts from the environment
+func loadEndpointTimeouts() EndpointTimeouts {
+	seconds := func(name string, def time.Duration) time.Duration {
+		return time.Duration(getEnvInt(name, int(def/time.Second))) * time.Second
+	}
+	return EndpointTimeouts{
+		Send:     seconds("MCP_SEND_TIMEOUT_SEC", endpointTimeouts.Send),
+		Upload:   seconds("MCP_UPLOAD_TIMEOUT_SEC", endpointTimeouts.Upload),
+		Download: seconds("MCP_DOWNLOAD_TIMEOUT_SEC", endpointTimeouts.Download),
+		Query:    seconds("MCP_QUERY_TIMEOUT_SEC", endpointTimeouts.Query),
+	}
+}
+
+// withOptionalTimeout applies a timeout unless it is zero (disabled)
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextErrorMessage explains why a call stopped when its context ended ("" if it didn't)
+func contextErrorMessage(ctx context.Context, action string, timeout time.Duration) string {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Sprintf("Timeout %s (%v exceeded)", action, timeout)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Sprintf("Cancelled while %s (client went away)", action)
+	}
+	return ""
+}
+
+// Offline sync state: after each connect the server replays events missed while offline.
+// Consumers should hold replies until completed is true so they don't answer stale backlog.
+type OfflineSyncState struct {
+	mutex       sync.RWMutex
+	completed   bool
+	expected    events.OfflineSyncPreview
+	delivered   int
+	connectedAt time.Time
+	completedAt time.Time
+}
+
+var offlineSyncState = &OfflineSyncState{}
+
+// Reset on a new connection (the server sends a fresh backlog)
+func (s *OfflineSyncState) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.completed = false
+	s.expected = events.OfflineSyncPreview{}
+	s.delivered = 0
+	s.connectedAt = time.Now()
+	s.completedAt = time.Time{}
+}
+
+func (s *OfflineSyncState) setPreview(preview events.OfflineSyncPreview) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expected = preview
+}
+
+func (s *OfflineSyncState) complete(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.completed = true
+	s.delivered = count
+	s.completedAt = time.Now()
+}
+
+// snapshot returns the state for API responses
+func (s *OfflineSyncState) snapshot() map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	snapshot := map[string]interface{}{
+		"completed":         s.completed,
+		"expected_total":    s.expected.Total,
+		"expected_messages": s.expected.Messages,
+		"delivered":         s.delivered,
+	}
+	if !s.completedAt.IsZero() {
+		snapshot["completed_at"] = s.completedAt.UTC().Format(time.RFC3339)
+		snapshot["duration_ms"] = s.completedAt.Sub(s.connectedAt).Milliseconds()
+	}
+	return snapshot
+}
+
+// getEnvInt reads an integer environment variable, returning def when unset or invalid
+func getEnvInt(name string, def int) int {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("Warning: invalid %s=%q, using default %d\n", name, value, def)
+		return def
+	}
+	return parsed
+}
+
+// getEnvBool reads a boolean environment variable, returning def when unset or invalid
+func getEnvBool(name string, def bool) bool {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("Warning: invalid %s=%q, using default %v\n", name, value, def)
+		return def
+	}
+	return parsed
+}
+
 // Message represents a chat message for our client
 type Message struct {
+	ID        string
 	Time      time.Time
 	Sender    string
 	Content   string
@@ -74,35 +485,78 @@ type Message struct {
 	Filename  string
 }
 
+// storeDir holds the primary account's databases and media, and the other accounts under accounts/
+// (-store-dir or MCP_STORE_DIR; relative paths resolve against the working directory)
+var storeDir = "store"
+
+// sqliteURI turns a database path into the file: URI go-sqlite3 opens on every OS: forward
+// slashes, a leading slash before Windows drive letters and URI metacharacters escaped
+func sqliteURI(path string) string {
+	uri := filepath.ToSlash(path)
+	if filepath.VolumeName(path) != "" {
+		// C:/x becomes /C:/x; UNC shares (//host/share) need an empty authority in front
+		uri = "/" + uri
+		if strings.HasPrefix(uri, "///") {
+			uri = "/" + uri
+		}
+	}
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(uri)
+}
+
 // Database handler for storing message history
 type MessageStore struct {
-	db *sql.DB
+	db     *sql.DB       // Read-only pool (messageDBReadConns) for queries
+	writer *sql.DB       // Writes, serialized over one connection
+	dir    string        // Holds messages.db and downloaded media (storeDir for the primary account)
+	writes *WriteBatcher // Batches chat and message upserts
+	// searchIndexed is set when messages_fts is available (SQLite built with FTS5)
+	searchIndexed bool
+	// ctx is the caller context queries are bound to (see WithContext); nil means none
+	ctx context.Context
 }
 
-// Initialize message store
-func NewMessageStore() (*MessageStore, error) {
+// Connection pool sizing for messages.db
+const (
+	// messageDBReadConns caps concurrent readers (polling, search, exports)
+	messageDBReadConns = 8
+	// messageDBBusyTimeout is how long SQLite waits for a lock before failing with SQLITE_BUSY
+	messageDBBusyTimeout = 10 * time.Second
+)
+
+// Initialize message store in dir
+func NewMessageStore(dir string) (*MessageStore, error) {
 	// Create directory for database if it doesn't exist
-	if err := os.MkdirAll("store", 0755); err != nil {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create store directory: %v", err)
 	}
 
 	// Open SQLite database for messages
 	// Use WAL mode for better concurrency and add synchronous=NORMAL for durability
-	db, err := sql.Open("sqlite3", "file:store/messages.db?_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL")
+	dsn := sqliteURI(filepath.Join(dir, "messages.db")) + "?_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL&_loc=UTC" +
+		"&_busy_timeout=" + strconv.FormatInt(messageDBBusyTimeout.Milliseconds(), 10)
+
+	// This handle becomes the writer, which also creates and migrates the schema. All writes
+	// share its one connection, so concurrent writers (history sync, live messages, API updates)
+	// queue up in the pool instead of contending for SQLite's write lock. Transactions start
+	// IMMEDIATE: a deferred one upgrading to a write lock gets SQLITE_BUSY straight away
+	// instead of waiting out the busy timeout.
+	db, err := sql.Open("sqlite3", dsn+"&_txlock=immediate")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open message database: %v", err)
+		return nil, fmt.Errorf("failed to open message database: %w", err)
 	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
 
 	// Ensure WAL mode is set and verify connection works
 	_, err = db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to set WAL mode: %v", err)
+		return nil, fmt.Errorf("failed to set WAL mode: %w", err)
 	}
 	_, err = db.Exec("PRAGMA synchronous=NORMAL")
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to set synchronous mode: %v", err)
+		return nil, fmt.Errorf("failed to set synchronous mode: %w", err)
 	}
 
 	// Create tables if they don't exist
@@ -130,2183 +584,19450 @@ func NewMessageStore() (*MessageStore, error) {
 			PRIMARY KEY (id, chat_jid),
 			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
 		);
+		CREATE INDEX IF NOT EXISTS idx_messages_chat_timestamp ON messages(chat_jid, timestamp, id);
+		CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp, id);
+
+		CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			filename TEXT,
+			mime_type TEXT,
+			total_size INTEGER,
+			received_size INTEGER DEFAULT 0,
+			status TEXT,
+			path TEXT,
+			created_at TIMESTAMP,
+			completed_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS event_responses (
+			event_id TEXT,
+			chat_jid TEXT,
+			responder TEXT,
+			response TEXT,
+			extra_guests INTEGER DEFAULT 0,
+			timestamp TIMESTAMP,
+			PRIMARY KEY (event_id, chat_jid, responder)
+		);
+
+		CREATE TABLE IF NOT EXISTS pinned_messages (
+			chat_jid TEXT,
+			message_id TEXT,
+			pinned_by TEXT,
+			pinned_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			PRIMARY KEY (chat_jid, message_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS message_reactions (
+			chat_jid TEXT,
+			message_id TEXT,
+			sender TEXT,
+			emoji TEXT,
+			reacted_at TIMESTAMP,
+			PRIMARY KEY (chat_jid, message_id, sender)
+		);
+
+		CREATE TABLE IF NOT EXISTS sync_checkpoints (
+			chat_jid TEXT PRIMARY KEY,
+			oldest_synced TIMESTAMP,
+			newest_synced TIMESTAMP,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS pending_sends (
+			id TEXT PRIMARY KEY,
+			requested_by TEXT,
+			request TEXT,
+			status TEXT,
+			reason TEXT,
+			result TEXT,
+			created_at TIMESTAMP,
+			decided_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS outbox (
+			id TEXT PRIMARY KEY,
+			idempotency_key TEXT UNIQUE,
+			request TEXT,
+			status TEXT,
+			attempts INTEGER DEFAULT 0,
+			next_attempt_at TIMESTAMP,
+			error_code TEXT,
+			result TEXT,
+			created_at TIMESTAMP,
+			completed_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox(status, next_attempt_at);
+
+		CREATE TABLE IF NOT EXISTS accounts (
+			id TEXT PRIMARY KEY,
+			name TEXT,
+			created_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS newsletter_posts (
+			newsletter_jid TEXT,
+			server_id INTEGER,
+			message_id TEXT,
+			type TEXT,
+			content TEXT,
+			posted_at TIMESTAMP,
+			views INTEGER DEFAULT 0,
+			reactions TEXT, -- JSON object of emoji -> count
+			updated_at TIMESTAMP,
+			PRIMARY KEY (newsletter_jid, server_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS message_templates (
+			name TEXT,
+			locale TEXT,
+			body TEXT,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (name, locale)
+		);
+
+		CREATE TABLE IF NOT EXISTS contact_attributes (
+			jid TEXT,
+			key TEXT,
+			value TEXT,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (jid, key)
+		);
+
+		CREATE TABLE IF NOT EXISTS opt_outs (
+			phone TEXT PRIMARY KEY,
+			source TEXT,
+			keyword TEXT,
+			reason TEXT,
+			created_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS campaigns (
+			id TEXT PRIMARY KEY,
+			name TEXT,
+			template TEXT,
+			template_name TEXT,
+			media_path TEXT,
+			status TEXT,
+			messages_per_minute INTEGER,
+			jitter_sec INTEGER DEFAULT 0,
+			start_at TIMESTAMP,
+			created_at TIMESTAMP,
+			completed_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS campaign_recipients (
+			campaign_id TEXT,
+			recipient TEXT,
+			send_to TEXT,
+			variables TEXT,
+			status TEXT,
+			message_id TEXT,
+			error TEXT,
+			sent_at TIMESTAMP,
+			delivered_at TIMESTAMP,
+			read_at TIMESTAMP,
+			PRIMARY KEY (campaign_id, recipient)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_campaign_recipients_message ON campaign_recipients(message_id);
+
+		CREATE TABLE IF NOT EXISTS chat_tags (
+			chat_jid TEXT,
+			tag TEXT COLLATE NOCASE,
+			created_at TIMESTAMP,
+			PRIMARY KEY (chat_jid, tag)
+		);
+
+		CREATE TABLE IF NOT EXISTS broadcast_lists (
+			jid TEXT PRIMARY KEY,
+			name TEXT,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS broadcast_recipients (
+			list_jid TEXT,
+			recipient_jid TEXT,
+			PRIMARY KEY (list_jid, recipient_jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS companion_devices (
+			device_id INTEGER PRIMARY KEY,
+			platform TEXT,
+			last_seen TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS avatars (
+			jid TEXT PRIMARY KEY,
+			picture_id TEXT,
+			url TEXT,
+			status TEXT,
+			fetched_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			payload TEXT,
+			created_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_events_created_at ON events(created_at);
+
+		CREATE TABLE IF NOT EXISTS pending_downloads (
+			job_id TEXT PRIMARY KEY,
+			message_id TEXT,
+			chat_jid TEXT,
+			batch_id TEXT,
+			notify_event_id INTEGER, -- Message event to deliver to webhooks once downloaded
+			created_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id TEXT,
+			event_id INTEGER,
+			body TEXT,
+			attempts INTEGER DEFAULT 0,
+			created_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_stats (
+			webhook_id TEXT PRIMARY KEY,
+			delivered INTEGER DEFAULT 0,
+			failed INTEGER DEFAULT 0,
+			last_success_at TIMESTAMP,
+			last_failure_at TIMESTAMP,
+			last_error TEXT
+		);
+
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			media_mode TEXT DEFAULT 'metadata',
+			inline_max_bytes INTEGER DEFAULT 0,
+			created_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id TEXT,
+			event_id INTEGER,
+			body TEXT,
+			attempts INTEGER,
+			last_error TEXT,
+			created_at TIMESTAMP,
+			failed_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS message_flags (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			rule TEXT,
+			match TEXT,
+			status TEXT,
+			note TEXT,
+			created_at TIMESTAMP,
+			reviewed_at TIMESTAMP,
+			UNIQUE (message_id, chat_jid, rule)
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_flags_status ON message_flags(status, created_at);
+
+		CREATE TABLE IF NOT EXISTS message_receipts (
+			message_id TEXT,
+			chat_jid TEXT,
+			recipient TEXT,
+			status TEXT,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid, recipient)
+		);
+
+		CREATE TABLE IF NOT EXISTS message_member_snapshots (
+			message_id TEXT,
+			chat_jid TEXT,
+			participants TEXT,
+			participant_count INTEGER,
+			captured_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS schema_markers (
+			name TEXT PRIMARY KEY,
+			applied_at TIMESTAMP
+		);
 	`)
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create tables: %v", err)
+		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
 
-	return &MessageStore{db: db}, nil
-}
-
-// Close the database connection
-func (store *MessageStore) Close() error {
-	return store.db.Close()
-}
+	// Schema migrations: add columns introduced after the original tables were created
+	migrations := []struct {
+		table, column, definition string
+	}{
+		{"messages", "local_path", "TEXT"}, // Set once media has been downloaded to store/
+		{"messages", "gif_playback", "BOOLEAN DEFAULT 0"},
+		{"messages", "page_count", "INTEGER"},
+		{"messages", "thumbnail", "BLOB"}, // Inline JPEG preview carried by document messages
+		{"messages", "is_animated", "BOOLEAN DEFAULT 0"},
+		{"messages", "is_kept", "BOOLEAN DEFAULT 0"},      // Kept in a disappearing chat
+		{"messages", "mentions_all", "BOOLEAN DEFAULT 0"}, // @all mention
+		{"messages", "group_mentions", "TEXT"},            // JSON list of mentioned community subgroups
+		{"messages", "broadcast_jid", "TEXT"},             // Broadcast list an inbound message was sent through
+		{"messages", "content_type", "TEXT"},              // See extractContentType
+		{"messages", "raw_message", "BLOB"},               // Serialized message proto, for re-parsing (MCP_STORE_RAW_MESSAGES)
+		{"messages", "quoted_message_id", "TEXT"},         // Message this one replies to
+		{"messages", "quoted_sender", "TEXT"},             // Author of the quoted message
+		{"messages", "edited_at", "TIMESTAMP"},            // Latest edit
+		{"messages", "edit_history", "TEXT"},              // JSON list of replaced versions, oldest first
+		{"messages", "read_at", "TIMESTAMP"},              // We sent a read receipt
+		{"messages", "content_unmasked", "TEXT"},          // Original of content masked by MCP_PII_MASKING
+		{"messages", "delivery_status", "TEXT"},           // Our messages: furthest receipt status (see receiptStatuses)
+		// Chat organization mirrored from the phone via app-state sync
+		{"chats", "is_muted", "BOOLEAN DEFAULT 0"},
+		{"chats", "muted_until", "TIMESTAMP"}, // NULL while muted = muted indefinitely
+		{"chats", "is_pinned", "BOOLEAN DEFAULT 0"},
+		{"chats", "is_archived", "BOOLEAN DEFAULT 0"},
+		{"chats", "chat_type", "TEXT"}, // See chatTypeForJID
+		{"chats", "notes", "TEXT"},     // Free-form agent notes, local only
+		// Inbound messages since the chat was last read (see ensureUnreadCounter)
+		{"chats", "unread_count", "INTEGER NOT NULL DEFAULT 0"},
+		// Conversation handoff (see handoffStates)
+		{"chats", "handoff_state", "TEXT"},
+		{"chats", "assignee", "TEXT"},
+		{"chats", "handoff_updated_at", "TIMESTAMP"},
+		{"chats", "welcomed_at", "TIMESTAMP"},   // First-contact greeting sent (MCP_WELCOME_MESSAGE)
+		{"chats", "intro_sent_at", "TIMESTAMP"}, // Group introduction sent (MCP_GROUP_INTRO_MESSAGE)
+		{"campaigns", "template_name", "TEXT"},  // Localized template (message_templates) instead of inline text
+		{"webhooks", "secret", "TEXT"},          // HMAC signing key (X-Webhook-Signature); NULL = unsigned
+		// Random extra delay per send on top of the pace
+		{"campaigns", "jitter_sec", "INTEGER DEFAULT 0"},
+		// When a failed delivery is next retried; NULL while its first attempt is in flight
+		{"webhook_deliveries", "next_attempt_at", "TIMESTAMP"},
+	}
+	for _, m := range migrations {
+		if err := addColumnIfMissing(db, m.table, m.column, m.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate %s.%s: %w", m.table, m.column, err)
+		}
+	}
 
-// StartCheckpointDaemon runs periodic WAL checkpoints to ensure data is synced to disk
-// This addresses Docker Desktop gRPC-FUSE filesystem sync issues on macOS
-// The daemon runs in a background goroutine and performs FULL checkpoint every 5 seconds
-func (store *MessageStore) StartCheckpointDaemon(stopChan <-chan struct{}) {
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
+	// Rows written before timestamps were normalized carry the writer's local UTC offset,
+	// which breaks text comparisons between them; rewrite them in UTC (once per database)
+	timestampColumns := []timestampColumn{
+		{"messages", "timestamp"},
+		{"messages", "edited_at"},
+		{"messages", "read_at"},
+		{"chats", "last_message_time"},
+		{"chats", "muted_until"},
+		{"event_responses", "timestamp"},
+		{"pinned_messages", "pinned_at"},
+		{"pinned_messages", "expires_at"},
+		{"message_reactions", "reacted_at"},
+		{"avatars", "fetched_at"},
+		{"events", "created_at"},
+		{"webhooks", "created_at"},
+		{"uploads", "created_at"},
+		{"uploads", "completed_at"},
+		{"chat_tags", "created_at"},
+		{"pending_sends", "created_at"},
+		{"webhook_stats", "last_success_at"},
+		{"accounts", "created_at"},
+		{"newsletter_posts", "posted_at"},
+		{"newsletter_posts", "updated_at"},
+		{"message_templates", "updated_at"},
+		{"contact_attributes", "updated_at"},
+		{"opt_outs", "created_at"},
+		{"message_flags", "created_at"},
+		{"message_flags", "reviewed_at"},
+		{"message_receipts", "updated_at"},
+		{"campaigns", "start_at"},
+		{"campaigns", "created_at"},
+		{"campaigns", "completed_at"},
+		{"campaign_recipients", "sent_at"},
+		{"campaign_recipients", "delivered_at"},
+		{"campaign_recipients", "read_at"},
+		{"webhook_stats", "last_failure_at"},
+		{"pending_sends", "decided_at"},
+		{"chats", "handoff_updated_at"},
+		{"chats", "welcomed_at"},
+		{"chats", "intro_sent_at"},
+		{"sync_checkpoints", "oldest_synced"},
+		{"sync_checkpoints", "newest_synced"},
+		{"sync_checkpoints", "updated_at"},
+		{"broadcast_lists", "updated_at"},
+		{"companion_devices", "last_seen"},
+		{"pending_downloads", "created_at"},
+		{"webhook_deliveries", "created_at"},
+		{"webhook_dead_letters", "created_at"},
+		{"webhook_dead_letters", "failed_at"},
+	}
+	if err := migrateTimestampsToUTC(db, timestampColumns); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to normalize timestamps to UTC: %v", err)
+	}
 
-		fmt.Println("📦 WAL checkpoint daemon started (5s interval)")
+	if err := backfillChatTypes(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to backfill chat types: %v", err)
+	}
+	if err := backfillContentTypes(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to backfill content types: %v", err)
+	}
 
-		for {
-			select {
-			case <-ticker.C:
-				// FULL checkpoint mode for maximum durability
-				// This transfers all WAL content to the main database file
-				_, err := store.db.Exec("PRAGMA wal_checkpoint(FULL)")
-				if err != nil {
-					fmt.Printf("Warning: Periodic WAL checkpoint failed: %v\n", err)
-				}
-			case <-stopChan:
-				// Final checkpoint before shutdown
-				store.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
-				fmt.Println("📦 WAL checkpoint daemon stopped")
-				return
-			}
-		}
-	}()
-}
+	if err := ensureUnreadCounter(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create unread counter: %v", err)
+	}
 
-// Store a chat in the database
-func (store *MessageStore) StoreChat(jid, name string, lastMessageTime time.Time) error {
-	_, err := store.db.Exec(
-		"INSERT OR REPLACE INTO chats (jid, name, last_message_time) VALUES (?, ?, ?)",
-		jid, name, lastMessageTime,
-	)
+	searchIndexed, err := ensureMessageSearchIndex(db)
 	if err != nil {
-		return err
+		db.Close()
+		return nil, fmt.Errorf("failed to create message search index: %v", err)
+	}
+	if !searchIndexed {
+		fmt.Println("⚠️ SQLite was built without FTS5 (sqlite_fts5 build tag); /api/search falls back to substring matching")
 	}
 
-	// CRITICAL FIX: Force WAL checkpoint after every write to ensure data is synced to disk
-	_, checkpointErr := store.db.Exec("PRAGMA wal_checkpoint(PASSIVE)")
-	if checkpointErr != nil {
-		fmt.Printf("Warning: WAL checkpoint failed: %v\n", checkpointErr)
+	// Queries get a separate read-only pool. With WAL, readers never wait for the writer, so
+	// heavy polling and search traffic can't hold up message ingestion (and vice versa).
+	reader, err := sql.Open("sqlite3", dsn+"&mode=ro")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open message database reader: %w", err)
+	}
+	reader.SetMaxOpenConns(messageDBReadConns)
+	reader.SetMaxIdleConns(messageDBReadConns)
+	if err := reader.Ping(); err != nil {
+		reader.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to open message database reader: %w", err)
 	}
 
-	return nil
+	return &MessageStore{db: reader, writer: db, dir: dir, writes: NewWriteBatcher(db), searchIndexed: searchIndexed}, nil
 }
 
-// Store a message in the database
-func (store *MessageStore) StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
-	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
-	// Only store if there's actual content or media
-	if content == "" && mediaType == "" {
-		return nil
+// ensureMessageSearchIndex maintains messages_fts, an FTS5 index over message content kept in
+// sync by triggers. It reports false when SQLite lacks FTS5; the triggers are then dropped so
+// writes keep working, and the index is rebuilt once a binary with FTS5 starts again.
+func ensureMessageSearchIndex(db *sql.DB) (bool, error) {
+	var available bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available); err != nil {
+		return false, err
 	}
-
-	_, err := store.db.Exec(
-		`INSERT OR REPLACE INTO messages
-		(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, chatJID, sender, content, timestamp, isFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength,
-	)
-	if err != nil {
-		return err
+	if !available {
+		_, err := db.Exec(`
+			DROP TRIGGER IF EXISTS messages_fts_insert;
+			DROP TRIGGER IF EXISTS messages_fts_delete;
+			DROP TRIGGER IF EXISTS messages_fts_update;
+		`)
+		return false, err
 	}
 
-	// CRITICAL FIX: Force WAL checkpoint after every write to ensure data is synced to disk
-	// This addresses Docker Desktop gRPC-FUSE filesystem sync issues on macOS
-	// PASSIVE mode checkpoints without blocking readers
-	_, checkpointErr := store.db.Exec("PRAGMA wal_checkpoint(PASSIVE)")
-	if checkpointErr != nil {
-		fmt.Printf("Warning: WAL checkpoint failed: %v\n", checkpointErr)
+	var triggers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'").Scan(&triggers); err != nil {
+		return false, err
+	}
+	if triggers == 3 {
+		return true, nil
 	}
+	// External-content table: only the index is stored, rows are read back from messages by rowid
+	_, err := db.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+			content, content='messages', tokenize='unicode61 remove_diacritics 2'
+		);
 
-	return nil
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+			INSERT INTO messages_fts(rowid, content) VALUES (new.rowid, new.content);
+		END;
+
+		INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');
+	`)
+	return err == nil, err
 }
 
-// Get messages from a chat
-func (store *MessageStore) GetMessages(chatJID string, limit int) ([]Message, error) {
-	rows, err := store.db.Query(
-		"SELECT sender, content, timestamp, is_from_me, media_type, filename FROM messages WHERE chat_jid = ? ORDER BY timestamp DESC LIMIT ?",
-		chatJID, limit,
-	)
-	if err != nil {
-		return nil, err
+// ensureUnreadCounter installs the trigger that counts new inbound messages into
+// chats.unread_count. The trigger only fires for inserts, so a redelivered message that is
+// upserted again isn't counted twice. Marking messages read resets the count (SetMessagesRead)
+// and history sync replaces it with the phone's count. When the trigger is first created, counts
+// are backfilled from messages without a read receipt.
+func ensureUnreadCounter(db *sql.DB) error {
+	var triggers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'chats_unread_insert'").Scan(&triggers); err != nil {
+		return err
 	}
-	defer rows.Close()
+	if triggers == 1 {
+		return nil
+	}
+	_, err := db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS chats_unread_insert AFTER INSERT ON messages
+		WHEN new.is_from_me = 0 AND new.read_at IS NULL BEGIN
+			UPDATE chats SET unread_count = unread_count + 1 WHERE jid = new.chat_jid;
+		END;
+
+		UPDATE chats SET unread_count = (
+			SELECT COUNT(*) FROM messages WHERE chat_jid = chats.jid AND is_from_me = 0 AND read_at IS NULL
+		);
+	`)
+	return err
+}
 
-	var messages []Message
+// Chat types stored in chats.chat_type
+const (
+	chatTypeIndividual = "individual"
+	chatTypeGroup      = "group"
+	chatTypeCommunity  = "community" // Parent group of a community; only known once group info was seen
+	chatTypeBroadcast  = "broadcast"
+	chatTypeNewsletter = "newsletter"
+	chatTypeStatus     = "status"
+)
+
+var chatTypes = []string{chatTypeIndividual, chatTypeGroup, chatTypeCommunity, chatTypeBroadcast, chatTypeNewsletter, chatTypeStatus}
+
+// chatTypeForJID classifies a chat by its JID server ("" when unknown)
+func chatTypeForJID(jid types.JID) string {
+	switch jid.Server {
+	case types.DefaultUserServer, types.HiddenUserServer, types.LegacyUserServer:
+		return chatTypeIndividual
+	case types.GroupServer:
+		return chatTypeGroup
+	case types.BroadcastServer:
+		if jid.User == types.StatusBroadcastJID.User {
+			return chatTypeStatus
+		}
+		return chatTypeBroadcast
+	case types.NewsletterServer:
+		return chatTypeNewsletter
+	}
+	return ""
+}
+
+// parseChatTypes parses a comma-separated chat_type filter, rejecting unknown types
+func parseChatTypes(value string) ([]string, error) {
+	var filter []string
+	for _, chatType := range strings.Split(value, ",") {
+		chatType = strings.ToLower(strings.TrimSpace(chatType))
+		if chatType == "" {
+			continue
+		}
+		if !slices.Contains(chatTypes, chatType) {
+			return nil, fmt.Errorf("unknown chat_type %q (expected one of %s)", chatType, strings.Join(chatTypes, ", "))
+		}
+		filter = append(filter, chatType)
+	}
+	return filter, nil
+}
+
+// backfillContentTypes classifies messages stored before content_type existed, using the
+// "type" field of the JSON that structured messages were rendered to
+func backfillContentTypes(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE messages SET content_type = CASE
+		WHEN json_valid(content) THEN CASE json_extract(content, '$.type')
+			WHEN 'interactive' THEN 'interactive'
+			WHEN 'list' THEN 'list'
+			WHEN 'buttons' THEN 'buttons'
+			WHEN 'list_response' THEN 'list_response'
+			WHEN 'buttons_response' THEN 'buttons_response'
+			WHEN 'template' THEN 'template'
+			WHEN 'template_response' THEN 'template_response'
+			WHEN 'contacts' THEN 'contact'
+			WHEN 'event' THEN 'event'
+			ELSE CASE WHEN COALESCE(media_type, '') != '' THEN 'media' ELSE 'text' END END
+		WHEN COALESCE(media_type, '') != '' THEN 'media'
+		ELSE 'text' END
+		WHERE content_type IS NULL`)
+	return err
+}
+
+// backfillChatTypes classifies chats stored before chat_type existed
+func backfillChatTypes(db *sql.DB) error {
+	rows, err := db.Query("SELECT jid FROM chats WHERE chat_type IS NULL")
+	if err != nil {
+		return err
+	}
+	var jids []string
 	for rows.Next() {
-		var msg Message
-		var timestamp time.Time
-		err := rows.Scan(&msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe, &msg.MediaType, &msg.Filename)
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
+			rows.Close()
+			return err
+		}
+		jids = append(jids, jid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, jid := range jids {
+		parsed, err := types.ParseJID(jid)
 		if err != nil {
-			return nil, err
+			continue
 		}
-		msg.Time = timestamp
-		messages = append(messages, msg)
+		if chatType := chatTypeForJID(parsed); chatType != "" {
+			if _, err := db.Exec("UPDATE chats SET chat_type = ? WHERE jid = ?", chatType, jid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// timestampColumn names a column holding timestamps
+type timestampColumn struct{ table, column string }
+
+// utcTimestampsMarker records in schema_markers that migrateTimestampsToUTC ran
+const utcTimestampsMarker = "utc_timestamps"
+
+// migrateTimestampsToUTC rewrites stored timestamps that are not already in UTC, keeping the
+// instant and its fractional seconds. Everything is written in UTC since, so it runs once:
+// schema_markers records it, instead of rescanning every column on each start.
+func migrateTimestampsToUTC(db *sql.DB, columns []timestampColumn) error {
+	var done int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_markers WHERE name = ?", utcTimestampsMarker).Scan(&done); err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
 	}
 
-	return messages, nil
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	layouts := append([]string{time.RFC3339Nano}, sqlite3.SQLiteTimestampFormats...)
+	for _, c := range columns {
+		rows, err := tx.Query(fmt.Sprintf(
+			"SELECT rowid, %[2]s FROM %[1]s WHERE typeof(%[2]s) = 'text' AND %[2]s NOT LIKE '%%+00:00'",
+			c.table, c.column,
+		))
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", c.table, c.column, err)
+		}
+		rewrites := make(map[int64]time.Time)
+		for rows.Next() {
+			var rowID int64
+			var value string
+			if err := rows.Scan(&rowID, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("%s.%s: %v", c.table, c.column, err)
+			}
+			for _, layout := range layouts {
+				if t, err := time.Parse(layout, value); err == nil {
+					rewrites[rowID] = t.UTC()
+					break
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%s.%s: %v", c.table, c.column, err)
+		}
+		for rowID, t := range rewrites {
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", c.table, c.column), t, rowID); err != nil {
+				return fmt.Errorf("%s.%s: %v", c.table, c.column, err)
+			}
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO schema_markers (name, applied_at) VALUES (?, ?)", utcTimestampsMarker, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// Get all chats
-func (store *MessageStore) GetChats() (map[string]time.Time, error) {
-	rows, err := store.db.Query("SELECT jid, last_message_time FROM chats ORDER BY last_message_time DESC")
+// addColumnIfMissing adds a column to an existing table unless it is already present
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	chats := make(map[string]time.Time)
 	for rows.Next() {
-		var jid string
-		var lastMessageTime time.Time
-		err := rows.Scan(&jid, &lastMessageTime)
-		if err != nil {
-			return nil, err
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
 		}
-		chats[jid] = lastMessageTime
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	rows.Close()
 
-	return chats, nil
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
-// InteractiveMessageData represents the JSON structure for interactive messages
-type InteractiveMessageData struct {
-	Type       string               `json:"type"`
-	Header     string               `json:"header,omitempty"`
-	Body       string               `json:"body,omitempty"`
-	Footer     string               `json:"footer,omitempty"`
-	Buttons    []InteractiveButton  `json:"buttons,omitempty"`
-	Sections   []InteractiveSection `json:"sections,omitempty"`
-	NativeFlow *NativeFlowData      `json:"native_flow,omitempty"`
+// WithContext returns a view of the store whose queries are cancelled along with ctx,
+// typically the HTTP request; the view shares the database and write batcher
+func (store *MessageStore) WithContext(ctx context.Context) *MessageStore {
+	view := *store
+	view.ctx = ctx
+	return &view
 }
 
-type InteractiveButton struct {
-	ID    string `json:"id"`
-	Title string `json:"title"`
+// context returns the caller context the store is bound to, or the background context
+func (store *MessageStore) context() context.Context {
+	if store.ctx != nil {
+		return store.ctx
+	}
+	return context.Background()
 }
 
-type InteractiveSection struct {
-	Title string           `json:"title,omitempty"`
-	Rows  []InteractiveRow `json:"rows"`
+// dbContext bounds a single store operation by the query timeout (MCP_QUERY_TIMEOUT_SEC),
+// so a locked database returns an error instead of blocking the caller indefinitely
+func (store *MessageStore) dbContext() (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(store.context(), endpointTimeouts.Query)
 }
 
-type InteractiveRow struct {
-	ID          string `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description,omitempty"`
+// Close the database connection (after committing queued writes)
+func (store *MessageStore) Close() error {
+	store.writes.Close()
+	if err := store.writer.Close(); err != nil {
+		store.db.Close()
+		return err
+	}
+	return store.db.Close()
 }
 
-type NativeFlowData struct {
-	Name       string                 `json:"name,omitempty"`
-	Parameters map[string]interface{} `json:"parameters,omitempty"`
-}
+// Write-behind batching of chat and message upserts
+const (
+	writeBatchSize       = 100
+	writeBatchInterval   = 200 * time.Millisecond
+	writeBatchQueueDepth = 1000
+)
 
-// formatInteractiveMessage converts an InteractiveMessage to JSON
-func formatInteractiveMessage(interactive *waProto.InteractiveMessage) string {
-	if interactive == nil {
-		return ""
-	}
+var errStoreClosed = errors.New("message store is closed")
 
-	data := InteractiveMessageData{
-		Type: "interactive",
-	}
+// pendingWrite is one queued statement; done receives its result when the caller waits for it
+type pendingWrite struct {
+	query string // Empty for a flush marker
+	args  []interface{}
+	done  chan error
+}
 
-	// Extract header
-	if header := interactive.GetHeader(); header != nil {
-		if title := header.GetTitle(); title != "" {
-			data.Header = title
-		} else if docMsg := header.GetDocumentMessage(); docMsg != nil {
-			data.Header = "[Document: " + docMsg.GetFileName() + "]"
-		} else if imgMsg := header.GetImageMessage(); imgMsg != nil {
-			data.Header = "[Image]"
-		} else if vidMsg := header.GetVideoMessage(); vidMsg != nil {
-			data.Header = "[Video]"
-		}
-	}
+// WriteBatcher commits queued writes together in one transaction every writeBatchInterval
+// or writeBatchSize rows, whichever comes first. A caller waiting on its write gets the batch
+// committed right away (along with whatever else is queued). WAL checkpoints are left to the
+// checkpoint daemon.
+type WriteBatcher struct {
+	db     *sql.DB
+	queue  chan pendingWrite
+	closed chan struct{}
 
-	// Extract body
-	if body := interactive.GetBody(); body != nil {
-		data.Body = body.GetText()
-	}
+	sendMutex sync.RWMutex
+	stopped   bool
 
-	// Extract footer
-	if footer := interactive.GetFooter(); footer != nil {
-		data.Footer = footer.GetText()
-	}
+	failedMutex sync.Mutex
+	failed      error // First error of a queued write since the last Flush
+}
 
-	// Extract native flow (used by business bots like Unimed)
-	if nativeFlow := interactive.GetNativeFlowMessage(); nativeFlow != nil {
-		data.NativeFlow = &NativeFlowData{}
-		// Try to parse the JSON parameters
-		if paramsJSON := nativeFlow.GetMessageParamsJSON(); paramsJSON != "" {
-			var params map[string]interface{}
-			if err := json.Unmarshal([]byte(paramsJSON), &params); err == nil {
-				data.NativeFlow.Parameters = params
-			}
-		}
-		// Extract buttons from native flow if available
-		if buttons := nativeFlow.GetButtons(); len(buttons) > 0 {
-			for _, btn := range buttons {
-				if btn != nil {
-					btnData := InteractiveButton{
-						ID:    btn.GetName(),
-						Title: btn.GetName(), // Native flow buttons typically use name for both
-					}
-					// Try to get button params for more details
-					if paramsJSON := btn.GetButtonParamsJSON(); paramsJSON != "" {
-						var params map[string]interface{}
-						if err := json.Unmarshal([]byte(paramsJSON), &params); err == nil {
-							if title, ok := params["display_text"].(string); ok {
-								btnData.Title = title
-							}
-							if id, ok := params["id"].(string); ok {
-								btnData.ID = id
-							}
-						}
-					}
-					data.Buttons = append(data.Buttons, btnData)
-				}
-			}
-		}
+func NewWriteBatcher(db *sql.DB) *WriteBatcher {
+	batcher := &WriteBatcher{
+		db:     db,
+		queue:  make(chan pendingWrite, writeBatchQueueDepth),
+		closed: make(chan struct{}),
 	}
+	go batcher.run()
+	return batcher
+}
 
-	// Extract collection message (product catalogs)
-	if collection := interactive.GetCollectionMessage(); collection != nil {
-		data.Type = "collection"
-		data.Body = collection.GetBizJID()
+func (batcher *WriteBatcher) send(write pendingWrite) error {
+	batcher.sendMutex.RLock()
+	defer batcher.sendMutex.RUnlock()
+	if batcher.stopped {
+		return errStoreClosed
 	}
+	batcher.queue <- write
+	return nil
+}
 
-	// Extract shop storefront message
-	if shop := interactive.GetShopStorefrontMessage(); shop != nil {
-		data.Type = "shop"
+// Exec queues a write and waits until it is committed or ctx ends; a write that is given
+// up on still commits with its batch
+func (batcher *WriteBatcher) Exec(ctx context.Context, query string, args []interface{}) error {
+	done := make(chan error, 1)
+	if err := batcher.send(pendingWrite{query: query, args: args, done: done}); err != nil {
+		return err
 	}
-
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Sprintf("[Interactive Message - Parse Error: %v]", err)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return string(jsonBytes)
+// Queue adds a write without waiting for it; failures are reported by the next Flush
+func (batcher *WriteBatcher) Queue(query string, args []interface{}) error {
+	return batcher.send(pendingWrite{query: query, args: args})
 }
 
-// formatListMessage converts a ListMessage to JSON
-func formatListMessage(list *waProto.ListMessage) string {
-	if list == nil {
-		return ""
+// Flush commits everything queued so far and returns the first queued write that failed
+func (batcher *WriteBatcher) Flush() error {
+	done := make(chan error, 1)
+	if err := batcher.send(pendingWrite{done: done}); err != nil {
+		return err
 	}
+	<-done
+	batcher.failedMutex.Lock()
+	defer batcher.failedMutex.Unlock()
+	err := batcher.failed
+	batcher.failed = nil
+	return err
+}
 
-	data := InteractiveMessageData{
-		Type:   "list",
-		Header: list.GetTitle(),
-		Body:   list.GetDescription(),
-		Footer: list.GetFooterText(),
+// Close commits what is queued and stops the batcher
+func (batcher *WriteBatcher) Close() {
+	batcher.sendMutex.Lock()
+	if !batcher.stopped {
+		batcher.stopped = true
+		close(batcher.queue)
 	}
+	batcher.sendMutex.Unlock()
+	<-batcher.closed
+}
 
-	// Extract sections and rows
-	for _, section := range list.GetSections() {
-		if section != nil {
-			sec := InteractiveSection{
-				Title: section.GetTitle(),
+func (batcher *WriteBatcher) run() {
+	defer close(batcher.closed)
+	timer := time.NewTimer(writeBatchInterval)
+	timer.Stop()
+
+	var batch []pendingWrite
+	for {
+		select {
+		case write, ok := <-batcher.queue:
+			if !ok {
+				batcher.commit(batch)
+				return
 			}
-			for _, row := range section.GetRows() {
-				if row != nil {
-					sec.Rows = append(sec.Rows, InteractiveRow{
-						ID:          row.GetRowID(),
-						Title:       row.GetTitle(),
-						Description: row.GetDescription(),
-					})
+			if len(batch) == 0 {
+				timer.Reset(writeBatchInterval)
+			}
+			batch = append(batch, write)
+			if write.done == nil && len(batch) < writeBatchSize {
+				continue
+			}
+			// Someone is waiting: take along what else is queued, then commit
+		drain:
+			for len(batch) < writeBatchSize {
+				select {
+				case more, ok := <-batcher.queue:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, more)
+				default:
+					break drain
 				}
 			}
-			data.Sections = append(data.Sections, sec)
+			timer.Stop()
+			batcher.commit(batch)
+			batch = nil
+
+		case <-timer.C:
+			batcher.commit(batch)
+			batch = nil
 		}
 	}
+}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Sprintf("[List Message - Parse Error: %v]", err)
+func (batcher *WriteBatcher) commit(batch []pendingWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	results := make([]error, len(batch))
+	tx, err := batcher.db.Begin()
+	if err == nil {
+		// A failing statement only rolls back itself, so the rest of the batch still commits
+		for i, write := range batch {
+			if write.query != "" {
+				_, results[i] = tx.Exec(write.query, write.args...)
+			}
+		}
+		err = tx.Commit()
+	}
+	for i, write := range batch {
+		if err != nil && write.query != "" {
+			results[i] = err
+		}
+		if write.done != nil {
+			write.done <- results[i]
+		} else if results[i] != nil {
+			fmt.Printf("Warning: queued write failed: %v\n", results[i])
+			batcher.failedMutex.Lock()
+			if batcher.failed == nil {
+				batcher.failed = results[i]
+			}
+			batcher.failedMutex.Unlock()
+		}
 	}
+}
 
-	return string(jsonBytes)
+// FlushWrites commits queued chat and message writes (see QueueChat and QueueMessage)
+func (store *MessageStore) FlushWrites() error {
+	return store.writes.Flush()
 }
 
-// formatButtonsMessage converts a ButtonsMessage to JSON
-func formatButtonsMessage(buttons *waProto.ButtonsMessage) string {
-	if buttons == nil {
-		return ""
-	}
+// StartCheckpointDaemon runs periodic WAL checkpoints to ensure data is synced to disk
+// This addresses Docker Desktop gRPC-FUSE filesystem sync issues on macOS
+// The daemon runs in a background goroutine and performs FULL checkpoint every 5 seconds
+func (store *MessageStore) StartCheckpointDaemon(stopChan <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
 
-	data := InteractiveMessageData{
-		Type:   "buttons",
-		Header: buttons.GetText(),
-		Body:   buttons.GetContentText(),
-		Footer: buttons.GetFooterText(),
-	}
+		fmt.Println("📦 WAL checkpoint daemon started (5s interval)")
 
-	// Extract buttons
-	for _, btn := range buttons.GetButtons() {
-		if btn != nil {
-			btnText := btn.GetButtonText()
-			if btnText != nil {
-				data.Buttons = append(data.Buttons, InteractiveButton{
-					ID:    btn.GetButtonID(),
-					Title: btnText.GetDisplayText(),
-				})
+		for {
+			select {
+			case <-ticker.C:
+				// FULL checkpoint mode for maximum durability
+				// This transfers all WAL content to the main database file
+				_, err := store.writer.Exec("PRAGMA wal_checkpoint(FULL)")
+				if err != nil {
+					fmt.Printf("Warning: Periodic WAL checkpoint failed: %v\n", err)
+				}
+			case <-stopChan:
+				// Final checkpoint before shutdown
+				store.writer.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+				fmt.Println("📦 WAL checkpoint daemon stopped")
+				return
 			}
 		}
-	}
+	}()
+}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Sprintf("[Buttons Message - Parse Error: %v]", err)
-	}
+// Store a chat in the database
+func (store *MessageStore) StoreChat(jid, name string, lastMessageTime time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, args := chatUpsert(jid, name, lastMessageTime)
+	return store.writes.Exec(ctx, query, args)
+}
 
-	return string(jsonBytes)
+// Queue a chat upsert without waiting for it (history sync); FlushWrites commits it
+func (store *MessageStore) QueueChat(jid, name string, lastMessageTime time.Time) error {
+	return store.writes.Queue(chatUpsert(jid, name, lastMessageTime))
 }
 
-// formatListResponseMessage converts a ListResponseMessage to JSON
-func formatListResponseMessage(response *waProto.ListResponseMessage) string {
-	if response == nil {
-		return ""
+func chatUpsert(jid, name string, lastMessageTime time.Time) (string, []interface{}) {
+	var chatType interface{}
+	if parsed, err := types.ParseJID(jid); err == nil && chatTypeForJID(parsed) != "" {
+		chatType = chatTypeForJID(parsed)
 	}
 
-	data := map[string]interface{}{
-		"type":        "list_response",
-		"title":       response.GetTitle(),
-		"description": response.GetDescription(),
-	}
+	// Upsert so app-state metadata (mute/pin/archive) survives new messages.
+	// A community classification (learned from group info) is never downgraded to "group".
+	return `INSERT INTO chats (jid, name, last_message_time, chat_type) VALUES (?, ?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET name = excluded.name, last_message_time = excluded.last_message_time,
+			chat_type = CASE WHEN chats.chat_type = 'community' THEN chats.chat_type ELSE COALESCE(excluded.chat_type, chats.chat_type) END`,
+		[]interface{}{jid, name, lastMessageTime.UTC(), chatType}
+}
 
-	if selection := response.GetSingleSelectReply(); selection != nil {
-		data["selected_row_id"] = selection.GetSelectedRowID()
+// Store a message in the database
+func (store *MessageStore) StoreMessage(id, chatJID, sender, content, contentType string, timestamp time.Time, isFromMe bool,
+	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
+	// Only store if there's actual content or media
+	if content == "" && mediaType == "" {
+		return nil
 	}
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, args := messageUpsert(id, chatJID, sender, content, contentType, timestamp, isFromMe,
+		mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength)
+	return store.writes.Exec(ctx, query, args)
+}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Sprintf("[List Response - Parse Error: %v]", err)
+// Queue a message upsert without waiting for it (history sync); FlushWrites commits it
+func (store *MessageStore) QueueMessage(id, chatJID, sender, content, contentType string, timestamp time.Time, isFromMe bool,
+	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
+	if content == "" && mediaType == "" {
+		return nil
 	}
+	return store.writes.Queue(messageUpsert(id, chatJID, sender, content, contentType, timestamp, isFromMe,
+		mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength))
+}
 
-	return string(jsonBytes)
+func messageUpsert(id, chatJID, sender, content, contentType string, timestamp time.Time, isFromMe bool,
+	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) (string, []interface{}) {
+	content, unmasked := maskInboundPII(content, isFromMe)
+	// Upsert rather than INSERT OR REPLACE so columns maintained elsewhere
+	// (e.g. local_path after a download) survive re-delivery and history sync
+	return `INSERT INTO messages
+		(id, chat_jid, sender, content, content_unmasked, content_type, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id, chat_jid) DO UPDATE SET
+			sender = excluded.sender,
+			content = excluded.content,
+			content_unmasked = excluded.content_unmasked,
+			content_type = excluded.content_type,
+			timestamp = excluded.timestamp,
+			is_from_me = excluded.is_from_me,
+			media_type = excluded.media_type,
+			filename = excluded.filename,
+			url = excluded.url,
+			media_key = excluded.media_key,
+			file_sha256 = excluded.file_sha256,
+			file_enc_sha256 = excluded.file_enc_sha256,
+			file_length = excluded.file_length`,
+		[]interface{}{id, chatJID, sender, content, unmasked, contentType, timestamp.UTC(), isFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength}
 }
 
-// formatButtonsResponseMessage converts a ButtonsResponseMessage to JSON
-func formatButtonsResponseMessage(response *waProto.ButtonsResponseMessage) string {
-	if response == nil {
-		return ""
-	}
+// APIMessage is a stored message as returned by /api/messages and /api/chats/{jid}/messages
+type APIMessage struct {
+	ID            string             `json:"id"`
+	ChatJID       string             `json:"chat_jid"`
+	ChatName      string             `json:"chat_name,omitempty"`
+	ChatType      string             `json:"chat_type,omitempty"`
+	Sender        string             `json:"sender"`
+	Content       string             `json:"content"`
+	ContentType   string             `json:"content_type,omitempty"`
+	Timestamp     string             `json:"timestamp"`
+	IsFromMe      bool               `json:"is_from_me"`
+	MediaType     string             `json:"media_type,omitempty"`
+	Filename      string             `json:"filename,omitempty"`
+	MediaURL      string             `json:"media_url,omitempty"`
+	LocalPath     string             `json:"local_path,omitempty"` // Set once media is downloaded (auto or via /api/download)
+	GifPlayback   bool               `json:"gif_playback,omitempty"`
+	PageCount     int64              `json:"page_count,omitempty"`
+	HasThumbnail  bool               `json:"has_thumbnail,omitempty"` // Fetch via /api/media/thumbnail
+	IsAnimated    bool               `json:"is_animated,omitempty"`
+	IsKept        bool               `json:"is_kept,omitempty"`
+	BroadcastJID  string             `json:"broadcast_jid,omitempty"` // Broadcast list the message was sent through
+	MentionsAll   bool               `json:"mentions_all,omitempty"`
+	GroupMentions []GroupMentionInfo `json:"group_mentions,omitempty"`
+	QuotedID      string             `json:"quoted_message_id,omitempty"` // Message this one replies to
+	QuotedSender  string             `json:"quoted_sender,omitempty"`
+	EditedAt      string             `json:"edited_at,omitempty"`
+	EditHistory   []MessageEdit      `json:"edit_history,omitempty"`     // Replaced versions, oldest first
+	ReadAt        string             `json:"read_at,omitempty"`          // When we sent a read receipt
+	Unmasked      string             `json:"content_unmasked,omitempty"` // Original of masked content (?unmasked=true)
+	Status        string             `json:"status,omitempty"`           // Our messages: sent, delivered, read or played
+	Reactions     []MessageReaction  `json:"reactions,omitempty"`
+
+	at time.Time // Full-precision timestamp, for cursors
+}
 
-	data := map[string]interface{}{
-		"type":                  "buttons_response",
-		"selected_button_id":    response.GetSelectedButtonID(),
-		"selected_display_text": response.GetSelectedDisplayText(),
-	}
+// apiMessageColumns is what scanAPIMessages reads, selected from messages m LEFT JOIN chats c
+const apiMessageColumns = `m.id, m.chat_jid, c.name AS chat_name, m.sender, m.content, m.timestamp, m.is_from_me,
+	m.media_type, m.filename, m.url, m.local_path, m.gif_playback, m.page_count, m.thumbnail IS NOT NULL,
+	m.is_animated, m.is_kept, m.broadcast_jid, m.mentions_all, m.group_mentions, c.chat_type, m.content_type,
+	m.quoted_message_id, m.quoted_sender, m.edited_at, m.edit_history, m.read_at, m.content_unmasked, m.delivery_status`
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Sprintf("[Buttons Response - Parse Error: %v]", err)
-	}
+// scanAPIMessages reads rows selected with apiMessageColumns, skipping rows that fail to scan.
+// content_unmasked is only filled in when includeUnmasked is set.
+func scanAPIMessages(rows *sql.Rows, includeUnmasked bool) []APIMessage {
+	var messages []APIMessage
+	for rows.Next() {
+		var msg APIMessage
+		var timestamp time.Time
+		var chatName, chatType, contentType, mediaType, filename, mediaURL, localPath, broadcastJID, groupMentions, quotedID, quotedSender, editHistory, unmasked, deliveryStatus sql.NullString
+		var gifPlayback, isAnimated, isKept, mentionsAll sql.NullBool
+		var pageCount sql.NullInt64
+		var editedAt, readAt sql.NullTime
+
+		err := rows.Scan(
+			&msg.ID,
+			&msg.ChatJID,
+			&chatName,
+			&msg.Sender,
+			&msg.Content,
+			&timestamp,
+			&msg.IsFromMe,
+			&mediaType,
+			&filename,
+			&mediaURL,
+			&localPath,
+			&gifPlayback,
+			&pageCount,
+			&msg.HasThumbnail,
+			&isAnimated,
+			&isKept,
+			&broadcastJID,
+			&mentionsAll,
+			&groupMentions,
+			&chatType,
+			&contentType,
+			&quotedID,
+			&quotedSender,
+			&editedAt,
+			&editHistory,
+			&readAt,
+			&unmasked,
+			&deliveryStatus,
+		)
+		if err != nil {
+			continue
+		}
 
-	return string(jsonBytes)
+		msg.Timestamp = timestamp.UTC().Format(time.RFC3339)
+		msg.at = timestamp
+		if chatName.Valid {
+			msg.ChatName = chatName.String
+		}
+		msg.ChatType = chatType.String
+		msg.ContentType = contentType.String
+		msg.BroadcastJID = broadcastJID.String
+		msg.QuotedID = quotedID.String
+		msg.QuotedSender = quotedSender.String
+		if editedAt.Valid {
+			msg.EditedAt = editedAt.Time.UTC().Format(time.RFC3339)
+		}
+		if editHistory.Valid {
+			json.Unmarshal([]byte(editHistory.String), &msg.EditHistory)
+		}
+		if readAt.Valid {
+			msg.ReadAt = readAt.Time.UTC().Format(time.RFC3339)
+		}
+		if includeUnmasked {
+			msg.Unmasked = unmasked.String
+		}
+		if msg.IsFromMe {
+			msg.Status = receiptStatuses[0]
+			if deliveryStatus.Valid {
+				msg.Status = deliveryStatus.String
+			}
+		}
+		msg.MentionsAll = mentionsAll.Valid && mentionsAll.Bool
+		if groupMentions.Valid {
+			json.Unmarshal([]byte(groupMentions.String), &msg.GroupMentions)
+		}
+		if mediaType.Valid {
+			msg.MediaType = mediaType.String
+		}
+		if filename.Valid {
+			msg.Filename = filename.String
+		}
+		if mediaURL.Valid {
+			msg.MediaURL = mediaURL.String
+		}
+		if localPath.Valid {
+			msg.LocalPath = localPath.String
+		}
+		msg.GifPlayback = gifPlayback.Valid && gifPlayback.Bool
+		msg.IsAnimated = isAnimated.Valid && isAnimated.Bool
+		msg.IsKept = isKept.Valid && isKept.Bool
+		if pageCount.Valid {
+			msg.PageCount = pageCount.Int64
+		}
+
+		messages = append(messages, msg)
+	}
+	return messages
 }
 
-// Extract text content from a message
-func sanitizeMentionToken(value string) string {
-	var builder strings.Builder
-	for _, r := range value {
-		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
-			builder.WriteRune(r)
+// attachReactions fills in the reactions of listed messages
+func (store *MessageStore) attachReactions(messages []APIMessage) {
+	messageIDs := make([]string, len(messages))
+	for i, msg := range messages {
+		messageIDs[i] = msg.ID
+	}
+	if reactions, err := store.GetReactionsFor("", messageIDs); err == nil {
+		for i := range messages {
+			messages[i].Reactions = reactions[messages[i].ChatJID+"/"+messages[i].ID]
 		}
+	} else {
+		fmt.Printf("Warning: failed to load reactions: %v\n", err)
 	}
-	return builder.String()
 }
 
-func resolveContactDisplayName(client *whatsmeow.Client, jidStr string) string {
-	if client == nil || jidStr == "" {
-		return ""
+// encodeMessageCursor and decodeMessageCursor carry a message position in the (timestamp, id)
+// order used for paging, so messages sharing a second are neither skipped nor repeated
+func encodeMessageCursor(timestamp time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", timestamp.UnixNano(), id)))
+}
+
+func decodeMessageCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errors.New("invalid cursor")
 	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	parsed, err := strconv.ParseInt(nanos, 10, 64)
+	if !found || err != nil || id == "" {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+	return time.Unix(0, parsed).UTC(), id, nil
+}
 
-	jid, err := types.ParseJID(jidStr)
+// Get messages from a chat
+func (store *MessageStore) GetMessages(chatJID string, limit int) ([]Message, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		"SELECT id, sender, content, timestamp, is_from_me, media_type, filename FROM messages WHERE chat_jid = ? ORDER BY timestamp DESC LIMIT ?",
+		chatJID, limit,
+	)
 	if err != nil {
-		return ""
+		return nil, err
 	}
+	defer rows.Close()
 
-	contact, err := client.Store.Contacts.GetContact(context.Background(), jid)
-	if err == nil {
-		for _, candidate := range []string{
-			contact.FullName,
-			contact.PushName,
-			contact.FirstName,
-			contact.BusinessName,
-		} {
-			if token := sanitizeMentionToken(candidate); token != "" {
-				return token
-			}
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var timestamp time.Time
+		var mediaType, filename sql.NullString
+		err := rows.Scan(&msg.ID, &msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe, &mediaType, &filename)
+		if err != nil {
+			return nil, err
 		}
+		msg.Time = timestamp
+		msg.MediaType, msg.Filename = mediaType.String, filename.String
+		messages = append(messages, msg)
 	}
 
-	return sanitizeMentionToken(jid.User)
+	return messages, nil
 }
 
-func hydrateMentionText(client *whatsmeow.Client, text string, contextInfo *waProto.ContextInfo) string {
-	if client == nil || contextInfo == nil || text == "" {
-		return text
+// Get all chats
+func (store *MessageStore) GetChats() (map[string]time.Time, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT jid, last_message_time FROM chats ORDER BY last_message_time DESC")
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	for _, mentionedJID := range contextInfo.GetMentionedJID() {
-		rawID := strings.Split(mentionedJID, "@")[0]
-		if rawID == "" {
-			continue
+	chats := make(map[string]time.Time)
+	for rows.Next() {
+		var jid string
+		var lastMessageTime time.Time
+		err := rows.Scan(&jid, &lastMessageTime)
+		if err != nil {
+			return nil, err
 		}
+		chats[jid] = lastMessageTime
+	}
 
-		displayToken := resolveContactDisplayName(client, mentionedJID)
-		if displayToken == "" {
-			continue
-		}
+	return chats, nil
+}
 
-		text = strings.ReplaceAll(text, "@"+rawID, "@"+displayToken)
-	}
+// ChatListFilter narrows GetChatList; zero values don't filter
+type ChatListFilter struct {
+	Query      string   // Case-insensitive substring of the name or JID
+	ChatTypes  []string // See chatTypes
+	Archived   *bool
+	UnreadOnly bool
+	Limit      int
+	Offset     int
+}
 
-	return text
+// ChatSummary is an inbox row: a chat with its latest message and state
+type ChatSummary struct {
+	JID             string `json:"jid"`
+	Name            string `json:"name"`
+	ChatType        string `json:"chat_type,omitempty"`
+	IsGroup         bool   `json:"is_group"`
+	LastMessageTime string `json:"last_message_time,omitempty"`
+	LastMessage     string `json:"last_message,omitempty"` // Preview: text (truncated) or [media type]
+	LastSender      string `json:"last_sender,omitempty"`
+	LastFromMe      bool   `json:"last_from_me,omitempty"`
+	UnreadCount     int    `json:"unread_count"`
+	Archived        bool   `json:"archived"`
+	Pinned          bool   `json:"pinned"`
+	Muted           bool   `json:"muted"`
+	MutedUntil      string `json:"muted_until,omitempty"`
 }
 
-func extractTextContent(client *whatsmeow.Client, msg *waProto.Message) string {
-	if msg == nil {
-		return ""
-	}
+// chatPreviewLength is how many characters of the last message GetChatList returns
+const chatPreviewLength = 100
 
-	// Try to get text content (most common)
-	if text := msg.GetConversation(); text != "" {
-		return text
+// GetChatList lists chats pinned first, then by latest activity, with their unread counters
+// (see ensureUnreadCounter)
+func (store *MessageStore) GetChatList(filter ChatListFilter) ([]ChatSummary, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := `SELECT c.jid, COALESCE(c.name, ''), c.chat_type, c.last_message_time,
+			COALESCE(c.is_archived, 0), COALESCE(c.is_pinned, 0), COALESCE(c.is_muted, 0), c.muted_until,
+			COALESCE(lm.content, ''), COALESCE(lm.media_type, ''), COALESCE(lm.sender, ''), COALESCE(lm.is_from_me, 0),
+			c.unread_count
+		FROM chats c
+		LEFT JOIN messages lm ON lm.rowid = (
+			SELECT rowid FROM messages WHERE chat_jid = c.jid ORDER BY timestamp DESC, id DESC LIMIT 1
+		)
+		WHERE 1 = 1`
+	var args []interface{}
+	if filter.Query != "" {
+		query += " AND (LOWER(COALESCE(c.name, '')) LIKE ? OR c.jid LIKE ?)"
+		pattern := "%" + strings.ToLower(filter.Query) + "%"
+		args = append(args, pattern, pattern)
 	}
-	if extendedText := msg.GetExtendedTextMessage(); extendedText != nil {
-		return hydrateMentionText(client, extendedText.GetText(), extendedText.GetContextInfo())
+	if len(filter.ChatTypes) > 0 {
+		query += " AND c.chat_type IN (?" + strings.Repeat(", ?", len(filter.ChatTypes)-1) + ")"
+		for _, chatType := range filter.ChatTypes {
+			args = append(args, chatType)
+		}
 	}
-
-	// Handle InteractiveMessage (used by business bots like Unimed)
-	if interactive := msg.GetInteractiveMessage(); interactive != nil {
-		return formatInteractiveMessage(interactive)
+	if filter.Archived != nil {
+		query += " AND COALESCE(c.is_archived, 0) = ?"
+		args = append(args, *filter.Archived)
 	}
-
-	// Handle ListMessage (list menus with sections/rows)
-	if list := msg.GetListMessage(); list != nil {
-		return formatListMessage(list)
+	if filter.UnreadOnly {
+		query += " AND c.unread_count > 0"
 	}
+	query += " ORDER BY COALESCE(c.is_pinned, 0) DESC, c.last_message_time DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
 
-	// Handle ButtonsMessage (simple button menus)
-	if buttons := msg.GetButtonsMessage(); buttons != nil {
-		return formatButtonsMessage(buttons)
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Handle ListResponseMessage (user selection from list)
-	if listResponse := msg.GetListResponseMessage(); listResponse != nil {
-		return formatListResponseMessage(listResponse)
+	chats := []ChatSummary{}
+	for rows.Next() {
+		var chat ChatSummary
+		var chatType sql.NullString
+		var lastMessageTime, mutedUntil sql.NullTime
+		var content, mediaType string
+		if err := rows.Scan(&chat.JID, &chat.Name, &chatType, &lastMessageTime, &chat.Archived, &chat.Pinned, &chat.Muted,
+			&mutedUntil, &content, &mediaType, &chat.LastSender, &chat.LastFromMe, &chat.UnreadCount); err != nil {
+			return nil, err
+		}
+		chat.ChatType = chatType.String
+		chat.IsGroup = strings.HasSuffix(chat.JID, "@"+types.GroupServer)
+		if chat.Name == "" {
+			chat.Name = strings.SplitN(chat.JID, "@", 2)[0]
+		}
+		if lastMessageTime.Valid && !lastMessageTime.Time.IsZero() {
+			chat.LastMessageTime = lastMessageTime.Time.UTC().Format(time.RFC3339)
+		}
+		// A mute that has run out is no longer in effect
+		if chat.Muted && mutedUntil.Valid {
+			if mutedUntil.Time.Before(time.Now()) {
+				chat.Muted = false
+			} else {
+				chat.MutedUntil = mutedUntil.Time.UTC().Format(time.RFC3339)
+			}
+		}
+		switch preview := []rune(content); {
+		case len(preview) > chatPreviewLength:
+			chat.LastMessage = string(preview[:chatPreviewLength]) + "…"
+		case content != "":
+			chat.LastMessage = content
+		case mediaType != "":
+			chat.LastMessage = "[" + mediaType + "]"
+		}
+		chats = append(chats, chat)
 	}
+	return chats, rows.Err()
+}
 
-	// Handle ButtonsResponseMessage (user selection from buttons)
-	if buttonsResponse := msg.GetButtonsResponseMessage(); buttonsResponse != nil {
-		return formatButtonsResponseMessage(buttonsResponse)
-	}
+// InteractiveMessageData represents the JSON structure for interactive messages
+type InteractiveMessageData struct {
+	Type       string               `json:"type"`
+	Header     string               `json:"header,omitempty"`
+	Body       string               `json:"body,omitempty"`
+	Footer     string               `json:"footer,omitempty"`
+	Buttons    []InteractiveButton  `json:"buttons,omitempty"`
+	Sections   []InteractiveSection `json:"sections,omitempty"`
+	NativeFlow *NativeFlowData      `json:"native_flow,omitempty"`
+}
 
-	// Handle TemplateMessage (template-based interactive messages)
-	if template := msg.GetTemplateMessage(); template != nil {
-		if hydratedTemplate := template.GetHydratedTemplate(); hydratedTemplate != nil {
-			data := map[string]interface{}{
-				"type": "template",
-				"body": hydratedTemplate.GetHydratedContentText(),
-			}
-			// Extract template buttons
-			var buttons []InteractiveButton
-			for i, btn := range hydratedTemplate.GetHydratedButtons() {
-				if btn != nil {
-					btnData := InteractiveButton{
-						ID: fmt.Sprintf("%d", i),
-					}
-					if qrBtn := btn.GetQuickReplyButton(); qrBtn != nil {
-						btnData.Title = qrBtn.GetDisplayText()
-						btnData.ID = qrBtn.GetID()
-					} else if urlBtn := btn.GetUrlButton(); urlBtn != nil {
-						btnData.Title = urlBtn.GetDisplayText()
-					} else if callBtn := btn.GetCallButton(); callBtn != nil {
-						btnData.Title = callBtn.GetDisplayText()
-					}
-					buttons = append(buttons, btnData)
-				}
-			}
-			if len(buttons) > 0 {
-				data["buttons"] = buttons
-			}
-			jsonBytes, _ := json.Marshal(data)
-			return string(jsonBytes)
-		}
-	}
-
-	// Handle TemplateButtonReplyMessage (response to template)
-	if templateReply := msg.GetTemplateButtonReplyMessage(); templateReply != nil {
-		data := map[string]interface{}{
-			"type":          "template_response",
-			"selected_id":   templateReply.GetSelectedID(),
-			"selected_text": templateReply.GetSelectedDisplayText(),
-		}
-		jsonBytes, _ := json.Marshal(data)
-		return string(jsonBytes)
-	}
-
-	// Extract caption from media messages (image, video, document)
-	if image := msg.GetImageMessage(); image != nil {
-		return image.GetCaption()
-	}
-	if video := msg.GetVideoMessage(); video != nil {
-		return video.GetCaption()
-	}
-	if document := msg.GetDocumentMessage(); document != nil {
-		return document.GetCaption()
-	}
-	if audio := msg.GetAudioMessage(); audio != nil {
-		// Audio typically doesn't have captions, but check anyway
-		return ""
-	}
+type InteractiveButton struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
 
-	return ""
+type InteractiveSection struct {
+	Title string           `json:"title,omitempty"`
+	Rows  []InteractiveRow `json:"rows"`
 }
 
-// SendMessageResponse represents the response for the send message API
-type SendMessageResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+type InteractiveRow struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
 }
 
-// SendMessageRequest represents the request body for the send message API
-type SendMessageRequest struct {
-	Recipient string `json:"recipient"`
-	Message   string `json:"message"`
-	MediaPath string `json:"media_path,omitempty"`
+type NativeFlowData struct {
+	Name       string                 `json:"name,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
 }
 
-// Function to send a WhatsApp message
-func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message string, mediaPath string) (bool, string) {
-	if !client.IsConnected() {
-		return false, "Not connected to WhatsApp"
+// formatInteractiveMessage converts an InteractiveMessage to JSON
+func formatInteractiveMessage(interactive *waProto.InteractiveMessage) string {
+	if interactive == nil {
+		return ""
 	}
 
-	// Create JID for recipient
-	var recipientJID types.JID
-	var err error
-
-	// Check if recipient is a JID
-	isJID := strings.Contains(recipient, "@")
-
-	if isJID {
-		// Parse the JID string
-		recipientJID, err = types.ParseJID(recipient)
-		if err != nil {
-			return false, fmt.Sprintf("Error parsing JID: %v", err)
-		}
-	} else {
-		// Normalize phone number - strip leading '+' if present
-		// WhatsApp expects numbers without the + prefix (e.g., "5500000000001", not "+5500000000001")
-		phoneNumber := strings.TrimPrefix(recipient, "+")
+	data := InteractiveMessageData{
+		Type: "interactive",
+	}
 
-		// Create JID from phone number
-		recipientJID = types.JID{
-			User:   phoneNumber,
-			Server: "s.whatsapp.net", // For personal chats
+	// Extract header
+	if header := interactive.GetHeader(); header != nil {
+		if title := header.GetTitle(); title != "" {
+			data.Header = title
+		} else if docMsg := header.GetDocumentMessage(); docMsg != nil {
+			data.Header = "[Document: " + docMsg.GetFileName() + "]"
+		} else if imgMsg := header.GetImageMessage(); imgMsg != nil {
+			data.Header = "[Image]"
+		} else if vidMsg := header.GetVideoMessage(); vidMsg != nil {
+			data.Header = "[Video]"
 		}
 	}
 
-	msg := &waProto.Message{}
-
-	// Check if we have media to send
-	if mediaPath != "" {
-		// Read media file
-		mediaData, err := os.ReadFile(mediaPath)
-		if err != nil {
-			return false, fmt.Sprintf("Error reading media file: %v", err)
-		}
+	// Extract body
+	if body := interactive.GetBody(); body != nil {
+		data.Body = body.GetText()
+	}
 
-		// Determine media type and mime type based on file extension
-		fileExt := strings.ToLower(mediaPath[strings.LastIndex(mediaPath, ".")+1:])
-		var mediaType whatsmeow.MediaType
-		var mimeType string
-
-		// Handle different media types
-		switch fileExt {
-		// Image types
-		case "jpg", "jpeg":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/jpeg"
-		case "png":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/png"
-		case "gif":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/gif"
-		case "webp":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/webp"
-
-		// Audio types
-		case "ogg":
-			mediaType = whatsmeow.MediaAudio
-			mimeType = "audio/ogg; codecs=opus"
-
-		// Video types
-		case "mp4":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/mp4"
-		case "avi":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/avi"
-		case "mov":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/quicktime"
-
-		// Document types (for any other file type)
-		default:
-			mediaType = whatsmeow.MediaDocument
-			mimeType = "application/octet-stream"
-		}
+	// Extract footer
+	if footer := interactive.GetFooter(); footer != nil {
+		data.Footer = footer.GetText()
+	}
 
-		// Upload media to WhatsApp servers (with 60s timeout to prevent indefinite hangs)
-		uploadCtx, uploadCancel := context.WithTimeout(context.Background(), 60*time.Second)
-		defer uploadCancel()
-		resp, err := client.Upload(uploadCtx, mediaData, mediaType)
-		if err != nil {
-			if uploadCtx.Err() == context.DeadlineExceeded {
-				return false, "Timeout uploading media to WhatsApp (60s exceeded)"
+	// Extract native flow (used by business bots like Unimed)
+	if nativeFlow := interactive.GetNativeFlowMessage(); nativeFlow != nil {
+		data.NativeFlow = &NativeFlowData{}
+		// Try to parse the JSON parameters
+		if paramsJSON := nativeFlow.GetMessageParamsJSON(); paramsJSON != "" {
+			var params map[string]interface{}
+			if err := json.Unmarshal([]byte(paramsJSON), &params); err == nil {
+				data.NativeFlow.Parameters = params
 			}
-			return false, fmt.Sprintf("Error uploading media: %v", err)
 		}
-
-		fmt.Println("Media uploaded", resp)
-
-		// Create the appropriate message type based on media type
-		switch mediaType {
-		case whatsmeow.MediaImage:
-			msg.ImageMessage = &waProto.ImageMessage{
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-			}
-		case whatsmeow.MediaAudio:
-			// Handle ogg audio files
-			var seconds uint32 = 30 // Default fallback
-			var waveform []byte = nil
-
-			// Try to analyze the ogg file
-			if strings.Contains(mimeType, "ogg") {
-				analyzedSeconds, analyzedWaveform, err := analyzeOggOpus(mediaData)
-				if err == nil {
-					seconds = analyzedSeconds
-					waveform = analyzedWaveform
-				} else {
-					return false, fmt.Sprintf("Failed to analyze Ogg Opus file: %v", err)
+		// Extract buttons from native flow if available
+		if buttons := nativeFlow.GetButtons(); len(buttons) > 0 {
+			for _, btn := range buttons {
+				if btn != nil {
+					btnData := InteractiveButton{
+						ID:    btn.GetName(),
+						Title: btn.GetName(), // Native flow buttons typically use name for both
+					}
+					// Try to get button params for more details
+					if paramsJSON := btn.GetButtonParamsJSON(); paramsJSON != "" {
+						var params map[string]interface{}
+						if err := json.Unmarshal([]byte(paramsJSON), &params); err == nil {
+							if title, ok := params["display_text"].(string); ok {
+								btnData.Title = title
+							}
+							if id, ok := params["id"].(string); ok {
+								btnData.ID = id
+							}
+						}
+					}
+					data.Buttons = append(data.Buttons, btnData)
 				}
-			} else {
-				fmt.Printf("Not an Ogg Opus file: %s\n", mimeType)
-			}
-
-			msg.AudioMessage = &waProto.AudioMessage{
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-				Seconds:       proto.Uint32(seconds),
-				PTT:           proto.Bool(true),
-				Waveform:      waveform,
-			}
-		case whatsmeow.MediaVideo:
-			msg.VideoMessage = &waProto.VideoMessage{
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
-			}
-		case whatsmeow.MediaDocument:
-			msg.DocumentMessage = &waProto.DocumentMessage{
-				Title:         proto.String(mediaPath[strings.LastIndex(mediaPath, "/")+1:]),
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
-				URL:           &resp.URL,
-				DirectPath:    &resp.DirectPath,
-				MediaKey:      resp.MediaKey,
-				FileEncSHA256: resp.FileEncSHA256,
-				FileSHA256:    resp.FileSHA256,
-				FileLength:    &resp.FileLength,
 			}
 		}
-	} else {
-		msg.Conversation = proto.String(message)
 	}
 
-	// Send message (with 60s timeout to prevent indefinite hangs)
-	sendCtx, sendCancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer sendCancel()
-	_, err = client.SendMessage(sendCtx, recipientJID, msg)
+	// Extract collection message (product catalogs)
+	if collection := interactive.GetCollectionMessage(); collection != nil {
+		data.Type = "collection"
+		data.Body = collection.GetBizJID()
+	}
+
+	// Extract shop storefront message
+	if shop := interactive.GetShopStorefrontMessage(); shop != nil {
+		data.Type = "shop"
+	}
 
+	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		if sendCtx.Err() == context.DeadlineExceeded {
-			return false, "Timeout sending message to WhatsApp (60s exceeded)"
-		}
-		return false, fmt.Sprintf("Error sending message: %v", err)
+		return fmt.Sprintf("[Interactive Message - Parse Error: %v]", err)
 	}
 
-	return true, fmt.Sprintf("Message sent to %s", recipient)
+	return string(jsonBytes)
 }
 
-// Extract media info from a message
-func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) {
-	if msg == nil {
-		return "", "", "", nil, nil, nil, 0
-	}
-
-	// Check for image message
-	if img := msg.GetImageMessage(); img != nil {
-		return "image", "image_" + time.Now().Format("20060102_150405") + ".jpg",
-			img.GetURL(), img.GetMediaKey(), img.GetFileSHA256(), img.GetFileEncSHA256(), img.GetFileLength()
+// formatListMessage converts a ListMessage to JSON
+func formatListMessage(list *waProto.ListMessage) string {
+	if list == nil {
+		return ""
 	}
 
-	// Check for video message
-	if vid := msg.GetVideoMessage(); vid != nil {
-		return "video", "video_" + time.Now().Format("20060102_150405") + ".mp4",
-			vid.GetURL(), vid.GetMediaKey(), vid.GetFileSHA256(), vid.GetFileEncSHA256(), vid.GetFileLength()
+	data := InteractiveMessageData{
+		Type:   "list",
+		Header: list.GetTitle(),
+		Body:   list.GetDescription(),
+		Footer: list.GetFooterText(),
 	}
 
-	// Check for audio message
-	if aud := msg.GetAudioMessage(); aud != nil {
-		return "audio", "audio_" + time.Now().Format("20060102_150405") + ".ogg",
-			aud.GetURL(), aud.GetMediaKey(), aud.GetFileSHA256(), aud.GetFileEncSHA256(), aud.GetFileLength()
+	// Extract sections and rows
+	for _, section := range list.GetSections() {
+		if section != nil {
+			sec := InteractiveSection{
+				Title: section.GetTitle(),
+			}
+			for _, row := range section.GetRows() {
+				if row != nil {
+					sec.Rows = append(sec.Rows, InteractiveRow{
+						ID:          row.GetRowID(),
+						Title:       row.GetTitle(),
+						Description: row.GetDescription(),
+					})
+				}
+			}
+			data.Sections = append(data.Sections, sec)
+		}
 	}
 
-	// Check for document message
-	if doc := msg.GetDocumentMessage(); doc != nil {
-		filename := doc.GetFileName()
-		if filename == "" {
-			filename = "document_" + time.Now().Format("20060102_150405")
-		}
-		return "document", filename,
-			doc.GetURL(), doc.GetMediaKey(), doc.GetFileSHA256(), doc.GetFileEncSHA256(), doc.GetFileLength()
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("[List Message - Parse Error: %v]", err)
 	}
 
-	return "", "", "", nil, nil, nil, 0
+	return string(jsonBytes)
 }
 
-// Handle regular incoming messages with media support
-func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, logger waLog.Logger) {
-	// CRITICAL DEBUG: Log function entry
-	rawChatJID := msg.Info.Chat.String()
-	canonicalChatJID, canonicalSenderJID := resolveMessageStorageIDs(client, &msg.Info, logger)
-	chatJID := canonicalChatJID.String()
-	if chatJID == "" {
-		chatJID = rawChatJID
+// formatButtonsMessage converts a ButtonsMessage to JSON
+func formatButtonsMessage(buttons *waProto.ButtonsMessage) string {
+	if buttons == nil {
+		return ""
 	}
-	sender := canonicalSenderJID.User
-	if sender == "" {
-		sender = msg.Info.Sender.User
+
+	data := InteractiveMessageData{
+		Type:   "buttons",
+		Header: buttons.GetText(),
+		Body:   buttons.GetContentText(),
+		Footer: buttons.GetFooterText(),
 	}
-	fmt.Printf("🔍 handleMessage CALLED: RawChatJID=%s, ChatJID=%s, Sender=%s, IsFromMe=%v\n", rawChatJID, chatJID, sender, msg.Info.IsFromMe)
 
-	// Save message to database
-	// Get appropriate chat name (pass nil for conversation since we don't have one for regular messages)
-	name := GetChatName(client, messageStore, canonicalChatJID, chatJID, nil, sender, msg.Info.PushName, logger)
+	// Extract buttons
+	for _, btn := range buttons.GetButtons() {
+		if btn != nil {
+			btnText := btn.GetButtonText()
+			if btnText != nil {
+				data.Buttons = append(data.Buttons, InteractiveButton{
+					ID:    btn.GetButtonID(),
+					Title: btnText.GetDisplayText(),
+				})
+			}
+		}
+	}
 
-	// Update chat in database with the message timestamp (keeps last message time updated)
-	err := messageStore.StoreChat(chatJID, name, msg.Info.Timestamp)
+	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		logger.Warnf("Failed to store chat: %v", err)
+		return fmt.Sprintf("[Buttons Message - Parse Error: %v]", err)
 	}
 
-	// Extract text content
-	content := extractTextContent(client, msg.Message)
-	fmt.Printf("🔍 Extracted content length: %d chars\n", len(content))
-
-	// Extract media info
-	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength := extractMediaInfo(msg.Message)
-	fmt.Printf("🔍 Media info: type=%s, filename=%s\n", mediaType, filename)
+	return string(jsonBytes)
+}
 
-	// Skip if there's no content and no media
-	if content == "" && mediaType == "" {
-		fmt.Printf("⚠️ SKIPPING: No content and no media\n")
-		return
+// formatListResponseMessage converts a ListResponseMessage to JSON
+func formatListResponseMessage(response *waProto.ListResponseMessage) string {
+	if response == nil {
+		return ""
 	}
 
-	// CRITICAL DEBUG: Log before storage attempt
-	fmt.Printf("DEBUG: Attempting to store message - ID=%s, ChatJID=%s, Content=%s, HasMedia=%v\n",
-		msg.Info.ID, chatJID, content[:min(50, len(content))], mediaType != "")
+	data := map[string]interface{}{
+		"type":        "list_response",
+		"title":       response.GetTitle(),
+		"description": response.GetDescription(),
+	}
 
-	// Store message in database
-	err = messageStore.StoreMessage(
-		msg.Info.ID,
-		chatJID,
-		sender,
-		content,
-		msg.Info.Timestamp,
-		msg.Info.IsFromMe,
-		mediaType,
-		filename,
-		url,
-		mediaKey,
-		fileSHA256,
-		fileEncSHA256,
-		fileLength,
-	)
+	if selection := response.GetSingleSelectReply(); selection != nil {
+		data["selected_row_id"] = selection.GetSelectedRowID()
+	}
 
+	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		// CRITICAL: Always log storage failures
-		fmt.Printf("❌ STORAGE FAILED: %v (ID=%s, ChatJID=%s)\n", err, msg.Info.ID, chatJID)
-		logger.Warnf("Failed to store message: %v", err)
-	} else {
-		// CRITICAL DEBUG: Confirm successful storage
-		fmt.Printf("✅ STORAGE SUCCESS: ID=%s stored in %s\n", msg.Info.ID, chatJID)
+		return fmt.Sprintf("[List Response - Parse Error: %v]", err)
+	}
 
-		// Log message reception
-		timestamp := msg.Info.Timestamp.Format("2006-01-02 15:04:05")
-		direction := "←"
-		if msg.Info.IsFromMe {
-			direction = "→"
-		}
+	return string(jsonBytes)
+}
 
-		// Log based on message type
-		if mediaType != "" {
-			fmt.Printf("[%s] %s %s: [%s: %s] %s\n", timestamp, direction, sender, mediaType, filename, content)
-		} else if content != "" {
-			fmt.Printf("[%s] %s %s: %s\n", timestamp, direction, sender, content)
-		}
+// formatButtonsResponseMessage converts a ButtonsResponseMessage to JSON
+func formatButtonsResponseMessage(response *waProto.ButtonsResponseMessage) string {
+	if response == nil {
+		return ""
 	}
-}
 
-// DownloadMediaRequest represents the request body for the download media API
-type DownloadMediaRequest struct {
-	MessageID string `json:"message_id"`
-	ChatJID   string `json:"chat_jid"`
-}
+	data := map[string]interface{}{
+		"type":                  "buttons_response",
+		"selected_button_id":    response.GetSelectedButtonID(),
+		"selected_display_text": response.GetSelectedDisplayText(),
+	}
 
-// DownloadMediaResponse represents the response for the download media API
-type DownloadMediaResponse struct {
-	Success     bool   `json:"success"`
-	Message     string `json:"message"`
-	Filename    string `json:"filename,omitempty"`
-	Path        string `json:"path,omitempty"`
-	FileContent string `json:"file_content,omitempty"` // Base64-encoded file bytes for container isolation
-}
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("[Buttons Response - Parse Error: %v]", err)
+	}
 
-// Store additional media info in the database
-func (store *MessageStore) StoreMediaInfo(id, chatJID, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
-	_, err := store.db.Exec(
-		"UPDATE messages SET url = ?, media_key = ?, file_sha256 = ?, file_enc_sha256 = ?, file_length = ? WHERE id = ? AND chat_jid = ?",
-		url, mediaKey, fileSHA256, fileEncSHA256, fileLength, id, chatJID,
-	)
-	return err
+	return string(jsonBytes)
 }
 
-// Get media info from the database
-func (store *MessageStore) GetMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error) {
-	var mediaType, filename, url string
-	var mediaKey, fileSHA256, fileEncSHA256 []byte
-	var fileLength uint64
-
-	err := store.db.QueryRow(
-		"SELECT media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length FROM messages WHERE id = ? AND chat_jid = ?",
-		id, chatJID,
-	).Scan(&mediaType, &filename, &url, &mediaKey, &fileSHA256, &fileEncSHA256, &fileLength)
+// Limits WhatsApp clients enforce when rendering interactive messages
+const (
+	maxInteractiveButtons = 3  // Reply buttons per message
+	maxListRows           = 10 // Rows across all sections of a list
+)
 
-	return mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err
-}
+// buildInteractiveMessage is the reverse of the format*Message parsers: it builds a
+// ButtonsMessage (type buttons), ListMessage (type list, buttonText opens the menu) or a native
+// flow InteractiveMessage (type interactive, buttons become quick replies) from data. Native flow
+// messages also need the returned biz node sent alongside; whatsmeow only adds it for the others.
+func buildInteractiveMessage(data InteractiveMessageData, buttonText string) (*waProto.Message, []waBinary.Node, error) {
+	if strings.TrimSpace(data.Body) == "" {
+		return nil, nil, errors.New("body is required")
+	}
+	checkIDs := func(ids []string) error {
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			if id == "" || seen[id] {
+				return errors.New("ids must be distinct and non-empty")
+			}
+			seen[id] = true
+		}
+		return nil
+	}
 
-// MediaDownloader implements the whatsmeow.DownloadableMessage interface
-type MediaDownloader struct {
-	URL           string
-	DirectPath    string
-	MediaKey      []byte
-	FileLength    uint64
-	FileSHA256    []byte
-	FileEncSHA256 []byte
-	MediaType     whatsmeow.MediaType
-}
+	switch data.Type {
+	case "buttons", "interactive":
+		if len(data.Buttons) == 0 || len(data.Buttons) > maxInteractiveButtons {
+			return nil, nil, fmt.Errorf("%s messages need between 1 and %d buttons", data.Type, maxInteractiveButtons)
+		}
+		ids := make([]string, len(data.Buttons))
+		for i, button := range data.Buttons {
+			if strings.TrimSpace(button.Title) == "" {
+				return nil, nil, fmt.Errorf("button %q has no title", button.ID)
+			}
+			ids[i] = button.ID
+		}
+		if err := checkIDs(ids); err != nil {
+			return nil, nil, err
+		}
+	case "list":
+		var ids []string
+		for _, section := range data.Sections {
+			for _, row := range section.Rows {
+				if strings.TrimSpace(row.Title) == "" {
+					return nil, nil, fmt.Errorf("row %q has no title", row.ID)
+				}
+				ids = append(ids, row.ID)
+			}
+		}
+		if len(ids) == 0 || len(ids) > maxListRows {
+			return nil, nil, fmt.Errorf("list messages need between 1 and %d rows", maxListRows)
+		}
+		if err := checkIDs(ids); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("type must be buttons, list or interactive (got %q)", data.Type)
+	}
 
-// GetDirectPath implements the DownloadableMessage interface
-func (d *MediaDownloader) GetDirectPath() string {
-	return d.DirectPath
-}
+	switch data.Type {
+	case "buttons":
+		buttons := &waProto.ButtonsMessage{
+			ContentText: proto.String(data.Body),
+			FooterText:  proto.String(data.Footer),
+			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+		}
+		if data.Header != "" {
+			buttons.HeaderType = waProto.ButtonsMessage_TEXT.Enum()
+			buttons.Header = &waProto.ButtonsMessage_Text{Text: data.Header}
+		}
+		for _, button := range data.Buttons {
+			buttons.Buttons = append(buttons.Buttons, &waProto.ButtonsMessage_Button{
+				ButtonID:   proto.String(button.ID),
+				ButtonText: &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(button.Title)},
+				Type:       waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+			})
+		}
+		return &waProto.Message{ButtonsMessage: buttons}, nil, nil
 
-// GetURL implements the DownloadableMessage interface
-func (d *MediaDownloader) GetURL() string {
-	return d.URL
-}
+	case "list":
+		if buttonText == "" {
+			buttonText = "Menu"
+		}
+		list := &waProto.ListMessage{
+			Title:       proto.String(data.Header),
+			Description: proto.String(data.Body),
+			FooterText:  proto.String(data.Footer),
+			ButtonText:  proto.String(buttonText),
+			ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+		}
+		for _, section := range data.Sections {
+			listSection := &waProto.ListMessage_Section{Title: proto.String(section.Title)}
+			for _, row := range section.Rows {
+				listSection.Rows = append(listSection.Rows, &waProto.ListMessage_Row{
+					RowID:       proto.String(row.ID),
+					Title:       proto.String(row.Title),
+					Description: proto.String(row.Description),
+				})
+			}
+			list.Sections = append(list.Sections, listSection)
+		}
+		return &waProto.Message{ListMessage: list}, nil, nil
+	}
 
-// GetMediaKey implements the DownloadableMessage interface
-func (d *MediaDownloader) GetMediaKey() []byte {
-	return d.MediaKey
+	name := "quick_reply"
+	nativeFlow := &waProto.InteractiveMessage_NativeFlowMessage{MessageVersion: proto.Int32(1)}
+	if data.NativeFlow != nil {
+		if data.NativeFlow.Name != "" {
+			name = data.NativeFlow.Name
+		}
+		if len(data.NativeFlow.Parameters) > 0 {
+			params, err := json.Marshal(data.NativeFlow.Parameters)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid native_flow parameters: %v", err)
+			}
+			nativeFlow.MessageParamsJSON = proto.String(string(params))
+		}
+	}
+	for _, button := range data.Buttons {
+		// formatInteractiveMessage reads the id and title back from these parameters
+		params, _ := json.Marshal(map[string]string{"display_text": button.Title, "id": button.ID})
+		nativeFlow.Buttons = append(nativeFlow.Buttons, &waProto.InteractiveMessage_NativeFlowMessage_NativeFlowButton{
+			Name:             proto.String(name),
+			ButtonParamsJSON: proto.String(string(params)),
+		})
+	}
+	interactive := &waProto.InteractiveMessage{
+		Body:   &waProto.InteractiveMessage_Body{Text: proto.String(data.Body)},
+		Footer: &waProto.InteractiveMessage_Footer{Text: proto.String(data.Footer)},
+		InteractiveMessage: &waProto.InteractiveMessage_NativeFlowMessage_{
+			NativeFlowMessage: nativeFlow,
+		},
+	}
+	if data.Header != "" {
+		interactive.Header = &waProto.InteractiveMessage_Header{
+			Title:              proto.String(data.Header),
+			HasMediaAttachment: proto.Bool(false),
+		}
+	}
+	biz := waBinary.Node{
+		Tag: "biz",
+		Content: []waBinary.Node{{
+			Tag:   "interactive",
+			Attrs: waBinary.Attrs{"type": "native_flow", "v": "1"},
+			Content: []waBinary.Node{{
+				Tag:   "native_flow",
+				Attrs: waBinary.Attrs{"v": "9", "name": "mixed"},
+			}},
+		}},
+	}
+	return &waProto.Message{InteractiveMessage: interactive}, []waBinary.Node{biz}, nil
 }
 
-// GetFileLength implements the DownloadableMessage interface
-func (d *MediaDownloader) GetFileLength() uint64 {
-	return d.FileLength
+// Extract text content from a message
+func sanitizeMentionToken(value string) string {
+	var builder strings.Builder
+	for _, r := range value {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
 }
 
-// GetFileSHA256 implements the DownloadableMessage interface
-func (d *MediaDownloader) GetFileSHA256() []byte {
-	return d.FileSHA256
-}
+func resolveContactDisplayName(client *whatsmeow.Client, jidStr string) string {
+	if client == nil || jidStr == "" {
+		return ""
+	}
 
-// GetFileEncSHA256 implements the DownloadableMessage interface
-func (d *MediaDownloader) GetFileEncSHA256() []byte {
-	return d.FileEncSHA256
-}
+	jid, err := types.ParseJID(jidStr)
+	if err != nil {
+		return ""
+	}
 
-// GetMediaType implements the DownloadableMessage interface
-func (d *MediaDownloader) GetMediaType() whatsmeow.MediaType {
-	return d.MediaType
+	contact, err := client.Store.Contacts.GetContact(context.Background(), jid)
+	if err == nil {
+		for _, candidate := range []string{
+			contact.FullName,
+			contact.PushName,
+			contact.FirstName,
+			contact.BusinessName,
+		} {
+			if token := sanitizeMentionToken(candidate); token != "" {
+				return token
+			}
+		}
+	}
+
+	return sanitizeMentionToken(jid.User)
 }
 
-// Function to download media from a message
-func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string) (bool, string, string, string, error) {
-	// Query the database for the message
-	var mediaType, filename, url string
-	var mediaKey, fileSHA256, fileEncSHA256 []byte
-	var fileLength uint64
-	var err error
+func hydrateMentionText(client *whatsmeow.Client, text string, contextInfo *waProto.ContextInfo) string {
+	if client == nil || contextInfo == nil || text == "" {
+		return text
+	}
 
-	// First, check if we already have this file
-	chatDir := fmt.Sprintf("store/%s", strings.ReplaceAll(chatJID, ":", "_"))
-	localPath := ""
+	for _, mentionedJID := range contextInfo.GetMentionedJID() {
+		rawID := strings.Split(mentionedJID, "@")[0]
+		if rawID == "" {
+			continue
+		}
 
-	// Get media info from the database
-	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err = messageStore.GetMediaInfo(messageID, chatJID)
+		displayToken := resolveContactDisplayName(client, mentionedJID)
+		if displayToken == "" {
+			continue
+		}
 
-	if err != nil {
-		// Try to get basic info if extended info isn't available
-		err = messageStore.db.QueryRow(
-			"SELECT media_type, filename FROM messages WHERE id = ? AND chat_jid = ?",
-			messageID, chatJID,
-		).Scan(&mediaType, &filename)
+		text = strings.ReplaceAll(text, "@"+rawID, "@"+displayToken)
+	}
 
-		if err != nil {
-			return false, "", "", "", fmt.Errorf("failed to find message: %v", err)
+	// Community subgroup mentions are written as "@<group id>" like user mentions
+	for _, groupMention := range contextInfo.GetGroupMentions() {
+		rawID := strings.Split(groupMention.GetGroupJID(), "@")[0]
+		if token := sanitizeMentionToken(groupMention.GetGroupSubject()); rawID != "" && token != "" {
+			text = strings.ReplaceAll(text, "@"+rawID, "@"+token)
 		}
 	}
 
-	// Check if this is a media message
-	if mediaType == "" {
-		return false, "", "", "", fmt.Errorf("not a media message")
-	}
+	return text
+}
 
-	// Create directory for the chat if it doesn't exist
-	if err := os.MkdirAll(chatDir, 0755); err != nil {
-		return false, "", "", "", fmt.Errorf("failed to create chat directory: %v", err)
-	}
+// nonJIDMentionAll is the ContextInfo.nonJIDMentions flag for a group-wide @all mention
+const nonJIDMentionAll uint32 = 1
 
-	// Generate a local path for the file
-	localPath = fmt.Sprintf("%s/%s", chatDir, filename)
+// GroupMentionInfo is a mentioned community subgroup
+type GroupMentionInfo struct {
+	GroupJID string `json:"group_jid"`
+	Subject  string `json:"subject,omitempty"`
+}
 
-	// Get absolute path
-	absPath, err := filepath.Abs(localPath)
-	if err != nil {
-		return false, "", "", "", fmt.Errorf("failed to get absolute path: %v", err)
+// messageContextInfo returns the ContextInfo of the message's main content, if any
+func messageContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
 	}
+	return nil
+}
 
-	// Check if file already exists
-	if _, err := os.Stat(localPath); err == nil {
-		// File exists, return it
-		return true, mediaType, filename, absPath, nil
+// extractGroupMentions returns whether the message mentions the whole group and which subgroups it mentions
+func extractGroupMentions(msg *waProto.Message) (mentionAll bool, groupMentions []GroupMentionInfo) {
+	contextInfo := messageContextInfo(msg)
+	if contextInfo == nil {
+		return false, nil
 	}
-
-	// If we don't have all the media info we need, we can't download
-	if url == "" || len(mediaKey) == 0 || len(fileSHA256) == 0 || len(fileEncSHA256) == 0 || fileLength == 0 {
-		return false, "", "", "", fmt.Errorf("incomplete media information for download")
+	for _, groupMention := range contextInfo.GetGroupMentions() {
+		groupMentions = append(groupMentions, GroupMentionInfo{
+			GroupJID: groupMention.GetGroupJID(),
+			Subject:  groupMention.GetGroupSubject(),
+		})
 	}
+	return contextInfo.GetNonJIDMentions()&nonJIDMentionAll != 0, groupMentions
+}
 
-	fmt.Printf("Attempting to download media for message %s in chat %s...\n", messageID, chatJID)
-
-	// Extract direct path from URL
-	directPath := extractDirectPathFromURL(url)
+// extractQuotedMessage returns the ID and author of the message this one replies to, if any
+func extractQuotedMessage(msg *waProto.Message) (messageID, sender string) {
+	contextInfo := messageContextInfo(msg)
+	if contextInfo.GetStanzaID() == "" {
+		return "", ""
+	}
+	return contextInfo.GetStanzaID(), contextInfo.GetParticipant()
+}
 
-	// Create a downloader that implements DownloadableMessage
-	var waMediaType whatsmeow.MediaType
-	switch mediaType {
-	case "image":
-		waMediaType = whatsmeow.MediaImage
-	case "video":
-		waMediaType = whatsmeow.MediaVideo
-	case "audio":
-		waMediaType = whatsmeow.MediaAudio
-	case "document":
-		waMediaType = whatsmeow.MediaDocument
-	default:
-		return false, "", "", "", fmt.Errorf("unsupported media type: %s", mediaType)
+// buildGroupMentionContext builds the ContextInfo for @all and community subgroup mentions.
+// Subgroup subjects are looked up so recipients see the group name instead of its ID.
+func buildGroupMentionContext(ctx context.Context, client *whatsmeow.Client, opts SendOptions) (*waProto.ContextInfo, error) {
+	contextInfo := &waProto.ContextInfo{}
+	if opts.MentionAll {
+		contextInfo.NonJIDMentions = proto.Uint32(nonJIDMentionAll)
+	}
+	for _, group := range opts.GroupMentions {
+		groupJID, err := types.ParseJID(group)
+		if err != nil || groupJID.Server != types.GroupServer {
+			return nil, fmt.Errorf("invalid group mention %q: must be a group JID", group)
+		}
+		mention := &waProto.GroupMention{GroupJID: proto.String(groupJID.String())}
+		if info, err := client.GetGroupInfo(ctx, groupJID); err == nil {
+			mention.GroupSubject = proto.String(info.Name)
+		} else {
+			client.Log.Warnf("Could not look up subject for mentioned group %s: %v", groupJID, err)
+		}
+		contextInfo.GroupMentions = append(contextInfo.GroupMentions, mention)
 	}
+	return contextInfo, nil
+}
 
-	downloader := &MediaDownloader{
-		URL:           url,
-		DirectPath:    directPath,
-		MediaKey:      mediaKey,
-		FileLength:    fileLength,
-		FileSHA256:    fileSHA256,
-		FileEncSHA256: fileEncSHA256,
-		MediaType:     waMediaType,
+// setMessageContextInfo attaches ContextInfo to the message's main content
+func setMessageContextInfo(msg *waProto.Message, contextInfo *waProto.ContextInfo) {
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = contextInfo
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = contextInfo
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = contextInfo
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = contextInfo
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = contextInfo
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = contextInfo
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = contextInfo
+	case msg.ContactsArrayMessage != nil:
+		msg.ContactsArrayMessage.ContextInfo = contextInfo
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = contextInfo
 	}
+}
 
-	// Download the media using whatsmeow client
-	mediaData, err := client.Download(context.Background(), downloader)
+// Store group-wide and subgroup mentions for a message
+func (store *MessageStore) StoreGroupMentions(id, chatJID string, mentionAll bool, groupMentions []GroupMentionInfo) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, args, err := groupMentionsUpdate(id, chatJID, mentionAll, groupMentions)
 	if err != nil {
-		return false, "", "", "", fmt.Errorf("failed to download media: %v", err)
+		return err
 	}
+	_, err = store.writer.ExecContext(ctx, query, args...)
+	return err
+}
 
-	// Save the downloaded media to file
-	if err := os.WriteFile(localPath, mediaData, 0644); err != nil {
-		return false, "", "", "", fmt.Errorf("failed to save media file: %v", err)
+// Queue group mentions behind their queued message upsert (history sync)
+func (store *MessageStore) QueueGroupMentions(id, chatJID string, mentionAll bool, groupMentions []GroupMentionInfo) error {
+	query, args, err := groupMentionsUpdate(id, chatJID, mentionAll, groupMentions)
+	if err != nil {
+		return err
 	}
+	return store.writes.Queue(query, args)
+}
 
-	fmt.Printf("Successfully downloaded %s media to %s (%d bytes)\n", mediaType, absPath, len(mediaData))
-	return true, mediaType, filename, absPath, nil
+func groupMentionsUpdate(id, chatJID string, mentionAll bool, groupMentions []GroupMentionInfo) (string, []interface{}, error) {
+	var encoded interface{}
+	if len(groupMentions) > 0 {
+		data, err := json.Marshal(groupMentions)
+		if err != nil {
+			return "", nil, err
+		}
+		encoded = string(data)
+	}
+	return "UPDATE messages SET mentions_all = ?, group_mentions = ? WHERE id = ? AND chat_jid = ?",
+		[]interface{}{mentionAll, encoded, id, chatJID}, nil
 }
 
-// Extract direct path from a WhatsApp media URL
-func extractDirectPathFromURL(url string) string {
-	// The direct path is typically in the URL, we need to extract it
-	// Example URL: https://mmg.whatsapp.net/v/t62.7118-24/13812002_698058036224062_3424455886509161511_n.enc?ccb=11-4&oh=...
+// Store the reply reference of a message
+func (store *MessageStore) StoreQuotedMessage(id, chatJID, quotedID, quotedSender string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, args := quotedMessageUpdate(id, chatJID, quotedID, quotedSender)
+	_, err := store.writer.ExecContext(ctx, query, args...)
+	return err
+}
 
-	// Find the path part after the domain
-	parts := strings.SplitN(url, ".net/", 2)
-	if len(parts) < 2 {
-		return url // Return original URL if parsing fails
-	}
+// Queue a quote reference behind its queued message upsert (history sync)
+func (store *MessageStore) QueueQuotedMessage(id, chatJID, quotedID, quotedSender string) error {
+	return store.writes.Queue(quotedMessageUpdate(id, chatJID, quotedID, quotedSender))
+}
 
-	pathPart := parts[1]
+func quotedMessageUpdate(id, chatJID, quotedID, quotedSender string) (string, []interface{}) {
+	return "UPDATE messages SET quoted_message_id = ?, quoted_sender = ? WHERE id = ? AND chat_jid = ?",
+		[]interface{}{quotedID, quotedSender, id, chatJID}
+}
 
-	// Remove query parameters
-	pathPart = strings.SplitN(pathPart, "?", 2)[0]
+// VCardPhone is a phone number parsed from a vCard TEL entry
+type VCardPhone struct {
+	Number       string `json:"number"`
+	Type         string `json:"type,omitempty"`          // e.g. CELL, WORK
+	WaID         string `json:"wa_id,omitempty"`         // waid parameter set by WhatsApp clients
+	IsRegistered *bool  `json:"is_registered,omitempty"` // Set when MCP_VCARD_CHECK_NUMBERS is enabled
+	JID          string `json:"jid,omitempty"`
+}
 
-	// Create proper direct path format
-	return "/" + pathPart
+// VCardContact is the structured form of a shared contact card
+type VCardContact struct {
+	DisplayName  string       `json:"display_name,omitempty"`
+	Name         string       `json:"name,omitempty"`
+	Organization string       `json:"organization,omitempty"`
+	Phones       []VCardPhone `json:"phones,omitempty"`
+	Emails       []string     `json:"emails,omitempty"`
 }
 
-// authMiddleware provides token-based authentication for MCP API endpoints
-// Phase Security-1: SSRF Prevention - prevents cross-tenant MCP access
-// Skips authentication for /api/health (required for Docker health checks)
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth for health endpoint (Docker health checks need to work without auth)
-		if r.URL.Path == "/api/health" {
-			next(w, r)
-			return
-		}
+// vcardCheckNumbers runs phones from incoming contact cards through IsOnWhatsApp (MCP_VCARD_CHECK_NUMBERS)
+var vcardCheckNumbers bool
 
-		// If no secret configured, allow all requests (backward compatibility during migration)
-		if apiSecret == "" {
-			next(w, r)
-			return
-		}
+// parseVCard extracts names, phones and emails from a vCard 3.0/4.0 payload
+func parseVCard(displayName, vcard string) VCardContact {
+	contact := VCardContact{DisplayName: displayName}
 
-		// Validate Bearer token
-		auth := r.Header.Get("Authorization")
-		if auth == "" {
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error": "Authorization header required"}`, http.StatusUnauthorized)
-			return
-		}
+	// Unfold continuation lines (RFC 6350 section 3.2)
+	vcard = strings.ReplaceAll(vcard, "\r\n", "\n")
+	vcard = strings.ReplaceAll(vcard, "\n ", "")
+	vcard = strings.ReplaceAll(vcard, "\n\t", "")
 
-		if !strings.HasPrefix(auth, "Bearer ") {
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error": "Invalid authorization format, expected Bearer token"}`, http.StatusUnauthorized)
-			return
+	var structuredName string
+	for _, line := range strings.Split(vcard, "\n") {
+		sep := strings.Index(line, ":")
+		if sep <= 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[sep+1:])
+		params := strings.Split(line[:sep], ";")
+		// Drop group prefixes such as "item1.TEL"
+		key := strings.ToUpper(params[0])
+		if dot := strings.LastIndex(key, "."); dot >= 0 {
+			key = key[dot+1:]
 		}
 
-		token := strings.TrimPrefix(auth, "Bearer ")
-		if token != apiSecret {
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error": "Invalid API secret"}`, http.StatusForbidden)
-			return
+		switch key {
+		case "FN":
+			contact.Name = vcardUnescape(value)
+		case "N":
+			// N:Family;Given;Additional;Prefix;Suffix
+			parts := strings.Split(value, ";")
+			var ordered []string
+			for _, i := range []int{3, 1, 2, 0, 4} {
+				if i < len(parts) && strings.TrimSpace(parts[i]) != "" {
+					ordered = append(ordered, strings.TrimSpace(parts[i]))
+				}
+			}
+			structuredName = strings.Join(ordered, " ")
+		case "ORG":
+			contact.Organization = strings.TrimSpace(strings.ReplaceAll(value, ";", " "))
+		case "TEL":
+			phone := VCardPhone{Number: value}
+			for _, param := range params[1:] {
+				name, val, found := strings.Cut(param, "=")
+				switch {
+				case !found:
+					phone.Type = strings.ToUpper(name)
+				case strings.EqualFold(name, "type"):
+					phone.Type = strings.ToUpper(val)
+				case strings.EqualFold(name, "waid"):
+					phone.WaID = val
+				}
+			}
+			if value != "" {
+				contact.Phones = append(contact.Phones, phone)
+			}
+		case "EMAIL":
+			if value != "" {
+				contact.Emails = append(contact.Emails, vcardUnescape(value))
+			}
 		}
+	}
 
-		// Token valid, proceed to handler
-		next(w, r)
+	if contact.Name == "" {
+		contact.Name = structuredName
 	}
+	return contact
 }
 
-// Start a REST API server to expose the WhatsApp client functionality
-func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port int) {
-	// Read API secret from environment (Phase Security-1)
-	apiSecret = os.Getenv("MCP_API_SECRET")
-	if apiSecret == "" {
-		fmt.Println("⚠️  WARNING: MCP_API_SECRET not set - API endpoints are unprotected!")
-	} else {
-		fmt.Println("🔒 MCP API authentication enabled")
+// extractVCardContacts parses ContactMessage/ContactsArrayMessage payloads
+func extractVCardContacts(msg *waProto.Message) []VCardContact {
+	if msg == nil {
+		return nil
 	}
-	// Handler for sending messages
-	http.HandleFunc("/api/send", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// Only allow POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Parse the request body
-		var req SendMessageRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
-			return
-		}
-
-		// Validate request
-		if req.Recipient == "" {
-			http.Error(w, "Recipient is required", http.StatusBadRequest)
-			return
+	if contact := msg.GetContactMessage(); contact != nil {
+		return []VCardContact{parseVCard(contact.GetDisplayName(), contact.GetVcard())}
+	}
+	if array := msg.GetContactsArrayMessage(); array != nil {
+		contacts := make([]VCardContact, 0, len(array.GetContacts()))
+		for _, contact := range array.GetContacts() {
+			contacts = append(contacts, parseVCard(contact.GetDisplayName(), contact.GetVcard()))
 		}
+		return contacts
+	}
+	return nil
+}
 
-		if req.Message == "" && req.MediaPath == "" {
-			http.Error(w, "Message or media path is required", http.StatusBadRequest)
-			return
+// formatVCardContacts converts parsed contact cards to JSON message content. phone_numbers
+// lists every number across the cards as digits (the waid when WhatsApp set one), deduplicated,
+// ready to be messaged or checked.
+func formatVCardContacts(contacts []VCardContact) string {
+	phoneNumbers := []string{}
+	for _, contact := range contacts {
+		for _, phone := range contact.Phones {
+			number := phone.WaID
+			if number == "" {
+				number = normalizePhoneDigits(phone.Number)
+			}
+			if number != "" && !slices.Contains(phoneNumbers, number) {
+				phoneNumbers = append(phoneNumbers, number)
+			}
 		}
+	}
+	data := map[string]interface{}{
+		"type":          "contacts",
+		"contacts":      contacts,
+		"phone_numbers": phoneNumbers,
+	}
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("[Contact Message - Parse Error: %v]", err)
+	}
+	return string(jsonBytes)
+}
 
-		fmt.Println("Received request to send message", req.Message, req.MediaPath)
+// vcardEscape escapes a vCard 3.0 text value
+func vcardEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
 
-		// Send the message
-		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, req.MediaPath)
-		fmt.Println("Message sent", success, message)
-		// Set response headers
-		w.Header().Set("Content-Type", "application/json")
+// vcardUnescape reverses vcardEscape
+func vcardUnescape(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, "\n", `\N`, "\n").Replace(value)
+}
 
-		// Set appropriate status code
-		if !success {
-			w.WriteHeader(http.StatusInternalServerError)
+// buildVCard renders a contact as a vCard 3.0 card. Phones carry a waid parameter, which
+// WhatsApp uses to offer messaging the number.
+func buildVCard(contact VCardContact) string {
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"N:;" + vcardEscape(contact.Name) + ";;;",
+		"FN:" + vcardEscape(contact.Name),
+	}
+	if contact.Organization != "" {
+		lines = append(lines, "ORG:"+vcardEscape(contact.Organization))
+	}
+	for _, phone := range contact.Phones {
+		params := "TEL"
+		if phone.Type != "" {
+			params += ";type=" + strings.ToUpper(phone.Type)
+		}
+		if digits := normalizePhoneDigits(phone.Number); digits != "" {
+			params += ";waid=" + digits
 		}
+		lines = append(lines, params+":"+vcardEscape(phone.Number))
+	}
+	for _, email := range contact.Emails {
+		lines = append(lines, "EMAIL:"+vcardEscape(email))
+	}
+	lines = append(lines, "END:VCARD")
+	return strings.Join(lines, "\n")
+}
 
-		// Send response
-		json.NewEncoder(w).Encode(SendMessageResponse{
-			Success: success,
-			Message: message,
-		})
-	}))
-
-	// Health check endpoint with detailed session state (NO AUTH - Docker health checks)
-	http.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
-		reconnectState.mutex.RLock()
-		reconnectAttempts := reconnectState.reconnectAttempts
-		needsReauth := reconnectState.needsReauth
-		isReconnecting := reconnectState.isReconnecting
-		lastActivity := reconnectState.lastActivityTime
-		sessionStart := reconnectState.sessionStartTime
-		reconnectState.mutex.RUnlock()
-
-		// Calculate session age
-		var sessionAgeSec int64
-		if !sessionStart.IsZero() {
-			sessionAgeSec = int64(time.Since(sessionStart).Seconds())
-		}
-
-		// Calculate time since last activity
-		var lastActivitySec int64
-		if !lastActivity.IsZero() {
-			lastActivitySec = int64(time.Since(lastActivity).Seconds())
-		}
-
-		// Use IsLoggedIn() to check actual authentication status, not just websocket connection
-		// IsConnected() only checks if websocket is open to WhatsApp servers
-		// IsLoggedIn() checks if we have a valid device session (QR code was scanned)
-		authenticated := client.IsLoggedIn()
-		connected := client.IsConnected()
-
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":             "healthy",
-			"connected":          connected,
-			"authenticated":      authenticated,
-			"needs_reauth":       needsReauth,
-			"is_reconnecting":    isReconnecting,
-			"reconnect_attempts": reconnectAttempts,
-			"session_age_sec":    sessionAgeSec,
-			"last_activity_sec":  lastActivitySec,
-		})
-	})
-
-	// QR code endpoint (returns base64-encoded PNG QR code)
-	http.HandleFunc("/api/qr-code", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		// Check if client is truly authenticated (not just has stored credentials)
-		// needsReauth is set when user logs out from phone (events.LoggedOut)
-		reconnectState.mutex.RLock()
-		needsReauth := reconnectState.needsReauth
-		reconnectState.mutex.RUnlock()
-
-		// Only report "Already authenticated" if BOTH:
-		// 1. client.IsLoggedIn() returns true (has stored credentials)
-		// 2. needsReauth is false (user didn't logout from phone)
-		if client.IsLoggedIn() && !needsReauth {
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"qr_code": nil,
-				"message": "Already authenticated",
-			})
-			return
+// validateSendContacts checks contact cards to send: each needs a name and a phone number
+func validateSendContacts(contacts []VCardContact) error {
+	for i, contact := range contacts {
+		if strings.TrimSpace(contact.Name) == "" {
+			return fmt.Errorf("contact %d has no name", i+1)
 		}
-
-		// Return stored QR code if available
-		qrCodeMutex.RLock()
-		qr := currentQRCode
-		qrCodeMutex.RUnlock()
-
-		w.WriteHeader(http.StatusOK)
-		if qr != "" {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"qr_code": qr,
-				"message": "Scan QR code with WhatsApp",
-			})
-		} else {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"qr_code": nil,
-				"message": "QR code not available yet, container starting...",
-			})
+		if len(contact.Phones) == 0 {
+			return fmt.Errorf("contact %q has no phones", contact.Name)
 		}
-	}))
-
-	// Logout endpoint (unpairs device from WhatsApp account)
-	http.HandleFunc("/api/logout", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+		for _, phone := range contact.Phones {
+			if normalizePhoneDigits(phone.Number) == "" {
+				return fmt.Errorf("contact %q has an invalid phone number %q", contact.Name, phone.Number)
+			}
 		}
+	}
+	return nil
+}
 
-		w.Header().Set("Content-Type", "application/json")
-
-		if !client.IsLoggedIn() {
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": true,
-				"message": "Already logged out",
-			})
-			return
+// contactsMessage builds a ContactMessage for one card, or a ContactsArrayMessage for several
+func contactsMessage(contacts []VCardContact) *waProto.Message {
+	cards := make([]*waProto.ContactMessage, 0, len(contacts))
+	for _, contact := range contacts {
+		displayName := contact.DisplayName
+		if displayName == "" {
+			displayName = contact.Name
 		}
+		cards = append(cards, &waProto.ContactMessage{
+			DisplayName: proto.String(displayName),
+			Vcard:       proto.String(buildVCard(contact)),
+		})
+	}
+	if len(cards) == 1 {
+		return &waProto.Message{ContactMessage: cards[0]}
+	}
+	return &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{
+		DisplayName: proto.String(fmt.Sprintf("%d contacts", len(cards))),
+		Contacts:    cards,
+	}}
+}
 
-		err := client.Logout(context.Background())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"message": fmt.Sprintf("Logout failed: %v", err),
-			})
-			return
+// normalizePhoneDigits strips a phone number down to its digits (no + prefix or separators)
+func normalizePhoneDigits(phone string) string {
+	var digits strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
 		}
+	}
+	return digits.String()
+}
 
-		qrCodeMutex.Lock()
-		currentQRCode = ""
-		qrCodeMutex.Unlock()
+// defaultCountryCode is the calling code national numbers are assumed to be in
+// (MCP_DEFAULT_COUNTRY_CODE, e.g. 55); empty means numbers must carry their country code
+var defaultCountryCode string
+
+// maxNormalizeNumbers caps one /api/phone/normalize request
+const maxNormalizeNumbers = 1000
+
+// twoDigitCountryCodes maps the two-digit calling codes to their country. Calling codes are
+// prefix-free: 1 and 7 are the only one-digit codes and every prefix not listed here is the
+// start of a three-digit code.
+var twoDigitCountryCodes = map[string]string{
+	"20": "EG", "27": "ZA", "30": "GR", "31": "NL", "32": "BE", "33": "FR", "34": "ES", "36": "HU",
+	"39": "IT", "40": "RO", "41": "CH", "43": "AT", "44": "GB", "45": "DK", "46": "SE", "47": "NO",
+	"48": "PL", "49": "DE", "51": "PE", "52": "MX", "53": "CU", "54": "AR", "55": "BR", "56": "CL",
+	"57": "CO", "58": "VE", "60": "MY", "61": "AU", "62": "ID", "63": "PH", "64": "NZ", "65": "SG",
+	"66": "TH", "81": "JP", "82": "KR", "84": "VN", "86": "CN", "90": "TR", "91": "IN", "92": "PK",
+	"93": "AF", "94": "LK", "95": "MM", "98": "IR",
+}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"message": "Device successfully unpaired from WhatsApp",
-		})
-	}))
+// threeDigitCountryCodes names the countries of the three-digit codes we see most; others
+// are still accepted, just without a region
+var threeDigitCountryCodes = map[string]string{
+	"212": "MA", "213": "DZ", "216": "TN", "233": "GH", "234": "NG", "244": "AO", "254": "KE", "258": "MZ",
+	"351": "PT", "352": "LU", "353": "IE", "358": "FI", "380": "UA", "502": "GT", "503": "SV", "504": "HN",
+	"505": "NI", "506": "CR", "507": "PA", "591": "BO", "593": "EC", "595": "PY", "598": "UY", "852": "HK",
+	"880": "BD", "966": "SA", "971": "AE", "972": "IL",
+}
 
-	// Handler for downloading media
-	http.HandleFunc("/api/download", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// Only allow POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// brazilAreaCodes are the valid Brazilian DDDs (two-digit area codes)
+var brazilAreaCodes = map[string]bool{
+	"11": true, "12": true, "13": true, "14": true, "15": true, "16": true, "17": true, "18": true, "19": true,
+	"21": true, "22": true, "24": true, "27": true, "28": true,
+	"31": true, "32": true, "33": true, "34": true, "35": true, "37": true, "38": true,
+	"41": true, "42": true, "43": true, "44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+	"51": true, "53": true, "54": true, "55": true,
+	"61": true, "62": true, "63": true, "64": true, "65": true, "66": true, "67": true, "68": true, "69": true,
+	"71": true, "73": true, "74": true, "75": true, "77": true, "79": true,
+	"81": true, "82": true, "83": true, "84": true, "85": true, "86": true, "87": true, "88": true, "89": true,
+	"91": true, "92": true, "93": true, "94": true, "95": true, "96": true, "97": true, "98": true, "99": true,
+}
 
-		// Parse the request body
-		var req DownloadMediaRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
-			return
-		}
+// nationalNumberLengths are the national number lengths of the countries whose plans we
+// check, used to tell a national number from one that already has its country code
+var nationalNumberLengths = map[string][]int{
+	"1":  {10},
+	"55": {10, 11},
+}
 
-		// Validate request
-		if req.MessageID == "" || req.ChatJID == "" {
-			http.Error(w, "Message ID and Chat JID are required", http.StatusBadRequest)
-			return
-		}
+// leadingZeroCountryCodes are the countries whose numbers keep their leading 0 internationally
+// (Italy and the Vatican share +39), where it is not a trunk prefix to drop
+var leadingZeroCountryCodes = map[string]bool{"39": true}
+
+// PhoneNumber is a phone number normalized to E.164
+type PhoneNumber struct {
+	Input          string `json:"input"`
+	E164           string `json:"e164"`
+	CountryCode    string `json:"country_code"`
+	NationalNumber string `json:"national_number"`
+	Region         string `json:"region,omitempty"`    // ISO 3166-1 alpha-2; empty for shared or unlisted codes
+	Type           string `json:"type,omitempty"`      // mobile or landline, where the numbering plan tells them apart
+	Alternate      string `json:"alternate,omitempty"` // Brazilian mobiles: the pre-2016 8-digit form older WhatsApp accounts are registered under
+}
 
-		// Download the media
-		success, mediaType, filename, path, err := downloadMedia(client, messageStore, req.MessageID, req.ChatJID)
+// Digits returns the number the way WhatsApp JIDs carry it (E.164 without the +)
+func (number PhoneNumber) Digits() string {
+	return strings.TrimPrefix(number.E164, "+")
+}
 
-		// Set response headers
-		w.Header().Set("Content-Type", "application/json")
+// splitCountryCode splits the calling code off an international number
+func splitCountryCode(digits string) (string, string) {
+	switch {
+	case digits[0] == '1' || digits[0] == '7':
+		return digits[:1], digits[1:]
+	case len(digits) >= 2 && twoDigitCountryCodes[digits[:2]] != "":
+		return digits[:2], digits[2:]
+	case len(digits) >= 3:
+		return digits[:3], digits[3:]
+	}
+	return digits, ""
+}
 
-		// Handle download result
-		if !success || err != nil {
-			errMsg := "Unknown error"
-			if err != nil {
-				errMsg = err.Error()
-			}
+// isCountryCallingCode reports whether code is a whole calling code (e.g. 55, not 5 or 550)
+func isCountryCallingCode(code string) bool {
+	if code == "" || normalizePhoneDigits(code) != code {
+		return false
+	}
+	// Padding stands in for the rest of a number, so a code only splits off whole
+	prefix, _ := splitCountryCode(code + "000")
+	return prefix == code
+}
 
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(DownloadMediaResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to download media: %s", errMsg),
-			})
-			return
+// normalizePhoneNumber parses a phone number written with an optional + or 00 prefix and the
+// usual separators into E.164. Numbers without either prefix are taken to include their country
+// code unless countryCode is set and the number looks national (a trunk 0, or a national length
+// for the countries in nationalNumberLengths).
+func normalizePhoneNumber(input, countryCode string) (PhoneNumber, error) {
+	number := PhoneNumber{Input: input}
+	trimmed := strings.TrimSpace(input)
+	for i, r := range trimmed {
+		if !(r >= '0' && r <= '9') && !strings.ContainsRune(" -.()/", r) && !(r == '+' && i == 0) {
+			return number, fmt.Errorf("unexpected character %q", r)
 		}
+	}
+	digits := normalizePhoneDigits(trimmed)
+	if digits == "" {
+		return number, fmt.Errorf("no digits")
+	}
 
-		// Read the file content to send back to backend
-		// This is necessary because backend and MCP run in separate containers
-		fileData, err := os.ReadFile(path)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(DownloadMediaResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to read downloaded file: %s", err.Error()),
-			})
-			return
+	international := strings.HasPrefix(trimmed, "+")
+	if !international && strings.HasPrefix(digits, "00") {
+		digits, international = digits[2:], true
+	}
+	var national string
+	if !international && countryCode != "" {
+		lengths, known := nationalNumberLengths[countryCode]
+		switch {
+		case strings.HasPrefix(digits, "0") && !leadingZeroCountryCodes[countryCode]:
+			national = strings.TrimPrefix(digits, "0")
+		case known && slices.Contains(lengths, len(digits)):
+			national = digits
+		case !known && !strings.HasPrefix(digits, countryCode):
+			national = digits
 		}
-
-		// Encode file content as base64 to send via JSON
-		fileBase64 := base64.StdEncoding.EncodeToString(fileData)
-
-		// Send successful response with file content
-		json.NewEncoder(w).Encode(DownloadMediaResponse{
-			Success:     true,
-			Message:     fmt.Sprintf("Successfully downloaded %s media", mediaType),
-			Filename:    filename,
-			Path:        path,
-			FileContent: fileBase64, // Add base64-encoded file content
-		})
-	}))
-
-	// Handler for selecting an option from interactive menus (list/buttons)
-	http.HandleFunc("/api/select-option", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// Only allow POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	}
+	if national != "" {
+		number.CountryCode = countryCode
+	} else if digits == "" {
+		return number, fmt.Errorf("no digits after the international prefix")
+	} else {
+		number.CountryCode, national = splitCountryCode(digits)
+		// A trunk 0 written after the country code, e.g. +55 (011) ...
+		if !leadingZeroCountryCodes[number.CountryCode] {
+			national = strings.TrimPrefix(national, "0")
 		}
+	}
 
-		// Parse the request body
-		var req struct {
-			Recipient    string `json:"recipient"`     // JID of the bot/chat
-			SelectedID   string `json:"selected_id"`   // The ID of the selected option
-			SelectedText string `json:"selected_text"` // Display text of selection (optional)
-			ResponseType string `json:"response_type"` // "list", "buttons", or "native_flow"
+	switch number.CountryCode {
+	case "1":
+		if len(national) != 10 {
+			return number, fmt.Errorf("North American numbers have 10 digits after the country code, got %d", len(national))
 		}
-
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
-			return
+	case "55":
+		// A long-distance carrier code dialled after the trunk 0 (0 XX DDD number)
+		if len(national) == 12 || len(national) == 13 {
+			national = national[2:]
 		}
-
-		// Validate request
-		if req.Recipient == "" {
-			http.Error(w, "Recipient is required", http.StatusBadRequest)
-			return
+		if len(national) != 10 && len(national) != 11 {
+			return number, fmt.Errorf("Brazilian numbers have a 2-digit area code and 8 or 9 digits, got %d digits", len(national))
 		}
-		if req.SelectedID == "" {
-			http.Error(w, "Selected ID is required", http.StatusBadRequest)
-			return
+		areaCode, subscriber := national[:2], national[2:]
+		if !brazilAreaCodes[areaCode] {
+			return number, fmt.Errorf("%s is not a Brazilian area code", areaCode)
 		}
-
-		// Default response type - native_flow works best with most business bots
-		// as it sends the selection as plain text which bots universally accept
-		if req.ResponseType == "" {
-			req.ResponseType = "native_flow"
+		switch {
+		case len(subscriber) == 9 && subscriber[0] == '9':
+			number.Type = "mobile"
+		case len(subscriber) == 8 && subscriber[0] >= '6':
+			// Mobiles gained a leading 9 nationwide by 2016; numbers written before still lack it
+			number.Type = "mobile"
+			subscriber = "9" + subscriber
+		case len(subscriber) == 8 && subscriber[0] >= '2':
+			number.Type = "landline"
+		default:
+			return number, fmt.Errorf("%s is not a valid Brazilian subscriber number", subscriber)
+		}
+		national = areaCode + subscriber
+		if number.Type == "mobile" {
+			number.Alternate = "+55" + areaCode + subscriber[1:]
 		}
+	}
+	if len(national) < 4 || len(number.CountryCode)+len(national) > 15 {
+		return number, fmt.Errorf("%d digits is not a valid phone number length", len(number.CountryCode)+len(national))
+	}
 
-		// Parse recipient JID
-		var recipientJID types.JID
-		var err error
+	number.NationalNumber = national
+	number.E164 = "+" + number.CountryCode + national
+	number.Region = twoDigitCountryCodes[number.CountryCode]
+	if number.Region == "" {
+		number.Region = threeDigitCountryCodes[number.CountryCode]
+	}
+	return number, nil
+}
 
-		if strings.Contains(req.Recipient, "@") {
-			recipientJID, err = types.ParseJID(req.Recipient)
-			if err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(SendMessageResponse{
-					Success: false,
-					Message: fmt.Sprintf("Invalid recipient JID: %v", err),
-				})
-				return
+// checkVCardNumbers annotates contact phones with their WhatsApp registration status
+func checkVCardNumbers(client *whatsmeow.Client, contacts []VCardContact) error {
+	type phoneRef struct{ contact, phone int }
+	var numbers []string
+	var refs []phoneRef
+	for ci := range contacts {
+		for pi, phone := range contacts[ci].Phones {
+			number := phone.WaID
+			if number == "" {
+				number = normalizePhoneDigits(phone.Number)
 			}
-		} else {
-			phoneNumber := strings.TrimPrefix(req.Recipient, "+")
-			recipientJID = types.JID{
-				User:   phoneNumber,
-				Server: "s.whatsapp.net",
+			if number == "" {
+				continue
 			}
+			numbers = append(numbers, number)
+			refs = append(refs, phoneRef{ci, pi})
 		}
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
+	// Same batch limit as /api/check-numbers
+	if len(numbers) > 50 {
+		numbers, refs = numbers[:50], refs[:50]
+	}
 
-		// Build the response message based on type
-		var msg *waProto.Message
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := client.IsOnWhatsApp(ctx, numbers)
+	if err != nil {
+		return err
+	}
 
-		switch req.ResponseType {
-		case "list":
-			// ListResponseMessage for list menu selections
-			msg = &waProto.Message{
-				ListResponseMessage: &waProto.ListResponseMessage{
-					Title:    proto.String(req.SelectedText),
+	// Results aren't guaranteed to come back in request order, so match them by number
+	byNumber := make(map[string]types.IsOnWhatsAppResponse, len(results))
+	for _, result := range results {
+		byNumber[strings.TrimPrefix(result.Query, "+")] = result
+	}
+	for i, number := range numbers {
+		result, ok := byNumber[number]
+		if !ok {
+			continue
+		}
+		phone := &contacts[refs[i].contact].Phones[refs[i].phone]
+		isRegistered := result.IsIn
+		phone.IsRegistered = &isRegistered
+		if result.IsIn && result.JID.User != "" {
+			phone.JID = result.JID.String()
+		}
+	}
+	return nil
+}
+
+// annotateVCardNumbers checks a stored contact card's phones and rewrites its content with the results
+func annotateVCardNumbers(client *whatsmeow.Client, messageStore *MessageStore, id, chatJID string, contacts []VCardContact, logger waLog.Logger) {
+	if err := checkVCardNumbers(client, contacts); err != nil {
+		logger.Warnf("Failed to check vCard numbers: %v", err)
+		return
+	}
+	if err := messageStore.UpdateInboundContent(id, chatJID, formatVCardContacts(contacts)); err != nil {
+		logger.Warnf("Failed to store vCard number checks: %v", err)
+	}
+}
+
+// formatEventMessage converts an EventMessage (calendar invite) to JSON
+func formatEventMessage(event *waProto.EventMessage) string {
+	data := map[string]interface{}{
+		"type":                 "event",
+		"name":                 event.GetName(),
+		"description":          event.GetDescription(),
+		"is_canceled":          event.GetIsCanceled(),
+		"extra_guests_allowed": event.GetExtraGuestsAllowed(),
+	}
+	if event.GetStartTime() > 0 {
+		data["start_time"] = time.Unix(event.GetStartTime(), 0).UTC().Format(time.RFC3339)
+	}
+	if event.GetEndTime() > 0 {
+		data["end_time"] = time.Unix(event.GetEndTime(), 0).UTC().Format(time.RFC3339)
+	}
+	if link := event.GetJoinLink(); link != "" {
+		data["join_link"] = link
+	}
+	if loc := event.GetLocation(); loc != nil {
+		data["location"] = map[string]interface{}{
+			"name":      loc.GetName(),
+			"address":   loc.GetAddress(),
+			"latitude":  loc.GetDegreesLatitude(),
+			"longitude": loc.GetDegreesLongitude(),
+		}
+	}
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("[Event Message - Parse Error: %v]", err)
+	}
+	return string(jsonBytes)
+}
+
+// formatLocationMessage renders a shared location pin as JSON
+func formatLocationMessage(location *waProto.LocationMessage) string {
+	data := map[string]interface{}{
+		"type":      "location",
+		"latitude":  location.GetDegreesLatitude(),
+		"longitude": location.GetDegreesLongitude(),
+	}
+	if name := location.GetName(); name != "" {
+		data["name"] = name
+	}
+	if address := location.GetAddress(); address != "" {
+		data["address"] = address
+	}
+	if url := location.GetURL(); url != "" {
+		data["url"] = url
+	}
+	if comment := location.GetComment(); comment != "" {
+		data["comment"] = comment
+	}
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("[Location Message - Parse Error: %v]", err)
+	}
+	return string(jsonBytes)
+}
+
+// formatLiveLocationMessage renders a live location update as JSON. Each update the sharer's
+// phone sends carries the latest position; sequence_number orders them.
+func formatLiveLocationMessage(live *waProto.LiveLocationMessage) string {
+	data := map[string]interface{}{
+		"type":            "live_location",
+		"latitude":        live.GetDegreesLatitude(),
+		"longitude":       live.GetDegreesLongitude(),
+		"sequence_number": live.GetSequenceNumber(),
+	}
+	if accuracy := live.GetAccuracyInMeters(); accuracy > 0 {
+		data["accuracy_meters"] = accuracy
+	}
+	if speed := live.GetSpeedInMps(); speed > 0 {
+		data["speed_mps"] = speed
+	}
+	if caption := live.GetCaption(); caption != "" {
+		data["caption"] = caption
+	}
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("[Live Location Message - Parse Error: %v]", err)
+	}
+	return string(jsonBytes)
+}
+
+// pollCreation returns the poll carried by any of the poll creation message versions
+func pollCreation(msg *waProto.Message) *waProto.PollCreationMessage {
+	for _, poll := range []*waProto.PollCreationMessage{
+		msg.GetPollCreationMessage(), msg.GetPollCreationMessageV2(), msg.GetPollCreationMessageV3(),
+		msg.GetPollCreationMessageV5(), msg.GetPollCreationMessageV6(),
+	} {
+		if poll != nil {
+			return poll
+		}
+	}
+	return nil
+}
+
+// maxPollOptions is the most options WhatsApp allows in a poll
+const maxPollOptions = 12
+
+// PollContent is the JSON stored as the content of a poll (content_type poll)
+type PollContent struct {
+	Type            string   `json:"type"`
+	Question        string   `json:"question"`
+	Options         []string `json:"options"`
+	SelectableCount int      `json:"selectable_count"` // 0 = any number of options
+}
+
+// formatPollMessage renders a poll as JSON; votes arrive separately (see formatPollVote)
+func formatPollMessage(poll *waProto.PollCreationMessage) string {
+	content := PollContent{
+		Type:            "poll",
+		Question:        poll.GetName(),
+		Options:         []string{},
+		SelectableCount: int(poll.GetSelectableOptionsCount()),
+	}
+	for _, option := range poll.GetOptions() {
+		content.Options = append(content.Options, option.GetOptionName())
+	}
+	jsonBytes, err := json.Marshal(content)
+	if err != nil {
+		return fmt.Sprintf("[Poll Message - Parse Error: %v]", err)
+	}
+	return string(jsonBytes)
+}
+
+// formatPollVote decrypts a poll vote and renders it as JSON with the selected option names.
+// Votes carry SHA-256 hashes of the option names, which are matched against the stored poll;
+// hashes that don't match (poll not stored) are kept hex-encoded. Each vote replaces the
+// voter's previous one, and an empty selection withdraws it. Returns "" if the vote can't be decrypted.
+func formatPollVote(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, chatJID string, voter types.JID, logger waLog.Logger) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	vote, err := client.DecryptPollVote(ctx, msg)
+	if err != nil {
+		logger.Warnf("Failed to process poll vote: %v", err)
+		return ""
+	}
+
+	if voter.IsEmpty() {
+		voter = msg.Info.Sender
+	}
+	pollID := msg.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+	var poll PollContent
+	if stored, err := messageStore.GetMessageContent(pollID, chatJID); err == nil {
+		json.Unmarshal([]byte(stored), &poll)
+	} else if err != sql.ErrNoRows {
+		logger.Warnf("Failed to load poll %s: %v", pollID, err)
+	}
+	optionNames := make(map[string]string, len(poll.Options))
+	for i, hash := range whatsmeow.HashPollOptions(poll.Options) {
+		optionNames[string(hash)] = poll.Options[i]
+	}
+	selected := []string{}
+	for _, hash := range vote.GetSelectedOptions() {
+		if name, ok := optionNames[string(hash)]; ok {
+			selected = append(selected, name)
+		} else {
+			selected = append(selected, hex.EncodeToString(hash))
+		}
+	}
+
+	jsonBytes, err := json.Marshal(map[string]interface{}{
+		"type":             "poll_vote",
+		"poll_id":          pollID,
+		"question":         poll.Question,
+		"voter":            voter.ToNonAD().String(),
+		"selected_options": selected,
+	})
+	if err != nil {
+		return fmt.Sprintf("[Poll Vote - Parse Error: %v]", err)
+	}
+	fmt.Printf("🗳️ Poll vote: %s -> %s (%s)\n", voter.User, redactLogContent(strings.Join(selected, ", ")), pollID)
+	return string(jsonBytes)
+}
+
+func extractTextContent(client *whatsmeow.Client, msg *waProto.Message) string {
+	if msg == nil {
+		return ""
+	}
+
+	// Try to get text content (most common)
+	if text := msg.GetConversation(); text != "" {
+		return text
+	}
+	if extendedText := msg.GetExtendedTextMessage(); extendedText != nil {
+		return hydrateMentionText(client, extendedText.GetText(), extendedText.GetContextInfo())
+	}
+
+	// Handle InteractiveMessage (used by business bots like Unimed)
+	if interactive := msg.GetInteractiveMessage(); interactive != nil {
+		return formatInteractiveMessage(interactive)
+	}
+
+	// Handle event invites (RSVP state is tracked separately in event_responses)
+	if event := msg.GetEventMessage(); event != nil {
+		return formatEventMessage(event)
+	}
+
+	// Handle polls (votes are decrypted in handleMessage, see formatPollVote)
+	if poll := pollCreation(msg); poll != nil {
+		return formatPollMessage(poll)
+	}
+
+	// Handle shared locations, static and live
+	if location := msg.GetLocationMessage(); location != nil {
+		return formatLocationMessage(location)
+	}
+	if live := msg.GetLiveLocationMessage(); live != nil {
+		return formatLiveLocationMessage(live)
+	}
+
+	// Handle shared contact cards (vCards)
+	if contacts := extractVCardContacts(msg); len(contacts) > 0 {
+		return formatVCardContacts(contacts)
+	}
+
+	// Handle ListMessage (list menus with sections/rows)
+	if list := msg.GetListMessage(); list != nil {
+		return formatListMessage(list)
+	}
+
+	// Handle ButtonsMessage (simple button menus)
+	if buttons := msg.GetButtonsMessage(); buttons != nil {
+		return formatButtonsMessage(buttons)
+	}
+
+	// Handle ListResponseMessage (user selection from list)
+	if listResponse := msg.GetListResponseMessage(); listResponse != nil {
+		return formatListResponseMessage(listResponse)
+	}
+
+	// Handle ButtonsResponseMessage (user selection from buttons)
+	if buttonsResponse := msg.GetButtonsResponseMessage(); buttonsResponse != nil {
+		return formatButtonsResponseMessage(buttonsResponse)
+	}
+
+	// Handle TemplateMessage (template-based interactive messages)
+	if template := msg.GetTemplateMessage(); template != nil {
+		if hydratedTemplate := template.GetHydratedTemplate(); hydratedTemplate != nil {
+			data := map[string]interface{}{
+				"type": "template",
+				"body": hydratedTemplate.GetHydratedContentText(),
+			}
+			// Extract template buttons
+			var buttons []InteractiveButton
+			for i, btn := range hydratedTemplate.GetHydratedButtons() {
+				if btn != nil {
+					btnData := InteractiveButton{
+						ID: fmt.Sprintf("%d", i),
+					}
+					if qrBtn := btn.GetQuickReplyButton(); qrBtn != nil {
+						btnData.Title = qrBtn.GetDisplayText()
+						btnData.ID = qrBtn.GetID()
+					} else if urlBtn := btn.GetUrlButton(); urlBtn != nil {
+						btnData.Title = urlBtn.GetDisplayText()
+					} else if callBtn := btn.GetCallButton(); callBtn != nil {
+						btnData.Title = callBtn.GetDisplayText()
+					}
+					buttons = append(buttons, btnData)
+				}
+			}
+			if len(buttons) > 0 {
+				data["buttons"] = buttons
+			}
+			jsonBytes, _ := json.Marshal(data)
+			return string(jsonBytes)
+		}
+	}
+
+	// Handle TemplateButtonReplyMessage (response to template)
+	if templateReply := msg.GetTemplateButtonReplyMessage(); templateReply != nil {
+		data := map[string]interface{}{
+			"type":          "template_response",
+			"selected_id":   templateReply.GetSelectedID(),
+			"selected_text": templateReply.GetSelectedDisplayText(),
+		}
+		jsonBytes, _ := json.Marshal(data)
+		return string(jsonBytes)
+	}
+
+	// Extract caption from media messages (image, video, document)
+	if image := msg.GetImageMessage(); image != nil {
+		return image.GetCaption()
+	}
+	if video := msg.GetVideoMessage(); video != nil {
+		return video.GetCaption()
+	}
+	if document := msg.GetDocumentMessage(); document != nil {
+		return document.GetCaption()
+	}
+	if audio := msg.GetAudioMessage(); audio != nil {
+		// Audio typically doesn't have captions, but check anyway
+		return ""
+	}
+
+	return ""
+}
+
+// Message content types: how the content column should be read. Structured types
+// carry the JSON rendered by the format* helpers; "media" content is the caption.
+const (
+	contentTypeText             = "text"
+	contentTypeMedia            = "media"
+	contentTypeInteractive      = "interactive"
+	contentTypeList             = "list"
+	contentTypeButtons          = "buttons"
+	contentTypeListResponse     = "list_response"
+	contentTypeButtonsResponse  = "buttons_response"
+	contentTypeTemplate         = "template"
+	contentTypeTemplateResponse = "template_response"
+	contentTypeContact          = "contact"
+	contentTypeEvent            = "event"
+	contentTypeLocation         = "location"
+	contentTypePoll             = "poll"
+	contentTypePollVote         = "poll_vote"
+)
+
+var contentTypes = []string{
+	contentTypeText, contentTypeMedia, contentTypeInteractive, contentTypeList, contentTypeButtons,
+	contentTypeListResponse, contentTypeButtonsResponse, contentTypeTemplate, contentTypeTemplateResponse,
+	contentTypeContact, contentTypeEvent, contentTypeLocation, contentTypePoll, contentTypePollVote,
+}
+
+// extractContentType classifies a message the same way extractTextContent renders it
+func extractContentType(msg *waProto.Message) string {
+	switch {
+	case msg == nil:
+		return ""
+	case msg.GetConversation() != "" || msg.GetExtendedTextMessage() != nil:
+		return contentTypeText
+	case msg.GetInteractiveMessage() != nil:
+		return contentTypeInteractive
+	case msg.GetEventMessage() != nil:
+		return contentTypeEvent
+	case msg.GetContactMessage() != nil || msg.GetContactsArrayMessage() != nil:
+		return contentTypeContact
+	case msg.GetListMessage() != nil:
+		return contentTypeList
+	case msg.GetButtonsMessage() != nil:
+		return contentTypeButtons
+	case msg.GetListResponseMessage() != nil:
+		return contentTypeListResponse
+	case msg.GetButtonsResponseMessage() != nil:
+		return contentTypeButtonsResponse
+	case msg.GetTemplateMessage().GetHydratedTemplate() != nil:
+		return contentTypeTemplate
+	case msg.GetTemplateButtonReplyMessage() != nil:
+		return contentTypeTemplateResponse
+	case msg.GetLocationMessage() != nil || msg.GetLiveLocationMessage() != nil:
+		return contentTypeLocation
+	case pollCreation(msg) != nil:
+		return contentTypePoll
+	case msg.GetPollUpdateMessage() != nil:
+		return contentTypePollVote
+	}
+	return contentTypeMedia
+}
+
+// SendMessageResponse represents the response for the send message API
+type SendMessageResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	ErrorCode string `json:"error_code,omitempty"` // Failures only, see classifySendFailure
+	Retryable bool   `json:"retryable,omitempty"`  // The same send may succeed if tried again later
+}
+
+// Send failure codes. Retryable failures may go through when the same send is tried again
+// later; terminal ones won't until the request or the recipient changes.
+const (
+	sendErrNotConnected           = "NOT_CONNECTED"
+	sendErrTimeout                = "TIMEOUT"
+	sendErrRateLimited            = "RATE_LIMITED"
+	sendErrServer                 = "SERVER_ERROR"
+	sendErrUploadFailed           = "UPLOAD_FAILED"
+	sendErrRecipientNotOnWhatsApp = "RECIPIENT_NOT_ON_WHATSAPP"
+	sendErrInvalidRecipient       = "INVALID_RECIPIENT"
+	sendErrRecipientBlocked       = "RECIPIENT_BLOCKED" // The server forbade messages to the recipient (403), e.g. blocked
+	sendErrRejected               = "REJECTED"          // The server refused the message (other 4xx but rate limits)
+	sendErrCancelled              = "CANCELLED"
+	sendErrFailed                 = "SEND_FAILED" // Anything else, e.g. invalid media or options
+)
+
+// retryableSendErrors are the failure codes worth retrying
+var retryableSendErrors = map[string]bool{
+	sendErrNotConnected: true,
+	sendErrTimeout:      true,
+	sendErrRateLimited:  true,
+	sendErrServer:       true,
+	sendErrUploadFailed: true,
+}
+
+// sendStatusPattern finds the status code whatsmeow puts in message send and info query errors
+var sendStatusPattern = regexp.MustCompile(`(?:server returned error|info query returned status) (\d{3})`)
+
+// classifySendFailure maps a failure message from sendWhatsAppMessage, including the whatsmeow
+// error it wraps, to a send failure code
+func classifySendFailure(result string) string {
+	contains := func(errs ...error) bool {
+		for _, err := range errs {
+			if strings.Contains(result, err.Error()) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case strings.HasPrefix(result, "Cancelled "):
+		return sendErrCancelled
+	case strings.HasPrefix(result, "Not connected"), contains(whatsmeow.ErrNotConnected, whatsmeow.ErrNotLoggedIn),
+		strings.Contains(result, "websocket disconnected"):
+		return sendErrNotConnected
+	case strings.HasPrefix(result, "Timeout "), contains(whatsmeow.ErrMessageTimedOut, whatsmeow.ErrIQTimedOut):
+		return sendErrTimeout
+	case strings.Contains(result, "not on WhatsApp"):
+		return sendErrRecipientNotOnWhatsApp
+	case strings.HasPrefix(result, "Error parsing JID"), strings.HasPrefix(result, "Invalid phone number"),
+		contains(whatsmeow.ErrUnknownServer, whatsmeow.ErrRecipientADJID, whatsmeow.ErrBroadcastListUnsupported):
+		return sendErrInvalidRecipient
+	}
+	if match := sendStatusPattern.FindStringSubmatch(result); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		switch {
+		case status == http.StatusTooManyRequests:
+			return sendErrRateLimited
+		case status == http.StatusForbidden:
+			return sendErrRecipientBlocked
+		case status >= 500:
+			return sendErrServer
+		default:
+			return sendErrRejected
+		}
+	}
+	if strings.HasPrefix(result, "Error uploading media") {
+		return sendErrUploadFailed
+	}
+	return sendErrFailed
+}
+
+// SendMessageRequest represents the request body for the send message API
+type SendMessageRequest struct {
+	Recipient     string   `json:"recipient"`
+	Message       string   `json:"message"`
+	MediaPath     string   `json:"media_path,omitempty"`
+	MediaHandle   string   `json:"media_handle,omitempty"`   // upload_id returned by /api/upload/complete
+	MediaBase64   string   `json:"media_base64,omitempty"`   // File contents (or a data: URI) for callers without filesystem access
+	MediaURL      string   `json:"media_url,omitempty"`      // Public http(s) URL the file is fetched from
+	MediaFilename string   `json:"media_filename,omitempty"` // Name for media_base64/media_url; the extension picks the media type
+	IsVoiceNote   *bool    `json:"is_voice_note,omitempty"`  // Audio only: true = voice note (PTT), false = audio file
+	GifPlayback   bool     `json:"gif_playback,omitempty"`   // mp4 only: recipient loops the video like a GIF
+	Sticker       bool     `json:"sticker,omitempty"`        // PNG/JPEG/GIF only: send as a 512x512 WebP sticker (animated for GIFs)
+	MentionAll    bool     `json:"mention_all,omitempty"`    // Group only: mention everyone (@all)
+	GroupMentions []string `json:"group_mentions,omitempty"` // Group only: community subgroup JIDs to mention
+	// QuotedMessageID makes the message a reply to a stored message in the same chat
+	QuotedMessageID string `json:"quoted_message_id,omitempty"`
+	// AllowDuplicate bypasses duplicate suppression for an intentional repeat
+	AllowDuplicate bool `json:"allow_duplicate,omitempty"`
+	// Personalize fills {key} placeholders in the message from the recipient's contact attributes
+	Personalize bool `json:"personalize,omitempty"`
+	// Template sends a stored template translated for the recipient's locale (message is the last fallback)
+	Template  string            `json:"template,omitempty"`
+	Variables map[string]string `json:"variables,omitempty"` // {key} values, applied before contact attributes
+	// Location sends a location pin instead of text; message becomes its comment
+	Location *SendLocation `json:"location,omitempty"`
+	// Contacts sends contact cards (name, phones, optionally organization and emails) instead of text
+	Contacts []VCardContact `json:"contacts,omitempty"`
+	// VerifyRecipient checks a phone number recipient is on WhatsApp before sending
+	// (failing with RECIPIENT_NOT_ON_WHATSAPP); answers are cached, see recipientChecks
+	VerifyRecipient bool `json:"verify_recipient,omitempty"`
+	// Queue hands the send to the durable outbox instead of sending it now; it is retried until
+	// it goes through, and idempotency_key (or the Idempotency-Key header) makes resubmits no-ops.
+	// The header is ignored on direct sends, which are not tracked.
+	Queue          bool   `json:"queue,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// SendLocation is a location pin for /api/send
+type SendLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+// validate checks the coordinates are on the globe
+func (location *SendLocation) validate() error {
+	if location.Latitude < -90 || location.Latitude > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90 (got %v)", location.Latitude)
+	}
+	if location.Longitude < -180 || location.Longitude > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180 (got %v)", location.Longitude)
+	}
+	return nil
+}
+
+// message builds the LocationMessage for the pin, with comment shown under it
+func (location *SendLocation) message(comment string) *waProto.LocationMessage {
+	msg := &waProto.LocationMessage{
+		DegreesLatitude:  proto.Float64(location.Latitude),
+		DegreesLongitude: proto.Float64(location.Longitude),
+	}
+	if location.Name != "" {
+		msg.Name = proto.String(location.Name)
+	}
+	if location.Address != "" {
+		msg.Address = proto.String(location.Address)
+	}
+	if comment != "" {
+		msg.Comment = proto.String(comment)
+	}
+	return msg
+}
+
+// SendBudget is the anti-ban pacing budget: at most limit sends per fixed window
+// (MCP_SEND_RATE_LIMIT per minute, 0 = unlimited). API sends and campaigns of an account
+// share it; each hosted account, being its own number, has its own (see sendBudgetFor).
+type SendBudget struct {
+	mutex       sync.Mutex
+	limit       int
+	window      time.Duration
+	windowStart time.Time
+	used        int
+}
+
+var sendBudget = &SendBudget{window: time.Minute} // Budget of the primary account
+
+// sendBudgetFor returns the send budget of the session owning messageStore
+func sendBudgetFor(messageStore *MessageStore) *SendBudget {
+	if account := accounts.byStore(messageStore); account != nil {
+		return account.budget
+	}
+	return sendBudget
+}
+
+// current rolls the window forward if it has elapsed; the caller holds the mutex
+func (b *SendBudget) current() {
+	if now := time.Now(); now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.used = 0
+	}
+}
+
+// take consumes one send if the budget allows, returning what is left and when it refills
+func (b *SendBudget) take() (allowed bool, remaining int, reset time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.limit <= 0 {
+		return true, 0, time.Time{}
+	}
+	b.current()
+	reset = b.windowStart.Add(b.window)
+	if b.used >= b.limit {
+		return false, 0, reset
+	}
+	b.used++
+	return true, b.limit - b.used, reset
+}
+
+// wait blocks until a send fits in the budget; false if ctx ends first
+func (b *SendBudget) wait(ctx context.Context) bool {
+	for {
+		allowed, _, reset := b.take()
+		if allowed {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Until(reset)):
+		}
+	}
+}
+
+// rateLimited charges each request to the send budget, reporting it in X-RateLimit-* headers
+// so callers can self-throttle, and answers 429 once the window's budget is spent
+func rateLimited(messageStore *MessageStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendBudget := sendBudgetFor(messageStore)
+		allowed, remaining, reset := sendBudget.take()
+		if sendBudget.limit > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(sendBudget.limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		}
+		if !allowed {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Send budget of %d per %s exhausted; retry after the reset", sendBudget.limit, sendBudget.window),
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Duplicate suppression modes (MCP_DUPLICATE_MODE)
+const (
+	duplicateModeReject   = "reject"   // 409 Conflict
+	duplicateModeCollapse = "collapse" // Report success without resending
+)
+
+// DuplicateGuard suppresses identical sends to the same recipient within a window
+// (MCP_DUPLICATE_WINDOW_SEC, 0 = disabled), protecting recipients from caller retry storms
+type DuplicateGuard struct {
+	mutex  sync.Mutex
+	window time.Duration
+	mode   string
+	recent map[string]time.Time
+}
+
+var duplicateGuard = &DuplicateGuard{recent: make(map[string]time.Time)} // Guard of the primary account
+
+// duplicateGuardFor returns the duplicate guard of the session owning messageStore, so the
+// same text sent from two accounts isn't mistaken for a retry
+func duplicateGuardFor(messageStore *MessageStore) *DuplicateGuard {
+	if account := accounts.byStore(messageStore); account != nil {
+		return account.dedupe
+	}
+	return duplicateGuard
+}
+
+func loadDuplicateGuard() *DuplicateGuard {
+	guard := &DuplicateGuard{
+		window: time.Duration(getEnvInt("MCP_DUPLICATE_WINDOW_SEC", 0)) * time.Second,
+		mode:   strings.ToLower(strings.TrimSpace(os.Getenv("MCP_DUPLICATE_MODE"))),
+		recent: make(map[string]time.Time),
+	}
+	if guard.mode != duplicateModeCollapse {
+		guard.mode = duplicateModeReject
+	}
+	return guard
+}
+
+// duplicateKey identifies a send by recipient and everything it would put on the wire: the
+// request is hashed whole (JSON sorts the variables) minus the flags that only steer delivery,
+// so a new content field is covered without touching this
+func duplicateKey(req SendMessageRequest) string {
+	req.Recipient = strings.TrimPrefix(req.Recipient, "+")
+	req.AllowDuplicate, req.VerifyRecipient, req.Queue, req.IdempotencyKey = false, false, false, ""
+	content, _ := json.Marshal(req)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// reserve records a send, returning how long ago the same send was made if it is a duplicate
+func (g *DuplicateGuard) reserve(key string) (time.Duration, bool) {
+	if g.window <= 0 {
+		return 0, false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	for k, at := range g.recent {
+		if now.Sub(at) > g.window {
+			delete(g.recent, k)
+		}
+	}
+	if at, ok := g.recent[key]; ok {
+		return now.Sub(at), true
+	}
+	g.recent[key] = now
+	return 0, false
+}
+
+// release forgets a reserved send that failed, so a retry goes through
+func (g *DuplicateGuard) release(key string) {
+	if g.window <= 0 {
+		return
+	}
+	g.mutex.Lock()
+	delete(g.recent, key)
+	g.mutex.Unlock()
+}
+
+// SendOptions carries optional per-message settings for sendWhatsAppMessage
+type SendOptions struct {
+	// IsVoiceNote controls PTT for audio. nil keeps the legacy behaviour
+	// (ogg/opus is sent as a voice note, other audio as a regular audio file).
+	IsVoiceNote *bool
+	// GifPlayback sends an mp4 video that loops like a GIF on the recipient side
+	GifPlayback bool
+	// Sticker converts an image to a WebP sticker and sends it as a StickerMessage
+	Sticker bool
+	// MentionAll mentions the whole group; the text should contain "@all" where it renders
+	MentionAll bool
+	// GroupMentions are community subgroup JIDs, written as "@<group id>" in the text
+	GroupMentions []string
+	// QuotedMessageID is a stored message in the recipient chat to reply to
+	QuotedMessageID string
+	// OnSent is called with the chat and message ID once WhatsApp accepts the message
+	OnSent func(chat types.JID, messageID types.MessageID)
+	// Personalize renders {key} placeholders from the recipient's contact attributes
+	Personalize bool
+	// Template picks the message body from a stored template by the recipient's locale attribute
+	Template string
+	// Variables fill {key} placeholders ahead of contact attributes
+	Variables map[string]string
+	// Location sends a location pin (with the text as its comment) instead of text or media
+	Location *SendLocation
+	// Contacts sends contact cards instead of text or media
+	Contacts []VCardContact
+	// VerifyRecipient fails the send when a phone number recipient is not on WhatsApp
+	VerifyRecipient bool
+}
+
+// mediaTypeForFile maps a file extension to the WhatsApp media type and MIME type it is sent as
+func mediaTypeForFile(mediaPath string) (mediaType whatsmeow.MediaType, mimeType string) {
+	fileExt := strings.ToLower(strings.TrimPrefix(filepath.Ext(mediaPath), "."))
+
+	// Handle different media types
+	switch fileExt {
+	// Image types
+	case "jpg", "jpeg":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/jpeg"
+	case "png":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/png"
+	case "gif":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/gif"
+	case "webp":
+		mediaType = whatsmeow.MediaImage
+		mimeType = "image/webp"
+
+	// Audio types
+	case "ogg", "opus":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/ogg; codecs=opus"
+	case "mp3":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/mpeg"
+	case "m4a":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/mp4"
+	case "aac":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/aac"
+	case "amr":
+		mediaType = whatsmeow.MediaAudio
+		mimeType = "audio/amr"
+
+	// Video types
+	case "mp4":
+		mediaType = whatsmeow.MediaVideo
+		mimeType = "video/mp4"
+	case "avi":
+		mediaType = whatsmeow.MediaVideo
+		mimeType = "video/avi"
+	case "mov":
+		mediaType = whatsmeow.MediaVideo
+		mimeType = "video/quicktime"
+
+	// Document types (for any other file type)
+	case "pdf":
+		mediaType = whatsmeow.MediaDocument
+		mimeType = "application/pdf"
+	default:
+		mediaType = whatsmeow.MediaDocument
+		mimeType = "application/octet-stream"
+	}
+	return mediaType, mimeType
+}
+
+// prepareOutgoingText renders the message body (template, variables, contact attributes) and
+// builds the mention/reply context, shared by sends and /api/preview
+func prepareOutgoingText(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, recipientJID types.JID, message string, opts SendOptions) (string, *waProto.ContextInfo, error) {
+	if opts.Personalize || opts.Template != "" {
+		attributes, err := messageStore.GetContactAttributes(recipientJID.String())
+		if err != nil {
+			return "", nil, fmt.Errorf("Failed to load contact attributes: %v", err)
+		}
+		if opts.Template != "" {
+			body, found, err := messageStore.ResolveTemplate(opts.Template, attributes["locale"])
+			if err != nil {
+				return "", nil, fmt.Errorf("Failed to load template: %v", err)
+			}
+			if found {
+				message = body
+			} else if message == "" {
+				return "", nil, fmt.Errorf("Template %q has no translation for locale %q or the default locale", opts.Template, attributes["locale"])
+			}
+		}
+		message = renderTemplate(renderTemplate(message, opts.Variables), attributes)
+	} else if len(opts.Variables) > 0 {
+		message = renderTemplate(message, opts.Variables)
+	}
+
+	// Group-wide and subgroup mentions are only meaningful in groups (the server
+	// enforces any admin-only restriction on @all)
+	var mentionContext *waProto.ContextInfo
+	if opts.MentionAll || len(opts.GroupMentions) > 0 {
+		if recipientJID.Server != types.GroupServer {
+			return "", nil, errors.New("mention_all and group_mentions require a group recipient")
+		}
+		var err error
+		mentionContext, err = buildGroupMentionContext(ctx, client, opts)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Replies carry the quoted message's stanza ID, author and body in the same context info
+	if opts.QuotedMessageID != "" {
+		quoteContext, err := buildQuoteContext(client, messageStore, recipientJID, opts.QuotedMessageID)
+		if err != nil {
+			return "", nil, fmt.Errorf("Cannot quote message: %v", err)
+		}
+		if mentionContext != nil {
+			quoteContext.NonJIDMentions = mentionContext.NonJIDMentions
+			quoteContext.GroupMentions = mentionContext.GroupMentions
+		}
+		mentionContext = quoteContext
+	}
+	return message, mentionContext, nil
+}
+
+// previewLinkPattern finds the URLs WhatsApp clients render as links in a text body
+var previewLinkPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+[^\s<>".,;:!?)\]}'"]`)
+
+// buildPreviewMessage assembles the message sendWhatsAppMessage would send, without uploading
+// media: the media fields WhatsApp fills on upload (URL, keys, hashes) are left out
+func buildPreviewMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, recipientJID types.JID, message, mediaName string, opts SendOptions) (*waProto.Message, string, error) {
+	message, contextInfo, err := prepareOutgoingText(ctx, client, messageStore, recipientJID, message, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	msg := &waProto.Message{}
+	if opts.Location != nil {
+		if mediaName != "" {
+			return nil, "", errors.New("location cannot be combined with media")
+		}
+		if err := opts.Location.validate(); err != nil {
+			return nil, "", err
+		}
+		msg.LocationMessage = opts.Location.message(message)
+	} else if len(opts.Contacts) > 0 {
+		if mediaName != "" || message != "" {
+			return nil, "", errors.New("contacts cannot be combined with a message or media")
+		}
+		if err := validateSendContacts(opts.Contacts); err != nil {
+			return nil, "", err
+		}
+		msg = contactsMessage(opts.Contacts)
+	} else if mediaName != "" {
+		mediaType, mimeType := mediaTypeForFile(mediaName)
+		if err := mediaPolicy.Check(mediaName, mimeType); err != nil {
+			return nil, "", err
+		}
+		if opts.Sticker {
+			if err := checkStickerSource(mimeType, message); err != nil {
+				return nil, "", err
+			}
+		}
+		switch mediaType {
+		case whatsmeow.MediaImage:
+			if opts.Sticker {
+				// The preview shows the sticker as sent, without converting the image
+				msg.StickerMessage = &waProto.StickerMessage{
+					Mimetype:   proto.String("image/webp"),
+					Width:      proto.Uint32(stickerSize),
+					Height:     proto.Uint32(stickerSize),
+					IsAnimated: proto.Bool(mimeType == "image/gif"),
+				}
+			} else {
+				msg.ImageMessage = &waProto.ImageMessage{Caption: proto.String(message), Mimetype: proto.String(mimeType)}
+			}
+		case whatsmeow.MediaAudio:
+			isVoiceNote := strings.Contains(mimeType, "ogg")
+			if opts.IsVoiceNote != nil {
+				isVoiceNote = *opts.IsVoiceNote
+			}
+			if isVoiceNote && !strings.Contains(mimeType, "ogg") {
+				return nil, "", fmt.Errorf("Voice notes must be Ogg Opus audio (got %s)", mimeType)
+			}
+			msg.AudioMessage = &waProto.AudioMessage{Mimetype: proto.String(mimeType), PTT: proto.Bool(isVoiceNote)}
+		case whatsmeow.MediaVideo:
+			if opts.GifPlayback && mimeType != "video/mp4" {
+				return nil, "", errors.New("gif_playback requires an mp4 video")
+			}
+			msg.VideoMessage = &waProto.VideoMessage{Caption: proto.String(message), Mimetype: proto.String(mimeType)}
+			if opts.GifPlayback {
+				msg.VideoMessage.GifPlayback = proto.Bool(true)
+			}
+		case whatsmeow.MediaDocument:
+			msg.DocumentMessage = &waProto.DocumentMessage{
+				Title:    proto.String(mediaName),
+				Caption:  proto.String(message),
+				Mimetype: proto.String(mimeType),
+			}
+		}
+		if mediaType != whatsmeow.MediaAudio && opts.IsVoiceNote != nil && *opts.IsVoiceNote {
+			return nil, "", errors.New("is_voice_note requires an audio file")
+		}
+	} else if contextInfo != nil {
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: proto.String(message)}
+	} else {
+		msg.Conversation = proto.String(message)
+	}
+	if contextInfo != nil {
+		setMessageContextInfo(msg, contextInfo)
+	}
+	return msg, message, nil
+}
+
+// How long IsOnWhatsApp answers for verify_recipient are reused. Numbers that aren't registered
+// are rechecked sooner, as they may sign up at any time.
+const (
+	recipientCheckTTL        = 24 * time.Hour
+	recipientCheckMissingTTL = time.Hour
+)
+
+// RecipientCheckCache remembers which phone numbers are on WhatsApp, and as which JID
+type RecipientCheckCache struct {
+	mutex   sync.Mutex
+	entries map[string]recipientCheck
+}
+
+type recipientCheck struct {
+	jid       types.JID
+	isIn      bool
+	checkedAt time.Time
+}
+
+var recipientChecks = &RecipientCheckCache{entries: make(map[string]recipientCheck)}
+
+// lookup reports whether a phone number (digits only) is on WhatsApp and its JID, asking the
+// server only when there is no fresh cached answer
+func (c *RecipientCheckCache) lookup(ctx context.Context, client *whatsmeow.Client, number string) (types.JID, bool, error) {
+	c.mutex.Lock()
+	cached, found := c.entries[number]
+	c.mutex.Unlock()
+	ttl := recipientCheckTTL
+	if !cached.isIn {
+		ttl = recipientCheckMissingTTL
+	}
+	if found && time.Since(cached.checkedAt) < ttl {
+		return cached.jid, cached.isIn, nil
+	}
+
+	results, err := client.IsOnWhatsApp(ctx, []string{number})
+	if err != nil {
+		return types.JID{}, false, err
+	}
+	check := recipientCheck{checkedAt: time.Now()}
+	if len(results) > 0 && results[0].IsIn && results[0].JID.User != "" {
+		check.jid, check.isIn = results[0].JID, true
+	}
+
+	c.mutex.Lock()
+	c.entries[number] = check
+	c.mutex.Unlock()
+	return check.jid, check.isIn, nil
+}
+
+// Function to send a WhatsApp message
+func sendWhatsAppMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, recipient string, message string, mediaPath string, opts SendOptions) (bool, string) {
+	if !client.IsConnected() {
+		return false, "Not connected to WhatsApp"
+	}
+
+	// Create JID for recipient
+	var recipientJID types.JID
+	var err error
+
+	// Check if recipient is a JID
+	isJID := strings.Contains(recipient, "@")
+
+	if isJID {
+		// Parse the JID string
+		recipientJID, err = types.ParseJID(recipient)
+		if err != nil {
+			return false, fmt.Sprintf("Error parsing JID: %v", err)
+		}
+	} else {
+		// Normalize the phone number to E.164 (national numbers take MCP_DEFAULT_COUNTRY_CODE)
+		// WhatsApp expects numbers without the + prefix (e.g., "5500000000001", not "+5500000000001")
+		number, err := normalizePhoneNumber(recipient, defaultCountryCode)
+		if err != nil {
+			return false, fmt.Sprintf("Invalid phone number %q: %v", recipient, err)
+		}
+
+		// Create JID from phone number
+		recipientJID = types.JID{
+			User:   number.Digits(),
+			Server: "s.whatsapp.net", // For personal chats
+		}
+
+		// Brazilian mobiles may be registered with or without their ninth digit, so both forms
+		// are looked up. Without verify_recipient an unresolved number is sent to as normalized.
+		if opts.VerifyRecipient || number.Alternate != "" {
+			jid, isIn, err := recipientChecks.lookup(ctx, client, number.Digits())
+			if err == nil && !isIn && number.Alternate != "" {
+				jid, isIn, err = recipientChecks.lookup(ctx, client, strings.TrimPrefix(number.Alternate, "+"))
+			}
+			switch {
+			case err != nil && opts.VerifyRecipient:
+				return false, fmt.Sprintf("Error checking recipient: %v", err)
+			case err != nil:
+				fmt.Printf("Warning: failed to resolve %s, sending to %s: %v\n", recipient, number.E164, err)
+			case isIn:
+				// The registered JID can differ from the dialled number (e.g. Brazilian mobile prefixes)
+				recipientJID = jid
+			case opts.VerifyRecipient:
+				return false, fmt.Sprintf("Recipient %s is not on WhatsApp", recipient)
+			}
+		}
+	}
+
+	message, mentionContext, err := prepareOutgoingText(ctx, client, messageStore, recipientJID, message, opts)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	msg := &waProto.Message{}
+
+	// A location pin, contact cards, media, or text
+	if opts.Location != nil {
+		if mediaPath != "" {
+			return false, "location cannot be combined with media"
+		}
+		if err := opts.Location.validate(); err != nil {
+			return false, err.Error()
+		}
+		msg.LocationMessage = opts.Location.message(message)
+	} else if len(opts.Contacts) > 0 {
+		if mediaPath != "" || message != "" {
+			return false, "contacts cannot be combined with a message or media"
+		}
+		if err := validateSendContacts(opts.Contacts); err != nil {
+			return false, err.Error()
+		}
+		msg = contactsMessage(opts.Contacts)
+	} else if mediaPath != "" {
+		// Open media file - it is streamed to the uploader so large videos
+		// (chunked uploads can be hundreds of MB) are never held in memory
+		mediaFile, err := os.Open(mediaPath)
+		if err != nil {
+			return false, fmt.Sprintf("Error reading media file: %v", err)
+		}
+		defer mediaFile.Close()
+
+		mediaInfo, err := mediaFile.Stat()
+		if err != nil {
+			return false, fmt.Sprintf("Error reading media file: %v", err)
+		}
+
+		// Determine media type and mime type based on file extension
+		mediaType, mimeType := mediaTypeForFile(mediaPath)
+		if err := mediaPolicy.Check(filepath.Base(mediaPath), mimeType); err != nil {
+			return false, err.Error()
+		}
+
+		// Voice notes (PTT) must be Ogg Opus; other audio is sent as a playable audio file
+		isVoiceNote := false
+		if mediaType == whatsmeow.MediaAudio {
+			isVoiceNote = strings.Contains(mimeType, "ogg")
+			if opts.IsVoiceNote != nil {
+				isVoiceNote = *opts.IsVoiceNote
+			}
+			if isVoiceNote && !strings.Contains(mimeType, "ogg") {
+				return false, fmt.Sprintf("Voice notes must be Ogg Opus audio (got %s)", mimeType)
+			}
+		} else if opts.IsVoiceNote != nil && *opts.IsVoiceNote {
+			return false, "is_voice_note requires an audio file"
+		}
+		if opts.GifPlayback && mimeType != "video/mp4" {
+			return false, "gif_playback requires an mp4 video"
+		}
+
+		// Stickers are converted to a 512x512 WebP, which is uploaded instead of the file
+		var sticker []byte
+		stickerAnimated := false
+		if opts.Sticker {
+			if err := checkStickerSource(mimeType, message); err != nil {
+				return false, err.Error()
+			}
+			convertCtx, convertCancel := context.WithTimeout(ctx, stickerConvertTimeout)
+			sticker, stickerAnimated, err = convertToSticker(convertCtx, mediaPath)
+			convertCancel()
+			if err != nil {
+				return false, fmt.Sprintf("Error converting sticker: %v", err)
+			}
+		}
+
+		// Upload media to WhatsApp servers (timeout scales with file size to prevent indefinite hangs)
+		uploadTimeout := uploadTimeoutForSize(mediaInfo.Size())
+		uploadCtx, uploadCancel := context.WithTimeout(ctx, uploadTimeout)
+		defer uploadCancel()
+
+		var resp whatsmeow.UploadResponse
+		var mediaData []byte
+		if mediaType == whatsmeow.MediaAudio {
+			// Voice notes are small and need the raw bytes for duration/waveform analysis
+			mediaData, err = io.ReadAll(mediaFile)
+			if err != nil {
+				return false, fmt.Sprintf("Error reading media file: %v", err)
+			}
+			resp, err = client.Upload(uploadCtx, mediaData, mediaType)
+		} else if sticker != nil {
+			resp, err = client.Upload(uploadCtx, sticker, mediaType)
+		} else {
+			resp, err = client.UploadReader(uploadCtx, mediaFile, nil, mediaType)
+		}
+		if err != nil {
+			if msg := contextErrorMessage(uploadCtx, "uploading media to WhatsApp", uploadTimeout); msg != "" {
+				return false, msg
+			}
+			return false, fmt.Sprintf("Error uploading media: %v", err)
+		}
+
+		fmt.Println("Media uploaded", resp)
+
+		// Create the appropriate message type based on media type
+		switch mediaType {
+		case whatsmeow.MediaImage:
+			if sticker != nil {
+				msg.StickerMessage = &waProto.StickerMessage{
+					Mimetype:      proto.String("image/webp"),
+					URL:           &resp.URL,
+					DirectPath:    &resp.DirectPath,
+					MediaKey:      resp.MediaKey,
+					FileEncSHA256: resp.FileEncSHA256,
+					FileSHA256:    resp.FileSHA256,
+					FileLength:    &resp.FileLength,
+					Width:         proto.Uint32(stickerSize),
+					Height:        proto.Uint32(stickerSize),
+					IsAnimated:    proto.Bool(stickerAnimated),
+				}
+			} else {
+				msg.ImageMessage = &waProto.ImageMessage{
+					Caption:       proto.String(message),
+					Mimetype:      proto.String(mimeType),
+					URL:           &resp.URL,
+					DirectPath:    &resp.DirectPath,
+					MediaKey:      resp.MediaKey,
+					FileEncSHA256: resp.FileEncSHA256,
+					FileSHA256:    resp.FileSHA256,
+					FileLength:    &resp.FileLength,
+				}
+			}
+		case whatsmeow.MediaAudio:
+			// Handle audio files
+			var seconds uint32 = 30 // Default fallback
+			var waveform []byte = nil
+			analyzed := false
+
+			// Try to analyze the ogg file
+			if strings.Contains(mimeType, "ogg") {
+				analyzedSeconds, analyzedWaveform, err := analyzeOggOpus(mediaData)
+				if err == nil {
+					seconds = analyzedSeconds
+					waveform = analyzedWaveform
+					analyzed = true
+				} else if isVoiceNote {
+					return false, fmt.Sprintf("Failed to analyze Ogg Opus file: %v", err)
+				}
+			} else {
+				fmt.Printf("Not an Ogg Opus file: %s\n", mimeType)
+			}
+
+			msg.AudioMessage = &waProto.AudioMessage{
+				Mimetype:      proto.String(mimeType),
+				URL:           &resp.URL,
+				DirectPath:    &resp.DirectPath,
+				MediaKey:      resp.MediaKey,
+				FileEncSHA256: resp.FileEncSHA256,
+				FileSHA256:    resp.FileSHA256,
+				FileLength:    &resp.FileLength,
+				PTT:           proto.Bool(isVoiceNote),
+			}
+			if isVoiceNote {
+				// Waveform is only rendered for voice notes
+				msg.AudioMessage.Seconds = proto.Uint32(seconds)
+				msg.AudioMessage.Waveform = waveform
+			} else if analyzed {
+				msg.AudioMessage.Seconds = proto.Uint32(seconds)
+			}
+		case whatsmeow.MediaVideo:
+			msg.VideoMessage = &waProto.VideoMessage{
+				Caption:       proto.String(message),
+				Mimetype:      proto.String(mimeType),
+				URL:           &resp.URL,
+				DirectPath:    &resp.DirectPath,
+				MediaKey:      resp.MediaKey,
+				FileEncSHA256: resp.FileEncSHA256,
+				FileSHA256:    resp.FileSHA256,
+				FileLength:    &resp.FileLength,
+			}
+			if opts.GifPlayback {
+				msg.VideoMessage.GifPlayback = proto.Bool(true)
+			}
+		case whatsmeow.MediaDocument:
+			msg.DocumentMessage = &waProto.DocumentMessage{
+				Title:         proto.String(filepath.Base(mediaPath)),
+				Caption:       proto.String(message),
+				Mimetype:      proto.String(mimeType),
+				URL:           &resp.URL,
+				DirectPath:    &resp.DirectPath,
+				MediaKey:      resp.MediaKey,
+				FileEncSHA256: resp.FileEncSHA256,
+				FileSHA256:    resp.FileSHA256,
+				FileLength:    &resp.FileLength,
+			}
+			if mimeType == "application/pdf" {
+				// Page count and first-page preview so recipients don't just see a generic icon
+				if pages := pdfPageCount(mediaPath); pages > 0 {
+					msg.DocumentMessage.PageCount = proto.Uint32(pages)
+				}
+				thumbCtx, thumbCancel := context.WithTimeout(ctx, pdfThumbnailTimeout)
+				thumb, width, height, err := renderPDFThumbnail(thumbCtx, mediaPath)
+				thumbCancel()
+				if err != nil {
+					fmt.Printf("⚠️ PDF thumbnail skipped: %v\n", err)
+				} else {
+					msg.DocumentMessage.JPEGThumbnail = thumb
+					msg.DocumentMessage.ThumbnailWidth = proto.Uint32(width)
+					msg.DocumentMessage.ThumbnailHeight = proto.Uint32(height)
+				}
+			}
+		}
+	} else if mentionContext != nil {
+		// Mentions and replies need the extended text form to carry context info
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: proto.String(message)}
+	} else {
+		msg.Conversation = proto.String(message)
+	}
+	if mentionContext != nil {
+		setMessageContextInfo(msg, mentionContext)
+	}
+
+	presenceManager.BeforeSend(client)
+	simulateTyping(ctx, client, recipientJID, msg.GetAudioMessage().GetPTT())
+
+	// Send message (bounded by MCP_SEND_TIMEOUT_SEC to prevent indefinite hangs)
+	sendCtx, sendCancel := context.WithTimeout(ctx, endpointTimeouts.Send)
+	defer sendCancel()
+	resp, err := client.SendMessage(sendCtx, recipientJID, msg)
+
+	if err != nil {
+		if msg := contextErrorMessage(sendCtx, "sending message to WhatsApp", endpointTimeouts.Send); msg != "" {
+			return false, msg
+		}
+		return false, fmt.Sprintf("Error sending message: %v", err)
+	}
+
+	// Record the send right away so chat history is complete without waiting for the phone's echo
+	storeSentMessage(client, messageStore, recipientJID, resp, msg)
+	if opts.OnSent != nil {
+		opts.OnSent(recipientJID, resp.ID)
+	}
+
+	return true, fmt.Sprintf("Message sent to %s", recipient)
+}
+
+// storeSentMessage stores a message sent through the API as if it had arrived as our own message.
+// The echo from the phone (when it arrives) upserts the same row by ID.
+func storeSentMessage(client *whatsmeow.Client, messageStore *MessageStore, chat types.JID, resp whatsmeow.SendResponse, msg *waProto.Message) {
+	if messageStore == nil || client.Store.ID == nil {
+		return
+	}
+	timestamp := resp.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	handleMessage(client, messageStore, &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:     chat,
+				Sender:   client.Store.ID.ToNonAD(),
+				IsFromMe: true,
+				IsGroup:  chat.Server == types.GroupServer,
+			},
+			ID:        resp.ID,
+			Timestamp: timestamp,
+		},
+		Message: msg,
+	}, waLog.Stdout("Send", "INFO", true))
+	if chat.Server == types.GroupServer {
+		go snapshotGroupMembers(client, messageStore, chat, resp.ID)
+	}
+}
+
+// snapshotGroupMembers records who was in a group when we sent a message to it, since
+// membership keeps changing after the fact
+func snapshotGroupMembers(client *whatsmeow.Client, messageStore *MessageStore, group types.JID, messageID types.MessageID) {
+	ctx, cancel := withOptionalTimeout(context.Background(), endpointTimeouts.Query)
+	defer cancel()
+	info, err := client.GetGroupInfo(ctx, group)
+	if err != nil {
+		fmt.Printf("Warning: failed to snapshot members of %s for message %s: %v\n", group, messageID, err)
+		return
+	}
+	if err := messageStore.StoreMemberSnapshot(messageID, group.String(), groupParticipantInfos(info.Participants), time.Now()); err != nil {
+		fmt.Printf("Warning: failed to store member snapshot of %s for message %s: %v\n", group, messageID, err)
+	}
+}
+
+// sandboxMode enables test-only endpoints such as /api/test/inject-message (MCP_SANDBOX_MODE)
+var sandboxMode bool
+
+// InjectMessageRequest fabricates an inbound text message for /api/test/inject-message
+type InjectMessageRequest struct {
+	Sender          string `json:"sender"`                      // Phone number or JID of the fake sender
+	ChatJID         string `json:"chat_jid,omitempty"`          // Defaults to the DM with sender
+	Message         string `json:"message"`                     // Text content
+	PushName        string `json:"push_name,omitempty"`         // Display name the sender would have set
+	MessageID       string `json:"message_id,omitempty"`        // Defaults to a generated ID
+	Timestamp       string `json:"timestamp,omitempty"`         // RFC3339, defaults to now
+	QuotedMessageID string `json:"quoted_message_id,omitempty"` // Stored message in the chat this replies to
+}
+
+// injectInboundMessage runs a fabricated inbound message through handleMessage, so storage,
+// rules and webhooks behave as for a real one (including any auto-replies they send)
+func injectInboundMessage(client *whatsmeow.Client, messageStore *MessageStore, chat, sender types.JID, req InjectMessageRequest, timestamp time.Time) {
+	msg := &waProto.Message{}
+	if req.QuotedMessageID != "" {
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{
+			Text:        proto.String(req.Message),
+			ContextInfo: &waProto.ContextInfo{StanzaID: proto.String(req.QuotedMessageID)},
+		}
+	} else {
+		msg.Conversation = proto.String(req.Message)
+	}
+	handleMessage(client, messageStore, &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    chat,
+				Sender:  sender,
+				IsGroup: chat.Server == types.GroupServer,
+			},
+			ID:        req.MessageID,
+			PushName:  req.PushName,
+			Timestamp: timestamp,
+			Type:      "text",
+		},
+		Message: msg,
+	}, waLog.Stdout("Inject", "INFO", true))
+}
+
+// Extract media info from a message
+func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) {
+	if msg == nil {
+		return "", "", "", nil, nil, nil, 0
+	}
+
+	// Check for image message
+	if img := msg.GetImageMessage(); img != nil {
+		return "image", "image_" + time.Now().Format("20060102_150405") + ".jpg",
+			img.GetURL(), img.GetMediaKey(), img.GetFileSHA256(), img.GetFileEncSHA256(), img.GetFileLength()
+	}
+
+	// Check for video message
+	if vid := msg.GetVideoMessage(); vid != nil {
+		return "video", "video_" + time.Now().Format("20060102_150405") + ".mp4",
+			vid.GetURL(), vid.GetMediaKey(), vid.GetFileSHA256(), vid.GetFileEncSHA256(), vid.GetFileLength()
+	}
+
+	// Check for audio message
+	if aud := msg.GetAudioMessage(); aud != nil {
+		return "audio", "audio_" + time.Now().Format("20060102_150405") + ".ogg",
+			aud.GetURL(), aud.GetMediaKey(), aud.GetFileSHA256(), aud.GetFileEncSHA256(), aud.GetFileLength()
+	}
+
+	// Check for sticker message (WebP, downloaded with image media keys)
+	if sticker := msg.GetStickerMessage(); sticker != nil {
+		return "sticker", "sticker_" + time.Now().Format("20060102_150405") + ".webp",
+			sticker.GetURL(), sticker.GetMediaKey(), sticker.GetFileSHA256(), sticker.GetFileEncSHA256(), sticker.GetFileLength()
+	}
+
+	// Check for document message
+	if doc := msg.GetDocumentMessage(); doc != nil {
+		filename := doc.GetFileName()
+		if filename == "" {
+			filename = "document_" + time.Now().Format("20060102_150405")
+		}
+		return "document", filename,
+			doc.GetURL(), doc.GetMediaKey(), doc.GetFileSHA256(), doc.GetFileEncSHA256(), doc.GetFileLength()
+	}
+
+	return "", "", "", nil, nil, nil, 0
+}
+
+// Extract the MIME type the sender declared for a media message
+func extractMediaMimetype(msg *waProto.Message) string {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetMimetype()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetMimetype()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetMimetype()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetMimetype()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetMimetype()
+	}
+	return ""
+}
+
+// MediaAttributes holds type-specific media flags not covered by extractMediaInfo
+type MediaAttributes struct {
+	GifPlayback bool   // Video is meant to loop like a GIF
+	PageCount   uint32 // Document page count (0 = unknown)
+	Thumbnail   []byte // Document JPEG preview
+	IsAnimated  bool   // Animated sticker
+}
+
+// Extract type-specific media attributes from a message
+func extractMediaAttributes(msg *waProto.Message) MediaAttributes {
+	var attrs MediaAttributes
+	if msg == nil {
+		return attrs
+	}
+	if vid := msg.GetVideoMessage(); vid != nil {
+		attrs.GifPlayback = vid.GetGifPlayback()
+	}
+	if doc := msg.GetDocumentMessage(); doc != nil {
+		attrs.PageCount = doc.GetPageCount()
+		attrs.Thumbnail = doc.GetJPEGThumbnail()
+	}
+	if sticker := msg.GetStickerMessage(); sticker != nil {
+		attrs.IsAnimated = sticker.GetIsAnimated()
+	}
+	return attrs
+}
+
+// Store type-specific media attributes for a message
+func (store *MessageStore) StoreMediaAttributes(id, chatJID string, attrs MediaAttributes) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, args := mediaAttributesUpdate(id, chatJID, attrs)
+	_, err := store.writer.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Queue media attributes behind their queued message upsert (history sync)
+func (store *MessageStore) QueueMediaAttributes(id, chatJID string, attrs MediaAttributes) error {
+	return store.writes.Queue(mediaAttributesUpdate(id, chatJID, attrs))
+}
+
+func mediaAttributesUpdate(id, chatJID string, attrs MediaAttributes) (string, []interface{}) {
+	var pageCount interface{}
+	if attrs.PageCount > 0 {
+		pageCount = attrs.PageCount
+	}
+	var thumbnail interface{}
+	if len(attrs.Thumbnail) > 0 {
+		thumbnail = attrs.Thumbnail
+	}
+	return "UPDATE messages SET gif_playback = ?, page_count = ?, thumbnail = ?, is_animated = ? WHERE id = ? AND chat_jid = ?",
+		[]interface{}{attrs.GifPlayback, pageCount, thumbnail, attrs.IsAnimated, id, chatJID}
+}
+
+// storeRawMessages keeps the serialized proto of each message so new extractors can be
+// backfilled over history via /api/admin/reparse (MCP_STORE_RAW_MESSAGES, default off).
+// The protos hold the original text, so they bypass MCP_PII_MASKING.
+var storeRawMessages = false
+
+// Store the raw proto of a message
+func (store *MessageStore) StoreRawMessage(id, chatJID string, message *waProto.Message) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, args, err := rawMessageUpdate(id, chatJID, message)
+	if err != nil || query == "" {
+		return err
+	}
+	_, err = store.writer.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Queue the raw proto behind its queued message upsert (history sync); FlushWrites commits it
+func (store *MessageStore) QueueRawMessage(id, chatJID string, message *waProto.Message) error {
+	query, args, err := rawMessageUpdate(id, chatJID, message)
+	if err != nil || query == "" {
+		return err
+	}
+	return store.writes.Queue(query, args)
+}
+
+// rawMessageUpdate builds the raw proto update; the query is empty when raw storage is off
+func rawMessageUpdate(id, chatJID string, message *waProto.Message) (string, []interface{}, error) {
+	if !storeRawMessages || message == nil {
+		return "", nil, nil
+	}
+	raw, err := proto.Marshal(message)
+	if err != nil {
+		return "", nil, err
+	}
+	return "UPDATE messages SET raw_message = ? WHERE id = ? AND chat_jid = ?", []interface{}{raw, id, chatJID}, nil
+}
+
+// Get the raw proto of a message (nil if it was stored without one)
+func (store *MessageStore) GetRawMessage(id, chatJID string) (*waProto.Message, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var raw []byte
+	if err := store.db.QueryRowContext(ctx, "SELECT raw_message FROM messages WHERE id = ? AND chat_jid = ?", id, chatJID).Scan(&raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	message := &waProto.Message{}
+	if err := proto.Unmarshal(raw, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// ReparseResult summarizes a re-run of the extractors over stored raw messages
+type ReparseResult struct {
+	Scanned    int `json:"scanned"`
+	Updated    int `json:"updated"`
+	Failed     int `json:"failed"`
+	WithoutRaw int `json:"without_raw"` // Stored before raw storage existed; cannot be re-parsed
+}
+
+// reparseStoredMessages re-runs the current extractors over stored raw protos (optionally
+// for one chat) and rewrites the derived columns, so columns added later cover history too
+func reparseStoredMessages(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, chatJID string) (ReparseResult, error) {
+	var result ReparseResult
+	filter := ""
+	var filterArgs []interface{}
+	if chatJID != "" {
+		filter = " AND chat_jid = ?"
+		filterArgs = append(filterArgs, chatJID)
+	}
+	if err := messageStore.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM messages WHERE raw_message IS NULL"+filter, filterArgs...,
+	).Scan(&result.WithoutRaw); err != nil {
+		return result, err
+	}
+
+	type storedMessage struct {
+		rowID            int64
+		id, chatJID      string
+		raw              []byte
+		isFromMe, edited bool
+	}
+	const batchSize = 500
+	var lastRowID int64
+	for {
+		args := append([]interface{}{lastRowID}, filterArgs...)
+		args = append(args, batchSize)
+		rows, err := messageStore.db.QueryContext(ctx,
+			"SELECT rowid, id, chat_jid, raw_message, is_from_me, edited_at IS NOT NULL FROM messages WHERE rowid > ? AND raw_message IS NOT NULL"+filter+" ORDER BY rowid LIMIT ?",
+			args...,
+		)
+		if err != nil {
+			return result, err
+		}
+		var batch []storedMessage
+		for rows.Next() {
+			var m storedMessage
+			if err := rows.Scan(&m.rowID, &m.id, &m.chatJID, &m.raw, &m.isFromMe, &m.edited); err != nil {
+				rows.Close()
+				return result, err
+			}
+			batch = append(batch, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return result, err
+		}
+		if len(batch) == 0 {
+			return result, nil
+		}
+
+		for _, m := range batch {
+			lastRowID = m.rowID
+			result.Scanned++
+
+			var message waProto.Message
+			if err := proto.Unmarshal(m.raw, &message); err != nil {
+				result.Failed++
+				continue
+			}
+			content := extractTextContent(client, &message)
+			mediaType, _, _, _, _, _, _ := extractMediaInfo(&message)
+			if content == "" && mediaType == "" {
+				continue
+			}
+
+			// The raw proto is the original; an edited message keeps its edited text
+			if !m.edited {
+				content, unmasked := maskInboundPII(content, m.isFromMe)
+				if _, err := messageStore.writer.ExecContext(ctx,
+					"UPDATE messages SET content = ?, content_unmasked = NULLIF(?, ''), content_type = ? WHERE id = ? AND chat_jid = ?",
+					content, unmasked, extractContentType(&message), m.id, m.chatJID,
+				); err != nil {
+					result.Failed++
+					continue
+				}
+			}
+			if mentionAll, groupMentions := extractGroupMentions(&message); mentionAll || len(groupMentions) > 0 {
+				if err := messageStore.StoreGroupMentions(m.id, m.chatJID, mentionAll, groupMentions); err != nil {
+					result.Failed++
+					continue
+				}
+			}
+			if quotedID, quotedSender := extractQuotedMessage(&message); quotedID != "" {
+				if err := messageStore.StoreQuotedMessage(m.id, m.chatJID, quotedID, quotedSender); err != nil {
+					result.Failed++
+					continue
+				}
+			}
+			if mediaType != "" {
+				if err := messageStore.StoreMediaAttributes(m.id, m.chatJID, extractMediaAttributes(&message)); err != nil {
+					result.Failed++
+					continue
+				}
+			}
+			result.Updated++
+		}
+
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+	}
+}
+
+// Get the stored JPEG thumbnail for a message
+func (store *MessageStore) GetThumbnail(id, chatJID string) ([]byte, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var thumbnail []byte
+	err := store.db.QueryRowContext(ctx,
+		"SELECT thumbnail FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	).Scan(&thumbnail)
+	return thumbnail, err
+}
+
+// EventResponse is one participant's RSVP to an event invite
+type EventResponse struct {
+	EventID     string `json:"event_id"`
+	ChatJID     string `json:"chat_jid"`
+	Responder   string `json:"responder"`
+	Response    string `json:"response"` // going, not_going, maybe
+	ExtraGuests int    `json:"extra_guests,omitempty"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// Store an RSVP, replacing the responder's previous answer
+func (store *MessageStore) StoreEventResponse(eventID, chatJID, responder, response string, extraGuests int, timestamp time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT OR REPLACE INTO event_responses (event_id, chat_jid, responder, response, extra_guests, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		eventID, chatJID, responder, response, extraGuests, timestamp.UTC(),
+	)
+	return err
+}
+
+// Get RSVPs for an event
+func (store *MessageStore) GetEventResponses(eventID, chatJID string) ([]EventResponse, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT event_id, chat_jid, responder, response, extra_guests, timestamp
+		FROM event_responses WHERE event_id = ? AND chat_jid = ? ORDER BY timestamp`,
+		eventID, chatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	responses := []EventResponse{}
+	for rows.Next() {
+		var resp EventResponse
+		var timestamp time.Time
+		if err := rows.Scan(&resp.EventID, &resp.ChatJID, &resp.Responder, &resp.Response, &resp.ExtraGuests, &timestamp); err != nil {
+			return nil, err
+		}
+		resp.Timestamp = timestamp.UTC().Format(time.RFC3339)
+		responses = append(responses, resp)
+	}
+	return responses, rows.Err()
+}
+
+// Update the stored content of a message (e.g. after an event edit)
+func (store *MessageStore) UpdateMessageContent(id, chatJID, content string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE messages SET content = ? WHERE id = ? AND chat_jid = ?",
+		content, id, chatJID,
+	)
+	return err
+}
+
+// UpdateInboundContent rewrites the content of a received message, masking it like StoreMessage does
+func (store *MessageStore) UpdateInboundContent(id, chatJID, content string) error {
+	content, unmasked := maskInboundPII(content, false)
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE messages SET content = ?, content_unmasked = NULLIF(?, '') WHERE id = ? AND chat_jid = ?",
+		content, unmasked, id, chatJID,
+	)
+	return err
+}
+
+// eventCreatorFromKey resolves who sent the original event from the key carried by a response.
+// Mirrors whatsmeow's handling for poll votes, which use the same key layout.
+func eventCreatorFromKey(evt *events.Message, key *waProto.MessageKey) (types.JID, error) {
+	if key.GetFromMe() {
+		return evt.Info.Sender, nil
+	}
+	if evt.Info.Chat.Server == types.DefaultUserServer || evt.Info.Chat.Server == types.HiddenUserServer {
+		return types.ParseJID(key.GetRemoteJID())
+	}
+	return types.ParseJID(key.GetParticipant())
+}
+
+// decryptEventResponse decrypts an RSVP using the event's message secret.
+// whatsmeow exposes decryption for poll votes but not event responses; both use
+// the same HKDF/AES-GCM scheme with a different use-case label.
+func decryptEventResponse(client *whatsmeow.Client, evt *events.Message) (*waProto.EventResponseMessage, error) {
+	enc := evt.Message.GetEncEventResponseMessage()
+	key := enc.GetEventCreationMessageKey()
+	creator, err := eventCreatorFromKey(evt, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse event creator: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	secret, creator, err := client.Store.MsgSecrets.GetMessageSecret(ctx, evt.Info.Chat, creator, key.GetID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event secret: %v", err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("event secret not found for %s", key.GetID())
+	}
+
+	creatorStr := creator.ToNonAD().String()
+	responderStr := evt.Info.Sender.ToNonAD().String()
+	useCase := key.GetID() + creatorStr + responderStr + "Event Response"
+	secretKey := hkdfutil.SHA256(secret, nil, []byte(useCase), 32)
+	additionalData := fmt.Appendf(nil, "%s\x00%s", key.GetID(), responderStr)
+
+	plaintext, err := gcmutil.Decrypt(secretKey, enc.GetEncIV(), enc.GetEncPayload(), additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt event response: %v", err)
+	}
+	var response waProto.EventResponseMessage
+	if err := proto.Unmarshal(plaintext, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode event response: %v", err)
+	}
+	return &response, nil
+}
+
+// Handle RSVPs and edits for event invites. Returns true when the message was consumed.
+func handleEventUpdate(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, chatJID, sender string, logger waLog.Logger) bool {
+	if msg.Message.GetEncEventResponseMessage() != nil {
+		response, err := decryptEventResponse(client, msg)
+		if err != nil {
+			logger.Warnf("Failed to process event response: %v", err)
+			return true
+		}
+		eventID := msg.Message.GetEncEventResponseMessage().GetEventCreationMessageKey().GetID()
+		timestamp := msg.Info.Timestamp
+		if ms := response.GetTimestampMS(); ms > 0 {
+			timestamp = time.UnixMilli(ms)
+		}
+		answer := strings.ToLower(response.GetResponse().String())
+		if err := messageStore.StoreEventResponse(eventID, chatJID, sender, answer, int(response.GetExtraGuestCount()), timestamp); err != nil {
+			logger.Warnf("Failed to store event response: %v", err)
+		}
+		fmt.Printf("📅 Event RSVP: %s -> %s (%s)\n", sender, answer, eventID)
+		return true
+	}
+
+	if enc := msg.Message.GetSecretEncryptedMessage(); enc != nil && enc.GetSecretEncType() == waProto.SecretEncryptedMessage_EVENT_EDIT {
+		edited, err := client.DecryptSecretEncryptedMessage(context.Background(), msg)
+		if err != nil {
+			logger.Warnf("Failed to decrypt event edit: %v", err)
+			return true
+		}
+		if event := edited.GetEventMessage(); event != nil {
+			if err := messageStore.UpdateMessageContent(enc.GetTargetMessageKey().GetID(), chatJID, formatEventMessage(event)); err != nil {
+				logger.Warnf("Failed to update edited event: %v", err)
+			}
+			pushCalendarEvent(messageStore, chatJID, enc.GetTargetMessageKey().GetID(), event)
+		}
+		return true
+	}
+
+	return false
+}
+
+// CalendarSync pushes WhatsApp event invites to a CalDAV calendar collection (MCP_CALDAV_URL),
+// authenticated with MCP_CALDAV_USERNAME/PASSWORD or, for Google Calendar's CalDAV endpoint,
+// an OAuth token in MCP_CALDAV_BEARER_TOKEN
+type CalendarSync struct {
+	URL         string
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+var calendarSync CalendarSync
+
+// icsEscape escapes an iCalendar TEXT value
+func icsEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// icsFold folds a content line at 75 octets without splitting UTF-8 sequences
+func icsFold(line string) string {
+	var folded strings.Builder
+	for width := 75; len(line) > width; width = 74 {
+		cut := width
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	folded.WriteString(line + "\r\n")
+	return folded.String()
+}
+
+// buildEventICS renders an event invite as an iCalendar VEVENT
+func buildEventICS(uid, chatName string, event *waProto.EventMessage) string {
+	const icsTime = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//whatsapp-mcp//events//EN",
+		"BEGIN:VEVENT",
+		"UID:" + uid,
+		"DTSTAMP:" + time.Now().UTC().Format(icsTime),
+		"DTSTART:" + time.Unix(event.GetStartTime(), 0).UTC().Format(icsTime),
+		"SUMMARY:" + icsEscape(event.GetName()),
+	}
+	if event.GetEndTime() > 0 {
+		lines = append(lines, "DTEND:"+time.Unix(event.GetEndTime(), 0).UTC().Format(icsTime))
+	}
+	description := event.GetDescription()
+	if chatName != "" {
+		description = strings.TrimSpace(description + "\n\nShared in " + chatName + " on WhatsApp")
+	}
+	if description != "" {
+		lines = append(lines, "DESCRIPTION:"+icsEscape(description))
+	}
+	if loc := event.GetLocation(); loc != nil {
+		where := loc.GetName()
+		if address := loc.GetAddress(); address != "" {
+			where = strings.TrimPrefix(where+", "+address, ", ")
+		}
+		if where != "" {
+			lines = append(lines, "LOCATION:"+icsEscape(where))
+		}
+		if loc.GetDegreesLatitude() != 0 || loc.GetDegreesLongitude() != 0 {
+			lines = append(lines, fmt.Sprintf("GEO:%f;%f", loc.GetDegreesLatitude(), loc.GetDegreesLongitude()))
+		}
+	}
+	if link := event.GetJoinLink(); link != "" {
+		lines = append(lines, "URL:"+link)
+	}
+	if event.GetIsCanceled() {
+		lines = append(lines, "STATUS:CANCELLED")
+	} else {
+		lines = append(lines, "STATUS:CONFIRMED")
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var ics strings.Builder
+	for _, line := range lines {
+		ics.WriteString(icsFold(line))
+	}
+	return ics.String()
+}
+
+// pushCalendarEvent creates or replaces the calendar entry for an event invite in the background.
+// The entry is keyed by the invite's message ID, so edits and cancellations update it in place.
+func pushCalendarEvent(messageStore *MessageStore, chatJID, messageID string, event *waProto.EventMessage) {
+	if calendarSync.URL == "" || event.GetStartTime() <= 0 {
+		return
+	}
+	go func() {
+		chatName := chatJID
+		if metadata, err := messageStore.GetChatMetadata(chatJID); err == nil && metadata.Name != "" {
+			chatName = metadata.Name
+		}
+		uid := messageID + "-" + strings.SplitN(chatJID, "@", 2)[0] + "@whatsapp"
+		target := strings.TrimSuffix(calendarSync.URL, "/") + "/" + url.PathEscape(uid) + ".ics"
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, strings.NewReader(buildEventICS(uid, chatName, event)))
+		if err != nil {
+			fmt.Printf("⚠️ Failed to push event %s to the calendar: %v\n", messageID, err)
+			return
+		}
+		req.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+		if calendarSync.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+calendarSync.BearerToken)
+		} else if calendarSync.Username != "" {
+			req.SetBasicAuth(calendarSync.Username, calendarSync.Password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("⚠️ Failed to push event %s to the calendar: %v\n", messageID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			fmt.Printf("⚠️ Calendar rejected event %s: %s\n", messageID, resp.Status)
+			return
+		}
+		fmt.Printf("📅 Event %q pushed to the calendar (%s)\n", redactLogContent(event.GetName()), uid)
+	}()
+}
+
+// Get the sender of a stored message
+func (store *MessageStore) GetMessageSender(id, chatJID string) (sender string, isFromMe bool, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	err = store.db.QueryRowContext(ctx,
+		"SELECT sender, is_from_me FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	).Scan(&sender, &isFromMe)
+	return sender, isFromMe, err
+}
+
+// Get the content of a stored message
+func (store *MessageStore) GetMessageContent(id, chatJID string) (content string, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	err = store.db.QueryRowContext(ctx,
+		"SELECT COALESCE(content, '') FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	).Scan(&content)
+	return content, err
+}
+
+// Record that read receipts were sent for messages in a chat; the chat counts as read, so its
+// unread counter is reset
+func (store *MessageStore) SetMessagesRead(chatJID string, ids []string, readAt time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{readAt.UTC(), chatJID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE messages SET read_at = ? WHERE chat_jid = ? AND read_at IS NULL AND id IN (?"+strings.Repeat(", ?", len(ids)-1)+")",
+		args...,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chats SET unread_count = 0 WHERE jid = ?", chatJID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replace a chat's unread counter (history sync carries the phone's count)
+func (store *MessageStore) SetUnreadCount(jid string, count int) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "UPDATE chats SET unread_count = ? WHERE jid = ?", count, jid)
+	return err
+}
+
+// autoMarkRead sends read receipts for messages returned by /api/messages (MCP_AUTO_MARK_READ;
+// ?mark_read= overrides it per request)
+var autoMarkRead bool
+
+// markMessagesRead sends read receipts for messages in a chat, returning how many were marked.
+// Group receipts must name the author, so IDs are batched per stored sender; sender covers
+// messages that were never stored. Our own messages are skipped.
+func markMessagesRead(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, chatJID types.JID, ids []string, sender types.JID) (int, error) {
+	bySender := make(map[types.JID][]types.MessageID)
+	var senders []types.JID
+	for _, id := range ids {
+		author := sender
+		stored, isFromMe, err := messageStore.GetMessageSender(id, chatJID.String())
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if err == nil {
+			if isFromMe {
+				continue
+			}
+			if author.IsEmpty() && stored != "" {
+				author = types.NewJID(stored, types.DefaultUserServer)
+			}
+		}
+		if author.IsEmpty() && chatJID.Server == types.GroupServer {
+			return 0, fmt.Errorf("message %s not found in %s (pass sender explicitly)", id, chatJID)
+		}
+		if _, seen := bySender[author]; !seen {
+			senders = append(senders, author)
+		}
+		bySender[author] = append(bySender[author], id)
+	}
+
+	now := time.Now()
+	marked := 0
+	for _, author := range senders {
+		batch := bySender[author]
+		if err := client.MarkRead(ctx, batch, now, chatJID, author); err != nil {
+			return marked, err
+		}
+		if err := messageStore.SetMessagesRead(chatJID.String(), batch, now); err != nil {
+			fmt.Printf("Warning: failed to record read receipts in %s: %v\n", chatJID, err)
+		}
+		marked += len(batch)
+	}
+	return marked, nil
+}
+
+// GroupSettings are the admin toggles of a group as read from its metadata
+type GroupSettings struct {
+	JID                  string `json:"jid"`
+	Name                 string `json:"name,omitempty"`
+	Announce             bool   `json:"announce"`               // only admins can send
+	Locked               bool   `json:"locked"`                 // only admins can edit group info
+	DisappearingTimer    uint32 `json:"disappearing_timer"`     // seconds, 0 = off
+	MemberAddMode        string `json:"member_add_mode"`        // admin_add or all_member_add
+	JoinApprovalRequired bool   `json:"join_approval_required"` // admins approve invite-link joins
+}
+
+func groupSettingsFromInfo(info *types.GroupInfo) GroupSettings {
+	settings := GroupSettings{
+		JID:                  info.JID.String(),
+		Name:                 info.Name,
+		Announce:             info.IsAnnounce,
+		Locked:               info.IsLocked,
+		MemberAddMode:        string(info.MemberAddMode),
+		JoinApprovalRequired: info.IsJoinApprovalRequired,
+	}
+	if info.IsEphemeral {
+		settings.DisappearingTimer = info.DisappearingTimer
+	}
+	if settings.MemberAddMode == "" {
+		settings.MemberAddMode = string(types.GroupMemberAddModeAdmin)
+	}
+	return settings
+}
+
+// GroupParticipantInfo is a group member, or the outcome of changing one
+type GroupParticipantInfo struct {
+	JID          string `json:"jid"`
+	Phone        string `json:"phone,omitempty"`
+	IsAdmin      bool   `json:"is_admin,omitempty"`
+	IsSuperAdmin bool   `json:"is_super_admin,omitempty"`
+	Error        int    `json:"error,omitempty"` // WhatsApp's per-participant failure code (e.g. 403 = privacy settings need an invite)
+}
+
+// GroupDetails is a group's metadata and members
+type GroupDetails struct {
+	GroupSettings
+	Topic            string                 `json:"topic,omitempty"`
+	Owner            string                 `json:"owner,omitempty"`
+	CreatedAt        string                 `json:"created_at,omitempty"`
+	IsCommunity      bool                   `json:"is_community,omitempty"`
+	ParentJID        string                 `json:"parent_jid,omitempty"` // Community the group belongs to
+	ParticipantCount int                    `json:"participant_count"`
+	Participants     []GroupParticipantInfo `json:"participants"`
+}
+
+func groupParticipantInfos(participants []types.GroupParticipant) []GroupParticipantInfo {
+	infos := make([]GroupParticipantInfo, 0, len(participants))
+	for _, participant := range participants {
+		info := GroupParticipantInfo{
+			JID:          participant.JID.String(),
+			IsAdmin:      participant.IsAdmin,
+			IsSuperAdmin: participant.IsSuperAdmin,
+			Error:        participant.Error,
+		}
+		if !participant.PhoneNumber.IsEmpty() {
+			info.Phone = participant.PhoneNumber.User
+		} else if participant.JID.Server == types.DefaultUserServer {
+			info.Phone = participant.JID.User
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func groupDetailsFromInfo(info *types.GroupInfo) GroupDetails {
+	details := GroupDetails{
+		GroupSettings:    groupSettingsFromInfo(info),
+		Topic:            info.Topic,
+		IsCommunity:      info.IsParent,
+		ParticipantCount: max(info.ParticipantCount, len(info.Participants)),
+		Participants:     groupParticipantInfos(info.Participants),
+	}
+	if !info.OwnerJID.IsEmpty() {
+		details.Owner = info.OwnerJID.String()
+	}
+	if !info.GroupCreated.IsZero() {
+		details.CreatedAt = info.GroupCreated.UTC().Format(time.RFC3339)
+	}
+	if !info.LinkedParentJID.IsEmpty() {
+		details.ParentJID = info.LinkedParentJID.String()
+	}
+	return details
+}
+
+var inviteCodePattern = regexp.MustCompile(`^[A-Za-z0-9]{10,32}$`)
+
+// parseInviteCode extracts the code from a chat.whatsapp.com invite link, or accepts a bare code
+func parseInviteCode(invite string) (string, error) {
+	code := strings.TrimSpace(invite)
+	for _, prefix := range []string{"https://", "http://"} {
+		code = strings.TrimPrefix(code, prefix)
+	}
+	code = strings.TrimPrefix(code, "chat.whatsapp.com/")
+	code = strings.TrimPrefix(code, "invite/")
+	if i := strings.IndexAny(code, "?#/"); i >= 0 {
+		code = code[:i]
+	}
+	if !inviteCodePattern.MatchString(code) {
+		return "", fmt.Errorf("invalid invite link or code")
+	}
+	return code, nil
+}
+
+// inviteErrorStatus maps invite link failures onto HTTP statuses
+func inviteErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, whatsmeow.ErrInviteLinkRevoked):
+		return http.StatusGone
+	case errors.Is(err, whatsmeow.ErrInviteLinkInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, whatsmeow.ErrGroupInviteLinkUnauthorized), errors.Is(err, whatsmeow.ErrNotInGroup):
+		return http.StatusForbidden
+	case errors.Is(err, whatsmeow.ErrGroupNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusBadGateway
+}
+
+// parseParticipantJIDs parses phone numbers or JIDs of group participants
+func parseParticipantJIDs(participants []string) ([]types.JID, error) {
+	jids := make([]types.JID, 0, len(participants))
+	for _, participant := range participants {
+		jid, err := parseRecipientJID(participant)
+		if err != nil || jid.Server == types.GroupServer {
+			return nil, fmt.Errorf("invalid participant %q", participant)
+		}
+		jids = append(jids, jid)
+	}
+	return jids, nil
+}
+
+// parseRecipientJID accepts a full JID or a phone number (with optional + prefix)
+func parseRecipientJID(recipient string) (types.JID, error) {
+	if strings.Contains(recipient, "@") {
+		return types.ParseJID(recipient)
+	}
+	return types.JID{
+		User:   strings.TrimPrefix(recipient, "+"),
+		Server: types.DefaultUserServer,
+	}, nil
+}
+
+// buildStoredMessageKey builds the key referencing an earlier message (for pins, reactions, edits...).
+// The sender is looked up from storage; senderOverride (phone or JID) is used for messages we never stored.
+func buildStoredMessageKey(client *whatsmeow.Client, messageStore *MessageStore, chatJID types.JID, messageID, senderOverride string) (*waProto.MessageKey, error) {
+	var senderJID types.JID
+	if senderOverride != "" {
+		parsed, err := parseRecipientJID(senderOverride)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sender: %v", err)
+		}
+		senderJID = parsed
+	} else {
+		sender, isFromMe, err := messageStore.GetMessageSender(messageID, chatJID.String())
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("message %s not found in %s (pass sender explicitly)", messageID, chatJID)
+		} else if err != nil {
+			return nil, err
+		}
+		if !isFromMe {
+			senderJID = types.NewJID(sender, types.DefaultUserServer)
+		}
+	}
+	return client.BuildMessageKey(chatJID, senderJID, messageID), nil
+}
+
+// buildQuoteContext builds the context that makes a new message a reply to a stored one.
+// The quoted body comes from the raw proto when kept, so the recipient sees the quote preview.
+func buildQuoteContext(client *whatsmeow.Client, messageStore *MessageStore, chatJID types.JID, messageID string) (*waProto.ContextInfo, error) {
+	key, err := buildStoredMessageKey(client, messageStore, chatJID, messageID, "")
+	if err != nil {
+		return nil, err
+	}
+	participant := key.GetParticipant()
+	if participant == "" {
+		if key.GetFromMe() && client.Store.ID != nil {
+			participant = client.Store.ID.ToNonAD().String()
+		} else {
+			participant = chatJID.ToNonAD().String()
+		}
+	}
+	contextInfo := &waProto.ContextInfo{
+		StanzaID:    proto.String(messageID),
+		Participant: proto.String(participant),
+	}
+	if quoted, err := messageStore.GetRawMessage(messageID, chatJID.String()); err == nil && quoted != nil {
+		contextInfo.QuotedMessage = quoted
+	}
+	return contextInfo, nil
+}
+
+// Pinned message durations accepted by WhatsApp clients
+var pinDurations = map[uint32]bool{
+	24 * 60 * 60:      true,
+	7 * 24 * 60 * 60:  true,
+	30 * 24 * 60 * 60: true,
+}
+
+const defaultPinDuration = 7 * 24 * 60 * 60
+
+// PinnedMessage is a message pinned in a chat
+type PinnedMessage struct {
+	ChatJID   string `json:"chat_jid"`
+	MessageID string `json:"message_id"`
+	PinnedBy  string `json:"pinned_by"`
+	PinnedAt  string `json:"pinned_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// Store a pin, replacing any earlier pin of the same message
+func (store *MessageStore) StorePin(chatJID, messageID, pinnedBy string, pinnedAt time.Time, duration time.Duration) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT OR REPLACE INTO pinned_messages (chat_jid, message_id, pinned_by, pinned_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		chatJID, messageID, pinnedBy, pinnedAt.UTC(), pinnedAt.Add(duration).UTC(),
+	)
+	return err
+}
+
+// Remove a pin
+func (store *MessageStore) DeletePin(chatJID, messageID string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "DELETE FROM pinned_messages WHERE chat_jid = ? AND message_id = ?", chatJID, messageID)
+	return err
+}
+
+// Get unexpired pins for a chat
+func (store *MessageStore) GetPins(chatJID string) ([]PinnedMessage, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT chat_jid, message_id, pinned_by, pinned_at, expires_at
+		FROM pinned_messages WHERE chat_jid = ? AND expires_at > ? ORDER BY pinned_at DESC`,
+		chatJID, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := []PinnedMessage{}
+	for rows.Next() {
+		var pin PinnedMessage
+		var pinnedAt, expiresAt time.Time
+		if err := rows.Scan(&pin.ChatJID, &pin.MessageID, &pin.PinnedBy, &pinnedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		pin.PinnedAt = pinnedAt.UTC().Format(time.RFC3339)
+		pin.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+// Handle pin/unpin notifications. Returns true when the message was consumed.
+func handlePinUpdate(messageStore *MessageStore, msg *events.Message, chatJID, sender string, logger waLog.Logger) bool {
+	pin := msg.Message.GetPinInChatMessage()
+	if pin == nil {
+		return false
+	}
+
+	messageID := pin.GetKey().GetID()
+	switch pin.GetType() {
+	case waProto.PinInChatMessage_PIN_FOR_ALL:
+		duration := msg.Message.GetMessageContextInfo().GetMessageAddOnDurationInSecs()
+		if duration == 0 {
+			duration = defaultPinDuration
+		}
+		pinnedAt := msg.Info.Timestamp
+		if ms := pin.GetSenderTimestampMS(); ms > 0 {
+			pinnedAt = time.UnixMilli(ms)
+		}
+		if err := messageStore.StorePin(chatJID, messageID, sender, pinnedAt, time.Duration(duration)*time.Second); err != nil {
+			logger.Warnf("Failed to store pin: %v", err)
+		}
+		fmt.Printf("📌 Message %s pinned in %s by %s\n", messageID, chatJID, sender)
+	case waProto.PinInChatMessage_UNPIN_FOR_ALL:
+		if err := messageStore.DeletePin(chatJID, messageID); err != nil {
+			logger.Warnf("Failed to remove pin: %v", err)
+		}
+		fmt.Printf("📌 Message %s unpinned in %s by %s\n", messageID, chatJID, sender)
+	}
+	return true
+}
+
+// MessageReaction is one participant's reaction to a message
+type MessageReaction struct {
+	Sender    string `json:"sender"`
+	Emoji     string `json:"emoji"`
+	ReactedAt string `json:"reacted_at"`
+}
+
+// Store a reaction; an empty emoji removes the sender's reaction
+func (store *MessageStore) StoreReaction(chatJID, messageID, sender, emoji string, reactedAt time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	if emoji == "" {
+		_, err := store.writer.ExecContext(ctx,
+			"DELETE FROM message_reactions WHERE chat_jid = ? AND message_id = ? AND sender = ?",
+			chatJID, messageID, sender,
+		)
+		return err
+	}
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT OR REPLACE INTO message_reactions (chat_jid, message_id, sender, emoji, reacted_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		chatJID, messageID, sender, emoji, reactedAt.UTC(),
+	)
+	return err
+}
+
+// Get the reactions of several messages, keyed by chat_jid + "/" + message_id
+func (store *MessageStore) GetReactionsFor(chatJID string, messageIDs []string) (map[string][]MessageReaction, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	reactions := map[string][]MessageReaction{}
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+	query := `SELECT chat_jid, message_id, sender, emoji, reacted_at FROM message_reactions
+		WHERE message_id IN (?` + strings.Repeat(", ?", len(messageIDs)-1) + ")"
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	if chatJID != "" {
+		query += " AND chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	rows, err := store.db.QueryContext(ctx, query+" ORDER BY reacted_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chat, messageID string
+		var reaction MessageReaction
+		var reactedAt time.Time
+		if err := rows.Scan(&chat, &messageID, &reaction.Sender, &reaction.Emoji, &reactedAt); err != nil {
+			return nil, err
+		}
+		reaction.ReactedAt = reactedAt.UTC().Format(time.RFC3339)
+		reactions[chat+"/"+messageID] = append(reactions[chat+"/"+messageID], reaction)
+	}
+	return reactions, rows.Err()
+}
+
+// ExportedMessage is one message as written to an export bundle
+type ExportedMessage struct {
+	ID          string `json:"id"`
+	ChatJID     string `json:"chat_jid"`
+	Sender      string `json:"sender"`
+	Content     string `json:"content"`
+	Timestamp   string `json:"timestamp"`
+	IsFromMe    bool   `json:"is_from_me"`
+	MediaType   string `json:"media_type,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Write chats and messages (optionally one chat, optionally only after since) as a JSON document,
+// streaming message rows so large stores are never held in memory
+func (store *MessageStore) ExportJSON(w io.Writer, chatJID string, since time.Time) error {
+	// Exports and backups run as long as they need; only the caller can stop them
+	ctx := store.context()
+	chatQuery := "SELECT jid, COALESCE(name, ''), last_message_time FROM chats"
+	messageQuery := `SELECT id, chat_jid, COALESCE(sender, ''), COALESCE(content, ''), timestamp, is_from_me,
+		COALESCE(media_type, ''), COALESCE(filename, ''), COALESCE(content_type, '') FROM messages WHERE timestamp > ?`
+	chatArgs := []interface{}{}
+	messageArgs := []interface{}{since}
+	if chatJID != "" {
+		chatQuery += " WHERE jid = ?"
+		chatArgs = append(chatArgs, chatJID)
+		messageQuery += " AND chat_jid = ?"
+		messageArgs = append(messageArgs, chatJID)
+	}
+
+	chats := []map[string]interface{}{}
+	chatRows, err := store.db.QueryContext(ctx, chatQuery+" ORDER BY jid", chatArgs...)
+	if err != nil {
+		return err
+	}
+	for chatRows.Next() {
+		var jid, name string
+		var lastMessage sql.NullTime
+		if err := chatRows.Scan(&jid, &name, &lastMessage); err != nil {
+			chatRows.Close()
+			return err
+		}
+		chat := map[string]interface{}{"jid": jid, "name": name}
+		if lastMessage.Valid {
+			chat["last_message_time"] = lastMessage.Time.UTC().Format(time.RFC3339)
+		}
+		chats = append(chats, chat)
+	}
+	chatRows.Close()
+	if err := chatRows.Err(); err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(chats)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, `{"exported_at":%q,"chat_jid":%q,"chats":%s,"messages":[`,
+		time.Now().UTC().Format(time.RFC3339), chatJID, header); err != nil {
+		return err
+	}
+
+	rows, err := store.db.QueryContext(ctx, messageQuery+" ORDER BY timestamp", messageArgs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+	for first := true; rows.Next(); first = false {
+		var msg ExportedMessage
+		var timestamp time.Time
+		if err := rows.Scan(&msg.ID, &msg.ChatJID, &msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe,
+			&msg.MediaType, &msg.Filename, &msg.ContentType); err != nil {
+			return err
+		}
+		msg.Timestamp = timestamp.UTC().Format(time.RFC3339)
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// Write a consistent copy of the whole message database to path, which must not exist yet
+func (store *MessageStore) Backup(path string) error {
+	// Exports and backups run as long as they need; only the caller can stop them
+	ctx := store.context()
+	if err := store.FlushWrites(); err != nil {
+		return err
+	}
+	_, err := store.db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// DBTableStats is the row count of one table in messages.db
+type DBTableStats struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// DBIndexStats describes one index. SQLite keeps no usage counters, so usage is reported through
+// the planner statistics ANALYZE writes to sqlite_stat1 (rows and average rows per key) and,
+// when SQLite was built with the dbstat table, the index's size on disk.
+type DBIndexStats struct {
+	Name      string `json:"name"`
+	Table     string `json:"table"`
+	Unique    bool   `json:"unique"`
+	Stat      string `json:"stat,omitempty"`       // sqlite_stat1 entry; empty until ANALYZE has run
+	SizeBytes int64  `json:"size_bytes,omitempty"` // dbstat builds only
+}
+
+// DBStats is a capacity snapshot of messages.db
+type DBStats struct {
+	DBBytes        int64          `json:"db_bytes"`
+	WALBytes       int64          `json:"wal_bytes"`
+	PageSize       int64          `json:"page_size"`
+	PageCount      int64          `json:"page_count"`
+	FreePages      int64          `json:"free_pages"`
+	Tables         []DBTableStats `json:"tables"`
+	Indexes        []DBIndexStats `json:"indexes"`
+	OldestMessage  string         `json:"oldest_message,omitempty"`
+	NewestMessage  string         `json:"newest_message,omitempty"`
+	IndexSizeKnown bool           `json:"index_size_known"` // Whether size_bytes comes from dbstat
+}
+
+// Collect row counts, file sizes, indexes and the stored message time range
+func (store *MessageStore) DBStats() (*DBStats, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+
+	stats := &DBStats{Tables: []DBTableStats{}, Indexes: []DBIndexStats{}}
+	path := filepath.Join(store.dir, "messages.db")
+	if info, err := os.Stat(path); err == nil {
+		stats.DBBytes = info.Size()
+	}
+	if info, err := os.Stat(path + "-wal"); err == nil {
+		stats.WALBytes = info.Size()
+	}
+	for pragma, value := range map[string]*int64{"page_size": &stats.PageSize, "page_count": &stats.PageCount, "freelist_count": &stats.FreePages} {
+		if err := store.db.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(value); err != nil {
+			return nil, fmt.Errorf("%s: %v", pragma, err)
+		}
+	}
+
+	// Virtual tables (the FTS index) are left out; counting them scans their content
+	rows, err := store.db.QueryContext(ctx, `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND sql NOT LIKE 'CREATE VIRTUAL TABLE%'
+		ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		var count int64
+		if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM "`+table+`"`).Scan(&count); err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		}
+		stats.Tables = append(stats.Tables, DBTableStats{Name: table, Rows: count})
+	}
+
+	rows, err = store.db.QueryContext(ctx, `
+		SELECT name, tbl_name, COALESCE(sql, '') LIKE 'CREATE UNIQUE%' OR sql IS NULL
+		FROM sqlite_master WHERE type = 'index' ORDER BY tbl_name, name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var index DBIndexStats
+		if err := rows.Scan(&index.Name, &index.Table, &index.Unique); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.Indexes = append(stats.Indexes, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Both sources are optional: sqlite_stat1 exists once ANALYZE has run, dbstat only in
+	// SQLite builds with SQLITE_ENABLE_DBSTAT_VTAB
+	planner := map[string]string{}
+	if rows, err := store.db.QueryContext(ctx, "SELECT idx, stat FROM sqlite_stat1 WHERE idx IS NOT NULL"); err == nil {
+		for rows.Next() {
+			var name, stat string
+			if rows.Scan(&name, &stat) == nil {
+				planner[name] = stat
+			}
+		}
+		rows.Close()
+	}
+	sizes := map[string]int64{}
+	if rows, err := store.db.QueryContext(ctx, "SELECT name, SUM(pgsize) FROM dbstat GROUP BY name"); err == nil {
+		stats.IndexSizeKnown = true
+		for rows.Next() {
+			var name string
+			var size int64
+			if rows.Scan(&name, &size) == nil {
+				sizes[name] = size
+			}
+		}
+		rows.Close()
+	}
+	for i := range stats.Indexes {
+		stats.Indexes[i].Stat = planner[stats.Indexes[i].Name]
+		stats.Indexes[i].SizeBytes = sizes[stats.Indexes[i].Name]
+	}
+
+	// ORDER BY rather than MIN/MAX so the driver still parses the column as a time
+	for destination, order := range map[*string]string{&stats.OldestMessage: "ASC", &stats.NewestMessage: "DESC"} {
+		var timestamp sql.NullTime
+		err := store.db.QueryRowContext(ctx, "SELECT timestamp FROM messages ORDER BY timestamp "+order+" LIMIT 1").Scan(&timestamp)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if timestamp.Valid {
+			*destination = timestamp.Time.UTC().Format(time.RFC3339)
+		}
+	}
+	return stats, nil
+}
+
+// MessageSearch filters a full-text search over stored messages. Zero values don't filter.
+type MessageSearch struct {
+	Query      string
+	ChatJID    string
+	Sender     string // Phone number (user part of the sender JID)
+	MediaTypes []string
+	After      time.Time
+	Before     time.Time
+	Cursor     string // next_cursor of the previous page
+	Limit      int
+}
+
+// SearchResult is a message matching a search, newest first
+type SearchResult struct {
+	ID        string `json:"id"`
+	ChatJID   string `json:"chat_jid"`
+	ChatName  string `json:"chat_name,omitempty"`
+	Sender    string `json:"sender"`
+	Content   string `json:"content"`
+	Snippet   string `json:"snippet,omitempty"` // Matched terms in [brackets]; FTS5 only
+	Timestamp string `json:"timestamp"`
+	IsFromMe  bool   `json:"is_from_me"`
+	MediaType string `json:"media_type,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+}
+
+// searchTerms splits a free-text query into terms; a trailing * makes a term a prefix match
+func searchTerms(query string) []string {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		if strings.Trim(term, "*") != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// ftsMatchExpression quotes each term so user input can't be parsed as FTS5 query syntax
+func ftsMatchExpression(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		prefix := strings.HasSuffix(term, "*")
+		quoted[i] = `"` + strings.ReplaceAll(strings.Trim(term, "*"), `"`, `""`) + `"`
+		if prefix {
+			quoted[i] += "*"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// encodeSearchCursor and decodeSearchCursor carry the position of the last result of a page
+func encodeSearchCursor(timestamp time.Time, rowID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", timestamp.UnixNano(), rowID)))
+}
+
+func decodeSearchCursor(cursor string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+	var nanos, rowID int64
+	if _, err := fmt.Sscanf(string(raw), "%d:%d", &nanos, &rowID); err != nil {
+		return time.Time{}, 0, errors.New("invalid cursor")
+	}
+	return time.Unix(0, nanos).UTC(), rowID, nil
+}
+
+// SearchMessages runs a full-text search (substring matching without FTS5), newest first.
+// The returned cursor is empty on the last page.
+func (store *MessageStore) SearchMessages(search MessageSearch) ([]SearchResult, string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return nil, "", errors.New("query has no search terms")
+	}
+
+	var query string
+	var args []interface{}
+	if store.searchIndexed {
+		query = `SELECT m.rowid, m.id, m.chat_jid, COALESCE(c.name, ''), COALESCE(m.sender, ''), COALESCE(m.content, ''),
+			snippet(messages_fts, 0, '[', ']', '…', 12), m.timestamp, m.is_from_me, COALESCE(m.media_type, ''), COALESCE(m.filename, '')
+			FROM messages_fts
+			JOIN messages m ON m.rowid = messages_fts.rowid
+			LEFT JOIN chats c ON m.chat_jid = c.jid
+			WHERE messages_fts MATCH ?`
+		args = append(args, ftsMatchExpression(terms))
+	} else {
+		query = `SELECT m.rowid, m.id, m.chat_jid, COALESCE(c.name, ''), COALESCE(m.sender, ''), COALESCE(m.content, ''),
+			'', m.timestamp, m.is_from_me, COALESCE(m.media_type, ''), COALESCE(m.filename, '')
+			FROM messages m
+			LEFT JOIN chats c ON m.chat_jid = c.jid
+			WHERE 1 = 1`
+		replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+		for _, term := range terms {
+			query += ` AND m.content LIKE ? ESCAPE '\'`
+			args = append(args, "%"+replacer.Replace(strings.Trim(term, "*"))+"%")
+		}
+	}
+	if search.ChatJID != "" {
+		query += " AND m.chat_jid = ?"
+		args = append(args, search.ChatJID)
+	}
+	if search.Sender != "" {
+		query += " AND m.sender = ?"
+		args = append(args, search.Sender)
+	}
+	if len(search.MediaTypes) > 0 {
+		query += " AND m.media_type IN (?" + strings.Repeat(", ?", len(search.MediaTypes)-1) + ")"
+		for _, mediaType := range search.MediaTypes {
+			args = append(args, mediaType)
+		}
+	}
+	if !search.After.IsZero() {
+		query += " AND m.timestamp >= ?"
+		args = append(args, search.After.UTC())
+	}
+	if !search.Before.IsZero() {
+		query += " AND m.timestamp < ?"
+		args = append(args, search.Before.UTC())
+	}
+	if search.Cursor != "" {
+		cursorTime, cursorRowID, err := decodeSearchCursor(search.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += " AND (m.timestamp < ? OR (m.timestamp = ? AND m.rowid < ?))"
+		args = append(args, cursorTime, cursorTime, cursorRowID)
+	}
+	// One extra row tells whether another page follows
+	query += " ORDER BY m.timestamp DESC, m.rowid DESC LIMIT ?"
+	args = append(args, search.Limit+1)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	var lastTime time.Time
+	var lastRowID int64
+	hasMore := false
+	for rows.Next() {
+		if len(results) == search.Limit {
+			hasMore = true
+			break
+		}
+		var result SearchResult
+		var rowID int64
+		var timestamp time.Time
+		if err := rows.Scan(&rowID, &result.ID, &result.ChatJID, &result.ChatName, &result.Sender, &result.Content,
+			&result.Snippet, &timestamp, &result.IsFromMe, &result.MediaType, &result.Filename); err != nil {
+			return nil, "", err
+		}
+		result.Timestamp = timestamp.UTC().Format(time.RFC3339)
+		results = append(results, result)
+		lastTime, lastRowID = timestamp, rowID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if !hasMore {
+		return results, "", nil
+	}
+	return results, encodeSearchCursor(lastTime, lastRowID), nil
+}
+
+// Handle reactions (and their removal). Returns true when the message was consumed.
+func handleReactionUpdate(messageStore *MessageStore, msg *events.Message, chatJID, sender string, logger waLog.Logger) bool {
+	reaction := msg.Message.GetReactionMessage()
+	if reaction == nil {
+		return false
+	}
+
+	messageID := reaction.GetKey().GetID()
+	reactedAt := msg.Info.Timestamp
+	if ms := reaction.GetSenderTimestampMS(); ms > 0 {
+		reactedAt = time.UnixMilli(ms)
+	}
+	if err := messageStore.StoreReaction(chatJID, messageID, sender, reaction.GetText(), reactedAt); err != nil {
+		logger.Warnf("Failed to store reaction: %v", err)
+	}
+	fmt.Printf("💬 Reaction %q to %s in %s by %s\n", reaction.GetText(), messageID, chatJID, sender)
+	go dispatchEventWebhooks(messageStore, "reaction", map[string]interface{}{
+		"chat_jid":   chatJID,
+		"message_id": messageID,
+		"sender":     sender,
+		"emoji":      reaction.GetText(),
+		"removed":    reaction.GetText() == "",
+		"is_from_me": msg.Info.IsFromMe,
+		"timestamp":  reactedAt.UTC().Format(time.RFC3339),
+	})
+	return true
+}
+
+// Mark a message as kept (or no longer kept) in a disappearing chat
+func (store *MessageStore) SetKept(id, chatJID string, kept bool) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE messages SET is_kept = ? WHERE id = ? AND chat_jid = ?",
+		kept, id, chatJID,
+	)
+	return err
+}
+
+// Handle keep/unkeep notifications. Returns true when the message was consumed.
+func handleKeepUpdate(messageStore *MessageStore, msg *events.Message, chatJID, sender string, logger waLog.Logger) bool {
+	keep := msg.Message.GetKeepInChatMessage()
+	if keep == nil {
+		return false
+	}
+
+	messageID := keep.GetKey().GetID()
+	kept := keep.GetKeepType() == waProto.KeepType_KEEP_FOR_ALL
+	if err := messageStore.SetKept(messageID, chatJID, kept); err != nil {
+		logger.Warnf("Failed to update kept state: %v", err)
+	}
+	fmt.Printf("📎 Message %s in %s kept=%v by %s\n", messageID, chatJID, kept, sender)
+	return true
+}
+
+// MessageEdit is an earlier version of an edited message
+type MessageEdit struct {
+	Content    string `json:"content"`
+	ReplacedAt string `json:"replaced_at"`
+}
+
+// Replace a message's content with an edit, keeping the previous text in edit_history.
+// Only the author may edit: fromMe and sender must match the stored message. Returns the
+// previous content, or found=false when the message isn't stored (or wasn't written by the editor).
+func (store *MessageStore) ApplyEdit(id, chatJID, sender string, fromMe bool, content string, editedAt time.Time) (previous string, found bool, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	// The message itself may still be waiting in the write batch
+	if err := store.FlushWrites(); err != nil {
+		return "", false, err
+	}
+
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var storedSender, history sql.NullString
+	var storedFromMe bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT content, sender, is_from_me, edit_history FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	).Scan(&previous, &storedSender, &storedFromMe, &history)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if storedFromMe != fromMe || (!fromMe && storedSender.String != sender) {
+		return "", false, nil
+	}
+
+	var edits []MessageEdit
+	if history.Valid {
+		json.Unmarshal([]byte(history.String), &edits)
+	}
+	edits = append(edits, MessageEdit{Content: previous, ReplacedAt: editedAt.UTC().Format(time.RFC3339)})
+	encoded, err := json.Marshal(edits)
+	if err != nil {
+		return "", false, err
+	}
+	content, unmasked := maskInboundPII(content, fromMe)
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE messages SET content = ?, content_unmasked = NULLIF(?, ''), edited_at = ?, edit_history = ? WHERE id = ? AND chat_jid = ?",
+		content, unmasked, editedAt.UTC(), string(encoded), id, chatJID,
+	); err != nil {
+		return "", false, err
+	}
+	return previous, true, tx.Commit()
+}
+
+// Handle message edits, including edited newsletter posts. Returns true when the message was consumed.
+func handleEditUpdate(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, chatJID, sender string, logger waLog.Logger) bool {
+	var messageID, content string
+	editedAt := msg.Info.Timestamp
+	if protocol := msg.Message.GetProtocolMessage(); protocol.GetType() == waProto.ProtocolMessage_MESSAGE_EDIT {
+		messageID = protocol.GetKey().GetID()
+		content = extractTextContent(client, protocol.GetEditedMessage())
+		if ms := protocol.GetTimestampMS(); ms > 0 {
+			editedAt = time.UnixMilli(ms)
+		}
+	} else if meta := msg.NewsletterMeta; meta != nil && !meta.EditTS.IsZero() {
+		// Newsletter edits carry the new content directly under the original ID
+		messageID = msg.Info.ID
+		content = extractTextContent(client, msg.Message)
+		editedAt = meta.EditTS
+	} else {
+		return false
+	}
+
+	previous, found, err := messageStore.ApplyEdit(messageID, chatJID, sender, msg.Info.IsFromMe, content, editedAt)
+	if err != nil {
+		logger.Warnf("Failed to apply edit of %s: %v", messageID, err)
+		return true
+	}
+	if !found {
+		fmt.Printf("✏️ Ignoring edit of unknown message %s in %s\n", messageID, chatJID)
+		return true
+	}
+	fmt.Printf("✏️ Message %s in %s edited by %s\n", messageID, chatJID, sender)
+	content, _ = maskInboundPII(content, msg.Info.IsFromMe)
+	go dispatchEventWebhooks(messageStore, "message_edited", map[string]interface{}{
+		"chat_jid":         chatJID,
+		"message_id":       messageID,
+		"sender":           sender,
+		"is_from_me":       msg.Info.IsFromMe,
+		"content":          content,
+		"previous_content": previous,
+		"edited_at":        editedAt.UTC().Format(time.RFC3339),
+	})
+	return true
+}
+
+// Placeholder media_type for messages that failed to decrypt; replaced once the retry arrives
+const undecryptableMediaType = "undecryptable"
+
+// Store a placeholder row without overwriting a message that was already stored
+func (store *MessageStore) StorePlaceholder(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		`INSERT OR IGNORE INTO messages (id, chat_jid, sender, content, timestamp, is_from_me, media_type)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, chatJID, sender, content, timestamp.UTC(), isFromMe, undecryptableMediaType,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// Handle messages that couldn't be decrypted. whatsmeow has already sent a retry receipt
+// to the sender (and schedules a request to our phone); when the retransmission arrives,
+// handleMessage stores it under the same ID, replacing the placeholder.
+func handleUndecryptableMessage(client *whatsmeow.Client, messageStore *MessageStore, evt *events.UndecryptableMessage, logger waLog.Logger) {
+	if evt.DecryptFailMode == events.DecryptFailHide {
+		// Hidden types (e.g. reactions, edits) never render as messages
+		return
+	}
+
+	canonicalChatJID, canonicalSenderJID := resolveMessageStorageIDs(client, &evt.Info, logger)
+	chatJID := canonicalChatJID.String()
+	if chatJID == "" {
+		chatJID = evt.Info.Chat.String()
+	}
+	sender := canonicalSenderJID.User
+	if sender == "" {
+		sender = evt.Info.Sender.User
+	}
+
+	content := "[Message could not be decrypted - waiting for retransmission]"
+	if evt.UnavailableType == events.UnavailableTypeViewOnce {
+		content = "[View-once message - not available on linked devices]"
+	}
+
+	name := GetChatName(client, messageStore, canonicalChatJID, chatJID, nil, sender, evt.Info.PushName, logger)
+	if err := messageStore.StoreChat(chatJID, name, evt.Info.Timestamp); err != nil {
+		logger.Warnf("Failed to store chat: %v", err)
+	}
+
+	stored, err := messageStore.StorePlaceholder(evt.Info.ID, chatJID, sender, content, evt.Info.Timestamp, evt.Info.IsFromMe)
+	if err != nil {
+		logger.Warnf("Failed to store undecryptable placeholder: %v", err)
+		return
+	}
+	if stored {
+		fmt.Printf("🔐 Undecryptable message %s in %s from %s (unavailable=%v) - placeholder stored, retry requested\n",
+			evt.Info.ID, chatJID, sender, evt.IsUnavailable)
+	}
+}
+
+// Set a chat's mute state (until nil = indefinitely)
+func (store *MessageStore) SetChatMuted(jid string, muted bool, until *time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	if until != nil {
+		utc := until.UTC()
+		until = &utc
+	}
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, is_muted, muted_until) VALUES (?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET is_muted = excluded.is_muted, muted_until = excluded.muted_until`,
+		jid, muted, until,
+	)
+	return err
+}
+
+// Set a chat's type (used to mark community parent groups)
+func (store *MessageStore) SetChatType(jid, chatType string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, chat_type) VALUES (?, ?)
+		ON CONFLICT(jid) DO UPDATE SET chat_type = excluded.chat_type`,
+		jid, chatType,
+	)
+	return err
+}
+
+// Approval queue statuses
+const (
+	approvalPending  = "pending"
+	approvalRejected = "rejected"
+	approvalSending  = "sending" // Approved, delivery in progress
+	approvalSent     = "sent"
+	approvalFailed   = "failed"
+)
+
+// PendingSend is a moderated /api/send request awaiting (or past) supervisor review
+type PendingSend struct {
+	ID          string             `json:"id"`
+	RequestedBy string             `json:"requested_by"` // Fingerprint of the moderated token
+	Request     SendMessageRequest `json:"request"`
+	Status      string             `json:"status"`
+	Reason      string             `json:"reason,omitempty"`
+	Result      string             `json:"result,omitempty"`
+	CreatedAt   string             `json:"created_at"`
+	DecidedAt   string             `json:"decided_at,omitempty"`
+}
+
+// Store a send awaiting approval
+func (store *MessageStore) AddPendingSend(pending PendingSend) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	request, err := json.Marshal(pending.Request)
+	if err != nil {
+		return err
+	}
+	_, err = store.writer.ExecContext(ctx,
+		"INSERT INTO pending_sends (id, requested_by, request, status, created_at) VALUES (?, ?, ?, ?, ?)",
+		pending.ID, pending.RequestedBy, string(request), pending.Status, time.Now().UTC(),
+	)
+	return err
+}
+
+// Record a decision on a pending send; returns false when it was already decided
+func (store *MessageStore) DecidePendingSend(id, status, reason string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		"UPDATE pending_sends SET status = ?, reason = NULLIF(?, ''), decided_at = ? WHERE id = ? AND status = ?",
+		status, reason, time.Now().UTC(), id, approvalPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Record the delivery outcome of an approved send
+func (store *MessageStore) SetPendingSendResult(id, status, result string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "UPDATE pending_sends SET status = ?, result = ? WHERE id = ?", status, result, id)
+	return err
+}
+
+// Fail approved sends that a shutdown cut short (approved before the cutoff, still sending).
+// Whether WhatsApp got them is unknown, so they are not retried; the supervisor can resubmit.
+func (store *MessageStore) FailInterruptedApprovals(before time.Time) (int64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		"UPDATE pending_sends SET status = ?, result = ? WHERE status = ? AND decided_at < ?",
+		approvalFailed, "Interrupted by a restart while sending; it may or may not have been delivered", approvalSending, before.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Get sends in the approval queue, newest first (status "" = all)
+func (store *MessageStore) GetPendingSends(status string, limit int) ([]PendingSend, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT id, requested_by, request, status, reason, result, created_at, decided_at FROM pending_sends"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sends := []PendingSend{}
+	for rows.Next() {
+		pending, err := scanPendingSend(rows)
+		if err != nil {
+			return nil, err
+		}
+		sends = append(sends, pending)
+	}
+	return sends, rows.Err()
+}
+
+// Get one send from the approval queue
+func (store *MessageStore) GetPendingSend(id string) (PendingSend, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	row := store.db.QueryRowContext(ctx,
+		"SELECT id, requested_by, request, status, reason, result, created_at, decided_at FROM pending_sends WHERE id = ?", id,
+	)
+	return scanPendingSend(row)
+}
+
+func scanPendingSend(row interface{ Scan(...interface{}) error }) (PendingSend, error) {
+	var pending PendingSend
+	var request string
+	var reason, result sql.NullString
+	var createdAt time.Time
+	var decidedAt sql.NullTime
+	if err := row.Scan(&pending.ID, &pending.RequestedBy, &request, &pending.Status, &reason, &result, &createdAt, &decidedAt); err != nil {
+		return pending, err
+	}
+	if err := json.Unmarshal([]byte(request), &pending.Request); err != nil {
+		return pending, err
+	}
+	pending.Reason, pending.Result = reason.String, result.String
+	pending.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	if decidedAt.Valid {
+		pending.DecidedAt = decidedAt.Time.UTC().Format(time.RFC3339)
+	}
+	return pending, nil
+}
+
+// queueSendForApproval holds a moderated send and notifies supervisors via the event stream
+func queueSendForApproval(messageStore *MessageStore, requestedBy string, req SendMessageRequest) (PendingSend, error) {
+	pending := PendingSend{
+		ID:          newRandomID(8),
+		RequestedBy: requestedBy,
+		Request:     req,
+		Status:      approvalPending,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := messageStore.AddPendingSend(pending); err != nil {
+		return pending, err
+	}
+	fmt.Printf("🛡️ Send %s to %s from token %s queued for approval\n", pending.ID, req.Recipient, requestedBy)
+	go dispatchEventWebhooks(messageStore, "approval_requested", pending)
+	return pending, nil
+}
+
+// Outbox statuses
+const (
+	outboxQueued  = "queued" // Waiting for its next attempt
+	outboxSending = "sending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+// outboxRetry bounds outbox retries (MCP_OUTBOX_MAX_ATTEMPTS, MCP_OUTBOX_RETRY_BASE_SEC); the
+// backoff works the same as for webhooks
+var outboxRetry = WebhookRetryPolicy{
+	MaxAttempts: 8,
+	BaseDelay:   5 * time.Second,
+	MaxDelay:    10 * time.Minute,
+}
+
+// outboxPollInterval is how often the outbox worker looks for due sends
+const outboxPollInterval = 2 * time.Second
+
+// QueuedSend is a send in the durable outbox (/api/send with queue)
+type QueuedSend struct {
+	ID             string             `json:"id"`
+	IdempotencyKey string             `json:"idempotency_key,omitempty"`
+	Request        SendMessageRequest `json:"request"`
+	Status         string             `json:"status"`
+	Attempts       int                `json:"attempts"`
+	NextAttemptAt  string             `json:"next_attempt_at,omitempty"`
+	ErrorCode      string             `json:"error_code,omitempty"`
+	Result         string             `json:"result,omitempty"`
+	CreatedAt      string             `json:"created_at"`
+	CompletedAt    string             `json:"completed_at,omitempty"`
+}
+
+// Add a send to the outbox. A send with an idempotency key already in the outbox is not added
+// again; the existing one is returned with added false.
+func (store *MessageStore) EnqueueSend(send QueuedSend) (QueuedSend, bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	request, err := json.Marshal(send.Request)
+	if err != nil {
+		return send, false, err
+	}
+	now := time.Now().UTC()
+	result, err := store.writer.ExecContext(ctx,
+		`INSERT INTO outbox (id, idempotency_key, request, status, attempts, next_attempt_at, created_at)
+		VALUES (?, NULLIF(?, ''), ?, ?, 0, ?, ?)
+		ON CONFLICT(idempotency_key) DO NOTHING`,
+		send.ID, send.IdempotencyKey, string(request), outboxQueued, now, now,
+	)
+	if err != nil {
+		return send, false, err
+	}
+	if added, err := result.RowsAffected(); err != nil || added > 0 {
+		send.Status, send.CreatedAt = outboxQueued, now.Format(time.RFC3339)
+		send.NextAttemptAt = send.CreatedAt
+		return send, added > 0, err
+	}
+	existing, err := scanQueuedSend(store.writer.QueryRowContext(ctx,
+		"SELECT "+queuedSendColumns+" FROM outbox WHERE idempotency_key = ?", send.IdempotencyKey,
+	))
+	return existing, false, err
+}
+
+const queuedSendColumns = "id, idempotency_key, request, status, attempts, next_attempt_at, error_code, result, created_at, completed_at"
+
+// Claim the oldest outbox send that is due, marking it as being sent; found is false when none is due
+func (store *MessageStore) ClaimDueSend() (send QueuedSend, found bool, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	send, err = scanQueuedSend(store.writer.QueryRowContext(ctx,
+		`UPDATE outbox SET status = ?, attempts = attempts + 1
+		WHERE id = (SELECT id FROM outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY created_at LIMIT 1)
+		RETURNING `+queuedSendColumns,
+		outboxSending, outboxQueued, time.Now().UTC(),
+	))
+	if err == sql.ErrNoRows {
+		return send, false, nil
+	}
+	return send, err == nil, err
+}
+
+// Record an attempt's outcome: back to queued until nextAttempt, or finished as sent or failed
+func (store *MessageStore) SetQueuedSendResult(id, status, errorCode, result string, nextAttempt time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var next, completed interface{}
+	if status == outboxQueued {
+		next = nextAttempt.UTC()
+	} else {
+		completed = time.Now().UTC()
+	}
+	_, err := store.writer.ExecContext(ctx,
+		`UPDATE outbox SET status = ?, error_code = NULLIF(?, ''), result = ?,
+			next_attempt_at = COALESCE(?, next_attempt_at), completed_at = ?
+		WHERE id = ?`,
+		status, errorCode, result, next, completed, id,
+	)
+	return err
+}
+
+// Put sends interrupted mid-attempt by a shutdown back in the queue. Whether WhatsApp got them
+// is unknown, so they may be delivered twice.
+func (store *MessageStore) RequeueInterruptedSends() (int64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx, "UPDATE outbox SET status = ? WHERE status = ?", outboxQueued, outboxSending)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Get outbox sends, newest first (status "" = all)
+func (store *MessageStore) GetQueuedSends(status string, limit int) ([]QueuedSend, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT " + queuedSendColumns + " FROM outbox"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sends := []QueuedSend{}
+	for rows.Next() {
+		send, err := scanQueuedSend(rows)
+		if err != nil {
+			return nil, err
+		}
+		sends = append(sends, send)
+	}
+	return sends, rows.Err()
+}
+
+// Get one outbox send by ID or idempotency key
+func (store *MessageStore) GetQueuedSend(id, idempotencyKey string) (QueuedSend, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query, arg := "SELECT "+queuedSendColumns+" FROM outbox WHERE id = ?", id
+	if id == "" {
+		query, arg = "SELECT "+queuedSendColumns+" FROM outbox WHERE idempotency_key = ?", idempotencyKey
+	}
+	return scanQueuedSend(store.db.QueryRowContext(ctx, query, arg))
+}
+
+func scanQueuedSend(row interface{ Scan(...interface{}) error }) (QueuedSend, error) {
+	var send QueuedSend
+	var request string
+	var idempotencyKey, errorCode, result sql.NullString
+	var createdAt time.Time
+	var nextAttemptAt, completedAt sql.NullTime
+	if err := row.Scan(&send.ID, &idempotencyKey, &request, &send.Status, &send.Attempts, &nextAttemptAt,
+		&errorCode, &result, &createdAt, &completedAt); err != nil {
+		return send, err
+	}
+	if err := json.Unmarshal([]byte(request), &send.Request); err != nil {
+		return send, err
+	}
+	send.IdempotencyKey, send.ErrorCode, send.Result = idempotencyKey.String, errorCode.String, result.String
+	send.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	if nextAttemptAt.Valid && send.Status == outboxQueued {
+		send.NextAttemptAt = nextAttemptAt.Time.UTC().Format(time.RFC3339)
+	}
+	if completedAt.Valid {
+		send.CompletedAt = completedAt.Time.UTC().Format(time.RFC3339)
+	}
+	return send, nil
+}
+
+// startOutbox delivers queued sends in order. Nothing is attempted while disconnected or
+// draining; retryable failures go back in the queue with exponential backoff and the rest
+// fail at once. Finished sends are announced as outbox_sent / outbox_failed events.
+func startOutbox(client *whatsmeow.Client, messageStore *MessageStore, stopChan <-chan struct{}) {
+	if requeued, err := messageStore.RequeueInterruptedSends(); err != nil {
+		fmt.Printf("Warning: failed to requeue interrupted outbox sends: %v\n", err)
+	} else if requeued > 0 {
+		fmt.Printf("📤 Requeued %d outbox sends interrupted by the last shutdown\n", requeued)
+	}
+
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for client.IsConnected() && client.IsLoggedIn() && attemptQueuedSend(client, messageStore) {
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// attemptQueuedSend makes one attempt at the next due outbox send; false when there was none
+// to attempt
+func attemptQueuedSend(client *whatsmeow.Client, messageStore *MessageStore) bool {
+	if !drainState.beginSend() {
+		return false
+	}
+	send, found, err := messageStore.ClaimDueSend()
+	if err != nil || !found {
+		drainState.endSend()
+		if err != nil {
+			fmt.Printf("Warning: failed to load due outbox sends: %v\n", err)
+		}
+		return false
+	}
+	success, result := dispatchSendRequest(context.Background(), client, messageStore, send.Request)
+	drainState.endSend()
+
+	status, code, next := outboxSent, "", time.Time{}
+	if !success {
+		code = classifySendFailure(result)
+		status = outboxFailed
+		if retryableSendErrors[code] && send.Attempts < outboxRetry.MaxAttempts {
+			status, next = outboxQueued, time.Now().Add(outboxRetry.Backoff(send.Attempts))
+			fmt.Printf("📤 Outbox send %s to %s failed (%s), attempt %d/%d: %s\n",
+				send.ID, send.Request.Recipient, code, send.Attempts, outboxRetry.MaxAttempts, result)
+		}
+	}
+	if err := messageStore.SetQueuedSendResult(send.ID, status, code, result, next); err != nil {
+		fmt.Printf("Warning: failed to record outbox send %s result: %v\n", send.ID, err)
+		return true
+	}
+	if status != outboxQueued {
+		send.Status, send.ErrorCode, send.Result = status, code, result
+		send.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+		fmt.Printf("📤 Outbox send %s to %s %s after %d attempts\n", send.ID, send.Request.Recipient, status, send.Attempts)
+		go dispatchEventWebhooks(messageStore, "outbox_"+status, send)
+	}
+	return true
+}
+
+// Maximum length of a chat tag
+const maxChatTagLength = 64
+
+// ChatMetadata is the local annotation (tags and notes) attached to a chat
+type ChatMetadata struct {
+	ChatJID  string   `json:"chat_jid"`
+	Name     string   `json:"name,omitempty"`
+	ChatType string   `json:"chat_type,omitempty"`
+	Tags     []string `json:"tags"`
+	Notes    string   `json:"notes,omitempty"`
+}
+
+// normalizeChatTags trims and de-duplicates tags (case-insensitively), rejecting invalid ones
+func normalizeChatTags(tags []string) ([]string, error) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if len(tag) > maxChatTagLength || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("invalid tag %q (at most %d characters, no commas)", tag, maxChatTagLength)
+		}
+		if !slices.ContainsFunc(normalized, func(existing string) bool { return strings.EqualFold(existing, tag) }) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// Update a chat's tags: replace them all when replace is non-nil, then apply add and remove
+func (store *MessageStore) UpdateChatTags(jid string, replace *[]string, add, remove []string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replace != nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chat_tags WHERE chat_jid = ?", jid); err != nil {
+			return err
+		}
+		add = append(*replace, add...)
+	}
+	now := time.Now().UTC()
+	for _, tag := range add {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO chat_tags (chat_jid, tag, created_at) VALUES (?, ?, ?)", jid, tag, now); err != nil {
+			return err
+		}
+	}
+	for _, tag := range remove {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chat_tags WHERE chat_jid = ? AND tag = ?", jid, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Set a chat's notes (empty clears them)
+func (store *MessageStore) SetChatNotes(jid, notes string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, notes) VALUES (?, NULLIF(?, ''))
+		ON CONFLICT(jid) DO UPDATE SET notes = excluded.notes`,
+		jid, notes,
+	)
+	return err
+}
+
+// Get the tags attached to each of the given chats
+func (store *MessageStore) GetChatTagsFor(jids []string) (map[string][]string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tags := make(map[string][]string)
+	if len(jids) == 0 {
+		return tags, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(jids)), ",")
+	args := make([]interface{}, len(jids))
+	for i, jid := range jids {
+		args[i] = jid
+	}
+	rows, err := store.db.QueryContext(ctx,
+		"SELECT chat_jid, tag FROM chat_tags WHERE chat_jid IN ("+placeholders+") ORDER BY created_at, tag",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jid, tag string
+		if err := rows.Scan(&jid, &tag); err != nil {
+			return nil, err
+		}
+		tags[jid] = append(tags[jid], tag)
+	}
+	return tags, rows.Err()
+}
+
+// Get a chat's tags and notes
+func (store *MessageStore) GetChatMetadata(jid string) (ChatMetadata, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	metadata := ChatMetadata{ChatJID: jid, Tags: []string{}}
+	var name, chatType, notes sql.NullString
+	err := store.db.QueryRowContext(ctx, "SELECT name, chat_type, notes FROM chats WHERE jid = ?", jid).Scan(&name, &chatType, &notes)
+	if err != nil && err != sql.ErrNoRows {
+		return metadata, err
+	}
+	metadata.Name, metadata.ChatType, metadata.Notes = name.String, chatType.String, notes.String
+
+	tags, err := store.GetChatTagsFor([]string{jid})
+	if err != nil {
+		return metadata, err
+	}
+	if len(tags[jid]) > 0 {
+		metadata.Tags = tags[jid]
+	}
+	return metadata, nil
+}
+
+// List chats carrying tags or notes, optionally only those with any of the given tags
+func (store *MessageStore) GetAnnotatedChats(tags []string) ([]ChatMetadata, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := `SELECT c.jid, c.name, c.chat_type, c.notes FROM chats c
+		WHERE (c.notes IS NOT NULL OR EXISTS (SELECT 1 FROM chat_tags t WHERE t.chat_jid = c.jid))`
+	var args []interface{}
+	if len(tags) > 0 {
+		query += " AND EXISTS (SELECT 1 FROM chat_tags t WHERE t.chat_jid = c.jid AND t.tag IN (" +
+			strings.TrimSuffix(strings.Repeat("?,", len(tags)), ",") + "))"
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+	}
+	query += " ORDER BY c.last_message_time DESC"
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	chats := []ChatMetadata{}
+	var jids []string
+	for rows.Next() {
+		var jid string
+		var name, chatType, notes sql.NullString
+		if err := rows.Scan(&jid, &name, &chatType, &notes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		chats = append(chats, ChatMetadata{ChatJID: jid, Name: name.String, ChatType: chatType.String, Notes: notes.String, Tags: []string{}})
+		jids = append(jids, jid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Attach tags with one query rather than one per chat
+	tagsByChat, err := store.GetChatTagsFor(jids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chats {
+		if chatTags := tagsByChat[chats[i].ChatJID]; len(chatTags) > 0 {
+			chats[i].Tags = chatTags
+		}
+	}
+	return chats, nil
+}
+
+// Conversation handoff states; chats without one are handled by the bot
+const (
+	handoffStateBot    = "bot"
+	handoffStateHuman  = "human"
+	handoffStateClosed = "closed"
+)
+
+var handoffStates = []string{handoffStateBot, handoffStateHuman, handoffStateClosed}
+
+// ChatAssignment is who currently owns a conversation
+type ChatAssignment struct {
+	ChatJID   string `json:"chat_jid"`
+	State     string `json:"state"`
+	Assignee  string `json:"assignee,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+// Set a chat's handoff state and assignee
+func (store *MessageStore) SetChatAssignment(jid, state, assignee string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, handoff_state, assignee, handoff_updated_at) VALUES (?, ?, NULLIF(?, ''), ?)
+		ON CONFLICT(jid) DO UPDATE SET handoff_state = excluded.handoff_state, assignee = excluded.assignee,
+			handoff_updated_at = excluded.handoff_updated_at`,
+		jid, state, assignee, time.Now().UTC(),
+	)
+	return err
+}
+
+// Get a chat's handoff state and assignee
+func (store *MessageStore) GetChatAssignment(jid string) (ChatAssignment, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	assignment := ChatAssignment{ChatJID: jid, State: handoffStateBot}
+	var state, assignee sql.NullString
+	var updatedAt sql.NullTime
+	err := store.db.QueryRowContext(ctx, "SELECT handoff_state, assignee, handoff_updated_at FROM chats WHERE jid = ?", jid).
+		Scan(&state, &assignee, &updatedAt)
+	if err == sql.ErrNoRows {
+		return assignment, nil
+	}
+	if err != nil {
+		return assignment, err
+	}
+	if state.String != "" {
+		assignment.State = state.String
+	}
+	assignment.Assignee = assignee.String
+	if updatedAt.Valid {
+		assignment.UpdatedAt = updatedAt.Time.UTC().Format(time.RFC3339)
+	}
+	return assignment, nil
+}
+
+// Set a chat's pinned state
+func (store *MessageStore) SetChatPinned(jid string, pinned bool) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, is_pinned) VALUES (?, ?)
+		ON CONFLICT(jid) DO UPDATE SET is_pinned = excluded.is_pinned`,
+		jid, pinned,
+	)
+	return err
+}
+
+// Set a chat's archived state
+func (store *MessageStore) SetChatArchived(jid string, archived bool) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, is_archived) VALUES (?, ?)
+		ON CONFLICT(jid) DO UPDATE SET is_archived = excluded.is_archived`,
+		jid, archived,
+	)
+	return err
+}
+
+// Rename an existing chat (contact edits on the phone)
+func (store *MessageStore) UpdateChatName(jid, name string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "UPDATE chats SET name = ? WHERE jid = ?", name, jid)
+	return err
+}
+
+// Mirror app-state changes made on the phone (mute, pin, archive, contact edits) into chat metadata
+func handleAppStateChange(client *whatsmeow.Client, messageStore *MessageStore, evt interface{}, logger waLog.Logger) {
+	var err error
+	switch v := evt.(type) {
+	case *events.Mute:
+		jid := resolveCanonicalJID(client, v.JID, types.EmptyJID, logger).String()
+		var until *time.Time
+		if end := v.Action.GetMuteEndTimestamp(); end > 0 {
+			t := time.UnixMilli(end)
+			until = &t
+		}
+		err = messageStore.SetChatMuted(jid, v.Action.GetMuted(), until)
+		logger.Infof("App state: %s muted=%v", jid, v.Action.GetMuted())
+	case *events.Pin:
+		jid := resolveCanonicalJID(client, v.JID, types.EmptyJID, logger).String()
+		err = messageStore.SetChatPinned(jid, v.Action.GetPinned())
+		logger.Infof("App state: %s pinned=%v", jid, v.Action.GetPinned())
+	case *events.Archive:
+		jid := resolveCanonicalJID(client, v.JID, types.EmptyJID, logger).String()
+		err = messageStore.SetChatArchived(jid, v.Action.GetArchived())
+		logger.Infof("App state: %s archived=%v", jid, v.Action.GetArchived())
+	case *events.Contact:
+		// whatsmeow updates its own contact store; keep the chat name in step
+		name := v.Action.GetFullName()
+		if name == "" {
+			name = v.Action.GetFirstName()
+		}
+		if name == "" {
+			return
+		}
+		jid := resolveCanonicalJID(client, v.JID, types.EmptyJID, logger).String()
+		err = messageStore.UpdateChatName(jid, name)
+		logger.Infof("App state: contact %s renamed to %s", jid, redactLogContent(name))
+	}
+	if err != nil {
+		logger.Warnf("Failed to apply app state change: %v", err)
+	}
+}
+
+// StoredEvent is an entry in the durable event log (GET /api/events)
+type StoredEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt string          `json:"created_at"`
+}
+
+// Append an event to the log, returning its ID
+func (store *MessageStore) RecordEvent(eventType string, payload interface{}) (int64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	result, err := store.writer.ExecContext(ctx,
+		"INSERT INTO events (type, payload, created_at) VALUES (?, ?, ?)",
+		eventType, string(data), time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Get the payload of a recorded event
+func (store *MessageStore) GetEventPayload(id int64) (string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var payload string
+	err := store.db.QueryRowContext(ctx, "SELECT payload FROM events WHERE id = ?", id).Scan(&payload)
+	return payload, err
+}
+
+// Get one event from the log
+func (store *MessageStore) GetStoredEvent(id int64) (StoredEvent, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var event StoredEvent
+	var payload string
+	var createdAt time.Time
+	err := store.db.QueryRowContext(ctx, "SELECT id, type, payload, created_at FROM events WHERE id = ?", id).
+		Scan(&event.ID, &event.Type, &payload, &createdAt)
+	if err != nil {
+		return event, err
+	}
+	event.Payload = json.RawMessage(payload)
+	event.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return event, nil
+}
+
+// Get events after a cursor, optionally filtered by type
+func (store *MessageStore) GetEvents(afterID int64, eventTypes []string, limit int) ([]StoredEvent, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT id, type, payload, created_at FROM events WHERE id > ?"
+	args := []interface{}{afterID}
+	if len(eventTypes) > 0 {
+		query += " AND type IN (?" + strings.Repeat(", ?", len(eventTypes)-1) + ")"
+		for _, t := range eventTypes {
+			args = append(args, t)
+		}
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedEvents := []StoredEvent{}
+	for rows.Next() {
+		var evt StoredEvent
+		var payload string
+		var createdAt time.Time
+		if err := rows.Scan(&evt.ID, &evt.Type, &payload, &createdAt); err != nil {
+			return nil, err
+		}
+		evt.Payload = json.RawMessage(payload)
+		evt.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		storedEvents = append(storedEvents, evt)
+	}
+	return storedEvents, rows.Err()
+}
+
+// Delete events older than the cutoff
+func (store *MessageStore) PruneEvents(before time.Time) (int64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx, "DELETE FROM events WHERE created_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Prune the event log hourly, keeping MCP_EVENT_RETENTION_HOURS (default 7 days)
+func (store *MessageStore) StartEventPruner(stopChan <-chan struct{}) {
+	retention := time.Duration(getEnvInt("MCP_EVENT_RETENTION_HOURS", 7*24)) * time.Hour
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := store.PruneEvents(time.Now().Add(-retention))
+				if err != nil {
+					fmt.Printf("Warning: Failed to prune events: %v\n", err)
+				} else if removed > 0 {
+					fmt.Printf("🧹 Pruned %d events older than %v\n", removed, retention)
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// recordEvent appends to the event log, logging (not returning) failures so callers stay simple
+func recordEvent(messageStore *MessageStore, eventType string, payload interface{}) int64 {
+	id, err := messageStore.RecordEvent(eventType, payload)
+	if err != nil {
+		fmt.Printf("Warning: failed to record %s event: %v\n", eventType, err)
+	}
+	return id
+}
+
+// Outgoing message statuses, in the order they are reached. A message we sent without
+// receipts yet is "sent"; receipts only ever move a recipient forward.
+var receiptStatuses = []string{"sent", "delivered", "read", "played"}
+
+// receiptRank orders a status column (or ? placeholder) by receiptStatuses in SQL
+func receiptRank(expr string) string {
+	return "CASE " + expr + " WHEN 'delivered' THEN 2 WHEN 'read' THEN 3 WHEN 'played' THEN 4 ELSE 1 END"
+}
+
+// MessageReceipt is how far one recipient got with one of our messages
+type MessageReceipt struct {
+	Recipient string `json:"recipient"`
+	Status    string `json:"status"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Record a receipt from a recipient (a group participant, or the peer of a DM) for our messages.
+// messages.delivery_status keeps the furthest status any recipient reached.
+func (store *MessageStore) StoreReceipts(chatJID, recipient string, messageIDs []types.MessageID, status string, at time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range messageIDs {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO message_receipts (message_id, chat_jid, recipient, status, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(message_id, chat_jid, recipient) DO UPDATE SET
+				status = excluded.status,
+				updated_at = excluded.updated_at
+			WHERE `+receiptRank("excluded.status")+` > `+receiptRank("message_receipts.status"),
+			id, chatJID, recipient, status, at.UTC(),
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE messages SET delivery_status = ? WHERE id = ? AND chat_jid = ? AND is_from_me = 1 AND "+
+				receiptRank("?")+" > "+receiptRank("delivery_status"),
+			status, id, chatJID, status,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get the status of one of our messages and the receipts behind it; found is false if
+// the message isn't stored as ours
+func (store *MessageStore) GetMessageStatus(messageID, chatJID string) (status string, receipts []MessageReceipt, found bool, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var deliveryStatus sql.NullString
+	err = store.db.QueryRowContext(ctx,
+		"SELECT delivery_status FROM messages WHERE id = ? AND chat_jid = ? AND is_from_me = 1", messageID, chatJID,
+	).Scan(&deliveryStatus)
+	if err == sql.ErrNoRows {
+		return "", nil, false, nil
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	status = receiptStatuses[0]
+	if deliveryStatus.Valid {
+		status = deliveryStatus.String
+	}
+
+	rows, err := store.db.QueryContext(ctx,
+		"SELECT recipient, status, updated_at FROM message_receipts WHERE message_id = ? AND chat_jid = ? ORDER BY updated_at",
+		messageID, chatJID,
+	)
+	if err != nil {
+		return "", nil, false, err
+	}
+	defer rows.Close()
+
+	receipts = []MessageReceipt{}
+	for rows.Next() {
+		var receipt MessageReceipt
+		var updatedAt time.Time
+		if err := rows.Scan(&receipt.Recipient, &receipt.Status, &updatedAt); err != nil {
+			return "", nil, false, err
+		}
+		receipt.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+		receipts = append(receipts, receipt)
+	}
+	return status, receipts, true, rows.Err()
+}
+
+// MemberSnapshot is a group's participant list as it was when we sent a message to it
+type MemberSnapshot struct {
+	MessageID        string                 `json:"message_id"`
+	ChatJID          string                 `json:"chat_jid"`
+	ParticipantCount int                    `json:"participant_count"`
+	Participants     []GroupParticipantInfo `json:"participants"`
+	CapturedAt       string                 `json:"captured_at"`
+}
+
+// Record the members of a group one of our messages was sent to
+func (store *MessageStore) StoreMemberSnapshot(messageID, chatJID string, participants []GroupParticipantInfo, at time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	data, err := json.Marshal(participants)
+	if err != nil {
+		return err
+	}
+	_, err = store.writer.ExecContext(ctx,
+		`INSERT OR REPLACE INTO message_member_snapshots (message_id, chat_jid, participants, participant_count, captured_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		messageID, chatJID, string(data), len(participants), at.UTC(),
+	)
+	return err
+}
+
+// Get the member snapshot taken when a message was sent; found is false if there is none
+func (store *MessageStore) GetMemberSnapshot(messageID, chatJID string) (snapshot MemberSnapshot, found bool, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var participants string
+	var capturedAt time.Time
+	err = store.db.QueryRowContext(ctx,
+		"SELECT participants, participant_count, captured_at FROM message_member_snapshots WHERE message_id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&participants, &snapshot.ParticipantCount, &capturedAt)
+	if err == sql.ErrNoRows {
+		return snapshot, false, nil
+	}
+	if err != nil {
+		return snapshot, false, err
+	}
+	if err := json.Unmarshal([]byte(participants), &snapshot.Participants); err != nil {
+		return snapshot, false, err
+	}
+	snapshot.MessageID, snapshot.ChatJID = messageID, chatJID
+	snapshot.CapturedAt = capturedAt.UTC().Format(time.RFC3339)
+	return snapshot, true, nil
+}
+
+// Record delivery/read receipts
+func handleReceipt(client *whatsmeow.Client, messageStore *MessageStore, evt *events.Receipt, logger waLog.Logger) {
+	if evt.IsFromMe {
+		noteOwnDeviceActivity(client, messageStore, evt.Sender, "", evt.Timestamp, logger)
+	}
+	receiptType := string(evt.Type)
+	if evt.Type == types.ReceiptTypeDelivered {
+		receiptType = "delivered"
+	}
+	if !evt.IsFromMe {
+		switch evt.Type {
+		case types.ReceiptTypeDelivered, types.ReceiptTypeRead, types.ReceiptTypePlayed:
+			read := evt.Type != types.ReceiptTypeDelivered
+			if err := messageStore.MarkCampaignReceipt(evt.MessageIDs, read, evt.Timestamp); err != nil {
+				logger.Warnf("Failed to record campaign receipt: %v", err)
+			}
+		}
+	}
+	chatJID := resolveCanonicalJID(client, evt.Chat, types.EmptyJID, logger).String()
+	sender := resolveCanonicalJID(client, evt.Sender, types.EmptyJID, logger).User
+	if !evt.IsFromMe && slices.Contains(receiptStatuses, receiptType) {
+		if err := messageStore.StoreReceipts(chatJID, sender, evt.MessageIDs, receiptType, evt.Timestamp); err != nil {
+			logger.Warnf("Failed to record receipt: %v", err)
+		}
+	}
+	recordEvent(messageStore, "receipt", map[string]interface{}{
+		"type":        receiptType,
+		"chat_jid":    chatJID,
+		"sender":      sender,
+		"is_from_me":  evt.IsFromMe,
+		"message_ids": evt.MessageIDs,
+		"timestamp":   evt.Timestamp.UTC().Format(time.RFC3339),
+	})
+}
+
+// CompanionDevice is a device linked to this account
+type CompanionDevice struct {
+	JID          string `json:"jid"`
+	DeviceID     uint16 `json:"device_id"`
+	IsPrimary    bool   `json:"is_primary"`     // Device 0 is the phone
+	IsThisDevice bool   `json:"is_this_device"` // This MCP instance
+	IsHosted     bool   `json:"is_hosted,omitempty"`
+	Platform     string `json:"platform"`            // Inferred from message IDs the device sent (see platformFromMessageID)
+	LastSeen     string `json:"last_seen,omitempty"` // Last message or receipt seen from the device
+}
+
+// platformFromMessageID infers the sending client from a message ID's shape
+func platformFromMessageID(id string) string {
+	switch {
+	case strings.HasPrefix(id, whatsmeow.WebMessageIDPrefix) || (strings.HasPrefix(id, "3E") && len(id) == 22):
+		return "web"
+	case strings.HasPrefix(id, "3A") && len(id) == 20:
+		return "ios"
+	case len(id) == 21 || len(id) == 32:
+		return "android"
+	case strings.HasPrefix(id, "3F") || len(id) == 18:
+		return "desktop"
+	}
+	return "unknown"
+}
+
+// Record activity from one of our own devices
+func (store *MessageStore) StoreDeviceActivity(deviceID uint16, platform string, seen time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO companion_devices (device_id, platform, last_seen) VALUES (?, ?, ?)
+		ON CONFLICT(device_id) DO UPDATE SET
+			platform = CASE WHEN excluded.platform = 'unknown' THEN companion_devices.platform ELSE excluded.platform END,
+			last_seen = MAX(COALESCE(companion_devices.last_seen, ''), excluded.last_seen)`,
+		deviceID, platform, seen.UTC(),
+	)
+	return err
+}
+
+// Get recorded activity for our own devices, keyed by device ID
+func (store *MessageStore) GetDeviceActivity() (map[uint16]CompanionDevice, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT device_id, platform, last_seen FROM companion_devices")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activity := make(map[uint16]CompanionDevice)
+	for rows.Next() {
+		var device CompanionDevice
+		var lastSeen time.Time
+		if err := rows.Scan(&device.DeviceID, &device.Platform, &lastSeen); err != nil {
+			return nil, err
+		}
+		device.LastSeen = lastSeen.UTC().Format(time.RFC3339)
+		activity[device.DeviceID] = device
+	}
+	return activity, rows.Err()
+}
+
+// noteOwnDeviceActivity records that another device of this account sent something
+func noteOwnDeviceActivity(client *whatsmeow.Client, messageStore *MessageStore, sender types.JID, messageID string, seen time.Time, logger waLog.Logger) {
+	if client.Store.ID == nil || sender.Device == client.Store.ID.Device {
+		return
+	}
+	if sender.User != client.Store.ID.User && sender.User != client.Store.GetLID().User {
+		return
+	}
+	platform := "unknown"
+	if messageID != "" {
+		platform = platformFromMessageID(messageID)
+	}
+	if err := messageStore.StoreDeviceActivity(sender.Device, platform, seen); err != nil {
+		logger.Warnf("Failed to record activity for device %d: %v", sender.Device, err)
+	}
+}
+
+// listCompanionDevices returns the devices linked to this account, merged with the activity seen from them
+func listCompanionDevices(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore) ([]CompanionDevice, error) {
+	if client.Store.ID == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+	own := client.Store.ID.ToNonAD()
+	jids, err := client.GetUserDevicesContext(ctx, []types.JID{own})
+	if err != nil {
+		return nil, err
+	}
+	activity, err := messageStore.GetDeviceActivity()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]CompanionDevice, 0, len(jids))
+	for _, jid := range jids {
+		device := CompanionDevice{
+			JID:          jid.String(),
+			DeviceID:     jid.Device,
+			IsPrimary:    jid.Device == 0,
+			IsThisDevice: jid.Device == client.Store.ID.Device,
+			IsHosted:     jid.Server == types.HostedServer || jid.Server == types.HostedLIDServer,
+			Platform:     "unknown",
+		}
+		if seen, ok := activity[jid.Device]; ok {
+			device.Platform = seen.Platform
+			device.LastSeen = seen.LastSeen
+		}
+		if device.IsThisDevice {
+			device.Platform = store.DeviceProps.GetOs()
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return devices, nil
+}
+
+// connectionEventState maps connection lifecycle events to a state name for the event log
+func connectionEventState(evt interface{}) (string, map[string]interface{}) {
+	switch v := evt.(type) {
+	case *events.Connected:
+		return "connected", nil
+	case *events.Disconnected:
+		return "disconnected", nil
+	case *events.LoggedOut:
+		return "logged_out", map[string]interface{}{"on_connect": v.OnConnect, "reason": v.Reason.String()}
+	case *events.StreamReplaced:
+		return "stream_replaced", nil
+	case *events.StreamError:
+		return "stream_error", map[string]interface{}{"code": v.Code}
+	case *events.TemporaryBan:
+		return "temporary_ban", map[string]interface{}{"code": v.Code.String(), "expire_sec": int64(v.Expire.Seconds())}
+	case *events.ClientOutdated:
+		return "client_outdated", nil
+	}
+	return "", nil
+}
+
+// Profile picture cache lifetime (picture URLs from WhatsApp expire, so entries are refetched)
+const avatarCacheTTL = 24 * time.Hour
+
+// Avatar statuses
+const (
+	avatarStatusSet    = "set"
+	avatarStatusNotSet = "not_set"
+	avatarStatusHidden = "hidden" // Privacy settings hide the picture from us
+)
+
+// Avatar is a cached profile picture lookup
+type Avatar struct {
+	JID       string `json:"jid"`
+	PictureID string `json:"picture_id,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Status    string `json:"status"`
+	FetchedAt string `json:"fetched_at"`
+	fetchedAt time.Time
+}
+
+// Get a cached avatar (nil when not cached)
+func (store *MessageStore) GetAvatar(jid string) (*Avatar, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	avatar := Avatar{JID: jid}
+	var pictureID, url sql.NullString
+	err := store.db.QueryRowContext(ctx,
+		"SELECT picture_id, url, status, fetched_at FROM avatars WHERE jid = ?",
+		jid,
+	).Scan(&pictureID, &url, &avatar.Status, &avatar.fetchedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	avatar.PictureID = pictureID.String
+	avatar.URL = url.String
+	avatar.FetchedAt = avatar.fetchedAt.UTC().Format(time.RFC3339)
+	return &avatar, nil
+}
+
+// Store an avatar lookup
+func (store *MessageStore) StoreAvatar(avatar *Avatar) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"INSERT OR REPLACE INTO avatars (jid, picture_id, url, status, fetched_at) VALUES (?, ?, ?, ?, ?)",
+		avatar.JID, avatar.PictureID, avatar.URL, avatar.Status, avatar.fetchedAt.UTC(),
+	)
+	return err
+}
+
+// Drop a cached avatar
+func (store *MessageStore) DeleteAvatar(jid string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "DELETE FROM avatars WHERE jid = ?", jid)
+	return err
+}
+
+// getAvatar returns the cached profile picture for a JID, fetching it from WhatsApp when
+// missing, stale, or when refresh is set
+func getAvatar(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, refresh bool) (*Avatar, error) {
+	if !refresh {
+		cached, err := messageStore.GetAvatar(jid.String())
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil && time.Since(cached.fetchedAt) < avatarCacheTTL {
+			return cached, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	avatar := &Avatar{JID: jid.String(), fetchedAt: time.Now()}
+	info, err := client.GetProfilePictureInfo(ctx, jid, &whatsmeow.GetProfilePictureParams{})
+	switch {
+	case errors.Is(err, whatsmeow.ErrProfilePictureNotSet):
+		avatar.Status = avatarStatusNotSet
+	case errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized):
+		avatar.Status = avatarStatusHidden
+	case err != nil:
+		return nil, err
+	case info == nil:
+		avatar.Status = avatarStatusNotSet
+	default:
+		avatar.Status = avatarStatusSet
+		avatar.PictureID = info.ID
+		avatar.URL = info.URL
+	}
+	avatar.FetchedAt = avatar.fetchedAt.UTC().Format(time.RFC3339)
+
+	if err := messageStore.StoreAvatar(avatar); err != nil {
+		fmt.Printf("Warning: failed to cache avatar for %s: %v\n", jid, err)
+	}
+	return avatar, nil
+}
+
+// Handle profile picture changes: invalidate the cache, refetch, and notify webhooks
+func handlePictureEvent(client *whatsmeow.Client, messageStore *MessageStore, evt *events.Picture, logger waLog.Logger) {
+	jid := resolveCanonicalJID(client, evt.JID, types.EmptyJID, logger)
+	if err := messageStore.DeleteAvatar(jid.String()); err != nil {
+		logger.Warnf("Failed to invalidate avatar for %s: %v", jid, err)
+	}
+
+	author := resolveCanonicalJID(client, evt.Author, types.EmptyJID, logger)
+	fmt.Printf("🖼️ Picture %s for %s (removed=%v)\n", evt.PictureID, jid, evt.Remove)
+
+	// Refresh off the event loop so other events aren't held up by the lookup
+	go func() {
+		payload := map[string]interface{}{
+			"jid":        jid.String(),
+			"author":     author.String(),
+			"picture_id": evt.PictureID,
+			"removed":    evt.Remove,
+			"timestamp":  evt.Timestamp.UTC().Format(time.RFC3339),
+		}
+		if !evt.Remove {
+			if avatar, err := getAvatar(client, messageStore, jid, true); err != nil {
+				logger.Warnf("Failed to refresh avatar for %s: %v", jid, err)
+			} else {
+				payload["url"] = avatar.URL
+			}
+		}
+		dispatchEventWebhooks(messageStore, "picture", payload)
+	}()
+}
+
+// isOwnJID reports whether jid is this account, by phone number or LID
+func isOwnJID(client *whatsmeow.Client, jid types.JID) bool {
+	if client.Store.ID == nil || jid.User == "" {
+		return false
+	}
+	return jid.User == client.Store.ID.User || jid.User == client.Store.GetLID().User
+}
+
+// handleGroupMembership emits group_joined, group_left, group_promoted and group_demoted
+// webhook events when our own membership of a group changes
+func handleGroupMembership(client *whatsmeow.Client, messageStore *MessageStore, evt interface{}, logger waLog.Logger) {
+	var group types.JID
+	var groupInfo *types.GroupInfo
+	var actor, actorPN *types.JID
+	var when time.Time
+	var changes []string
+	bySelf := false
+	base := map[string]interface{}{}
+	ownChange := func(jids []types.JID) bool {
+		return slices.ContainsFunc(jids, func(jid types.JID) bool { return isOwnJID(client, jid) })
+	}
+
+	switch v := evt.(type) {
+	case *events.JoinedGroup:
+		group, actor, actorPN = v.JID, v.Sender, v.SenderPN
+		groupInfo = &v.GroupInfo
+		changes = append(changes, "group_joined")
+		base["reason"] = v.Reason // "invite" when we joined through a link
+		base["type"] = v.Type     // "new" when the group was just created
+		base["name"] = v.Name
+		base["participants"] = len(v.Participants)
+		base["is_community"] = v.IsParent
+		when = time.Now()
+		bySelf = v.Reason == "invite"
+
+	case *events.GroupInfo:
+		group, actor, actorPN = v.JID, v.Sender, v.SenderPN
+		if ownChange(v.Join) {
+			changes = append(changes, "group_joined")
+			base["reason"] = v.JoinReason
+		}
+		if ownChange(v.Leave) {
+			changes = append(changes, "group_left")
+		}
+		if ownChange(v.Promote) {
+			changes = append(changes, "group_promoted")
+		}
+		if ownChange(v.Demote) {
+			changes = append(changes, "group_demoted")
+		}
+		when = v.Timestamp
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	base["group_jid"] = group.String()
+	base["timestamp"] = when.UTC().Format(time.RFC3339)
+	if actor != nil {
+		var alt types.JID
+		if actorPN != nil {
+			alt = *actorPN
+		}
+		actorJID := resolveCanonicalJID(client, *actor, alt, logger)
+		bySelf = bySelf || isOwnJID(client, actorJID)
+		base["actor"] = actorJID.String()
+	}
+	base["by_self"] = bySelf
+	for _, event := range changes {
+		payload := maps.Clone(base)
+		if event == "group_left" {
+			// Leaving on our own vs. being removed by an admin
+			payload["removed"] = actor != nil && !isOwnJID(client, *actor)
+		}
+		fmt.Printf("👥 %s: %s\n", event, group)
+		go dispatchEventWebhooks(messageStore, event, payload)
+
+		// Introduce ourselves when someone else added us (not for groups we created or joined ourselves)
+		if event == "group_joined" && !bySelf && time.Since(when) < welcomeMaxAge {
+			maybeSendGroupIntro(client, messageStore, group, groupInfo, logger)
+		}
+	}
+}
+
+// BroadcastList is a broadcast list owned by this account. whatsmeow can't fetch list
+// definitions, so lists are learned from history sync and from our own list sends.
+type BroadcastList struct {
+	JID        string   `json:"jid"`
+	Name       string   `json:"name,omitempty"`
+	Recipients []string `json:"recipients"`
+	UpdatedAt  string   `json:"updated_at"`
+}
+
+// Store a broadcast list, replacing its recipients when any are given
+func (store *MessageStore) StoreBroadcastList(jid, name string, recipients []string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO broadcast_lists (jid, name, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET name = COALESCE(NULLIF(excluded.name, ''), broadcast_lists.name), updated_at = excluded.updated_at`,
+		jid, name, time.Now().UTC(),
+	); err != nil {
+		return err
+	}
+	if len(recipients) > 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM broadcast_recipients WHERE list_jid = ?", jid); err != nil {
+			return err
+		}
+		for _, recipient := range recipients {
+			if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO broadcast_recipients (list_jid, recipient_jid) VALUES (?, ?)", jid, recipient); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Get all known broadcast lists with their recipients
+func (store *MessageStore) GetBroadcastLists() ([]BroadcastList, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT l.jid, COALESCE(l.name, ''), l.updated_at, r.recipient_jid
+		FROM broadcast_lists l LEFT JOIN broadcast_recipients r ON r.list_jid = l.jid
+		ORDER BY l.name, l.jid, r.recipient_jid`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []BroadcastList{}
+	for rows.Next() {
+		var list BroadcastList
+		var updatedAt time.Time
+		var recipient sql.NullString
+		if err := rows.Scan(&list.JID, &list.Name, &updatedAt, &recipient); err != nil {
+			return nil, err
+		}
+		if len(lists) == 0 || lists[len(lists)-1].JID != list.JID {
+			list.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+			list.Recipients = []string{}
+			lists = append(lists, list)
+		}
+		if recipient.Valid {
+			last := &lists[len(lists)-1]
+			last.Recipients = append(last.Recipients, recipient.String)
+		}
+	}
+	return lists, rows.Err()
+}
+
+// Get the recipients of a broadcast list
+func (store *MessageStore) GetBroadcastRecipients(jid string) ([]string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT recipient_jid FROM broadcast_recipients WHERE list_jid = ? ORDER BY recipient_jid", jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []string
+	for rows.Next() {
+		var recipient string
+		if err := rows.Scan(&recipient); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, rows.Err()
+}
+
+// Record the broadcast list a stored message arrived through
+func (store *MessageStore) SetMessageBroadcast(id, chatJID, broadcastJID string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "UPDATE messages SET broadcast_jid = ? WHERE id = ? AND chat_jid = ?", broadcastJID, id, chatJID)
+	return err
+}
+
+// broadcastRecipientJIDs lists the recipients of one of our own broadcast list sends, preferring phone numbers
+func broadcastRecipientJIDs(recipients []types.BroadcastRecipient) []string {
+	jids := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		if !recipient.PN.IsEmpty() {
+			jids = append(jids, recipient.PN.ToNonAD().String())
+		} else if !recipient.LID.IsEmpty() {
+			jids = append(jids, recipient.LID.ToNonAD().String())
+		}
+	}
+	return jids
+}
+
+// defaultLocale ends every template's fallback chain (MCP_DEFAULT_LOCALE)
+var defaultLocale = "en"
+
+// normalizeLocale lowercases a locale tag and uses "-" as separator ("pt_BR" -> "pt-br")
+func normalizeLocale(locale string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+}
+
+// localeFallbacks lists the locales tried for a contact, most specific first:
+// the contact's locale, its base language, then the default locale and its base language
+func localeFallbacks(locale string) []string {
+	var chain []string
+	for _, candidate := range []string{normalizeLocale(locale), normalizeLocale(defaultLocale)} {
+		for candidate != "" {
+			if !slices.Contains(chain, candidate) {
+				chain = append(chain, candidate)
+			}
+			cut := strings.LastIndex(candidate, "-")
+			if cut < 0 {
+				break
+			}
+			candidate = candidate[:cut]
+		}
+	}
+	return chain
+}
+
+// MessageTemplate is one translation of a named template
+type MessageTemplate struct {
+	Name      string `json:"name"`
+	Locale    string `json:"locale"`
+	Body      string `json:"body"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Store a template translation
+func (store *MessageStore) SetTemplate(name, locale, body string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO message_templates (name, locale, body, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name, locale) DO UPDATE SET body = excluded.body, updated_at = excluded.updated_at`,
+		name, normalizeLocale(locale), body, time.Now().UTC(),
+	)
+	return err
+}
+
+// Delete a template translation, or every translation when locale is empty
+func (store *MessageStore) DeleteTemplate(name, locale string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "DELETE FROM message_templates WHERE name = ?"
+	args := []interface{}{name}
+	if locale != "" {
+		query += " AND locale = ?"
+		args = append(args, normalizeLocale(locale))
+	}
+	result, err := store.writer.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Get template translations (name "" = all templates)
+func (store *MessageStore) GetTemplates(name string) ([]MessageTemplate, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT name, locale, body, updated_at FROM message_templates"
+	var args []interface{}
+	if name != "" {
+		query += " WHERE name = ?"
+		args = append(args, name)
+	}
+	query += " ORDER BY name, locale"
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []MessageTemplate{}
+	for rows.Next() {
+		var template MessageTemplate
+		var updatedAt time.Time
+		if err := rows.Scan(&template.Name, &template.Locale, &template.Body, &updatedAt); err != nil {
+			return nil, err
+		}
+		template.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+// Get the template body for a locale, walking the fallback chain
+func (store *MessageStore) ResolveTemplate(name, locale string) (string, bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	for _, candidate := range localeFallbacks(locale) {
+		var body string
+		err := store.db.QueryRowContext(ctx, "SELECT body FROM message_templates WHERE name = ? AND locale = ?", name, candidate).Scan(&body)
+		if err == nil {
+			return body, true, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+// Limits for contact attribute keys and values
+const (
+	maxContactAttributeKeyLength   = 64
+	maxContactAttributeValueLength = 1024
+)
+
+// contactAttributeJID normalizes a phone number or JID to the JID attributes are stored under
+func contactAttributeJID(contact string) (string, error) {
+	if strings.Contains(contact, "@") {
+		jid, err := types.ParseJID(contact)
+		if err != nil {
+			return "", err
+		}
+		return jid.ToNonAD().String(), nil
+	}
+	phone := normalizePhoneDigits(contact)
+	if phone == "" {
+		return "", fmt.Errorf("invalid phone number %q", contact)
+	}
+	return types.NewJID(phone, types.DefaultUserServer).String(), nil
+}
+
+// Get a contact's attributes
+func (store *MessageStore) GetContactAttributes(jid string) (map[string]string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT key, value FROM contact_attributes WHERE jid = ?", jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attributes := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		attributes[key] = value
+	}
+	return attributes, rows.Err()
+}
+
+// Set and remove contact attributes in one transaction
+func (store *MessageStore) UpdateContactAttributes(jid string, set map[string]string, remove []string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for key, value := range set {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO contact_attributes (jid, key, value, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(jid, key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+			jid, key, value, now,
+		); err != nil {
+			return err
+		}
+	}
+	for _, key := range remove {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM contact_attributes WHERE jid = ? AND key = ?", jid, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NewsletterPost is one channel post with its latest view and reaction counts
+type NewsletterPost struct {
+	ServerID      int            `json:"server_id"`
+	MessageID     string         `json:"message_id,omitempty"`
+	Type          string         `json:"type,omitempty"`
+	Content       string         `json:"content,omitempty"`
+	PostedAt      string         `json:"posted_at,omitempty"`
+	Views         int            `json:"views"`
+	Reactions     map[string]int `json:"reactions"`
+	ReactionTotal int            `json:"reaction_total"`
+	UpdatedAt     string         `json:"updated_at"`
+}
+
+// NewsletterSummary totals the stored posts of one channel
+type NewsletterSummary struct {
+	JID           string `json:"jid"`
+	Name          string `json:"name,omitempty"`
+	Posts         int    `json:"posts"`
+	Views         int    `json:"views"`
+	ReactionTotal int    `json:"reaction_total"`
+	LastPostAt    string `json:"last_post_at,omitempty"`
+	UpdatedAt     string `json:"updated_at,omitempty"`
+}
+
+// Store the view and reaction counts of channel posts (content only arrives with fetched messages)
+func (store *MessageStore) StoreNewsletterPosts(client *whatsmeow.Client, newsletterJID string, posts []*types.NewsletterMessage) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, post := range posts {
+		reactions, err := json.Marshal(post.ReactionCounts)
+		if err != nil {
+			return err
+		}
+		var content string
+		var postedAt interface{}
+		if post.Message != nil {
+			content = extractTextContent(client, post.Message)
+		}
+		if !post.Timestamp.IsZero() {
+			postedAt = post.Timestamp.UTC()
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO newsletter_posts (newsletter_jid, server_id, message_id, type, content, posted_at, views, reactions, updated_at)
+			VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?)
+			ON CONFLICT(newsletter_jid, server_id) DO UPDATE SET
+				message_id = COALESCE(excluded.message_id, message_id),
+				type = COALESCE(excluded.type, type),
+				content = COALESCE(excluded.content, content),
+				posted_at = COALESCE(excluded.posted_at, posted_at),
+				views = excluded.views, reactions = excluded.reactions, updated_at = excluded.updated_at`,
+			newsletterJID, int(post.MessageServerID), post.MessageID, post.Type, content, postedAt,
+			post.ViewsCount, string(reactions), now,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get a channel's posts with their stats, newest first
+func (store *MessageStore) GetNewsletterPosts(newsletterJID string, limit int) ([]NewsletterPost, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT server_id, message_id, type, content, posted_at, views, reactions, updated_at
+		FROM newsletter_posts WHERE newsletter_jid = ? ORDER BY server_id DESC LIMIT ?`,
+		newsletterJID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []NewsletterPost{}
+	for rows.Next() {
+		var post NewsletterPost
+		var messageID, postType, content, reactions sql.NullString
+		var postedAt sql.NullTime
+		var updatedAt time.Time
+		if err := rows.Scan(&post.ServerID, &messageID, &postType, &content, &postedAt, &post.Views, &reactions, &updatedAt); err != nil {
+			return nil, err
+		}
+		post.MessageID, post.Type, post.Content = messageID.String, postType.String, content.String
+		post.Reactions = map[string]int{}
+		if reactions.Valid {
+			json.Unmarshal([]byte(reactions.String), &post.Reactions)
+		}
+		for _, count := range post.Reactions {
+			post.ReactionTotal += count
+		}
+		if postedAt.Valid {
+			post.PostedAt = postedAt.Time.UTC().Format(time.RFC3339)
+		}
+		post.UpdatedAt = updatedAt.UTC().Format(time.RFC3339)
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// Get per-channel totals over the stored posts
+func (store *MessageStore) GetNewsletterSummaries() ([]NewsletterSummary, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, `
+		SELECT p.newsletter_jid, COALESCE(c.name, ''), COUNT(*), COALESCE(SUM(p.views), 0),
+			COALESCE(SUM((SELECT SUM(value) FROM json_each(p.reactions))), 0),
+			(SELECT posted_at FROM newsletter_posts l WHERE l.newsletter_jid = p.newsletter_jid ORDER BY posted_at DESC LIMIT 1),
+			(SELECT updated_at FROM newsletter_posts u WHERE u.newsletter_jid = p.newsletter_jid ORDER BY updated_at DESC LIMIT 1)
+		FROM newsletter_posts p
+		LEFT JOIN chats c ON c.jid = p.newsletter_jid
+		GROUP BY p.newsletter_jid
+		ORDER BY p.newsletter_jid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []NewsletterSummary{}
+	for rows.Next() {
+		var summary NewsletterSummary
+		var lastPost, updated sql.NullString
+		if err := rows.Scan(&summary.JID, &summary.Name, &summary.Posts, &summary.Views, &summary.ReactionTotal, &lastPost, &updated); err != nil {
+			return nil, err
+		}
+		summary.LastPostAt = formatStoredTimestamp(lastPost)
+		summary.UpdatedAt = formatStoredTimestamp(updated)
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// formatStoredTimestamp renders a timestamp read without column type info (subqueries) as RFC3339
+func formatStoredTimestamp(value sql.NullString) string {
+	if !value.Valid {
+		return ""
+	}
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.Parse(layout, value.String); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return value.String
+}
+
+// How many recent posts per channel the analytics refresh fetches
+const newsletterAnalyticsPosts = 50
+
+// refreshNewsletterAnalytics fetches the latest posts (with view and reaction counts) of a channel
+func refreshNewsletterAnalytics(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, jid types.JID) (int, error) {
+	posts, err := client.GetNewsletterMessages(ctx, jid, &whatsmeow.GetNewsletterMessagesParams{Count: newsletterAnalyticsPosts})
+	if err != nil {
+		return 0, err
+	}
+	if err := messageStore.StoreNewsletterPosts(client, jid.String(), posts); err != nil {
+		return 0, err
+	}
+	return len(posts), nil
+}
+
+// startNewsletterAnalytics refreshes post stats of every followed channel on an interval
+// (MCP_NEWSLETTER_ANALYTICS_INTERVAL_SEC, 0 = only on demand)
+func startNewsletterAnalytics(client *whatsmeow.Client, messageStore *MessageStore, interval time.Duration, stopChan <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !client.IsConnected() || !client.IsLoggedIn() {
+					continue
+				}
+				ctx, cancel := withOptionalTimeout(context.Background(), endpointTimeouts.Query)
+				newsletters, err := client.GetSubscribedNewsletters(ctx)
+				cancel()
+				if err != nil {
+					fmt.Printf("Warning: failed to list followed channels: %v\n", err)
+					continue
+				}
+				for _, newsletter := range newsletters {
+					ctx, cancel := withOptionalTimeout(context.Background(), endpointTimeouts.Query)
+					if _, err := refreshNewsletterAnalytics(ctx, client, messageStore, newsletter.ID); err != nil {
+						fmt.Printf("Warning: failed to refresh analytics for %s: %v\n", newsletter.ID, err)
+					}
+					cancel()
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Campaign statuses
+const (
+	campaignScheduled = "scheduled"
+	campaignRunning   = "running"
+	campaignPaused    = "paused"
+	campaignCompleted = "completed"
+	campaignCancelled = "cancelled"
+)
+
+// Campaign recipient statuses
+const (
+	recipientPending    = "pending"
+	recipientSent       = "sent"
+	recipientFailed     = "failed"
+	recipientInvalid    = "invalid"    // Not on WhatsApp (validate_numbers)
+	recipientSuppressed = "suppressed" // On the opt-out list when its turn came
+)
+
+// Pacing bounds for campaigns
+const (
+	defaultCampaignMessagesPerMinute = 10
+	maxCampaignMessagesPerMinute     = 60
+	maxCampaignJitterSec             = 300
+)
+
+// Campaign is a paced bulk send of a template to a recipient list
+type Campaign struct {
+	ID                string         `json:"id"`
+	Name              string         `json:"name"`
+	Template          string         `json:"template"`
+	TemplateName      string         `json:"template_name,omitempty"` // Stored template, translated per recipient
+	MediaPath         string         `json:"media_path,omitempty"`
+	Status            string         `json:"status"`
+	MessagesPerMinute int            `json:"messages_per_minute"`
+	JitterSec         int            `json:"jitter_sec,omitempty"` // Up to this many extra seconds, random, after each send
+	StartAt           string         `json:"start_at,omitempty"`
+	CreatedAt         string         `json:"created_at"`
+	CompletedAt       string         `json:"completed_at,omitempty"`
+	Stats             *CampaignStats `json:"stats,omitempty"`
+}
+
+// CampaignStats counts recipients by outcome (delivered and read overlap with sent)
+type CampaignStats struct {
+	Total      int `json:"total"`
+	Pending    int `json:"pending"`
+	Sent       int `json:"sent"`
+	Delivered  int `json:"delivered"`
+	Read       int `json:"read"`
+	Failed     int `json:"failed"`
+	Invalid    int `json:"invalid"`
+	Suppressed int `json:"suppressed"`
+}
+
+// CampaignRecipient is one recipient of a campaign and its delivery state
+type CampaignRecipient struct {
+	Recipient   string            `json:"recipient"`
+	SendTo      string            `json:"send_to,omitempty"` // JID resolved by number validation
+	Variables   map[string]string `json:"variables,omitempty"`
+	Status      string            `json:"status"`
+	MessageID   string            `json:"message_id,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	SentAt      string            `json:"sent_at,omitempty"`
+	DeliveredAt string            `json:"delivered_at,omitempty"`
+	ReadAt      string            `json:"read_at,omitempty"`
+}
+
+// renderTemplate substitutes {key} placeholders; unknown placeholders are left as-is
+func renderTemplate(template string, variables map[string]string) string {
+	for key, value := range variables {
+		template = strings.ReplaceAll(template, "{"+key+"}", value)
+	}
+	return template
+}
+
+// Store a new campaign with its recipients
+func (store *MessageStore) CreateCampaign(campaign Campaign, startAt *time.Time, recipients []CampaignRecipient) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var start interface{}
+	if startAt != nil {
+		start = startAt.UTC()
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO campaigns (id, name, template, template_name, media_path, status, messages_per_minute, jitter_sec, start_at, created_at)
+		VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?, ?)`,
+		campaign.ID, campaign.Name, campaign.Template, campaign.TemplateName, campaign.MediaPath, campaign.Status,
+		campaign.MessagesPerMinute, campaign.JitterSec, start, time.Now().UTC(),
+	); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		var variables interface{}
+		if len(recipient.Variables) > 0 {
+			data, err := json.Marshal(recipient.Variables)
+			if err != nil {
+				return err
+			}
+			variables = string(data)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO campaign_recipients (campaign_id, recipient, send_to, variables, status, error)
+			VALUES (?, ?, NULLIF(?, ''), ?, ?, NULLIF(?, ''))`,
+			campaign.ID, recipient.Recipient, recipient.SendTo, variables, recipient.Status, recipient.Error,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Update a campaign's status; from limits the change to campaigns currently in one of those states
+func (store *MessageStore) SetCampaignStatus(id, status string, from ...string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "UPDATE campaigns SET status = ?"
+	args := []interface{}{status}
+	if status == campaignCompleted || status == campaignCancelled {
+		query += ", completed_at = ?"
+		args = append(args, time.Now().UTC())
+	}
+	query += " WHERE id = ?"
+	args = append(args, id)
+	if len(from) > 0 {
+		query += " AND status IN (?" + strings.Repeat(", ?", len(from)-1) + ")"
+		for _, f := range from {
+			args = append(args, f)
+		}
+	}
+	result, err := store.writer.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Get campaigns, newest first (status "" = all)
+func (store *MessageStore) GetCampaigns(status string) ([]Campaign, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT id, name, template, template_name, media_path, status, messages_per_minute, COALESCE(jitter_sec, 0), start_at, created_at, completed_at FROM campaigns"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []Campaign{}
+	for rows.Next() {
+		campaign, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns, rows.Err()
+}
+
+// Get one campaign
+func (store *MessageStore) GetCampaign(id string) (Campaign, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	row := store.db.QueryRowContext(ctx,
+		"SELECT id, name, template, template_name, media_path, status, messages_per_minute, COALESCE(jitter_sec, 0), start_at, created_at, completed_at FROM campaigns WHERE id = ?", id,
+	)
+	return scanCampaign(row)
+}
+
+func scanCampaign(row interface{ Scan(...interface{}) error }) (Campaign, error) {
+	var campaign Campaign
+	var templateName, mediaPath sql.NullString
+	var createdAt time.Time
+	var startAt, completedAt sql.NullTime
+	if err := row.Scan(&campaign.ID, &campaign.Name, &campaign.Template, &templateName, &mediaPath, &campaign.Status,
+		&campaign.MessagesPerMinute, &campaign.JitterSec, &startAt, &createdAt, &completedAt); err != nil {
+		return campaign, err
+	}
+	campaign.TemplateName, campaign.MediaPath = templateName.String, mediaPath.String
+	campaign.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	if startAt.Valid {
+		campaign.StartAt = startAt.Time.UTC().Format(time.RFC3339)
+	}
+	if completedAt.Valid {
+		campaign.CompletedAt = completedAt.Time.UTC().Format(time.RFC3339)
+	}
+	return campaign, nil
+}
+
+// Get a campaign's recipient counts
+func (store *MessageStore) GetCampaignStats(id string) (CampaignStats, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var stats CampaignStats
+	err := store.db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COALESCE(SUM(status = 'pending'), 0),
+			COALESCE(SUM(status = 'sent'), 0),
+			COALESCE(SUM(delivered_at IS NOT NULL), 0),
+			COALESCE(SUM(read_at IS NOT NULL), 0),
+			COALESCE(SUM(status = 'failed'), 0),
+			COALESCE(SUM(status = 'invalid'), 0),
+			COALESCE(SUM(status = 'suppressed'), 0)
+		FROM campaign_recipients WHERE campaign_id = ?`, id,
+	).Scan(&stats.Total, &stats.Pending, &stats.Sent, &stats.Delivered, &stats.Read, &stats.Failed, &stats.Invalid, &stats.Suppressed)
+	return stats, err
+}
+
+// Get a campaign's recipients in list order
+func (store *MessageStore) GetCampaignRecipients(id string) ([]CampaignRecipient, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT recipient, send_to, variables, status, message_id, error, sent_at, delivered_at, read_at
+		FROM campaign_recipients WHERE campaign_id = ? ORDER BY rowid`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []CampaignRecipient{}
+	for rows.Next() {
+		var recipient CampaignRecipient
+		var sendTo, variables, messageID, errorText sql.NullString
+		var sentAt, deliveredAt, readAt sql.NullTime
+		if err := rows.Scan(&recipient.Recipient, &sendTo, &variables, &recipient.Status, &messageID, &errorText,
+			&sentAt, &deliveredAt, &readAt); err != nil {
+			return nil, err
+		}
+		recipient.SendTo, recipient.MessageID, recipient.Error = sendTo.String, messageID.String, errorText.String
+		if variables.Valid {
+			json.Unmarshal([]byte(variables.String), &recipient.Variables)
+		}
+		for _, ts := range []struct {
+			value sql.NullTime
+			dst   *string
+		}{{sentAt, &recipient.SentAt}, {deliveredAt, &recipient.DeliveredAt}, {readAt, &recipient.ReadAt}} {
+			if ts.value.Valid {
+				*ts.dst = ts.value.Time.UTC().Format(time.RFC3339)
+			}
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, rows.Err()
+}
+
+// Get the next recipient of a campaign still waiting to be sent
+func (store *MessageStore) NextCampaignRecipient(id string) (CampaignRecipient, bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var recipient CampaignRecipient
+	var sendTo, variables sql.NullString
+	err := store.db.QueryRowContext(ctx,
+		`SELECT recipient, send_to, variables FROM campaign_recipients
+		WHERE campaign_id = ? AND status = ? ORDER BY rowid LIMIT 1`, id, recipientPending,
+	).Scan(&recipient.Recipient, &sendTo, &variables)
+	if err == sql.ErrNoRows {
+		return recipient, false, nil
+	}
+	if err != nil {
+		return recipient, false, err
+	}
+	recipient.SendTo = sendTo.String
+	if variables.Valid {
+		json.Unmarshal([]byte(variables.String), &recipient.Variables)
+	}
+	recipient.Status = recipientPending
+	return recipient, true, nil
+}
+
+// Record the outcome of sending to one campaign recipient
+func (store *MessageStore) SetCampaignRecipientResult(id, recipient, status, messageID, errorText string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`UPDATE campaign_recipients SET status = ?, message_id = NULLIF(?, ''), error = NULLIF(?, ''), sent_at = ?
+		WHERE campaign_id = ? AND recipient = ?`,
+		status, messageID, errorText, time.Now().UTC(), id, recipient,
+	)
+	return err
+}
+
+// Mark campaign messages delivered (and read) from a receipt
+func (store *MessageStore) MarkCampaignReceipt(messageIDs []types.MessageID, read bool, at time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	args := []interface{}{at.UTC()}
+	query := "UPDATE campaign_recipients SET delivered_at = COALESCE(delivered_at, ?)"
+	if read {
+		query += ", read_at = COALESCE(read_at, ?)"
+		args = append(args, at.UTC())
+	}
+	query += " WHERE message_id IN (?" + strings.Repeat(", ?", len(messageIDs)-1) + ")"
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	_, err := store.writer.ExecContext(ctx, query, args...)
+	return err
+}
+
+// CampaignRunner owns the goroutines sending running campaigns
+type CampaignRunner struct {
+	mutex   sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+var campaignRunner = &CampaignRunner{running: make(map[string]context.CancelFunc)}
+
+// start launches the sender for a running campaign unless it is already active
+func (cr *CampaignRunner) start(client *whatsmeow.Client, messageStore *MessageStore, id string) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if _, active := cr.running[id]; active {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cr.running[id] = cancel
+	go func() {
+		defer func() {
+			cr.mutex.Lock()
+			delete(cr.running, id)
+			cr.mutex.Unlock()
+		}()
+		runCampaign(ctx, client, messageStore, id)
+	}()
+}
+
+// stop halts a campaign's sender (after pause or cancel)
+func (cr *CampaignRunner) stop(id string) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cancel, active := cr.running[id]; active {
+		cancel()
+		delete(cr.running, id)
+	}
+}
+
+// Campaign sends that fail with a retryable error are retried this many times, waiting
+// campaignRetryDelay longer before each attempt
+const (
+	campaignSendRetries = 3
+	campaignRetryDelay  = 30 * time.Second
+)
+
+// runCampaign sends to pending recipients one at a time at the campaign's pace until
+// the list is exhausted or the campaign is paused or cancelled
+func runCampaign(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, id string) {
+	campaign, err := messageStore.GetCampaign(id)
+	if err != nil {
+		fmt.Printf("Warning: failed to load campaign %s: %v\n", id, err)
+		return
+	}
+	interval := time.Minute / time.Duration(max(campaign.MessagesPerMinute, 1))
+	fmt.Printf("📣 Campaign %s (%s) running at %d/min\n", campaign.ID, campaign.Name, campaign.MessagesPerMinute)
+	// Jitter only ever adds to the interval, so the per-minute cap still holds
+	jitter := time.Duration(campaign.JitterSec) * time.Second
+
+	wait := func(d time.Duration) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	// Retryable failures are tried again (the recipient stays pending); terminal ones fail at once
+	retries := map[string]int{}
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		// Hold off while disconnected or draining rather than failing recipients
+		if !client.IsConnected() || !client.IsLoggedIn() || !drainState.beginSend() {
+			if !wait(5 * time.Second) {
+				return
+			}
+			continue
+		}
+
+		recipient, found, err := messageStore.NextCampaignRecipient(id)
+		if err != nil || !found {
+			drainState.endSend()
+			if err != nil {
+				fmt.Printf("Warning: failed to load next campaign %s recipient: %v\n", id, err)
+				if !wait(5 * time.Second) {
+					return
+				}
+				continue
+			}
+			if ok, _ := messageStore.SetCampaignStatus(id, campaignCompleted, campaignRunning); ok {
+				stats, _ := messageStore.GetCampaignStats(id)
+				fmt.Printf("📣 Campaign %s completed: %+v\n", id, stats)
+				go dispatchEventWebhooks(messageStore, "campaign_completed", map[string]interface{}{
+					"campaign_id": id,
+					"stats":       stats,
+				})
+			}
+			return
+		}
+
+		sendTo := recipient.SendTo
+		if sendTo == "" {
+			sendTo = recipient.Recipient
+		}
+		if !sendBudgetFor(messageStore).wait(ctx) {
+			drainState.endSend()
+			return
+		}
+		if optedOut, err := messageStore.IsOptedOut(sendTo); err != nil || optedOut {
+			drainState.endSend()
+			status, errorText := recipientSuppressed, "Recipient opted out"
+			if err != nil {
+				status, errorText = recipientFailed, fmt.Sprintf("Failed to check opt-out list: %v", err)
+			}
+			if err := messageStore.SetCampaignRecipientResult(id, recipient.Recipient, status, "", errorText); err != nil {
+				fmt.Printf("Warning: failed to record campaign %s result for %s: %v\n", id, recipient.Recipient, err)
+			}
+			continue
+		}
+		var messageID string
+		success, result := sendWhatsAppMessage(ctx, client, messageStore, sendTo, campaign.Template,
+			campaign.MediaPath, SendOptions{
+				OnSent:      func(_ types.JID, sentID types.MessageID) { messageID = sentID },
+				Personalize: true, // Contact attributes fill placeholders the recipient's variables left
+				Template:    campaign.TemplateName,
+				Variables:   recipient.Variables,
+			})
+		drainState.endSend()
+		if ctx.Err() != nil && !success {
+			// Paused or cancelled mid-send; the recipient stays pending
+			return
+		}
+
+		status, errorText := recipientSent, ""
+		if !success {
+			code := classifySendFailure(result)
+			if retryableSendErrors[code] && retries[recipient.Recipient] < campaignSendRetries {
+				retries[recipient.Recipient]++
+				fmt.Printf("📣 Campaign %s send to %s failed (%s), retry %d/%d: %s\n",
+					id, recipient.Recipient, code, retries[recipient.Recipient], campaignSendRetries, result)
+				if !wait(time.Duration(retries[recipient.Recipient]) * campaignRetryDelay) {
+					return
+				}
+				continue
+			}
+			status, errorText = recipientFailed, code+": "+result
+			rerouteIfUndeliverable(messageStore, SendMessageRequest{
+				Recipient:   recipient.Recipient,
+				Message:     campaign.Template,
+				MediaPath:   campaign.MediaPath,
+				Personalize: true,
+				Template:    campaign.TemplateName,
+				Variables:   recipient.Variables,
+			}, code, result)
+		}
+		delete(retries, recipient.Recipient)
+		if err := messageStore.SetCampaignRecipientResult(id, recipient.Recipient, status, messageID, errorText); err != nil {
+			fmt.Printf("Warning: failed to record campaign %s result for %s: %v\n", id, recipient.Recipient, err)
+		}
+
+		delay := interval
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		if !wait(delay) {
+			return
+		}
+	}
+}
+
+// startCampaignScheduler resumes campaigns that were running before a restart and
+// starts scheduled campaigns once their start time arrives
+func startCampaignScheduler(client *whatsmeow.Client, messageStore *MessageStore, stopChan <-chan struct{}) {
+	if running, err := messageStore.GetCampaigns(campaignRunning); err == nil {
+		for _, campaign := range running {
+			campaignRunner.start(client, messageStore, campaign.ID)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				scheduled, err := messageStore.GetCampaigns(campaignScheduled)
+				if err != nil {
+					fmt.Printf("Warning: failed to load scheduled campaigns: %v\n", err)
+					continue
+				}
+				for _, campaign := range scheduled {
+					startAt, err := time.Parse(time.RFC3339, campaign.StartAt)
+					if err != nil || time.Now().Before(startAt) {
+						continue
+					}
+					if ok, _ := messageStore.SetCampaignStatus(campaign.ID, campaignRunning, campaignScheduled); ok {
+						campaignRunner.start(client, messageStore, campaign.ID)
+					}
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// validateCampaignNumbers marks phone-number recipients that are not on WhatsApp as invalid
+// and resolves the rest to their JIDs (JID recipients are taken as-is)
+func validateCampaignNumbers(ctx context.Context, client *whatsmeow.Client, recipients []CampaignRecipient) error {
+	var numbers []string
+	var refs []int
+	for i, recipient := range recipients {
+		if strings.Contains(recipient.Recipient, "@") {
+			continue
+		}
+		numbers = append(numbers, normalizePhoneDigits(recipient.Recipient))
+		refs = append(refs, i)
+	}
+
+	// Same batch limit as /api/check-numbers
+	for start := 0; start < len(numbers); start += 50 {
+		end := min(start+50, len(numbers))
+		results, err := client.IsOnWhatsApp(ctx, numbers[start:end])
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			recipient := &recipients[refs[start+i]]
+			if result.IsIn && result.JID.User != "" {
+				recipient.SendTo = result.JID.String()
+			} else {
+				recipient.Status = recipientInvalid
+				recipient.Error = "Not on WhatsApp"
+			}
+		}
+	}
+	return nil
+}
+
+// dispatchSendRequest sends a validated /api/send request (broadcast lists fan out to each recipient).
+// Sends WhatsApp can't deliver at all are handed to the fallback webhook, when one is configured.
+func dispatchSendRequest(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, req SendMessageRequest) (bool, string) {
+	opts := req.sendOptions()
+	if listJID, err := types.ParseJID(req.Recipient); err == nil && listJID.IsBroadcastList() {
+		if req.QuotedMessageID != "" {
+			return false, "quoted_message_id cannot be used with broadcast lists"
+		}
+		return sendToBroadcastList(ctx, client, messageStore, listJID, req.Message, req.MediaPath, opts)
+	}
+	success, result := sendWhatsAppMessage(ctx, client, messageStore, req.Recipient, req.Message, req.MediaPath, opts)
+	if !success {
+		rerouteIfUndeliverable(messageStore, req, classifySendFailure(result), result)
+	}
+	return success, result
+}
+
+// fallbackWebhook receives sends WhatsApp can't deliver (MCP_FALLBACK_WEBHOOK_URL, signed with
+// MCP_FALLBACK_WEBHOOK_SECRET when set), e.g. an SMS gateway; nil when not configured
+var fallbackWebhook *Webhook
+
+// fallbackWebhookID identifies the fallback webhook in delivery records and stats
+const fallbackWebhookID = "fallback"
+
+// undeliverableSendErrors are the terminal failures where the recipient can't be reached on
+// WhatsApp at all: not registered, or blocked. Other rejections (bad media, options, etc.)
+// are the request's fault and would fail over any channel.
+var undeliverableSendErrors = map[string]bool{
+	sendErrRecipientNotOnWhatsApp: true,
+	sendErrRecipientBlocked:       true,
+}
+
+// rerouteIfUndeliverable hands a failed send to the fallback webhook, when one is configured,
+// if the failure means WhatsApp can't reach the recipient at all
+func rerouteIfUndeliverable(messageStore *MessageStore, req SendMessageRequest, code, result string) {
+	if fallbackWebhook != nil && undeliverableSendErrors[code] {
+		go rerouteUndeliverable(messageStore, req, code, result)
+	}
+}
+
+// rerouteUndeliverable records a send_undeliverable event and POSTs it to the fallback webhook,
+// with the usual webhook retries. The payload carries the original request so the receiver can
+// resend it over another channel.
+func rerouteUndeliverable(messageStore *MessageStore, req SendMessageRequest, code, result string) {
+	req.MediaBase64 = "" // Already resolved to media_path; too large to pass on
+	payload := map[string]interface{}{
+		"recipient":  req.Recipient,
+		"request":    req,
+		"error_code": code,
+		"error":      result,
+		"failed_at":  time.Now().UTC().Format(time.RFC3339),
+	}
+	eventID := recordEvent(messageStore, "send_undeliverable", payload)
+	body, err := eventWebhookBody("send_undeliverable", eventID, payload)
+	if err != nil {
+		fmt.Printf("Warning: failed to encode fallback payload: %v\n", err)
+		return
+	}
+	fmt.Printf("↪️ Send to %s undeliverable (%s), rerouting to the fallback webhook\n", req.Recipient, code)
+	deliverWebhook(messageStore, *fallbackWebhook, eventID, body)
+}
+
+// sendOptions maps the request's formatting flags onto the options sendWhatsAppMessage takes
+func (req SendMessageRequest) sendOptions() SendOptions {
+	return SendOptions{
+		IsVoiceNote:     req.IsVoiceNote,
+		GifPlayback:     req.GifPlayback,
+		Sticker:         req.Sticker,
+		MentionAll:      req.MentionAll,
+		GroupMentions:   req.GroupMentions,
+		QuotedMessageID: req.QuotedMessageID,
+		Personalize:     req.Personalize,
+		Template:        req.Template,
+		Variables:       req.Variables,
+		Location:        req.Location,
+		Contacts:        req.Contacts,
+		VerifyRecipient: req.VerifyRecipient,
+	}
+}
+
+// sendToBroadcastList delivers a message to every recipient of a broadcast list. Like the
+// phone does, each recipient gets it as a direct message (whatsmeow can't send to lists).
+// Opted-out recipients are left out and reported apart from failures.
+func sendToBroadcastList(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, listJID types.JID, message, mediaPath string, opts SendOptions) (bool, string) {
+	members, err := messageStore.GetBroadcastRecipients(listJID.String())
+	if err != nil {
+		return false, fmt.Sprintf("Failed to load broadcast list: %v", err)
+	}
+	if len(members) == 0 {
+		return false, fmt.Sprintf("Broadcast list %s is unknown or has no recipients", listJID)
+	}
+
+	var recipients, optedOut, failures []string
+	for _, member := range members {
+		// The opt-out list is keyed by phone number, so members stored by LID are resolved first
+		phone := member
+		if jid, err := types.ParseJID(member); err == nil && jid.Server == types.HiddenUserServer {
+			phone = resolveCanonicalJID(client, jid, types.EmptyJID, waLog.Noop).String()
+		}
+		if skip, err := messageStore.IsOptedOut(phone); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: failed to check opt-out list: %v", member, err))
+		} else if skip {
+			optedOut = append(optedOut, member)
+		} else {
+			recipients = append(recipients, member)
+		}
+	}
+	if len(optedOut) > 0 {
+		fmt.Printf("📵 Broadcast to %s skips %d opted-out recipients\n", listJID, len(optedOut))
+	}
+	if len(recipients) == 0 && len(failures) == 0 {
+		return false, fmt.Sprintf("Every recipient of broadcast list %s opted out", listJID)
+	}
+
+	for _, recipient := range recipients {
+		if ok, result := sendWhatsAppMessage(ctx, client, messageStore, recipient, message, mediaPath, opts); !ok {
+			failures = append(failures, fmt.Sprintf("%s: %s", recipient, result))
+		}
+	}
+	skipped := ""
+	if len(optedOut) > 0 {
+		skipped = fmt.Sprintf("; %d opted out skipped", len(optedOut))
+	}
+	attempted := len(members) - len(optedOut)
+	if len(failures) == attempted {
+		return false, fmt.Sprintf("Broadcast to %s failed for all %d recipients%s: %s", listJID, attempted, skipped, strings.Join(failures, "; "))
+	}
+	if len(failures) > 0 {
+		return true, fmt.Sprintf("Broadcast sent to %d of %d recipients of %s%s (failed: %s)",
+			attempted-len(failures), attempted, listJID, skipped, strings.Join(failures, "; "))
+	}
+	return true, fmt.Sprintf("Broadcast sent to %d recipients of %s%s", attempted, listJID, skipped)
+}
+
+// optOutKeywords are whole-message replies (case-insensitive) that put the sender on the
+// opt-out list (MCP_OPT_OUT_KEYWORDS, comma-separated; set empty to disable)
+var optOutKeywords = map[string]bool{}
+
+const defaultOptOutKeywords = "STOP,UNSUBSCRIBE"
+
+// OptOut is a number that must not receive campaign or broadcast sends
+type OptOut struct {
+	Phone     string `json:"phone"`
+	Source    string `json:"source"` // keyword or api
+	Keyword   string `json:"keyword,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// optOutPhone reduces a recipient (phone number or JID) to the digits the opt-out list is keyed by
+func optOutPhone(recipient string) string {
+	if strings.Contains(recipient, "@") {
+		if jid, err := types.ParseJID(recipient); err == nil {
+			return jid.User
+		}
+	}
+	return normalizePhoneDigits(recipient)
+}
+
+// Add a number to the opt-out list; false if it was already there
+func (store *MessageStore) AddOptOut(phone, source, keyword, reason string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		`INSERT OR IGNORE INTO opt_outs (phone, source, keyword, reason, created_at)
+		VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		optOutPhone(phone), source, keyword, reason, time.Now().UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Remove a number from the opt-out list
+func (store *MessageStore) RemoveOptOut(phone string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx, "DELETE FROM opt_outs WHERE phone = ?", optOutPhone(phone))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Check whether a recipient is on the opt-out list
+func (store *MessageStore) IsOptedOut(recipient string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var exists int
+	err := store.db.QueryRowContext(ctx, "SELECT 1 FROM opt_outs WHERE phone = ?", optOutPhone(recipient)).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get the opt-out list, newest first
+func (store *MessageStore) GetOptOuts() ([]OptOut, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT phone, source, keyword, reason, created_at FROM opt_outs ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	optOuts := []OptOut{}
+	for rows.Next() {
+		var optOut OptOut
+		var keyword, reason sql.NullString
+		var createdAt time.Time
+		if err := rows.Scan(&optOut.Phone, &optOut.Source, &keyword, &reason, &createdAt); err != nil {
+			return nil, err
+		}
+		optOut.Keyword, optOut.Reason = keyword.String, reason.String
+		optOut.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		optOuts = append(optOuts, optOut)
+	}
+	return optOuts, rows.Err()
+}
+
+// maybeRecordOptOut adds an individual sender to the opt-out list when their message is an opt-out keyword
+func maybeRecordOptOut(messageStore *MessageStore, msg *events.Message, chatJID types.JID, content string, logger waLog.Logger) {
+	if len(optOutKeywords) == 0 || msg.Info.IsFromMe || chatTypeForJID(chatJID) != chatTypeIndividual {
+		return
+	}
+	keyword := strings.ToUpper(strings.Trim(strings.TrimSpace(content), ".!"))
+	if !optOutKeywords[keyword] {
+		return
+	}
+	added, err := messageStore.AddOptOut(chatJID.User, "keyword", keyword, "")
+	if err != nil {
+		logger.Warnf("Failed to record opt-out from %s: %v", chatJID, err)
+		return
+	}
+	if added {
+		fmt.Printf("🚫 %s opted out (%s)\n", chatJID, keyword)
+		go dispatchEventWebhooks(messageStore, "opt_out", map[string]interface{}{
+			"chat_jid": chatJID.String(),
+			"phone":    chatJID.User,
+			"keyword":  keyword,
+		})
+	}
+}
+
+// FlagRule flags inbound messages for review without affecting delivery or storage.
+// Configured through MCP_FLAG_RULES as a JSON list, e.g.
+// [{"name":"profanity","keywords":["darn"]},{"name":"card","type":"payment_card"}]
+type FlagRule struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"` // keyword (default when keywords are set), regex or payment_card
+	Keywords []string `json:"keywords,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+var flagRules []FlagRule
+
+// Candidate card numbers: 13-19 digits, optionally grouped by spaces or dashes
+var paymentCardPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+// parseFlagRules compiles MCP_FLAG_RULES
+func parseFlagRules(raw string) ([]FlagRule, error) {
+	var rules []FlagRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("invalid MCP_FLAG_RULES: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" || seen[rule.Name] {
+			return nil, fmt.Errorf("flag rule %d needs a unique name", i)
+		}
+		seen[rule.Name] = true
+		if rule.Type == "" && len(rule.Keywords) > 0 {
+			rule.Type = "keyword"
+		}
+		switch rule.Type {
+		case "keyword":
+			var quoted []string
+			for _, keyword := range rule.Keywords {
+				if keyword = strings.TrimSpace(keyword); keyword != "" {
+					quoted = append(quoted, regexp.QuoteMeta(keyword))
+				}
+			}
+			if len(quoted) == 0 {
+				return nil, fmt.Errorf("flag rule %q has no keywords", rule.Name)
+			}
+			rule.re = regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+		case "regex":
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("flag rule %q: %w", rule.Name, err)
+			}
+			rule.re = re
+		case "payment_card":
+			rule.re = paymentCardPattern
+		default:
+			return nil, fmt.Errorf("flag rule %q has unknown type %q", rule.Name, rule.Type)
+		}
+	}
+	return rules, nil
+}
+
+// luhnValid reports whether a digit string passes the card number checksum
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := range len(digits) {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// match returns the text that triggered the rule, or "". Card numbers are reduced to
+// their last four digits so the review queue never holds a full number.
+func (rule *FlagRule) match(content string) string {
+	if rule.Type != "payment_card" {
+		return rule.re.FindString(content)
+	}
+	for _, candidate := range rule.re.FindAllString(content, -1) {
+		digits := normalizePhoneDigits(candidate)
+		if luhnValid(digits) {
+			return "card ending " + digits[len(digits)-4:]
+		}
+	}
+	return ""
+}
+
+// Review queue statuses
+const (
+	flagPending   = "pending"
+	flagConfirmed = "confirmed" // Reviewer agreed the message breaks the rule
+	flagDismissed = "dismissed" // False positive
+)
+
+// MessageFlag is an inbound message matched by a flag rule
+type MessageFlag struct {
+	ID         int64  `json:"id"`
+	MessageID  string `json:"message_id"`
+	ChatJID    string `json:"chat_jid"`
+	Sender     string `json:"sender"`
+	Rule       string `json:"rule"`
+	Match      string `json:"match"`
+	Content    string `json:"content,omitempty"` // Current message text; omitted once the message is gone
+	Status     string `json:"status"`
+	Note       string `json:"note,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	ReviewedAt string `json:"reviewed_at,omitempty"`
+}
+
+// Add a message to the review queue; false if the rule already flagged it
+func (store *MessageStore) AddFlag(messageID, chatJID, sender, rule, match string) (int64, bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		`INSERT OR IGNORE INTO message_flags (message_id, chat_jid, sender, rule, match, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		messageID, chatJID, sender, rule, match, flagPending, time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return 0, false, err
+	}
+	id, err := result.LastInsertId()
+	return id, true, err
+}
+
+// Record a review decision on a pending flag; false if it isn't pending (or doesn't exist)
+func (store *MessageStore) ReviewFlag(id int64, status, note string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		"UPDATE message_flags SET status = ?, note = NULLIF(?, ''), reviewed_at = ? WHERE id = ? AND status = ?",
+		status, note, time.Now().UTC(), id, flagPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Get flags, newest first (status "" = all, chatJID "" = every chat)
+func (store *MessageStore) GetFlags(status, chatJID string, limit int) ([]MessageFlag, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := `SELECT f.id, f.message_id, f.chat_jid, f.sender, f.rule, f.match, m.content,
+		f.status, f.note, f.created_at, f.reviewed_at
+		FROM message_flags f LEFT JOIN messages m ON m.id = f.message_id AND m.chat_jid = f.chat_jid
+		WHERE 1 = 1`
+	var args []interface{}
+	if status != "" {
+		query += " AND f.status = ?"
+		args = append(args, status)
+	}
+	if chatJID != "" {
+		query += " AND f.chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	query += " ORDER BY f.created_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []MessageFlag{}
+	for rows.Next() {
+		var flag MessageFlag
+		var content, note sql.NullString
+		var createdAt time.Time
+		var reviewedAt sql.NullTime
+		if err := rows.Scan(&flag.ID, &flag.MessageID, &flag.ChatJID, &flag.Sender, &flag.Rule, &flag.Match, &content,
+			&flag.Status, &note, &createdAt, &reviewedAt); err != nil {
+			return nil, err
+		}
+		flag.Content, flag.Note = content.String, note.String
+		flag.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+		if reviewedAt.Valid {
+			flag.ReviewedAt = reviewedAt.Time.UTC().Format(time.RFC3339)
+		}
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// maybeFlagMessage queues an inbound message for review under every flag rule it matches
+func maybeFlagMessage(messageStore *MessageStore, msg *events.Message, chatJID, sender, content string, logger waLog.Logger) {
+	if len(flagRules) == 0 || msg.Info.IsFromMe || content == "" {
+		return
+	}
+	for i := range flagRules {
+		rule := &flagRules[i]
+		match := rule.match(content)
+		if match == "" {
+			continue
+		}
+		id, added, err := messageStore.AddFlag(msg.Info.ID, chatJID, sender, rule.Name, match)
+		if err != nil {
+			logger.Warnf("Failed to flag message %s: %v", msg.Info.ID, err)
+			continue
+		}
+		if added {
+			fmt.Printf("🚩 Message %s in %s flagged by rule %s\n", msg.Info.ID, chatJID, rule.Name)
+			go dispatchEventWebhooks(messageStore, "message_flagged", map[string]interface{}{
+				"flag_id":    id,
+				"message_id": msg.Info.ID,
+				"chat_jid":   chatJID,
+				"sender":     sender,
+				"rule":       rule.Name,
+				"match":      match,
+			})
+		}
+	}
+}
+
+// piiMasking stores inbound text with emails, card numbers and national ID numbers masked
+// (MCP_PII_MASKING). The original is kept in messages.content_unmasked, which is only
+// returned on request (?unmasked=true) to full-access tokens.
+var piiMasking bool
+
+// piiPatterns are replaced in order; cards are checked against paymentCardPattern separately
+var piiPatterns = []struct {
+	re          *regexp.Regexp
+	placeholder string
+}{
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+	{regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), "[national id]"},                                // US SSN
+	{regexp.MustCompile(`\b\d{3}\.\d{3}\.\d{3}-\d{2}\b`), "[national id]"},                        // Brazilian CPF
+	{regexp.MustCompile(`\b[A-CEGHJ-PR-TW-Z]{2} ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`), "[national id]"}, // UK National Insurance
+	{regexp.MustCompile(`\b\d{2}\.\d{3}\.\d{3}/\d{4}-\d{2}\b`), "[national id]"},                  // Brazilian CNPJ
+}
+
+// maskPII returns content with PII replaced by placeholders, and whether any was found
+func maskPII(content string) (string, bool) {
+	masked := paymentCardPattern.ReplaceAllStringFunc(content, func(candidate string) string {
+		if luhnValid(normalizePhoneDigits(candidate)) {
+			return "[card]"
+		}
+		return candidate
+	})
+	for _, pattern := range piiPatterns {
+		masked = pattern.re.ReplaceAllString(masked, pattern.placeholder)
+	}
+	return masked, masked != content
+}
+
+// maskInboundPII applies MCP_PII_MASKING to message content, returning the text consumers see
+// and the original to keep in the restricted column ("" when nothing had to be masked)
+func maskInboundPII(content string, isFromMe bool) (visible, unmasked string) {
+	if !piiMasking || isFromMe || content == "" {
+		return content, ""
+	}
+	if masked, found := maskPII(content); found {
+		return masked, content
+	}
+	return content, ""
+}
+
+// EmailBridgeRule forwards matching inbound messages, with their attachment, to email
+// (MCP_EMAIL_BRIDGE_RULES, a JSON list), e.g.
+// [{"name":"invoices","chats":["120363000000000000@g.us"],"media_types":["document"],"to":["ap@example.com"]}]
+type EmailBridgeRule struct {
+	Name       string   `json:"name"`
+	Chats      []string `json:"chats,omitempty"`       // Chat JIDs; empty = any chat
+	Senders    []string `json:"senders,omitempty"`     // Sender phone numbers; empty = anyone
+	MediaTypes []string `json:"media_types,omitempty"` // image, video, audio, document, sticker or text; empty = any
+	To         []string `json:"to,omitempty"`          // Defaults to MCP_SMTP_TO
+}
+
+// matches reports whether an inbound message falls under the rule
+func (rule *EmailBridgeRule) matches(message WebhookMessage) bool {
+	mediaType := message.MediaType
+	if mediaType == "" {
+		mediaType = "text"
+	}
+	return (len(rule.Chats) == 0 || slices.Contains(rule.Chats, message.ChatJID)) &&
+		(len(rule.Senders) == 0 || slices.Contains(rule.Senders, message.Sender)) &&
+		(len(rule.MediaTypes) == 0 || slices.Contains(rule.MediaTypes, mediaType))
+}
+
+// SMTPConfig is the mail relay the email bridge sends through (MCP_SMTP_*). Port 465 uses
+// implicit TLS; other ports upgrade with STARTTLS when the server offers it.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string // Default recipients
+}
+
+var emailBridge struct {
+	smtp          SMTPConfig
+	rules         []EmailBridgeRule
+	maxAttachment int64 // Larger files are mentioned in the body but not attached
+}
+
+// parseEmailBridgeRules validates MCP_EMAIL_BRIDGE_RULES against the SMTP settings
+func parseEmailBridgeRules(raw string, smtpConfig SMTPConfig) ([]EmailBridgeRule, error) {
+	var rules []EmailBridgeRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("invalid MCP_EMAIL_BRIDGE_RULES: %w", err)
+	}
+	if len(rules) > 0 && (smtpConfig.Host == "" || smtpConfig.From == "") {
+		return nil, fmt.Errorf("the email bridge needs MCP_SMTP_HOST and MCP_SMTP_FROM")
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("email bridge rule %d needs a name", i)
+		}
+		if len(rule.To) == 0 && len(smtpConfig.To) == 0 {
+			return nil, fmt.Errorf("email bridge rule %q has no recipients (set to or MCP_SMTP_TO)", rule.Name)
+		}
+	}
+	return rules, nil
+}
+
+// maybeForwardToEmail mails an inbound message to the recipients of every bridge rule it
+// matches, downloading the attachment first. Runs in the background.
+func maybeForwardToEmail(client *whatsmeow.Client, messageStore *MessageStore, message WebhookMessage, mimeType string) {
+	if len(emailBridge.rules) == 0 || message.IsFromMe {
+		return
+	}
+	var recipients, matched []string
+	for i := range emailBridge.rules {
+		rule := &emailBridge.rules[i]
+		if !rule.matches(message) {
+			continue
+		}
+		matched = append(matched, rule.Name)
+		to := rule.To
+		if len(to) == 0 {
+			to = emailBridge.smtp.To
+		}
+		for _, address := range to {
+			if !slices.Contains(recipients, address) {
+				recipients = append(recipients, address)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	go func() {
+		chat := message.ChatName
+		if chat == "" {
+			chat = message.ChatJID
+		}
+		var body strings.Builder
+		fmt.Fprintf(&body, "From: %s\nChat: %s (%s)\nSent: %s\nRules: %s\n", message.Sender, chat, message.ChatJID, message.Timestamp, strings.Join(matched, ", "))
+		if message.Content != "" {
+			fmt.Fprintf(&body, "\n%s\n", message.Content)
+		}
+
+		subject := "WhatsApp message from " + chat
+		attachment := ""
+		if message.MediaType != "" {
+			subject = fmt.Sprintf("WhatsApp %s from %s", message.MediaType, chat)
+			if message.Filename != "" {
+				subject += ": " + message.Filename
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), endpointTimeouts.Download)
+			success, _, _, path, err := downloadMedia(ctx, client, messageStore, message.ID, message.ChatJID, nil)
+			cancel()
+			if err == nil && !success {
+				err = fmt.Errorf("download failed")
+			}
+			var info os.FileInfo
+			if err == nil {
+				info, err = os.Stat(path)
+			}
+			switch {
+			case err != nil:
+				fmt.Fprintf(&body, "\n(The attachment could not be downloaded: %v)\n", err)
+			case info.Size() > emailBridge.maxAttachment:
+				fmt.Fprintf(&body, "\n(The %d byte attachment exceeds the email size limit; it is stored at %s)\n", info.Size(), path)
+			default:
+				attachment = path
+			}
+		}
+
+		if err := sendEmail(emailBridge.smtp, recipients, subject, body.String(), attachment, mimeType); err != nil {
+			fmt.Printf("⚠️ Failed to forward message %s to email: %v\n", message.ID, err)
+			return
+		}
+		fmt.Printf("📧 Forwarded message %s from %s to %d email recipients\n", message.ID, message.ChatJID, len(recipients))
+	}()
+}
+
+// sendEmail sends a plain-text email, with an optional attachment, through the SMTP relay
+func sendEmail(config SMTPConfig, to []string, subject, body, attachmentPath, attachmentType string) error {
+	var msg bytes.Buffer
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		config.From, strings.Join(to, ", "), mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z), parts.Boundary())
+
+	text, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(text)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+
+	if attachmentPath != "" {
+		data, err := os.ReadFile(attachmentPath)
+		if err != nil {
+			return err
+		}
+		if attachmentType == "" {
+			attachmentType = "application/octet-stream"
+		}
+		name := filepath.Base(attachmentPath)
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(attachmentType, map[string]string{"name": name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			io.WriteString(part, encoded[:76]+"\r\n")
+			encoded = encoded[76:]
+		}
+		io.WriteString(part, encoded+"\r\n")
+	}
+	if err := parts.Close(); err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)), 30*time.Second)
+	if err != nil {
+		return err
+	}
+	if config.Port == 465 {
+		conn = tls.Client(conn, &tls.Config{ServerName: config.Host})
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	smtpClient, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer smtpClient.Close()
+
+	if ok, _ := smtpClient.Extension("STARTTLS"); ok && config.Port != 465 {
+		if err := smtpClient.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
+			return err
+		}
+	}
+	if config.Username != "" {
+		if err := smtpClient.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := smtpClient.Mail(config.From); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := smtpClient.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	data, err := smtpClient.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return smtpClient.Quit()
+}
+
+// welcomeMessage is sent the first time an unseen contact messages us (MCP_WELCOME_MESSAGE,
+// empty = disabled); "{name}" is replaced with the sender's push name
+var welcomeMessage string
+
+// Messages older than this (e.g. replayed by offline sync) never trigger a welcome
+const welcomeMaxAge = 10 * time.Minute
+
+// Claim the first-contact welcome for a chat; true only if the chat has never been seen
+// or welcomed before. Must run before the message updates the chat's last_message_time.
+func (store *MessageStore) ClaimWelcome(jid string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, welcomed_at) VALUES (?, ?)
+		ON CONFLICT(jid) DO UPDATE SET welcomed_at = excluded.welcomed_at
+			WHERE chats.welcomed_at IS NULL AND chats.last_message_time IS NULL`,
+		jid, time.Now().UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// maybeSendWelcome greets a first-time individual contact with the configured welcome message
+func maybeSendWelcome(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, chatJID types.JID, logger waLog.Logger) {
+	if welcomeMessage == "" || msg.Info.IsFromMe || chatTypeForJID(chatJID) != chatTypeIndividual ||
+		time.Since(msg.Info.Timestamp) > welcomeMaxAge {
+		return
+	}
+	claimed, err := messageStore.ClaimWelcome(chatJID.String())
+	if err != nil {
+		logger.Warnf("Failed to check first contact for %s: %v", chatJID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	text := welcomeMessage
+	if attributes, err := messageStore.GetContactAttributes(chatJID.String()); err == nil {
+		text = renderTemplate(text, attributes)
+	}
+	text = strings.ReplaceAll(text, "{name}", msg.Info.PushName)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), endpointTimeouts.Send)
+		defer cancel()
+		if success, result := sendWhatsAppMessage(ctx, client, messageStore, chatJID.String(), text, "", SendOptions{}); success {
+			fmt.Printf("👋 Welcome message sent to first-time contact %s\n", chatJID)
+		} else {
+			logger.Warnf("Failed to send welcome message to %s: %s", chatJID, result)
+		}
+	}()
+}
+
+// groupIntroMessage is posted once when the account is added to a group (MCP_GROUP_INTRO_MESSAGE,
+// with {group}, {participants} and {description} placeholders)
+var groupIntroMessage string
+
+// groupIntroFetchInfo refreshes the group's metadata before the introduction (MCP_GROUP_INTRO_FETCH_INFO)
+var groupIntroFetchInfo bool
+
+// Claim the introduction for a group; true only the first time
+func (store *MessageStore) ClaimGroupIntro(jid string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		`INSERT INTO chats (jid, intro_sent_at) VALUES (?, ?)
+		ON CONFLICT(jid) DO UPDATE SET intro_sent_at = excluded.intro_sent_at WHERE chats.intro_sent_at IS NULL`,
+		jid, time.Now().UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// maybeSendGroupIntro introduces the account in a group it was just added to. info is the
+// group metadata that came with the event (nil when it carried none).
+func maybeSendGroupIntro(client *whatsmeow.Client, messageStore *MessageStore, group types.JID, info *types.GroupInfo, logger waLog.Logger) {
+	if groupIntroMessage == "" {
+		return
+	}
+	claimed, err := messageStore.ClaimGroupIntro(group.String())
+	if err != nil {
+		logger.Warnf("Failed to check group introduction for %s: %v", group, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	go func() {
+		if groupIntroFetchInfo || info == nil {
+			ctx, cancel := withOptionalTimeout(context.Background(), endpointTimeouts.Query)
+			fetched, err := client.GetGroupInfo(ctx, group)
+			cancel()
+			if err != nil {
+				logger.Warnf("Failed to fetch group info for %s: %v", group, err)
+			} else {
+				info = fetched
+				if info.Name != "" {
+					if err := messageStore.UpdateChatName(group.String(), info.Name); err != nil {
+						logger.Warnf("Failed to store group name for %s: %v", group, err)
+					}
+				}
+			}
+		}
+
+		variables := map[string]string{"group": "", "participants": "", "description": ""}
+		if info != nil {
+			variables["group"] = info.Name
+			variables["participants"] = strconv.Itoa(len(info.Participants))
+			variables["description"] = info.Topic
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), endpointTimeouts.Send)
+		defer cancel()
+		text := renderTemplate(groupIntroMessage, variables)
+		if success, result := sendWhatsAppMessage(ctx, client, messageStore, group.String(), text, "", SendOptions{}); success {
+			fmt.Printf("👋 Introduction sent to group %s\n", group)
+		} else {
+			logger.Warnf("Failed to send introduction to %s: %s", group, result)
+		}
+	}()
+}
+
+// Handle regular incoming messages with media support
+func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, logger waLog.Logger) {
+	// CRITICAL DEBUG: Log function entry
+	rawChatJID := msg.Info.Chat.String()
+	canonicalChatJID, canonicalSenderJID := resolveMessageStorageIDs(client, &msg.Info, logger)
+	chatJID := canonicalChatJID.String()
+	if chatJID == "" {
+		chatJID = rawChatJID
+	}
+	sender := canonicalSenderJID.User
+	if sender == "" {
+		sender = msg.Info.Sender.User
+	}
+
+	// A message sent to us through someone's broadcast list belongs in the DM with the
+	// sender (as on the phone); the list is kept in broadcast_jid for attribution
+	var broadcastJID string
+	if msg.Info.Chat.IsBroadcastList() {
+		if !msg.Info.IsFromMe && !canonicalSenderJID.IsEmpty() {
+			broadcastJID = rawChatJID
+			canonicalChatJID = canonicalSenderJID.ToNonAD()
+			chatJID = canonicalChatJID.String()
+		} else if msg.Info.IsFromMe && len(msg.Info.BroadcastRecipients) > 0 {
+			// Our own list send (from the phone) reveals the list's recipients
+			if err := messageStore.StoreBroadcastList(rawChatJID, "", broadcastRecipientJIDs(msg.Info.BroadcastRecipients)); err != nil {
+				logger.Warnf("Failed to store broadcast list %s: %v", rawChatJID, err)
+			}
+		}
+	}
+	if msg.Info.IsFromMe {
+		noteOwnDeviceActivity(client, messageStore, msg.Info.Sender, msg.Info.ID, msg.Info.Timestamp, logger)
+	}
+	fmt.Printf("🔍 handleMessage CALLED: RawChatJID=%s, ChatJID=%s, Sender=%s, IsFromMe=%v\n", rawChatJID, chatJID, sender, msg.Info.IsFromMe)
+
+	// Event RSVPs and edits update an existing invite rather than adding a message
+	if handleEventUpdate(client, messageStore, msg, chatJID, sender, logger) {
+		return
+	}
+	if handlePinUpdate(messageStore, msg, chatJID, sender, logger) {
+		return
+	}
+	if handleKeepUpdate(messageStore, msg, chatJID, sender, logger) {
+		return
+	}
+	if handleReactionUpdate(messageStore, msg, chatJID, sender, logger) {
+		return
+	}
+	if handleEditUpdate(client, messageStore, msg, chatJID, sender, logger) {
+		return
+	}
+
+	// Save message to database
+	// Get appropriate chat name (pass nil for conversation since we don't have one for regular messages)
+	name := GetChatName(client, messageStore, canonicalChatJID, chatJID, nil, sender, msg.Info.PushName, logger)
+
+	// Greet first-time contacts before the chat is recorded as seen
+	maybeSendWelcome(client, messageStore, msg, canonicalChatJID, logger)
+
+	// Update chat in database with the message timestamp (keeps last message time updated)
+	err := messageStore.StoreChat(chatJID, name, msg.Info.Timestamp)
+	if err != nil {
+		logger.Warnf("Failed to store chat: %v", err)
+	}
+
+	// Extract text content
+	content := extractTextContent(client, msg.Message)
+	if msg.Message.GetPollUpdateMessage() != nil {
+		content = formatPollVote(client, messageStore, msg, chatJID, canonicalSenderJID, logger)
+	}
+	fmt.Printf("🔍 Extracted content length: %d chars\n", len(content))
+	maybeRecordOptOut(messageStore, msg, canonicalChatJID, content, logger)
+	maybeFlagMessage(messageStore, msg, chatJID, sender, content, logger)
+	// Past this point only the masked text is used; StoreMessage keeps the original aside
+	visibleContent, _ := maskInboundPII(content, msg.Info.IsFromMe)
+
+	// Extract media info
+	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength := extractMediaInfo(msg.Message)
+	fmt.Printf("🔍 Media info: type=%s, filename=%s\n", mediaType, filename)
+
+	// Skip if there's no content and no media
+	if content == "" && mediaType == "" {
+		fmt.Printf("⚠️ SKIPPING: No content and no media\n")
+		return
+	}
+
+	// CRITICAL DEBUG: Log before storage attempt
+	fmt.Printf("DEBUG: Attempting to store message - ID=%s, ChatJID=%s, Content=%s, HasMedia=%v\n",
+		msg.Info.ID, chatJID, redactLogContent(visibleContent[:min(50, len(visibleContent))]), mediaType != "")
+
+	// Store message in database
+	contentType := extractContentType(msg.Message)
+	err = messageStore.StoreMessage(
+		msg.Info.ID,
+		chatJID,
+		sender,
+		content,
+		contentType,
+		msg.Info.Timestamp,
+		msg.Info.IsFromMe,
+		mediaType,
+		filename,
+		url,
+		mediaKey,
+		fileSHA256,
+		fileEncSHA256,
+		fileLength,
+	)
+
+	if err != nil {
+		// CRITICAL: Always log storage failures
+		fmt.Printf("❌ STORAGE FAILED: %v (ID=%s, ChatJID=%s)\n", err, msg.Info.ID, chatJID)
+		logger.Warnf("Failed to store message: %v", err)
+	} else {
+		// CRITICAL DEBUG: Confirm successful storage
+		fmt.Printf("✅ STORAGE SUCCESS: ID=%s stored in %s\n", msg.Info.ID, chatJID)
+
+		if err := messageStore.StoreRawMessage(msg.Info.ID, chatJID, msg.Message); err != nil {
+			logger.Warnf("Failed to store raw message: %v", err)
+		}
+		if vcardCheckNumbers && !msg.Info.IsFromMe {
+			if contacts := extractVCardContacts(msg.Message); len(contacts) > 0 {
+				// The lookup is a server round-trip; annotate the stored card once it answers
+				go annotateVCardNumbers(client, messageStore, msg.Info.ID, chatJID, contacts, logger)
+			}
+		}
+
+		if mediaType != "" {
+			if err := messageStore.StoreMediaAttributes(msg.Info.ID, chatJID, extractMediaAttributes(msg.Message)); err != nil {
+				logger.Warnf("Failed to store media attributes: %v", err)
+			}
+		}
+		if broadcastJID != "" {
+			if err := messageStore.SetMessageBroadcast(msg.Info.ID, chatJID, broadcastJID); err != nil {
+				logger.Warnf("Failed to store broadcast attribution: %v", err)
+			}
+		}
+		mentionAll, groupMentions := extractGroupMentions(msg.Message)
+		if mentionAll || len(groupMentions) > 0 {
+			if err := messageStore.StoreGroupMentions(msg.Info.ID, chatJID, mentionAll, groupMentions); err != nil {
+				logger.Warnf("Failed to store group mentions: %v", err)
+			}
+		}
+		quotedID, quotedSender := extractQuotedMessage(msg.Message)
+		if quotedID != "" {
+			if err := messageStore.StoreQuotedMessage(msg.Info.ID, chatJID, quotedID, quotedSender); err != nil {
+				logger.Warnf("Failed to store quoted message reference: %v", err)
+			}
+		}
+		if event := msg.Message.GetEventMessage(); event != nil {
+			pushCalendarEvent(messageStore, chatJID, msg.Info.ID, event)
+		}
+
+		event := WebhookMessage{
+			ID:            msg.Info.ID,
+			ChatJID:       chatJID,
+			ChatName:      name,
+			Sender:        sender,
+			Content:       visibleContent,
+			ContentType:   contentType,
+			Timestamp:     msg.Info.Timestamp.UTC().Format(time.RFC3339),
+			IsFromMe:      msg.Info.IsFromMe,
+			MediaType:     mediaType,
+			Filename:      filename,
+			FileLength:    fileLength,
+			BroadcastJID:  broadcastJID,
+			MentionsAll:   mentionAll,
+			GroupMentions: groupMentions,
+			QuotedID:      quotedID,
+			QuotedSender:  quotedSender,
+		}
+		// Let webhook consumers route on who owns the conversation
+		if assignment, err := messageStore.GetChatAssignment(chatJID); err == nil {
+			event.HandoffState = assignment.State
+			event.Assignee = assignment.Assignee
+		} else {
+			logger.Warnf("Failed to load chat assignment: %v", err)
+		}
+		eventID := recordEvent(messageStore, "message", event)
+
+		// Notify webhooks of inbound messages. When the attachment is auto-downloaded,
+		// delivery waits for the download so the payload can carry the local path.
+		if !msg.Info.IsFromMe {
+			maybeForwardToEmail(client, messageStore, event, extractMediaMimetype(msg.Message))
+			queued := maybeAutoDownload(messageStore, msg.Info.ID, chatJID, mediaType, filename, extractMediaMimetype(msg.Message), fileLength, eventID, func(job DownloadJob) {
+				event.LocalPath = job.Path
+				dispatchMessageWebhooks(client, messageStore, eventID, event)
+			})
+			if !queued {
+				dispatchMessageWebhooks(client, messageStore, eventID, event)
+			}
+		}
+
+		// Log message reception
+		timestamp := msg.Info.Timestamp.Format("2006-01-02 15:04:05")
+		direction := "←"
+		if msg.Info.IsFromMe {
+			direction = "→"
+		}
+
+		// Log based on message type
+		if mediaType != "" {
+			fmt.Printf("[%s] %s %s: [%s: %s] %s\n", timestamp, direction, sender, mediaType, filename, redactLogContent(visibleContent))
+		} else if content != "" {
+			fmt.Printf("[%s] %s %s: %s\n", timestamp, direction, sender, redactLogContent(visibleContent))
+		}
+	}
+}
+
+// DownloadMediaRequest represents the request body for the download media API
+type DownloadMediaRequest struct {
+	MessageID string `json:"message_id"`
+	ChatJID   string `json:"chat_jid"`
+	Async     bool   `json:"async,omitempty"` // Return a job_id immediately and poll /api/download/status
+	// Omit the base64 file_content and fetch the file from file_url instead
+	SkipContent bool `json:"skip_content,omitempty"`
+}
+
+// DownloadMediaResponse represents the response for the download media API
+type DownloadMediaResponse struct {
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	Filename    string `json:"filename,omitempty"`
+	Path        string `json:"path,omitempty"`
+	FileURL     string `json:"file_url,omitempty"`     // Path on the authenticated media file server
+	FileContent string `json:"file_content,omitempty"` // Base64-encoded file bytes for container isolation
+}
+
+// Store additional media info in the database
+func (store *MessageStore) StoreMediaInfo(id, chatJID, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE messages SET url = ?, media_key = ?, file_sha256 = ?, file_enc_sha256 = ?, file_length = ? WHERE id = ? AND chat_jid = ?",
+		url, mediaKey, fileSHA256, fileEncSHA256, fileLength, id, chatJID,
+	)
+	return err
+}
+
+// Record where a message's media was downloaded to
+func (store *MessageStore) SetLocalPath(id, chatJID, localPath string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE messages SET local_path = ? WHERE id = ? AND chat_jid = ?",
+		localPath, id, chatJID,
+	)
+	return err
+}
+
+// Get media info from the database
+func (store *MessageStore) GetMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var mediaType, filename, url string
+	var mediaKey, fileSHA256, fileEncSHA256 []byte
+	var fileLength uint64
+
+	err := store.db.QueryRowContext(ctx,
+		"SELECT media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	).Scan(&mediaType, &filename, &url, &mediaKey, &fileSHA256, &fileEncSHA256, &fileLength)
+
+	return mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err
+}
+
+// MediaDownloader implements the whatsmeow.DownloadableMessage interface
+type MediaDownloader struct {
+	URL           string
+	DirectPath    string
+	MediaKey      []byte
+	FileLength    uint64
+	FileSHA256    []byte
+	FileEncSHA256 []byte
+	MediaType     whatsmeow.MediaType
+}
+
+// GetDirectPath implements the DownloadableMessage interface
+func (d *MediaDownloader) GetDirectPath() string {
+	return d.DirectPath
+}
+
+// GetURL implements the DownloadableMessage interface
+func (d *MediaDownloader) GetURL() string {
+	return d.URL
+}
+
+// GetMediaKey implements the DownloadableMessage interface
+func (d *MediaDownloader) GetMediaKey() []byte {
+	return d.MediaKey
+}
+
+// GetFileLength implements the DownloadableMessage interface
+func (d *MediaDownloader) GetFileLength() uint64 {
+	return d.FileLength
+}
+
+// GetFileSHA256 implements the DownloadableMessage interface
+func (d *MediaDownloader) GetFileSHA256() []byte {
+	return d.FileSHA256
+}
+
+// GetFileEncSHA256 implements the DownloadableMessage interface
+func (d *MediaDownloader) GetFileEncSHA256() []byte {
+	return d.FileEncSHA256
+}
+
+// GetMediaType implements the DownloadableMessage interface
+func (d *MediaDownloader) GetMediaType() whatsmeow.MediaType {
+	return d.MediaType
+}
+
+// Function to download media from a message
+// progress may be nil; when set it receives byte counts as the file is streamed to disk
+func downloadMedia(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string, progress DownloadProgressFunc) (bool, string, string, string, error) {
+	// Query the database for the message
+	var mediaType, filename, url string
+	var mediaKey, fileSHA256, fileEncSHA256 []byte
+	var fileLength uint64
+	var err error
+
+	// First, check if we already have this file
+	chatDir := filepath.Join(messageStore.dir, strings.ReplaceAll(chatJID, ":", "_"))
+	localPath := ""
+
+	// Get media info from the database
+	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err = messageStore.GetMediaInfo(messageID, chatJID)
+
+	if err != nil {
+		// Try to get basic info if extended info isn't available
+		err = messageStore.db.QueryRowContext(ctx,
+			"SELECT media_type, filename FROM messages WHERE id = ? AND chat_jid = ?",
+			messageID, chatJID,
+		).Scan(&mediaType, &filename)
+
+		if err != nil {
+			return false, "", "", "", fmt.Errorf("failed to find message: %v", err)
+		}
+	}
+
+	// Check if this is a media message
+	if mediaType == "" {
+		return false, "", "", "", fmt.Errorf("not a media message")
+	}
+
+	// Create directory for the chat if it doesn't exist
+	if err := os.MkdirAll(chatDir, 0755); err != nil {
+		return false, "", "", "", fmt.Errorf("failed to create chat directory: %v", err)
+	}
+
+	// Generate a local path for the file
+	localPath = filepath.Join(chatDir, sanitizeFilename(filename))
+
+	// Get absolute path
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return false, "", "", "", fmt.Errorf("failed to get absolute path: %v", err)
+	}
+
+	// Serialize downloads of the same file so concurrent requests don't write the same partial file
+	unlock := lockMediaDownload(localPath)
+	defer unlock()
+
+	// Check if file already exists
+	if _, err := os.Stat(localPath); err == nil {
+		// File exists, return it
+		messageStore.SetLocalPath(messageID, chatJID, absPath)
+		return true, mediaType, filename, absPath, nil
+	}
+
+	// If we don't have all the media info we need, we can't download
+	if url == "" || len(mediaKey) == 0 || len(fileSHA256) == 0 || len(fileEncSHA256) == 0 || fileLength == 0 {
+		return false, "", "", "", fmt.Errorf("incomplete media information for download")
+	}
+
+	fmt.Printf("Attempting to download media for message %s in chat %s...\n", messageID, chatJID)
+
+	// Extract direct path from URL
+	directPath := extractDirectPathFromURL(url)
+
+	// Create a downloader that implements DownloadableMessage
+	var waMediaType whatsmeow.MediaType
+	switch mediaType {
+	case "image", "sticker":
+		waMediaType = whatsmeow.MediaImage
+	case "video":
+		waMediaType = whatsmeow.MediaVideo
+	case "audio":
+		waMediaType = whatsmeow.MediaAudio
+	case "document":
+		waMediaType = whatsmeow.MediaDocument
+	default:
+		return false, "", "", "", fmt.Errorf("unsupported media type: %s", mediaType)
+	}
+
+	downloader := &MediaDownloader{
+		URL:           url,
+		DirectPath:    directPath,
+		MediaKey:      mediaKey,
+		FileLength:    fileLength,
+		FileSHA256:    fileSHA256,
+		FileEncSHA256: fileEncSHA256,
+		MediaType:     waMediaType,
+	}
+
+	// Stream the encrypted media to disk, resuming a previous partial download if one exists.
+	// A cancelled or timed-out download keeps its .part file so the next attempt resumes.
+	downloadCtx, downloadCancel := withOptionalTimeout(ctx, endpointTimeouts.Download)
+	defer downloadCancel()
+	partPath := localPath + ".enc.part"
+	resumed, err := downloadMediaResumable(downloadCtx, downloader, partPath, localPath, progress)
+	if errors.Is(err, errMediaURLUnavailable) {
+		// Stored URL expired - let whatsmeow resolve a fresh media host via the direct path
+		fmt.Printf("Stored media URL unavailable for %s, falling back to direct path download\n", messageID)
+		err = downloadMediaToFile(downloadCtx, client, downloader, localPath, progress)
+	}
+	if msg := contextErrorMessage(downloadCtx, "downloading media", endpointTimeouts.Download); msg != "" {
+		return false, "", "", "", errors.New(msg)
+	}
+	if err != nil {
+		return false, "", "", "", fmt.Errorf("failed to download media: %v", err)
+	}
+
+	if err := messageStore.SetLocalPath(messageID, chatJID, absPath); err != nil {
+		fmt.Printf("Warning: failed to record local path for %s: %v\n", messageID, err)
+	}
+
+	var size int64
+	if info, statErr := os.Stat(localPath); statErr == nil {
+		size = info.Size()
+	}
+	if resumed {
+		fmt.Printf("Successfully resumed %s media download to %s (%d bytes)\n", mediaType, absPath, size)
+	} else {
+		fmt.Printf("Successfully downloaded %s media to %s (%d bytes)\n", mediaType, absPath, size)
+	}
+	return true, mediaType, filename, absPath, nil
+}
+
+// mediaDownloadLock serializes downloads of one file; holders counts the goroutines holding or
+// waiting for it, so the last one out removes it from mediaDownloadLocks
+type mediaDownloadLock struct {
+	sync.Mutex
+	holders int
+}
+
+// Per-file locks for media downloads, present only while a download of the file is under way
+var mediaDownloadLocks = struct {
+	sync.Mutex
+	byPath map[string]*mediaDownloadLock
+}{byPath: make(map[string]*mediaDownloadLock)}
+
+func lockMediaDownload(path string) func() {
+	mediaDownloadLocks.Lock()
+	lock := mediaDownloadLocks.byPath[path]
+	if lock == nil {
+		lock = &mediaDownloadLock{}
+		mediaDownloadLocks.byPath[path] = lock
+	}
+	lock.holders++
+	mediaDownloadLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		mediaDownloadLocks.Lock()
+		if lock.holders--; lock.holders == 0 {
+			delete(mediaDownloadLocks.byPath, path)
+		}
+		mediaDownloadLocks.Unlock()
+	}
+}
+
+// mediaCDNClient fetches encrypted media from the WhatsApp CDN. There is no overall timeout, as
+// large files legitimately take long (the caller's context bounds the download), but a CDN
+// that stops answering fails the attempt instead of hanging it.
+var mediaCDNClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	},
+}
+
+// DownloadProgressFunc receives the number of bytes written so far and the expected total
+type DownloadProgressFunc func(downloaded, total int64)
+
+// Length of the truncated HMAC-SHA256 appended to encrypted WhatsApp media
+const mediaHMACLength = 10
+
+// errMediaURLUnavailable means the stored CDN URL can no longer be used (expired or missing)
+var errMediaURLUnavailable = errors.New("media URL unavailable")
+
+// progressWriter reports bytes written through it to a DownloadProgressFunc
+type progressWriter struct {
+	writer   io.Writer
+	written  int64
+	total    int64
+	progress DownloadProgressFunc
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.writer.Write(p)
+	pw.written += int64(n)
+	if pw.progress != nil {
+		pw.progress(pw.written, pw.total)
+	}
+	return n, err
+}
+
+// encryptedMediaSize returns the size of the encrypted blob for a plaintext of the given length
+// (AES-CBC with PKCS#7 padding always adds 1-16 bytes, followed by the truncated HMAC)
+func encryptedMediaSize(plaintextLength uint64) int64 {
+	return int64((plaintextLength/aes.BlockSize+1)*aes.BlockSize) + mediaHMACLength
+}
+
+// downloadMediaResumable streams the encrypted media blob from the stored CDN URL into partPath,
+// continuing from an existing partial file with an HTTP Range request. Once complete the blob is
+// verified (SHA256 + HMAC), decrypted in place and moved to localPath.
+// Returns whether a previous partial download was resumed.
+func downloadMediaResumable(ctx context.Context, media *MediaDownloader, partPath, localPath string, progress DownloadProgressFunc) (bool, error) {
+	if !strings.HasPrefix(media.URL, "https://") || strings.HasPrefix(media.URL, "https://web.whatsapp.net") {
+		return false, errMediaURLUnavailable
+	}
+
+	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open partial file: %v", err)
+	}
+	defer partFile.Close()
+
+	info, err := partFile.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat partial file: %v", err)
+	}
+
+	expectedSize := encryptedMediaSize(media.FileLength)
+	offset := info.Size()
+	if offset > expectedSize {
+		// Partial file is corrupt - start over
+		offset = 0
+	}
+	resumed := offset > 0
+
+	if offset < expectedSize {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, media.URL, nil)
+		if err != nil {
+			return false, fmt.Errorf("failed to prepare request: %v", err)
+		}
+		req.Header.Set("Origin", socket.Origin)
+		req.Header.Set("Referer", socket.Origin+"/")
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		resp, err := mediaCDNClient.Do(req)
+		if err != nil {
+			return false, fmt.Errorf("media request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			// Server honoured the range - append to what we already have
+		case http.StatusOK:
+			// Server ignored the range - restart from zero
+			offset = 0
+			resumed = false
+		case http.StatusRequestedRangeNotSatisfiable:
+			// Nothing left to fetch; verification below decides whether the file is usable
+			offset = expectedSize
+		case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+			return false, errMediaURLUnavailable
+		default:
+			return false, fmt.Errorf("media download failed with HTTP %d", resp.StatusCode)
+		}
+
+		if offset < expectedSize {
+			if err := partFile.Truncate(offset); err != nil {
+				return false, fmt.Errorf("failed to truncate partial file: %v", err)
+			}
+			if _, err := partFile.Seek(offset, io.SeekStart); err != nil {
+				return false, fmt.Errorf("failed to seek partial file: %v", err)
+			}
+			if resumed {
+				fmt.Printf("Resuming media download at byte %d of %d\n", offset, expectedSize)
+			}
+
+			writer := &progressWriter{writer: partFile, written: offset, total: expectedSize, progress: progress}
+			if _, err := io.Copy(writer, resp.Body); err != nil {
+				// Keep the partial file so the next attempt can resume
+				return resumed, fmt.Errorf("media download interrupted at byte %d: %v", writer.written, err)
+			}
+		}
+	}
+
+	if err := verifyAndDecryptMedia(partFile, media); err != nil {
+		// Corrupt data can't be resumed - discard it so the next attempt starts fresh
+		partFile.Close()
+		os.Remove(partPath)
+		return resumed, err
+	}
+
+	partFile.Close()
+	if err := os.Rename(partPath, localPath); err != nil {
+		return resumed, fmt.Errorf("failed to save media file: %v", err)
+	}
+	return resumed, nil
+}
+
+// verifyAndDecryptMedia checks the encrypted blob in file against the message hashes and
+// decrypts it in place, leaving only the plaintext media
+func verifyAndDecryptMedia(file *os.File, media *MediaDownloader) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat media file: %v", err)
+	}
+	size := info.Size()
+	if size <= mediaHMACLength {
+		return fmt.Errorf("media file too short")
+	}
+
+	if len(media.FileEncSHA256) == 32 {
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, size)); err != nil {
+			return fmt.Errorf("failed to hash media file: %v", err)
+		}
+		if !bytes.Equal(hasher.Sum(nil), media.FileEncSHA256) {
+			return fmt.Errorf("encrypted media SHA256 mismatch")
+		}
+	}
+
+	// Same key derivation as whatsmeow: HKDF(mediaKey, info=media type) -> iv | cipherKey | macKey
+	expanded := hkdfutil.SHA256(media.MediaKey, nil, []byte(media.MediaType), 112)
+	iv, cipherKey, macKey := expanded[:16], expanded[16:48], expanded[48:80]
+
+	mac := make([]byte, mediaHMACLength)
+	if _, err := file.ReadAt(mac, size-mediaHMACLength); err != nil {
+		return fmt.Errorf("failed to read media MAC: %v", err)
+	}
+	h := hmac.New(sha256.New, macKey)
+	h.Write(iv)
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, size-mediaHMACLength)); err != nil {
+		return fmt.Errorf("failed to hash media file: %v", err)
+	}
+	if !hmac.Equal(h.Sum(nil)[:mediaHMACLength], mac) {
+		return fmt.Errorf("invalid media HMAC")
+	}
+
+	if err := file.Truncate(size - mediaHMACLength); err != nil {
+		return fmt.Errorf("failed to strip media MAC: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek media file: %v", err)
+	}
+	if err := cbcutil.DecryptFile(cipherKey, iv, file); err != nil {
+		return fmt.Errorf("failed to decrypt media: %v", err)
+	}
+
+	if len(media.FileSHA256) == 32 {
+		hasher := sha256.New()
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek media file: %v", err)
+		}
+		if _, err := io.Copy(hasher, file); err != nil {
+			return fmt.Errorf("failed to hash media file: %v", err)
+		}
+		if !bytes.Equal(hasher.Sum(nil), media.FileSHA256) {
+			return fmt.Errorf("decrypted media SHA256 mismatch")
+		}
+	}
+	return nil
+}
+
+// downloadMediaToFile downloads via whatsmeow (which resolves a fresh media host from the
+// direct path) into a temporary file, then moves it to localPath. Not resumable.
+func downloadMediaToFile(ctx context.Context, client *whatsmeow.Client, media *MediaDownloader, localPath string, progress DownloadProgressFunc) error {
+	tmpPath := localPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create media file: %v", err)
+	}
+
+	err = client.DownloadToFile(ctx, media, tmpFile)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if progress != nil {
+		progress(int64(media.FileLength), int64(media.FileLength))
+	}
+	return os.Rename(tmpPath, localPath)
+}
+
+// DownloadJob tracks a media download so clients can poll its progress
+type DownloadJob struct {
+	ID              string    `json:"job_id"`
+	MessageID       string    `json:"message_id"`
+	ChatJID         string    `json:"chat_jid"`
+	BatchID         string    `json:"batch_id,omitempty"` // Set for jobs created by a bulk chat download
+	Status          string    `json:"status"`             // "queued", "downloading", "complete" or "failed"
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+	TotalBytes      int64     `json:"total_bytes"`
+	Path            string    `json:"path,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	onDone        func(job DownloadJob) // Called once the job completes or fails
+	notifyEventID int64                 // Message event delivered to webhooks by onDone (kept for restart recovery)
+}
+
+// DownloadJobTracker holds download jobs in memory (finished jobs are pruned after an hour)
+type DownloadJobTracker struct {
+	mutex sync.RWMutex
+	jobs  map[string]*DownloadJob
+}
+
+var downloadJobs = &DownloadJobTracker{jobs: make(map[string]*DownloadJob)}
+
+// Create registers a new queued download job
+func (t *DownloadJobTracker) Create(messageID, chatJID, batchID string) *DownloadJob {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Prune finished jobs so the map doesn't grow without bound
+	for id, job := range t.jobs {
+		if (job.Status == "complete" || job.Status == "failed") && time.Since(job.UpdatedAt) > time.Hour {
+			delete(t.jobs, id)
+		}
+	}
+
+	now := time.Now().UTC()
+	job := &DownloadJob{
+		ID:        newRandomID(8),
+		MessageID: messageID,
+		ChatJID:   chatJID,
+		BatchID:   batchID,
+		Status:    "queued",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	t.jobs[job.ID] = job
+	return job
+}
+
+// Update applies fn to the job under the tracker lock
+func (t *DownloadJobTracker) Update(id string, fn func(job *DownloadJob)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if job, ok := t.jobs[id]; ok {
+		fn(job)
+		job.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// Get returns a copy of the job
+func (t *DownloadJobTracker) Get(id string) (DownloadJob, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	job, ok := t.jobs[id]
+	if !ok {
+		return DownloadJob{}, false
+	}
+	return *job, true
+}
+
+// DownloadWorkerPool runs queued download jobs on a fixed number of workers so bulk
+// operations can't spawn unbounded goroutines or saturate the media connection
+type DownloadWorkerPool struct {
+	queue   chan string // job IDs
+	workers int
+	store   *MessageStore // Queued jobs are persisted here until they finish
+}
+
+// Configured from MCP_DOWNLOAD_WORKERS / MCP_DOWNLOAD_QUEUE_SIZE in main()
+var downloadPool *DownloadWorkerPool // Workers of the primary account; see downloadPoolFor
+
+// downloadPoolFor returns the download workers of the session owning messageStore
+func downloadPoolFor(messageStore *MessageStore) *DownloadWorkerPool {
+	if account := accounts.byStore(messageStore); account != nil {
+		return account.downloads
+	}
+	return downloadPool
+}
+
+var errDownloadQueueFull = errors.New("download queue is full")
+
+func NewDownloadWorkerPool(workers, queueSize int) *DownloadWorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &DownloadWorkerPool{
+		queue:   make(chan string, queueSize),
+		workers: workers,
+	}
+}
+
+// Start launches the workers; they exit when stopChan is closed
+func (pool *DownloadWorkerPool) Start(client *whatsmeow.Client, messageStore *MessageStore, stopChan <-chan struct{}) {
+	pool.store = messageStore
+	for i := 0; i < pool.workers; i++ {
+		go func() {
+			for {
+				select {
+				case jobID := <-pool.queue:
+					runDownloadJob(client, messageStore, jobID)
+				case <-stopChan:
+					return
+				}
+			}
+		}()
+	}
+	fmt.Printf("📥 Download worker pool started (%d workers, queue size %d)\n", pool.workers, cap(pool.queue))
+}
+
+// Enqueue adds a job without blocking; returns errDownloadQueueFull when at capacity
+func (pool *DownloadWorkerPool) Enqueue(jobID string) error {
+	if job, ok := downloadJobs.Get(jobID); ok && pool.store != nil {
+		if err := pool.store.AddPendingDownload(job); err != nil {
+			fmt.Printf("Warning: failed to persist download job %s: %v\n", jobID, err)
+		}
+	}
+	select {
+	case pool.queue <- jobID:
+		return nil
+	default:
+		downloadJobs.Update(jobID, func(j *DownloadJob) {
+			j.Status = "failed"
+			j.Error = errDownloadQueueFull.Error()
+		})
+		if pool.store != nil {
+			pool.store.DeletePendingDownload(jobID)
+		}
+		return errDownloadQueueFull
+	}
+}
+
+// PendingDownload is a queued download job persisted for restart recovery
+type PendingDownload struct {
+	JobID         string
+	MessageID     string
+	ChatJID       string
+	BatchID       string
+	NotifyEventID int64
+}
+
+// Persist a queued download job
+func (store *MessageStore) AddPendingDownload(job DownloadJob) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT OR REPLACE INTO pending_downloads (job_id, message_id, chat_jid, batch_id, notify_event_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		job.ID, job.MessageID, job.ChatJID, job.BatchID, job.notifyEventID, job.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// Remove a finished download job
+func (store *MessageStore) DeletePendingDownload(jobID string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "DELETE FROM pending_downloads WHERE job_id = ?", jobID)
+	return err
+}
+
+// Get download jobs queued before the cutoff that never finished
+func (store *MessageStore) GetPendingDownloads(before time.Time) ([]PendingDownload, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT job_id, message_id, chat_jid, COALESCE(batch_id, ''), COALESCE(notify_event_id, 0)
+		FROM pending_downloads WHERE created_at < ? ORDER BY created_at`,
+		before.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []PendingDownload
+	for rows.Next() {
+		var download PendingDownload
+		if err := rows.Scan(&download.JobID, &download.MessageID, &download.ChatJID, &download.BatchID, &download.NotifyEventID); err != nil {
+			return nil, err
+		}
+		pending = append(pending, download)
+	}
+	return pending, rows.Err()
+}
+
+// QueueDepth returns the number of jobs waiting for a worker
+func (pool *DownloadWorkerPool) QueueDepth() int {
+	return len(pool.queue)
+}
+
+// Get IDs of media messages in a chat, newest first, optionally filtered by media type
+func (store *MessageStore) GetMediaMessageIDs(chatJID string, mediaTypes []string, limit int) ([]string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT id FROM messages WHERE chat_jid = ? AND media_type IS NOT NULL AND media_type != ''"
+	args := []interface{}{chatJID}
+	if len(mediaTypes) > 0 {
+		query += " AND media_type IN (?" + strings.Repeat(", ?", len(mediaTypes)-1) + ")"
+		for _, mediaType := range mediaTypes {
+			args = append(args, mediaType)
+		}
+	}
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DownloadedMedia is a chat attachment that has been downloaded to the store
+type DownloadedMedia struct {
+	MessageID string
+	Sender    string
+	Timestamp time.Time
+	MediaType string
+	Filename  string
+	LocalPath string
+}
+
+// Get the downloaded attachments of a chat, oldest first; zero since/until leave that side open
+func (store *MessageStore) GetDownloadedMedia(chatJID string, since, until time.Time) ([]DownloadedMedia, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := `SELECT id, COALESCE(sender, ''), timestamp, media_type, COALESCE(filename, ''), local_path FROM messages
+		WHERE chat_jid = ? AND local_path IS NOT NULL AND local_path != ''`
+	args := []interface{}{chatJID}
+	if !since.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, since.UTC())
+	}
+	if !until.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, until.UTC())
+	}
+
+	rows, err := store.db.QueryContext(ctx, query+" ORDER BY timestamp", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var media []DownloadedMedia
+	for rows.Next() {
+		var item DownloadedMedia
+		if err := rows.Scan(&item.MessageID, &item.Sender, &item.Timestamp, &item.MediaType, &item.Filename, &item.LocalPath); err != nil {
+			return nil, err
+		}
+		media = append(media, item)
+	}
+	return media, rows.Err()
+}
+
+// GetBatch returns copies of all jobs belonging to a bulk download batch
+func (t *DownloadJobTracker) GetBatch(batchID string) []DownloadJob {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	jobs := []DownloadJob{}
+	for _, job := range t.jobs {
+		if job.BatchID == batchID {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// defaultBlockedMediaTypes keeps executables and installers out unless MCP_MEDIA_BLOCKED_TYPES overrides it
+const defaultBlockedMediaTypes = ".exe,.msi,.bat,.cmd,.com,.scr,.pif,.cpl,.dll,.vbs,.vbe,.js,.jse,.wsf,.wsh,.ps1,.psm1,.hta,.jar,.apk,.sh,.app,.dmg,.deb,.rpm," +
+	"application/x-msdownload,application/x-msdos-program,application/x-dosexec,application/x-executable," +
+	"application/vnd.microsoft.portable-executable,application/x-sh,application/java-archive,application/vnd.android.package-archive"
+
+// MediaPolicy restricts which attachments may be sent and auto-downloaded.
+// Entries are MIME types ("image/png"), MIME families ("image/*") or extensions (".pdf").
+// MCP_MEDIA_ALLOWED_TYPES: if set, only matching media is allowed.
+// MCP_MEDIA_BLOCKED_TYPES: matching media is always rejected; defaults to common
+// executables, "none" disables blocking.
+type MediaPolicy struct {
+	allowed []string
+	blocked []string
+}
+
+var mediaPolicy MediaPolicy
+
+func loadMediaPolicy() MediaPolicy {
+	blocked, ok := os.LookupEnv("MCP_MEDIA_BLOCKED_TYPES")
+	if !ok {
+		blocked = defaultBlockedMediaTypes
+	} else if strings.EqualFold(strings.TrimSpace(blocked), "none") {
+		blocked = ""
+	}
+	return MediaPolicy{
+		allowed: parseMediaTypeList(os.Getenv("MCP_MEDIA_ALLOWED_TYPES")),
+		blocked: parseMediaTypeList(blocked),
+	}
+}
+
+func parseMediaTypeList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") && !strings.HasPrefix(entry, ".") {
+			entry = "." + entry // bare "exe" means the extension
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// matchMediaType reports whether the filename/MIME type matches any entry
+func matchMediaType(entries []string, ext, mimeType string) (string, bool) {
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry, "."):
+			if ext == entry {
+				return entry, true
+			}
+		case strings.HasSuffix(entry, "/*"):
+			if strings.HasPrefix(mimeType, strings.TrimSuffix(entry, "*")) {
+				return entry, true
+			}
+		case mimeType == entry:
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// Check returns an error when the policy does not allow media with this filename and MIME type
+func (p MediaPolicy) Check(filename, mimeType string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if base, _, found := strings.Cut(mimeType, ";"); found {
+		mimeType = strings.TrimSpace(base) // drop parameters such as "; codecs=opus"
+	}
+
+	if entry, blocked := matchMediaType(p.blocked, ext, mimeType); blocked {
+		return fmt.Errorf("media type %s is blocked by policy", entry)
+	}
+	if len(p.allowed) > 0 {
+		if _, allowed := matchMediaType(p.allowed, ext, mimeType); !allowed {
+			label := mimeType
+			if ext != "" {
+				label = fmt.Sprintf("%s (%s)", ext, mimeType)
+			}
+			return fmt.Errorf("media type %s is not in the allowed list", label)
+		}
+	}
+	return nil
+}
+
+// AutoDownloadConfig controls fetching inbound attachments as they arrive so consumers
+// don't have to call /api/download per message.
+// MCP_AUTO_DOWNLOAD_TYPES: comma-separated media types, each optionally with its own size
+// limit ("image,audio,document:10485760"), or "all" (again optionally "all:N"); empty disables auto-download.
+// MCP_AUTO_DOWNLOAD_MAX_BYTES: default size limit for types without one (default 16MB).
+type AutoDownloadConfig struct {
+	maxBytes map[string]uint64 // media type -> size limit
+	all      bool
+	allMax   uint64 // Size limit for types "all" brings in
+	defMax   uint64
+}
+
+var autoDownloadConfig AutoDownloadConfig
+
+func loadAutoDownloadConfig() AutoDownloadConfig {
+	config := AutoDownloadConfig{
+		maxBytes: make(map[string]uint64),
+		defMax:   uint64(getEnvInt("MCP_AUTO_DOWNLOAD_MAX_BYTES", 16*1024*1024)),
+	}
+	for _, entry := range strings.Split(os.Getenv("MCP_AUTO_DOWNLOAD_TYPES"), ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		mediaType, limit, hasLimit := strings.Cut(entry, ":")
+		maxBytes := config.defMax
+		if hasLimit {
+			if parsed, err := strconv.ParseUint(limit, 10, 64); err == nil {
+				maxBytes = parsed
+			} else {
+				fmt.Printf("Warning: invalid auto-download size limit %q for %s\n", limit, mediaType)
+			}
+		}
+		if mediaType == "all" {
+			config.all = true
+			config.allMax = maxBytes
+			continue
+		}
+		config.maxBytes[mediaType] = maxBytes
+	}
+	return config
+}
+
+// Enabled reports whether any media type is configured for auto-download
+func (c AutoDownloadConfig) Enabled() bool {
+	return c.all || len(c.maxBytes) > 0
+}
+
+// ShouldDownload reports whether an attachment of this type and size should be fetched on arrival
+func (c AutoDownloadConfig) ShouldDownload(mediaType string, size uint64) bool {
+	if mediaType == "" {
+		return false
+	}
+	limit, ok := c.maxBytes[mediaType]
+	if !ok {
+		if !c.all {
+			return false
+		}
+		limit = c.allMax
+	}
+	return size <= limit
+}
+
+// maybeAutoDownload queues an inbound attachment for download when auto-download allows it.
+// onDone (optional) runs when the download finishes; notifyEventID is the message event it
+// delivers, so the delivery can be redone after a restart. Returns whether a job was queued.
+func maybeAutoDownload(messageStore *MessageStore, messageID, chatJID, mediaType, filename, mimeType string, fileLength uint64, notifyEventID int64, onDone func(job DownloadJob)) bool {
+	downloadPool := downloadPoolFor(messageStore)
+	if downloadPool == nil || !autoDownloadConfig.ShouldDownload(mediaType, fileLength) {
+		return false
+	}
+	if err := mediaPolicy.Check(filename, mimeType); err != nil {
+		fmt.Printf("⚠️ Auto-download of %s skipped: %v\n", messageID, err)
+		return false
+	}
+	job := downloadJobs.Create(messageID, chatJID, "")
+	downloadJobs.Update(job.ID, func(j *DownloadJob) {
+		j.onDone = onDone
+		j.notifyEventID = notifyEventID
+	})
+	if err := downloadPool.Enqueue(job.ID); err != nil {
+		fmt.Printf("Warning: auto-download of %s skipped: %v\n", messageID, err)
+		return false
+	}
+	fmt.Printf("📥 Auto-download queued for %s media %s (job %s)\n", mediaType, messageID, job.ID)
+	return true
+}
+
+// runDownloadJob downloads the job's media, recording progress and the final result
+func runDownloadJob(client *whatsmeow.Client, messageStore *MessageStore, jobID string) {
+	job, ok := downloadJobs.Get(jobID)
+	if !ok {
+		return
+	}
+
+	downloadJobs.Update(jobID, func(j *DownloadJob) { j.Status = "downloading" })
+	success, _, _, path, err := downloadMedia(context.Background(), client, messageStore, job.MessageID, job.ChatJID, func(downloaded, total int64) {
+		downloadJobs.Update(jobID, func(j *DownloadJob) {
+			j.BytesDownloaded = downloaded
+			j.TotalBytes = total
+		})
+	})
+
+	downloadJobs.Update(jobID, func(j *DownloadJob) {
+		if !success || err != nil {
+			j.Status = "failed"
+			if err != nil {
+				j.Error = err.Error()
+			}
+			return
+		}
+		j.Status = "complete"
+		j.Path = path
+		if info, statErr := os.Stat(path); statErr == nil {
+			j.BytesDownloaded = info.Size()
+			j.TotalBytes = info.Size()
+		}
+	})
+
+	if final, ok := downloadJobs.Get(jobID); ok && final.onDone != nil {
+		final.onDone(final)
+	}
+	if err := messageStore.DeletePendingDownload(jobID); err != nil {
+		fmt.Printf("Warning: failed to clear download job %s: %v\n", jobID, err)
+	}
+}
+
+// Extract direct path from a WhatsApp media URL
+func extractDirectPathFromURL(url string) string {
+	// The direct path is typically in the URL, we need to extract it
+	// Example URL: https://mmg.whatsapp.net/v/t62.7118-24/13812002_698058036224062_3424455886509161511_n.enc?ccb=11-4&oh=...
+
+	// Find the path part after the domain
+	parts := strings.SplitN(url, ".net/", 2)
+	if len(parts) < 2 {
+		return url // Return original URL if parsing fails
+	}
+
+	pathPart := parts[1]
+
+	// Remove query parameters
+	pathPart = strings.SplitN(pathPart, "?", 2)[0]
+
+	// Create proper direct path format
+	return "/" + pathPart
+}
+
+// Chunked upload configuration
+// Large videos/documents are uploaded in chunks (initiate -> PUT chunks -> complete)
+// because reading multi-hundred-MB bodies in one request times out or OOMs the container
+const (
+	uploadChunkSize  = 8 * 1024 * 1024        // Recommended chunk size returned on initiate
+	maxUploadChunk   = 32 * 1024 * 1024       // Hard limit per PUT request
+	maxUploadSize    = 2 * 1024 * 1024 * 1024 // WhatsApp document limit (2GB)
+	uploadSessionTTL = 24 * time.Hour         // Upload sessions and their files are discarded after this
+)
+
+// UploadSession tracks a resumable upload that produces a media handle for /api/send
+type UploadSession struct {
+	ID           string    `json:"upload_id"`
+	Filename     string    `json:"filename"`
+	MimeType     string    `json:"mime_type,omitempty"`
+	TotalSize    int64     `json:"total_size"`
+	ReceivedSize int64     `json:"received_size"`
+	Status       string    `json:"status"` // "uploading" or "complete"
+	Path         string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Per-upload locks so concurrent chunk PUTs for the same upload don't interleave
+var uploadLocks sync.Map
+
+func lockUpload(id string) func() {
+	value, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// newRandomID returns a random hex identifier of n bytes
+func newRandomID(n int) string {
+	buf := make([]byte, n)
+	if _, err := cryptorand.Read(buf); err != nil {
+		// crypto/rand never fails on supported platforms; fall back to time-based ID
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// sanitizeFilename strips directory components so user-supplied names can't escape the upload directory,
+// and replaces characters Windows doesn't allow in names so stores stay portable between hosts
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "upload"
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// uploadTimeoutForSize returns a media upload timeout that grows with the file size
+// (60s base plus 1s per MB) so large videos aren't cut off by the default 60s limit
+func uploadTimeoutForSize(size int64) time.Duration {
+	return endpointTimeouts.Upload + time.Duration(size/(1024*1024))*time.Second
+}
+
+// Create a new upload session
+func (store *MessageStore) CreateUpload(session *UploadSession) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO uploads (id, filename, mime_type, total_size, received_size, status, path, created_at)
+		VALUES (?, ?, ?, ?, 0, ?, ?, ?)`,
+		session.ID, session.Filename, session.MimeType, session.TotalSize, session.Status, session.Path, session.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// Get an upload session by ID
+func (store *MessageStore) GetUpload(id string) (*UploadSession, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var session UploadSession
+	var mimeType sql.NullString
+	err := store.db.QueryRowContext(ctx,
+		"SELECT id, filename, mime_type, total_size, received_size, status, path, created_at FROM uploads WHERE id = ?",
+		id,
+	).Scan(&session.ID, &session.Filename, &mimeType, &session.TotalSize, &session.ReceivedSize, &session.Status, &session.Path, &session.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	session.MimeType = mimeType.String
+	return &session, nil
+}
+
+// Update the received byte count of an upload
+func (store *MessageStore) UpdateUploadProgress(id string, receivedSize int64) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "UPDATE uploads SET received_size = ? WHERE id = ?", receivedSize, id)
+	return err
+}
+
+// Mark an upload as complete with its final file path
+func (store *MessageStore) CompleteUpload(id, path string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE uploads SET status = 'complete', path = ?, completed_at = ? WHERE id = ?",
+		path, time.Now().UTC(), id,
+	)
+	return err
+}
+
+// Delete an upload session record
+func (store *MessageStore) DeleteUpload(id string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "DELETE FROM uploads WHERE id = ?", id)
+	return err
+}
+
+// Get IDs of uploads created before the given time. Uploads that an unfinished outbox send,
+// an approval still to be sent or a campaign yet to finish refers to (by media_path or
+// media_handle, both of which carry the upload ID) are kept until it is done with them.
+func (store *MessageStore) GetExpiredUploads(before time.Time) ([]string, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT id FROM uploads u WHERE created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM outbox o WHERE o.status IN (?, ?) AND instr(o.request, u.id) > 0)
+		AND NOT EXISTS (SELECT 1 FROM pending_sends p WHERE p.status IN (?, ?) AND instr(p.request, u.id) > 0)
+		AND NOT EXISTS (SELECT 1 FROM campaigns c WHERE c.status IN (?, ?, ?) AND instr(c.media_path, u.id) > 0)`,
+		before.UTC(), outboxQueued, outboxSending, approvalPending, approvalSending,
+		campaignScheduled, campaignRunning, campaignPaused,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// initiateUpload creates a new upload session and its staging file
+func initiateUpload(messageStore *MessageStore, filename, mimeType string, totalSize int64) (*UploadSession, error) {
+	if totalSize < 0 || totalSize > maxUploadSize {
+		return nil, fmt.Errorf("total_size must be between 0 and %d bytes", int64(maxUploadSize))
+	}
+
+	session := &UploadSession{
+		ID:        newRandomID(16),
+		Filename:  sanitizeFilename(filename),
+		MimeType:  mimeType,
+		TotalSize: totalSize,
+		Status:    "uploading",
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// Each upload gets its own directory so the final file keeps its original name
+	// (the basename is used as the document title when sending)
+	sessionDir := filepath.Join(storeDir, "uploads", session.ID)
+	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	session.Path = filepath.Join(sessionDir, session.Filename+".part")
+
+	partFile, err := os.Create(session.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %v", err)
+	}
+	partFile.Close()
+
+	if err := messageStore.CreateUpload(session); err != nil {
+		os.RemoveAll(sessionDir)
+		return nil, fmt.Errorf("failed to create upload session: %v", err)
+	}
+
+	return session, nil
+}
+
+// writeUploadChunk writes a chunk at the given offset. Re-sending an already received
+// range is allowed (idempotent retries), but gaps are rejected so the file stays contiguous.
+func writeUploadChunk(messageStore *MessageStore, id string, offset int64, body io.Reader) (*UploadSession, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	session, err := messageStore.GetUpload(id)
+	if err != nil {
+		return nil, fmt.Errorf("upload not found")
+	}
+	if session.Status != "uploading" {
+		return nil, fmt.Errorf("upload is already %s", session.Status)
+	}
+	if offset < 0 || offset > session.ReceivedSize {
+		return nil, fmt.Errorf("invalid offset %d (expected <= %d)", offset, session.ReceivedSize)
+	}
+
+	partFile, err := os.OpenFile(session.Path, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %v", err)
+	}
+	defer partFile.Close()
+
+	if _, err := partFile.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek upload file: %v", err)
+	}
+
+	written, err := io.Copy(partFile, io.LimitReader(body, maxUploadChunk+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write chunk: %v", err)
+	}
+	if written > maxUploadChunk {
+		return nil, fmt.Errorf("chunk exceeds maximum size of %d bytes", maxUploadChunk)
+	}
+
+	end := offset + written
+	if session.TotalSize > 0 && end > session.TotalSize {
+		return nil, fmt.Errorf("chunk exceeds declared total_size of %d bytes", session.TotalSize)
+	}
+	if end > maxUploadSize {
+		return nil, fmt.Errorf("upload exceeds maximum size of %d bytes", int64(maxUploadSize))
+	}
+
+	if end > session.ReceivedSize {
+		session.ReceivedSize = end
+		if err := messageStore.UpdateUploadProgress(id, session.ReceivedSize); err != nil {
+			return nil, fmt.Errorf("failed to record upload progress: %v", err)
+		}
+	}
+
+	return session, nil
+}
+
+// finishUpload verifies the received data and moves the staging file into place
+func finishUpload(messageStore *MessageStore, id, expectedSHA256 string) (*UploadSession, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	session, err := messageStore.GetUpload(id)
+	if err != nil {
+		return nil, fmt.Errorf("upload not found")
+	}
+	if session.Status == "complete" {
+		return session, nil
+	}
+	if session.ReceivedSize == 0 {
+		return nil, fmt.Errorf("no data received")
+	}
+	if session.TotalSize > 0 && session.ReceivedSize != session.TotalSize {
+		return nil, fmt.Errorf("incomplete upload: received %d of %d bytes", session.ReceivedSize, session.TotalSize)
+	}
+
+	// Drop any bytes beyond the acknowledged size (e.g. from an aborted chunk)
+	if err := os.Truncate(session.Path, session.ReceivedSize); err != nil {
+		return nil, fmt.Errorf("failed to finalize upload file: %v", err)
+	}
+
+	if expectedSHA256 != "" {
+		partFile, err := os.Open(session.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open upload file: %v", err)
+		}
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, partFile)
+		partFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash upload file: %v", err)
+		}
+		if !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), expectedSHA256) {
+			return nil, fmt.Errorf("sha256 mismatch")
+		}
+	}
+
+	finalPath := strings.TrimSuffix(session.Path, ".part")
+	if err := os.Rename(session.Path, finalPath); err != nil {
+		return nil, fmt.Errorf("failed to finalize upload file: %v", err)
+	}
+	if err := messageStore.CompleteUpload(id, finalPath); err != nil {
+		return nil, fmt.Errorf("failed to complete upload session: %v", err)
+	}
+
+	session.Status = "complete"
+	session.Path = finalPath
+	fmt.Printf("📤 Upload %s complete: %s (%d bytes)\n", id, session.Filename, session.ReceivedSize)
+	return session, nil
+}
+
+// resolveMediaHandle returns the local file path for a completed upload
+func resolveMediaHandle(messageStore *MessageStore, handle string) (string, error) {
+	session, err := messageStore.GetUpload(handle)
+	if err != nil {
+		return "", fmt.Errorf("unknown media handle")
+	}
+	if session.Status != "complete" {
+		return "", fmt.Errorf("upload %s is not complete", handle)
+	}
+	return session.Path, nil
+}
+
+// inlineMediaMaxBytes caps media sent as media_base64 or media_url (MCP_INLINE_MEDIA_MAX_MB)
+var inlineMediaMaxBytes int64 = 64 << 20
+
+// mediaURLAllowedHosts may be fetched through media_url even though they resolve to private
+// addresses, e.g. the backend's container (MCP_MEDIA_URL_ALLOWED_HOSTS, comma-separated)
+var mediaURLAllowedHosts = map[string]bool{}
+
+// Extensions for MIME types that can't be inferred from a name (mediaTypeForFile goes by extension)
+var inlineMediaExtensions = map[string]string{
+	"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp",
+	"audio/ogg": ".ogg", "audio/mpeg": ".mp3", "audio/mp4": ".m4a", "audio/aac": ".aac", "audio/amr": ".amr",
+	"video/mp4": ".mp4", "video/quicktime": ".mov", "application/pdf": ".pdf",
+}
+
+// inlineMediaFilename makes sure a name carries an extension matching its MIME type
+func inlineMediaFilename(name, mimeType string) string {
+	name = sanitizeFilename(name)
+	if filepath.Ext(name) != "" {
+		return name
+	}
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	if ext, ok := inlineMediaExtensions[mediaType]; ok {
+		return name + ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return name + exts[0]
+	}
+	return name
+}
+
+// isPublicIP reports whether an address is routable on the internet (not loopback, private,
+// link-local, carrier-grade NAT, multicast or unspecified)
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil && (ip4[0] == 0 || (ip4[0] == 100 && ip4[1]&0xc0 == 64)) {
+		return false
+	}
+	return true
+}
+
+// publicDialContext dials only public addresses, except for hosts in allowed. Addresses are
+// checked after DNS resolution, so a public name can't be pointed (or rebound) at an internal service.
+func publicDialContext(purpose string, allowed map[string]bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		if !allowed[strings.ToLower(host)] {
+			dialer.Control = func(network, address string, _ syscall.RawConn) error {
+				ipStr, _, _ := net.SplitHostPort(address)
+				if ip := net.ParseIP(ipStr); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("%s host %s resolves to a non-public address", purpose, host)
+				}
+				return nil
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// checkPublicHost resolves a host up front so a non-public target is refused when it is
+// configured, not only when it is first dialed
+func checkPublicHost(ctx context.Context, purpose, host string, allowed map[string]bool) error {
+	host = strings.ToLower(host)
+	if allowed[host] {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%s host %s does not resolve: %v", purpose, host, err)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%s host %s resolves to a non-public address", purpose, host)
+		}
+	}
+	return nil
+}
+
+// mediaURLClient fetches media_url, checking the address of every redirect hop
+var mediaURLClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 nil,
+		DialContext:           publicDialContext("media_url", mediaURLAllowedHosts),
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// stageInlineMedia writes inline media to a completed upload session, so the send, an
+// approval queued for later and the upload janitor all treat it like a chunked upload
+func stageInlineMedia(messageStore *MessageStore, filename, mimeType string, body io.Reader) (string, error) {
+	session, err := initiateUpload(messageStore, filename, mimeType, 0)
+	if err != nil {
+		return "", err
+	}
+	discard := func() {
+		os.RemoveAll(filepath.Dir(session.Path))
+		messageStore.DeleteUpload(session.ID)
+	}
+
+	partFile, err := os.OpenFile(session.Path, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		discard()
+		return "", fmt.Errorf("failed to open upload file: %v", err)
+	}
+	written, err := io.Copy(partFile, io.LimitReader(body, inlineMediaMaxBytes+1))
+	partFile.Close()
+	if err != nil {
+		discard()
+		return "", err
+	}
+	if written > inlineMediaMaxBytes {
+		discard()
+		return "", fmt.Errorf("media exceeds the %d byte limit for inline media", inlineMediaMaxBytes)
+	}
+	if written == 0 {
+		discard()
+		return "", fmt.Errorf("media is empty")
+	}
+
+	finalPath := strings.TrimSuffix(session.Path, ".part")
+	if err := os.Rename(session.Path, finalPath); err != nil {
+		discard()
+		return "", fmt.Errorf("failed to finalize media: %v", err)
+	}
+	if err := messageStore.UpdateUploadProgress(session.ID, written); err != nil {
+		fmt.Printf("Warning: failed to record inline media size: %v\n", err)
+	}
+	if err := messageStore.CompleteUpload(session.ID, finalPath); err != nil {
+		discard()
+		return "", fmt.Errorf("failed to record media: %v", err)
+	}
+	return finalPath, nil
+}
+
+// resolveInlineMedia turns media_base64 or media_url into a local media_path. The inline
+// fields are cleared so requests queued for approval don't carry the payload.
+func resolveInlineMedia(ctx context.Context, messageStore *MessageStore, req *SendMessageRequest) error {
+	if req.MediaBase64 == "" && req.MediaURL == "" {
+		return nil
+	}
+	if (req.MediaBase64 != "" && req.MediaURL != "") || req.MediaPath != "" || req.MediaHandle != "" {
+		return fmt.Errorf("only one of media_path, media_handle, media_base64 or media_url may be set")
+	}
+
+	if req.MediaBase64 != "" {
+		// Accept data URIs (data:image/png;base64,...) as well as bare base64
+		payload, mimeType := req.MediaBase64, ""
+		if rest, ok := strings.CutPrefix(payload, "data:"); ok {
+			header, data, found := strings.Cut(rest, ",")
+			if !found || !strings.HasSuffix(header, ";base64") {
+				return fmt.Errorf("media_base64 data URI must be base64 encoded")
+			}
+			mimeType, payload = strings.TrimSuffix(header, ";base64"), data
+		}
+		if req.MediaFilename == "" && mimeType == "" {
+			return fmt.Errorf("media_filename is required with media_base64")
+		}
+		name := req.MediaFilename
+		if name == "" {
+			name = "media"
+		}
+		if int64(base64.StdEncoding.DecodedLen(len(payload))) > inlineMediaMaxBytes+2 {
+			return fmt.Errorf("media exceeds the %d byte limit for inline media", inlineMediaMaxBytes)
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return fmt.Errorf("media_base64 is not valid base64: %v", err)
+		}
+		path, err := stageInlineMedia(messageStore, inlineMediaFilename(name, mimeType), mimeType, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.MediaPath, req.MediaBase64 = path, ""
+		return nil
+	}
+
+	mediaURL, err := url.Parse(req.MediaURL)
+	if err != nil || (mediaURL.Scheme != "http" && mediaURL.Scheme != "https") || mediaURL.Host == "" {
+		return fmt.Errorf("media_url must be an http(s) URL")
+	}
+	fetchCtx, cancel := withOptionalTimeout(ctx, endpointTimeouts.Download)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, mediaURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := mediaURLClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to fetch media_url: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch media_url: %s", resp.Status)
+	}
+	if resp.ContentLength > inlineMediaMaxBytes {
+		return fmt.Errorf("media exceeds the %d byte limit for inline media", inlineMediaMaxBytes)
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	name := req.MediaFilename
+	if name == "" {
+		name = filepath.Base(resp.Request.URL.Path)
+	}
+	if name == "" || name == "/" || name == "." {
+		name = "media"
+	}
+	staged, err := stageInlineMedia(messageStore, inlineMediaFilename(name, mimeType), mimeType, resp.Body)
+	if err != nil {
+		return err
+	}
+	req.MediaPath, req.MediaURL = staged, ""
+	return nil
+}
+
+// StartUploadJanitor periodically removes upload sessions older than uploadSessionTTL
+func (store *MessageStore) StartUploadJanitor(stopChan <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ids, err := store.GetExpiredUploads(time.Now().Add(-uploadSessionTTL))
+				if err != nil {
+					fmt.Printf("Warning: Failed to list expired uploads: %v\n", err)
+					continue
+				}
+				for _, id := range ids {
+					unlock := lockUpload(id)
+					os.RemoveAll(filepath.Join(storeDir, "uploads", id))
+					store.DeleteUpload(id)
+					unlock()
+					uploadLocks.Delete(id)
+				}
+				if len(ids) > 0 {
+					fmt.Printf("🧹 Removed %d expired uploads\n", len(ids))
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Webhook media delivery modes
+const (
+	webhookMediaMetadata = "metadata" // Media fields only (type, filename, size, local path)
+	webhookMediaURL      = "url"      // Adds a presigned streaming URL to /api/media/stream
+	webhookMediaInline   = "inline"   // Adds base64 file content when under inline_max_bytes
+)
+
+// Default inline size threshold for webhooks that don't set one
+const defaultWebhookInlineMaxBytes = 1024 * 1024
+
+// Webhook is a registered destination for inbound message events
+type Webhook struct {
+	ID             string    `json:"id"`
+	URL            string    `json:"url"`
+	MediaMode      string    `json:"media_mode"`
+	InlineMaxBytes int64     `json:"inline_max_bytes"`
+	CreatedAt      time.Time `json:"created_at"`
+	Secret         string    `json:"-"` // Only returned when the webhook is created
+}
+
+// WebhookMessage is the message payload delivered to webhooks
+type WebhookMessage struct {
+	ID            string             `json:"id"`
+	ChatJID       string             `json:"chat_jid"`
+	ChatName      string             `json:"chat_name,omitempty"`
+	Sender        string             `json:"sender"`
+	Content       string             `json:"content"`
+	ContentType   string             `json:"content_type,omitempty"`
+	Timestamp     string             `json:"timestamp"`
+	IsFromMe      bool               `json:"is_from_me"`
+	MediaType     string             `json:"media_type,omitempty"`
+	Filename      string             `json:"filename,omitempty"`
+	FileLength    uint64             `json:"file_length,omitempty"`
+	LocalPath     string             `json:"local_path,omitempty"`
+	BroadcastJID  string             `json:"broadcast_jid,omitempty"`
+	MentionsAll   bool               `json:"mentions_all,omitempty"`
+	GroupMentions []GroupMentionInfo `json:"group_mentions,omitempty"`
+	QuotedID      string             `json:"quoted_message_id,omitempty"`
+	QuotedSender  string             `json:"quoted_sender,omitempty"`
+	HandoffState  string             `json:"handoff_state,omitempty"`
+	Assignee      string             `json:"assignee,omitempty"`
+	Media         *WebhookMedia      `json:"media,omitempty"`
+}
+
+// WebhookMedia carries the attachment according to the webhook's media mode
+type WebhookMedia struct {
+	Mode         string `json:"mode"`
+	FileURL      string `json:"file_url,omitempty"` // Authenticated media file server URL (once downloaded)
+	URL          string `json:"url,omitempty"`
+	URLExpiresAt string `json:"url_expires_at,omitempty"`
+	Base64       string `json:"base64,omitempty"`
+}
+
+// Base URL used when building media URLs for webhook payloads (MCP_PUBLIC_URL)
+var publicBaseURL string
+
+// Key used to sign media stream URLs; falls back to a per-process random key
+// when MCP_API_SECRET is not configured
+var mediaSigningKey []byte
+var mediaSigningKeyOnce sync.Once
+
+func getMediaSigningKey() []byte {
+	mediaSigningKeyOnce.Do(func() {
+		if apiSecret != "" {
+			mediaSigningKey = []byte(apiSecret)
+		} else {
+			mediaSigningKey = []byte(newRandomID(32))
+		}
+	})
+	return mediaSigningKey
+}
+
+// signMediaStream returns the signature for a media stream URL
+func signMediaStream(chatJID, messageID string, expires int64) string {
+	mac := hmac.New(sha256.New, getMediaSigningKey())
+	fmt.Fprintf(mac, "%s|%s|%d", chatJID, messageID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// buildMediaStreamURL returns a presigned URL for streaming a message's media
+func buildMediaStreamURL(chatJID, messageID string, ttl time.Duration) (string, time.Time) {
+	expiresAt := time.Now().Add(ttl)
+	query := url.Values{}
+	query.Set("chat_jid", chatJID)
+	query.Set("message_id", messageID)
+	query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set("sig", signMediaStream(chatJID, messageID, expiresAt.Unix()))
+	return strings.TrimSuffix(publicBaseURL, "/") + "/api/media/stream?" + query.Encode(), expiresAt
+}
+
+// verifyMediaStreamSignature checks a presigned media URL
+func verifyMediaStreamSignature(chatJID, messageID, expiresParam, sig string) bool {
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := signMediaStream(chatJID, messageID, expires)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+// Create a webhook
+func (store *MessageStore) CreateWebhook(webhook *Webhook) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"INSERT INTO webhooks (id, url, media_mode, inline_max_bytes, created_at, secret) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))",
+		webhook.ID, webhook.URL, webhook.MediaMode, webhook.InlineMaxBytes, webhook.CreatedAt.UTC(), webhook.Secret,
+	)
+	return err
+}
+
+// Get all webhooks
+func (store *MessageStore) GetWebhooks() ([]Webhook, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT id, url, media_mode, inline_max_bytes, created_at, COALESCE(secret, '') FROM webhooks ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &webhook.MediaMode, &webhook.InlineMaxBytes, &webhook.CreatedAt, &webhook.Secret); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// Delete a webhook, reporting whether it existed
+func (store *MessageStore) DeleteWebhook(id string) (bool, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	if affected > 0 {
+		store.writer.ExecContext(ctx, "DELETE FROM webhook_stats WHERE webhook_id = ?", id)
+		store.writer.ExecContext(ctx, "DELETE FROM webhook_dead_letters WHERE webhook_id = ?", id)
+	}
+	return affected > 0, nil
+}
+
+// WebhookStats summarizes delivery attempts for one webhook
+type WebhookStats struct {
+	WebhookID          string  `json:"webhook_id"`
+	URL                string  `json:"url"`
+	Delivered          int64   `json:"delivered"`
+	Failed             int64   `json:"failed"` // Failed attempts, including ones later retried successfully
+	SuccessRate        float64 `json:"success_rate"`
+	LastSuccessAt      string  `json:"last_success_at,omitempty"`
+	LastFailureAt      string  `json:"last_failure_at,omitempty"`
+	LastError          string  `json:"last_error,omitempty"`
+	PendingDeliveries  int64   `json:"pending_deliveries"` // Not yet accepted (in flight or awaiting retry)
+	PendingRetries     int64   `json:"pending_retries"`    // Pending deliveries that already failed at least once
+	OldestPendingEvent int64   `json:"oldest_pending_event_id,omitempty"`
+	DeadLetters        int64   `json:"dead_letters"` // Deliveries abandoned after the last retry
+}
+
+// Record the outcome of one webhook POST
+func (store *MessageStore) RecordWebhookAttempt(webhookID string, deliveryErr error) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	now := time.Now().UTC()
+	if deliveryErr == nil {
+		_, err := store.writer.ExecContext(ctx,
+			`INSERT INTO webhook_stats (webhook_id, delivered, last_success_at) VALUES (?, 1, ?)
+			ON CONFLICT(webhook_id) DO UPDATE SET delivered = delivered + 1, last_success_at = excluded.last_success_at`,
+			webhookID, now,
+		)
+		return err
+	}
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO webhook_stats (webhook_id, failed, last_failure_at, last_error) VALUES (?, 1, ?, ?)
+		ON CONFLICT(webhook_id) DO UPDATE SET failed = failed + 1, last_failure_at = excluded.last_failure_at,
+			last_error = excluded.last_error`,
+		webhookID, now, deliveryErr.Error(),
+	)
+	return err
+}
+
+// Get delivery stats for every registered webhook
+func (store *MessageStore) GetWebhookStats() ([]WebhookStats, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, `
+		SELECT w.id, w.url, COALESCE(s.delivered, 0), COALESCE(s.failed, 0),
+			s.last_success_at, s.last_failure_at, s.last_error,
+			(SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id),
+			(SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.attempts > 0),
+			(SELECT MIN(event_id) FROM webhook_deliveries d WHERE d.webhook_id = w.id),
+			(SELECT COUNT(*) FROM webhook_dead_letters l WHERE l.webhook_id = w.id)
+		FROM webhooks w
+		LEFT JOIN webhook_stats s ON s.webhook_id = w.id
+		ORDER BY w.created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []WebhookStats{}
+	for rows.Next() {
+		var stat WebhookStats
+		var lastSuccess, lastFailure sql.NullTime
+		var lastError sql.NullString
+		var oldestPending sql.NullInt64
+		if err := rows.Scan(&stat.WebhookID, &stat.URL, &stat.Delivered, &stat.Failed,
+			&lastSuccess, &lastFailure, &lastError, &stat.PendingDeliveries, &stat.PendingRetries, &oldestPending, &stat.DeadLetters); err != nil {
+			return nil, err
+		}
+		if total := stat.Delivered + stat.Failed; total > 0 {
+			stat.SuccessRate = math.Round(float64(stat.Delivered)/float64(total)*1000) / 1000
+		}
+		if lastSuccess.Valid {
+			stat.LastSuccessAt = lastSuccess.Time.UTC().Format(time.RFC3339)
+		}
+		if lastFailure.Valid {
+			stat.LastFailureAt = lastFailure.Time.UTC().Format(time.RFC3339)
+		}
+		stat.LastError = lastError.String
+		stat.OldestPendingEvent = oldestPending.Int64
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// webhookAllowedHosts may receive webhooks even though they resolve to private addresses,
+// e.g. the backend's container (MCP_WEBHOOK_ALLOWED_HOSTS, comma-separated; the fallback
+// webhook's host is always allowed)
+var webhookAllowedHosts = map[string]bool{}
+
+// Shared HTTP client for webhook deliveries; like mediaURLClient it only dials public addresses
+var webhookHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy:               nil,
+		DialContext:         publicDialContext("webhook", webhookAllowedHosts),
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// dispatchMessageWebhooks delivers an inbound message to every registered webhook
+func dispatchMessageWebhooks(client *whatsmeow.Client, messageStore *MessageStore, eventID int64, message WebhookMessage) {
+	webhooks, err := messageStore.GetWebhooks()
+	if err != nil {
+		fmt.Printf("Warning: failed to load webhooks: %v\n", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		go deliverMessageWebhook(client, messageStore, webhook, eventID, message)
+	}
+}
+
+// deliverMessageWebhook applies the webhook's media mode and POSTs the payload
+func deliverMessageWebhook(client *whatsmeow.Client, messageStore *MessageStore, webhook Webhook, eventID int64, message WebhookMessage) error {
+	if message.MediaType != "" {
+		message.Media = buildWebhookMedia(client, messageStore, webhook, message)
+	}
+
+	body, err := eventWebhookBody("message", eventID, message)
+	if err != nil {
+		fmt.Printf("Warning: failed to encode webhook payload: %v\n", err)
+		return err
+	}
+
+	return deliverWebhook(messageStore, webhook, eventID, body)
+}
+
+// eventWebhookBody encodes a webhook payload as {"event": event, "event_id": id, event: payload}
+func eventWebhookBody(event string, eventID int64, payload interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":    event,
+		"event_id": eventID,
+		event:      payload,
+	})
+}
+
+// deliverWebhook records the delivery before POSTing it and clears the record once the
+// endpoint accepts it, so deliveries cut short by a restart are resumed on boot. The first
+// attempt's result is returned; a failed delivery keeps retrying in the background.
+func deliverWebhook(messageStore *MessageStore, webhook Webhook, eventID int64, body []byte) error {
+	drainState.beginWebhook()
+	defer drainState.endWebhook()
+
+	deliveryID, err := messageStore.AddWebhookDelivery(webhook.ID, eventID, body)
+	if err != nil {
+		fmt.Printf("Warning: failed to persist webhook delivery: %v\n", err)
+	}
+	if err := attemptWebhook(messageStore, webhook, body); err != nil {
+		fmt.Printf("⚠️ Webhook %s delivery failed: %v\n", webhook.ID, err)
+		if deliveryID > 0 {
+			if err := messageStore.ScheduleWebhookRetry(deliveryID, 1, time.Now().Add(webhookRetry.Backoff(1))); err != nil {
+				fmt.Printf("Warning: failed to schedule webhook retry: %v\n", err)
+			}
+		}
+		return err
+	}
+	if deliveryID > 0 {
+		messageStore.DeleteWebhookDelivery(deliveryID)
+	}
+	return nil
+}
+
+// WebhookRetryPolicy bounds webhook retries (MCP_WEBHOOK_MAX_ATTEMPTS, MCP_WEBHOOK_RETRY_BASE_SEC)
+type WebhookRetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var webhookRetry = WebhookRetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+// Backoff returns the wait before the next attempt of a delivery that failed attempts times
+func (p WebhookRetryPolicy) Backoff(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// Webhook retry worker timing
+const (
+	webhookRetryInterval = 1 * time.Second // How often the worker looks for due retries
+	webhookDeliveryLease = 1 * time.Minute // A claimed retry is due again after this, should the attempt be cut short
+)
+
+// startWebhookRetries retries failed webhook deliveries as their backoff runs out and moves
+// them to the dead-letter table once they have failed MaxAttempts times. Nothing is retried
+// while draining; the deliveries stay persisted so the next boot resumes them.
+func startWebhookRetries(messageStore *MessageStore, stopChan <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(webhookRetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for !drainState.isDraining() && retryDueWebhookDelivery(messageStore) {
+				}
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// retryDueWebhookDelivery makes one attempt at the next due webhook retry; false when there
+// was none to attempt
+func retryDueWebhookDelivery(messageStore *MessageStore) bool {
+	delivery, found, err := messageStore.ClaimDueWebhookDelivery()
+	if err != nil || !found {
+		if err != nil {
+			fmt.Printf("Warning: failed to claim webhook retry: %v\n", err)
+		}
+		return false
+	}
+	webhook, found, err := findWebhook(messageStore, delivery.WebhookID)
+	if err != nil {
+		fmt.Printf("Warning: failed to load webhooks: %v\n", err)
+		return false
+	}
+	if !found {
+		messageStore.DeleteWebhookDelivery(delivery.ID)
+		return true
+	}
+
+	var lastErr error
+	if delivery.Attempts < webhookRetry.MaxAttempts {
+		drainState.beginWebhook()
+		lastErr = attemptWebhook(messageStore, webhook, delivery.Body)
+		drainState.endWebhook()
+		if lastErr == nil {
+			messageStore.DeleteWebhookDelivery(delivery.ID)
+			return true
+		}
+		delivery.Attempts++
+		fmt.Printf("⚠️ Webhook %s retry %d/%d of event %d failed: %v\n",
+			webhook.ID, delivery.Attempts, webhookRetry.MaxAttempts, delivery.EventID, lastErr)
+		// Recorded even for the last attempt, which the dead letter counts too
+		next := time.Now().Add(webhookRetry.Backoff(delivery.Attempts))
+		if err := messageStore.ScheduleWebhookRetry(delivery.ID, delivery.Attempts, next); err != nil {
+			fmt.Printf("Warning: failed to schedule webhook retry: %v\n", err)
+		}
+		if delivery.Attempts < webhookRetry.MaxAttempts {
+			return true
+		}
+	}
+
+	errorText := ""
+	if lastErr != nil {
+		errorText = lastErr.Error()
+	}
+	if err := messageStore.DeadLetterWebhookDelivery(delivery.ID, errorText); err != nil {
+		fmt.Printf("Warning: failed to dead-letter webhook delivery %d: %v\n", delivery.ID, err)
+		return true
+	}
+	fmt.Printf("☠️ Webhook %s delivery of event %d dead-lettered after %d attempts\n", webhook.ID, delivery.EventID, delivery.Attempts)
+	return true
+}
+
+// findWebhook looks up a registered webhook, or the fallback webhook, by ID
+func findWebhook(messageStore *MessageStore, id string) (Webhook, bool, error) {
+	if fallbackWebhook != nil && id == fallbackWebhook.ID {
+		return *fallbackWebhook, true, nil
+	}
+	webhooks, err := messageStore.GetWebhooks()
+	if err != nil {
+		return Webhook{}, false, err
+	}
+	index := slices.IndexFunc(webhooks, func(webhook Webhook) bool { return webhook.ID == id })
+	if index < 0 {
+		return Webhook{}, false, nil
+	}
+	return webhooks[index], true, nil
+}
+
+// WebhookDeadLetter is a delivery abandoned after its last retry
+type WebhookDeadLetter struct {
+	ID        int64           `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	EventID   int64           `json:"event_id"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt string          `json:"created_at"`
+	FailedAt  string          `json:"failed_at"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+// Move a pending webhook delivery to the dead-letter table
+func (store *MessageStore) DeadLetterWebhookDelivery(id int64, lastError string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	tx, err := store.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO webhook_dead_letters (webhook_id, event_id, body, attempts, last_error, created_at, failed_at)
+		SELECT webhook_id, event_id, body, attempts, NULLIF(?, ''), created_at, ? FROM webhook_deliveries WHERE id = ?`,
+		lastError, time.Now().UTC(), id,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get dead-lettered deliveries, newest first (webhookID "" = all webhooks)
+func (store *MessageStore) GetWebhookDeadLetters(webhookID string, limit int, withBody bool) ([]WebhookDeadLetter, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	query := "SELECT id, webhook_id, event_id, attempts, last_error, created_at, failed_at, body FROM webhook_dead_letters"
+	var args []interface{}
+	if webhookID != "" {
+		query += " WHERE webhook_id = ?"
+		args = append(args, webhookID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []WebhookDeadLetter{}
+	for rows.Next() {
+		var deadLetter WebhookDeadLetter
+		var lastError sql.NullString
+		var createdAt, failedAt sql.NullTime
+		var body string
+		if err := rows.Scan(&deadLetter.ID, &deadLetter.WebhookID, &deadLetter.EventID, &deadLetter.Attempts,
+			&lastError, &createdAt, &failedAt, &body); err != nil {
+			return nil, err
+		}
+		deadLetter.LastError = lastError.String
+		if createdAt.Valid {
+			deadLetter.CreatedAt = createdAt.Time.UTC().Format(time.RFC3339)
+		}
+		if failedAt.Valid {
+			deadLetter.FailedAt = failedAt.Time.UTC().Format(time.RFC3339)
+		}
+		if withBody {
+			deadLetter.Body = json.RawMessage(body)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+// Remove a dead-lettered delivery and return it (for retry or purge)
+func (store *MessageStore) TakeWebhookDeadLetter(id int64) (WebhookDelivery, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var delivery WebhookDelivery
+	var body string
+	// One statement, so two concurrent takes can't both get (and redeliver) it
+	err := store.writer.QueryRowContext(ctx,
+		"DELETE FROM webhook_dead_letters WHERE id = ? RETURNING id, webhook_id, event_id, body, attempts", id,
+	).Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &body, &delivery.Attempts)
+	delivery.Body = []byte(body)
+	return delivery, err
+}
+
+// attemptWebhook POSTs a payload once and records the outcome in the webhook's stats
+func attemptWebhook(messageStore *MessageStore, webhook Webhook, body []byte) error {
+	err := postWebhook(webhook, body)
+	if statsErr := messageStore.RecordWebhookAttempt(webhook.ID, err); statsErr != nil {
+		fmt.Printf("Warning: failed to record webhook stats: %v\n", statsErr)
+	}
+	return err
+}
+
+// signWebhookBody returns the X-Webhook-Signature value: HMAC-SHA256 over "<timestamp>.<body>"
+func signWebhookBody(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends an encoded payload to one webhook, signed when it has a secret
+func postWebhook(webhook Webhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-Webhook-Signature", signWebhookBody(webhook.Secret, timestamp, body))
+	}
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// WebhookDelivery is a webhook POST that has not been accepted yet
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID string
+	EventID   int64
+	Body      []byte
+	Attempts  int
+}
+
+// Record a webhook delivery about to be attempted
+func (store *MessageStore) AddWebhookDelivery(webhookID string, eventID int64, body []byte) (int64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	result, err := store.writer.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries (webhook_id, event_id, body, attempts, created_at) VALUES (?, ?, ?, 0, ?)",
+		webhookID, eventID, string(body), time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Record a webhook delivery's failed attempts and when to try it next
+func (store *MessageStore) ScheduleWebhookRetry(id int64, attempts int, next time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE webhook_deliveries SET attempts = ?, next_attempt_at = ? WHERE id = ?",
+		attempts, next.UTC(), id,
+	)
+	return err
+}
+
+// Schedule a delivery whose first attempt was cut short; already scheduled retries keep their time
+func (store *MessageStore) ResumeWebhookDelivery(id int64, next time.Time) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		"UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND next_attempt_at IS NULL",
+		next.UTC(), id,
+	)
+	return err
+}
+
+// Claim the webhook retry that has been due longest, leasing it for webhookDeliveryLease;
+// found is false when none is due
+func (store *MessageStore) ClaimDueWebhookDelivery() (delivery WebhookDelivery, found bool, err error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	now := time.Now().UTC()
+	var body string
+	err = store.writer.QueryRowContext(ctx,
+		`UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id = (SELECT id FROM webhook_deliveries WHERE next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT 1)
+		RETURNING id, webhook_id, event_id, body, attempts`,
+		now.Add(webhookDeliveryLease), now,
+	).Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &body, &delivery.Attempts)
+	if err == sql.ErrNoRows {
+		return delivery, false, nil
+	}
+	delivery.Body = []byte(body)
+	return delivery, err == nil, err
+}
+
+// Remove a webhook delivery once accepted (or abandoned)
+func (store *MessageStore) DeleteWebhookDelivery(id int64) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE id = ?", id)
+	return err
+}
+
+// Get webhook deliveries recorded before the cutoff that were never accepted, oldest first
+func (store *MessageStore) GetWebhookDeliveries(before time.Time) ([]WebhookDelivery, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx,
+		"SELECT id, webhook_id, event_id, body, attempts FROM webhook_deliveries WHERE created_at < ? ORDER BY id",
+		before.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var body string
+		if err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &body, &delivery.Attempts); err != nil {
+			return nil, err
+		}
+		delivery.Body = []byte(body)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// dispatchEventWebhooks records a non-message event for replay and delivers it to every
+// registered webhook. The payload is sent as {"event": event, "event_id": id, event: payload}.
+func dispatchEventWebhooks(messageStore *MessageStore, event string, payload interface{}) {
+	eventID := recordEvent(messageStore, event, payload)
+
+	webhooks, err := messageStore.GetWebhooks()
+	if err != nil {
+		fmt.Printf("Warning: failed to load webhooks: %v\n", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	body, err := eventWebhookBody(event, eventID, payload)
+	if err != nil {
+		fmt.Printf("Warning: failed to encode webhook payload: %v\n", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		go deliverWebhook(messageStore, webhook, eventID, body)
+	}
+}
+
+// recoverPendingWork resumes work interrupted by a restart: download jobs that never
+// finished (re-delivering their message webhooks afterwards) and webhook deliveries that
+// were never accepted, and fails approved sends cut off mid-send (pending approvals simply
+// keep waiting). Only work recorded before startedAt is picked up, so anything this process
+// queued itself isn't run twice. Outbound sends are resumed elsewhere: startOutbox requeues
+// queued sends left sending, and startCampaignScheduler restarts running campaigns.
+func recoverPendingWork(client *whatsmeow.Client, messageStore *MessageStore, startedAt time.Time) {
+	downloads, err := messageStore.GetPendingDownloads(startedAt)
+	if err != nil {
+		fmt.Printf("Warning: failed to load pending downloads: %v\n", err)
+	}
+	downloadPool := downloadPoolFor(messageStore)
+	resumedDownloads := 0
+	for _, pending := range downloads {
+		messageStore.DeletePendingDownload(pending.JobID)
+		if downloadPool == nil {
+			continue
+		}
+		job := downloadJobs.Create(pending.MessageID, pending.ChatJID, pending.BatchID)
+		if pending.NotifyEventID > 0 {
+			eventID := pending.NotifyEventID
+			downloadJobs.Update(job.ID, func(j *DownloadJob) {
+				j.notifyEventID = eventID
+				j.onDone = func(done DownloadJob) {
+					redeliverMessageEvent(client, messageStore, eventID, done.Path)
+				}
+			})
+		}
+		if err := downloadPool.Enqueue(job.ID); err != nil {
+			fmt.Printf("Warning: could not resume download of %s: %v\n", pending.MessageID, err)
+			continue
+		}
+		resumedDownloads++
+	}
+
+	if failed, err := messageStore.FailInterruptedApprovals(startedAt); err != nil {
+		fmt.Printf("Warning: failed to settle interrupted approvals: %v\n", err)
+	} else if failed > 0 {
+		fmt.Printf("🛡️ Marked %d approved sends interrupted by the last shutdown as failed\n", failed)
+	}
+
+	deliveries, err := messageStore.GetWebhookDeliveries(startedAt)
+	if err != nil {
+		fmt.Printf("Warning: failed to load pending webhook deliveries: %v\n", err)
+	}
+	webhooks, err := messageStore.GetWebhooks()
+	if err != nil {
+		fmt.Printf("Warning: failed to load webhooks: %v\n", err)
+		return
+	}
+	webhooksByID := make(map[string]Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		webhooksByID[webhook.ID] = webhook
+	}
+	if fallbackWebhook != nil {
+		webhooksByID[fallbackWebhook.ID] = *fallbackWebhook
+	}
+	resumedDeliveries := 0
+	for _, delivery := range deliveries {
+		if _, ok := webhooksByID[delivery.WebhookID]; !ok {
+			messageStore.DeleteWebhookDelivery(delivery.ID)
+			continue
+		}
+		// Scheduled retries are already due to the retry worker; this covers deliveries
+		// interrupted before their first attempt was recorded
+		if err := messageStore.ResumeWebhookDelivery(delivery.ID, time.Now().Add(webhookRetry.Backoff(delivery.Attempts))); err != nil {
+			fmt.Printf("Warning: failed to resume webhook delivery %d: %v\n", delivery.ID, err)
+			continue
+		}
+		resumedDeliveries++
+	}
+
+	if len(downloads) > 0 || len(deliveries) > 0 {
+		fmt.Printf("♻️ Startup recovery: resumed %d of %d downloads and %d of %d pending webhooks\n",
+			resumedDownloads, len(downloads), resumedDeliveries, len(deliveries))
+	}
+}
+
+// redeliverMessageEvent dispatches a recorded message event to webhooks after its download finished
+func redeliverMessageEvent(client *whatsmeow.Client, messageStore *MessageStore, eventID int64, localPath string) {
+	payload, err := messageStore.GetEventPayload(eventID)
+	if err != nil {
+		fmt.Printf("Warning: failed to load event %d for redelivery: %v\n", eventID, err)
+		return
+	}
+	var message WebhookMessage
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		fmt.Printf("Warning: failed to decode event %d for redelivery: %v\n", eventID, err)
+		return
+	}
+	message.LocalPath = localPath
+	dispatchMessageWebhooks(client, messageStore, eventID, message)
+}
+
+// buildWebhookMedia renders the media section for one webhook's delivery mode.
+// Inline mode falls back to a streaming URL when the file exceeds the size threshold.
+func buildWebhookMedia(client *whatsmeow.Client, messageStore *MessageStore, webhook Webhook, message WebhookMessage) *WebhookMedia {
+	media := &WebhookMedia{Mode: webhookMediaMetadata}
+	if message.LocalPath != "" {
+		if fileURL := mediaFileURL(message.LocalPath); fileURL != "" {
+			media.FileURL = strings.TrimSuffix(publicBaseURL, "/") + fileURL
+		}
+	}
+
+	if webhook.MediaMode == webhookMediaInline {
+		limit := webhook.InlineMaxBytes
+		if limit <= 0 {
+			limit = defaultWebhookInlineMaxBytes
+		}
+		if message.FileLength > 0 && int64(message.FileLength) <= limit {
+			path := message.LocalPath
+			if path == "" {
+				if ok, _, _, downloaded, err := downloadMedia(context.Background(), client, messageStore, message.ID, message.ChatJID, nil); ok && err == nil {
+					path = downloaded
+				}
+			}
+			if path != "" {
+				if data, err := os.ReadFile(path); err == nil && int64(len(data)) <= limit {
+					media.Mode = webhookMediaInline
+					media.Base64 = base64.StdEncoding.EncodeToString(data)
+					return media
+				}
+			}
+		}
+	}
+
+	if webhook.MediaMode == webhookMediaURL || webhook.MediaMode == webhookMediaInline {
+		ttl := time.Duration(getEnvInt("MCP_MEDIA_URL_TTL_SEC", 3600)) * time.Second
+		streamURL, expiresAt := buildMediaStreamURL(message.ChatJID, message.ID, ttl)
+		media.Mode = webhookMediaURL
+		media.URL = streamURL
+		media.URLExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	return media
+}
+
+// URL prefix for the authenticated media file server
+const mediaFilesPrefix = "/api/media/files/"
+
+// resolveMediaFilePath maps a path relative to store/ onto a servable media file.
+// Only files inside subdirectories (chat media folders and uploads) are served - top-level
+// files such as messages.db/whatsapp.db, partial downloads and symlink escapes are rejected.
+func resolveMediaFilePath(relPath string) (string, error) {
+	relPath = strings.TrimPrefix(filepath.ToSlash(relPath), "/")
+	if relPath == "" || strings.Contains(relPath, "\x00") {
+		return "", fmt.Errorf("invalid path")
+	}
+	for _, segment := range strings.Split(relPath, "/") {
+		// ':' would name a Windows drive or alternate data stream; stored names never contain one
+		if segment == ".." || segment == "." || segment == "" || strings.Contains(segment, ":") {
+			return "", fmt.Errorf("invalid path")
+		}
+	}
+	if !strings.Contains(relPath, "/") {
+		return "", fmt.Errorf("invalid path")
+	}
+	lower := strings.ToLower(relPath)
+	for _, suffix := range []string{".part", ".tmp", ".db", ".db-wal", ".db-shm"} {
+		if strings.HasSuffix(lower, suffix) {
+			return "", fmt.Errorf("invalid path")
+		}
+	}
+
+	storeRoot, err := filepath.Abs(storeDir)
+	if err != nil {
+		return "", err
+	}
+	storeRoot, err = filepath.EvalSymlinks(storeRoot)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(storeRoot, filepath.FromSlash(relPath)))
+	if err != nil {
+		return "", fmt.Errorf("file not found")
+	}
+	if !strings.HasPrefix(resolved, storeRoot+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path")
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil || info.IsDir() {
+		return "", fmt.Errorf("file not found")
+	}
+	return resolved, nil
+}
+
+// mediaFileURL returns the media file server URL path for a file under store/, or "" if outside it
+func mediaFileURL(absPath string) string {
+	storeRoot, err := filepath.Abs(storeDir)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(storeRoot, absPath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return mediaFilesPrefix + strings.Join(segments, "/")
+}
+
+// DrainState coordinates zero-loss rolling deploys (POST /api/admin/drain): once draining,
+// new sends are refused while in-flight sends and webhook deliveries are allowed to finish.
+type DrainState struct {
+	mutex            sync.Mutex
+	draining         bool
+	startedAt        time.Time
+	inflightSends    int
+	inflightWebhooks int
+}
+
+var drainState = &DrainState{}
+
+// beginSend registers an in-flight send; returns false while draining
+func (d *DrainState) beginSend() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflightSends++
+	return true
+}
+
+func (d *DrainState) endSend() {
+	d.mutex.Lock()
+	d.inflightSends--
+	d.mutex.Unlock()
+}
+
+func (d *DrainState) isDraining() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.draining
+}
+
+func (d *DrainState) beginWebhook() {
+	d.mutex.Lock()
+	d.inflightWebhooks++
+	d.mutex.Unlock()
+}
+
+func (d *DrainState) endWebhook() {
+	d.mutex.Lock()
+	d.inflightWebhooks--
+	d.mutex.Unlock()
+}
+
+// start enters draining mode (idempotent)
+func (d *DrainState) start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.draining {
+		d.draining = true
+		d.startedAt = time.Now()
+	}
+}
+
+// resume leaves draining mode, e.g. when a deploy is rolled back
+func (d *DrainState) resume() {
+	d.mutex.Lock()
+	d.draining = false
+	d.startedAt = time.Time{}
+	d.mutex.Unlock()
+}
+
+func (d *DrainState) snapshot() map[string]interface{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	snapshot := map[string]interface{}{
+		"draining":          d.draining,
+		"inflight_sends":    d.inflightSends,
+		"inflight_webhooks": d.inflightWebhooks,
+	}
+	if d.draining {
+		snapshot["started_at"] = d.startedAt.UTC().Format(time.RFC3339)
+	}
+	return snapshot
+}
+
+// wait blocks until nothing is in flight or the timeout passes, reporting whether it drained
+func (d *DrainState) wait(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.mutex.Lock()
+		idle := d.inflightSends == 0 && d.inflightWebhooks == 0
+		d.mutex.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Process exit codes, so supervisors can tell a failure worth restarting from one that needs an operator
+const (
+	exitOK            = 0
+	exitError         = 1 // Unclassified failure; restarting may help
+	exitConfigInvalid = 2 // Bad flags or environment; restarting won't help until the config is fixed
+	exitAuthRequired  = 3 // The session was unlinked or replaced and must be paired again
+	exitBanned        = 4 // WhatsApp banned the account
+	exitDBCorrupt     = 5 // A store database is damaged or not a database
+)
+
+// shutdownHook is cleanup that runs once before the process exits
+type shutdownHook struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+var shutdownState struct {
+	mutex sync.Mutex
+	hooks []shutdownHook
+	once  sync.Once
+}
+
+// onShutdown registers cleanup for shutdown; like defers, hooks run in reverse registration order
+func onShutdown(name string, run func(ctx context.Context) error) {
+	shutdownState.mutex.Lock()
+	shutdownState.hooks = append(shutdownState.hooks, shutdownHook{name: name, run: run})
+	shutdownState.mutex.Unlock()
+}
+
+// shutdown runs the registered hooks within MCP_SHUTDOWN_TIMEOUT_SEC and exits with code.
+// Only the first call does anything; concurrent callers block until the process is gone.
+func shutdown(code int, reason string) {
+	shutdownState.once.Do(func() {
+		fmt.Printf("🛑 Shutting down (%s, exit code %d)\n", reason, code)
+		shutdownReason, shutdownCode = reason, code
+
+		shutdownState.mutex.Lock()
+		hooks := slices.Clone(shutdownState.hooks)
+		shutdownState.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(max(getEnvInt("MCP_SHUTDOWN_TIMEOUT_SEC", 15), 1))*time.Second)
+		defer cancel()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			done := make(chan error, 1)
+			go func() { done <- hooks[i].run(ctx) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					fmt.Printf("Warning: shutdown hook %s failed: %v\n", hooks[i].name, err)
+				}
+			case <-ctx.Done():
+				fmt.Printf("Warning: shutdown timed out in hook %s, exiting without the rest\n", hooks[i].name)
+				os.Exit(code)
+			}
+		}
+		os.Exit(code)
+	})
+}
+
+// Why the process is going down, for the shutting_down event; set once shutdown starts
+var (
+	shutdownReason string
+	shutdownCode   int
+)
+
+// announceShutdown stops accepting sends, tells webhooks the process is going down and
+// waits for in-flight sends and webhook deliveries. Undelivered webhooks stay persisted
+// and are resumed on the next boot.
+func announceShutdown(ctx context.Context, messageStore *MessageStore) error {
+	drainState.start()
+
+	payload := map[string]interface{}{"reason": shutdownReason, "exit_code": shutdownCode}
+	eventID := recordEvent(messageStore, "shutting_down", payload)
+	webhooks, err := messageStore.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	body, err := eventWebhookBody("shutting_down", eventID, payload)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, webhook := range webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliverWebhook(messageStore, webhook, eventID, body)
+		}()
+	}
+	wg.Wait()
+
+	deadline, _ := ctx.Deadline()
+	if !drainState.wait(ctx, time.Until(deadline)) {
+		return errors.New("sends or webhook deliveries still in flight")
+	}
+	return nil
+}
+
+// isDatabaseCorrupt reports whether err is SQLite finding a damaged or foreign database file
+func isDatabaseCorrupt(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB)
+}
+
+// exitCodeForStoreError picks the exit code for a database that failed to open
+func exitCodeForStoreError(err error) int {
+	if isDatabaseCorrupt(err) {
+		return exitDBCorrupt
+	}
+	return exitError
+}
+
+// QueueStats is the backlog of one internal queue
+type QueueStats struct {
+	Name         string `json:"name"`
+	Depth        int    `json:"depth"`
+	OldestAgeSec int64  `json:"oldest_age_sec"`     // 0 when empty or untracked
+	Capacity     int    `json:"capacity,omitempty"` // Bounded in-memory queues only
+}
+
+// Get the depth and oldest item of a persisted queue; from/where select its rows
+func (store *MessageStore) queueBacklog(from, where, timeColumn string, args ...interface{}) (int, int64, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var depth int
+	if err := store.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+from+" WHERE "+where, args...).Scan(&depth); err != nil {
+		return 0, 0, err
+	}
+	if depth == 0 {
+		return 0, 0, nil
+	}
+	var oldest sql.NullTime
+	err := store.db.QueryRowContext(ctx, "SELECT "+timeColumn+" FROM "+from+" WHERE "+where+" ORDER BY "+timeColumn+" LIMIT 1", args...).Scan(&oldest)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	var ageSec int64
+	if oldest.Valid {
+		ageSec = int64(time.Since(oldest.Time).Seconds())
+	}
+	return depth, ageSec, nil
+}
+
+// collectQueueStats reports every queue a message or event can wait in
+func collectQueueStats(messageStore *MessageStore) ([]QueueStats, error) {
+	drain := drainState.snapshot()
+	queues := []QueueStats{
+		{Name: "sends_inflight", Depth: drain["inflight_sends"].(int)},
+		{Name: "webhooks_inflight", Depth: drain["inflight_webhooks"].(int)},
+	}
+
+	persisted := []struct {
+		name, from, where, timeColumn string
+		args                          []interface{}
+	}{
+		{"outbound_approvals", "pending_sends", "status = ?", "created_at", []interface{}{approvalPending}},
+		{"outbox", "outbox", "status IN (?, ?)", "created_at", []interface{}{outboxQueued, outboxSending}},
+		{"outbound_campaigns", "campaign_recipients r JOIN campaigns c ON c.id = r.campaign_id",
+			"r.status = ? AND c.status = ?", "c.created_at", []interface{}{recipientPending, campaignRunning}},
+		{"webhook_deliveries", "webhook_deliveries", "attempts = 0", "created_at", nil},
+		{"webhook_retries", "webhook_deliveries", "attempts > 0", "created_at", nil},
+		{"webhook_dead_letters", "webhook_dead_letters", "1 = 1", "failed_at", nil},
+		{"downloads", "pending_downloads", "1 = 1", "created_at", nil},
+	}
+	for _, q := range persisted {
+		depth, ageSec, err := messageStore.queueBacklog(q.from, q.where, q.timeColumn, q.args...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", q.name, err)
+		}
+		queues = append(queues, QueueStats{Name: q.name, Depth: depth, OldestAgeSec: ageSec})
+	}
+
+	// Chat and message upserts waiting for the next batch commit
+	queues = append(queues, QueueStats{
+		Name:     "store_writes",
+		Depth:    len(messageStore.writes.queue),
+		Capacity: cap(messageStore.writes.queue),
+	})
+
+	// Jobs buffered for the download workers (a subset of downloads)
+	if downloadPool := downloadPoolFor(messageStore); downloadPool != nil {
+		queues = append(queues, QueueStats{
+			Name:     "download_workers",
+			Depth:    len(downloadPool.queue),
+			Capacity: cap(downloadPool.queue),
+		})
+	}
+	return queues, nil
+}
+
+// writeQueueMetrics renders queue stats in the OpenMetrics text format
+func writeQueueMetrics(w io.Writer, queues []QueueStats) {
+	fmt.Fprintln(w, "# TYPE whatsapp_queue_depth gauge")
+	fmt.Fprintln(w, "# HELP whatsapp_queue_depth Items waiting in the queue.")
+	for _, q := range queues {
+		fmt.Fprintf(w, "whatsapp_queue_depth{queue=%q} %d\n", q.Name, q.Depth)
+	}
+	fmt.Fprintln(w, "# TYPE whatsapp_queue_oldest_age_seconds gauge")
+	fmt.Fprintln(w, "# UNIT whatsapp_queue_oldest_age_seconds seconds")
+	fmt.Fprintln(w, "# HELP whatsapp_queue_oldest_age_seconds Age of the oldest waiting item.")
+	for _, q := range queues {
+		fmt.Fprintf(w, "whatsapp_queue_oldest_age_seconds{queue=%q} %d\n", q.Name, q.OldestAgeSec)
+	}
+	fmt.Fprintln(w, "# TYPE whatsapp_queue_capacity gauge")
+	fmt.Fprintln(w, "# HELP whatsapp_queue_capacity Maximum depth of bounded in-memory queues.")
+	for _, q := range queues {
+		if q.Capacity > 0 {
+			fmt.Fprintf(w, "whatsapp_queue_capacity{queue=%q} %d\n", q.Name, q.Capacity)
+		}
+	}
+	fmt.Fprintln(w, "# EOF")
+}
+
+// drainGuard refuses sends with 503 while draining and tracks the ones in flight
+func drainGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !drainState.beginSend() {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: "Service is draining for shutdown; retry against another instance",
+			})
+			return
+		}
+		defer drainState.endSend()
+		next(w, r)
+	}
+}
+
+// tokenFingerprint identifies a token in the approval queue without storing it
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// moderatedSender returns the fingerprint of the moderated token behind a request, if any
+func moderatedSender(r *http.Request) (string, bool) {
+	fingerprint, ok := r.Context().Value(moderationContextKey{}).(string)
+	return fingerprint, ok
+}
+
+// authMiddleware provides token-based authentication for MCP API endpoints
+// Phase Security-1: SSRF Prevention - prevents cross-tenant MCP access
+// Skips authentication for /api/health (required for Docker health checks)
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Skip auth for health endpoint (Docker health checks need to work without auth)
+		if r.URL.Path == "/api/health" {
+			next(w, r)
+			return
+		}
+
+		// Moderated tokens are recognized with or without MCP_API_SECRET; their sends await approval
+		if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); moderatedTokens[token] {
+			if !moderatedAllowed(r) {
+				w.Header().Set("Content-Type", "application/json")
+				http.Error(w, `{"error": "Not permitted for moderated tokens"}`, http.StatusForbidden)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), moderationContextKey{}, tokenFingerprint(token))))
+			return
+		}
+
+		// If no secret configured, allow all requests (backward compatibility during migration)
+		if apiSecret == "" {
+			next(w, r)
+			return
+		}
+
+		// Validate Bearer token
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error": "Authorization header required"}`, http.StatusUnauthorized)
+			return
+		}
+
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error": "Invalid authorization format, expected Bearer token"}`, http.StatusUnauthorized)
+			return
+		}
+
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token != apiSecret {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error": "Invalid API secret"}`, http.StatusForbidden)
+			return
+		}
+
+		// Token valid, proceed to handler
+		next(w, r)
+	}
+}
+
+// Start a REST API server to expose the WhatsApp client functionality
+func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port int) {
+	// Read API secret from environment (Phase Security-1)
+	apiSecret = os.Getenv("MCP_API_SECRET")
+	if apiSecret == "" {
+		fmt.Println("⚠️  WARNING: MCP_API_SECRET not set - API endpoints are unprotected!")
+	} else {
+		fmt.Println("🔒 MCP API authentication enabled")
+	}
+	for _, token := range strings.Split(os.Getenv("MCP_MODERATED_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" && token != apiSecret {
+			moderatedTokens[token] = true
+		}
+	}
+	if len(moderatedTokens) > 0 {
+		fmt.Printf("🛡️ Approval queue enabled for %d moderated token(s)\n", len(moderatedTokens))
+	}
+
+	// Public base URL for links handed to webhook consumers (e.g. http://mcp-agent-tenant_1:8080)
+	publicBaseURL = os.Getenv("MCP_PUBLIC_URL")
+	if publicBaseURL == "" {
+		publicBaseURL = fmt.Sprintf("http://localhost:%d", port)
+	}
+
+	// Every hosted account gets its own copy of the API; the primary one also manages the others
+	mux := newSessionMux(client, messageStore)
+	mux.HandleFunc("/api/accounts", authMiddleware(accountsHandler(client, messageStore)))
+
+	// Start the server
+	serverAddr := fmt.Sprintf(":%d", port)
+	fmt.Printf("Starting REST API server on %s...\n", serverAddr)
+
+	// Run server in a goroutine so it doesn't block
+	go func() {
+		if err := http.ListenAndServe(serverAddr, accountRouter(mux)); err != nil {
+			fmt.Printf("REST API server error: %v\n", err)
+		}
+	}()
+}
+
+// newSessionMux registers the REST API of one WhatsApp session
+func newSessionMux(client *whatsmeow.Client, messageStore *MessageStore) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Handler for sending messages
+	mux.HandleFunc("/api/send", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the request body
+		var req SendMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		// Validate request
+		if req.Recipient == "" {
+			http.Error(w, "Recipient is required", http.StatusBadRequest)
+			return
+		}
+
+		if req.Message == "" && req.MediaPath == "" && req.MediaHandle == "" && req.MediaBase64 == "" && req.MediaURL == "" && req.Template == "" && req.Location == nil && len(req.Contacts) == 0 {
+			http.Error(w, "Message, template, location, contacts, media path, media handle, media base64 or media URL is required", http.StatusBadRequest)
+			return
+		}
+		if req.Location != nil {
+			if req.MediaPath != "" || req.MediaHandle != "" || req.MediaBase64 != "" || req.MediaURL != "" {
+				http.Error(w, "location cannot be combined with media", http.StatusBadRequest)
+				return
+			}
+			if err := req.Location.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid location: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if len(req.Contacts) > 0 {
+			if req.Location != nil || req.Message != "" || req.Template != "" || req.MediaPath != "" || req.MediaHandle != "" || req.MediaBase64 != "" || req.MediaURL != "" {
+				http.Error(w, "contacts cannot be combined with a message, template, location or media", http.StatusBadRequest)
+				return
+			}
+			if err := validateSendContacts(req.Contacts); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid contacts: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Materialize media passed inline or by URL as an upload
+		if err := resolveInlineMedia(r.Context(), messageStore, &req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid media: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// Resolve chunked upload handle to its local file
+		if req.MediaHandle != "" {
+			if req.MediaPath != "" {
+				http.Error(w, "Only one of media_path or media_handle may be set", http.StatusBadRequest)
+				return
+			}
+			path, err := resolveMediaHandle(messageStore, req.MediaHandle)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid media handle: %v", err), http.StatusBadRequest)
+				return
+			}
+			req.MediaPath = path
+		}
+
+		// Reject disallowed media up front with 422 (sendWhatsAppMessage enforces it too)
+		if req.MediaPath != "" {
+			_, mimeType := mediaTypeForFile(req.MediaPath)
+			if err := mediaPolicy.Check(filepath.Base(req.MediaPath), mimeType); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: err.Error(),
+				})
+				return
+			}
+		}
+
+		// Sends from moderated tokens wait in the approval queue
+		if requestedBy, moderated := moderatedSender(r); moderated {
+			pending, err := queueSendForApproval(messageStore, requestedBy, req)
+			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Failed to queue message for approval: %v", err),
+				})
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":     true,
+				"message":     "Message queued for approval",
+				"approval_id": pending.ID,
+				"status":      pending.Status,
+			})
+			return
+		}
+
+		// Queued sends are answered with their outbox entry; the idempotency key stands in
+		// for duplicate suppression
+		if req.IdempotencyKey == "" && req.Queue {
+			req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		}
+		if req.IdempotencyKey != "" && !req.Queue {
+			http.Error(w, "idempotency_key requires queue", http.StatusBadRequest)
+			return
+		}
+		if req.Queue {
+			req.MediaBase64 = "" // Already resolved to media_path
+			send, added, err := messageStore.EnqueueSend(QueuedSend{
+				ID:             newRandomID(8),
+				IdempotencyKey: req.IdempotencyKey,
+				Request:        req,
+			})
+			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Failed to queue message: %v", err),
+				})
+				return
+			}
+			message := "Message queued"
+			if added {
+				fmt.Printf("📤 Queued outbox send %s to %s\n", send.ID, req.Recipient)
+				w.WriteHeader(http.StatusAccepted)
+			} else {
+				message = "Already queued with this idempotency key"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":   true,
+				"message":   message,
+				"duplicate": !added,
+				"send":      send,
+			})
+			return
+		}
+
+		// Identical text to the same recipient within the window is suppressed unless overridden
+		dupKey := duplicateKey(req)
+		duplicates := duplicateGuardFor(messageStore)
+		if !req.AllowDuplicate {
+			if age, duplicate := duplicates.reserve(dupKey); duplicate {
+				fmt.Printf("🔁 Suppressed duplicate send to %s (same message %s ago)\n", req.Recipient, age.Round(time.Second))
+				w.Header().Set("Content-Type", "application/json")
+				if duplicates.mode == duplicateModeCollapse {
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success":   true,
+						"message":   fmt.Sprintf("Duplicate of a message sent %s ago; not resent", age.Round(time.Second)),
+						"duplicate": true,
+					})
+					return
+				}
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Duplicate message: identical text was sent to this recipient %s ago (set allow_duplicate to resend)", age.Round(time.Second)),
+				})
+				return
+			}
+		}
+
+		fmt.Printf("Received request to send message to %s: %s %s\n", req.Recipient, redactLogContent(req.Message), req.MediaPath)
+
+		success, message := dispatchSendRequest(r.Context(), client, messageStore, req)
+		if !success && !req.AllowDuplicate {
+			duplicates.release(dupKey)
+		}
+		fmt.Printf("Message sent: %v %s\n", success, message)
+		// Set response headers
+		w.Header().Set("Content-Type", "application/json")
+
+		// Set appropriate status code
+		if !success {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		// Send response
+		response := SendMessageResponse{
+			Success: success,
+			Message: message,
+		}
+		if !success {
+			response.ErrorCode = classifySendFailure(message)
+			response.Retryable = retryableSendErrors[response.ErrorCode]
+		}
+		json.NewEncoder(w).Encode(response)
+	}))))
+
+	// Handler for rendering a send request into the exact message payload without sending it
+	mux.HandleFunc("/api/preview", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req SendMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Recipient == "" {
+			http.Error(w, "Recipient is required", http.StatusBadRequest)
+			return
+		}
+		if req.Message == "" && req.MediaPath == "" && req.MediaHandle == "" && req.MediaBase64 == "" && req.MediaURL == "" && req.Template == "" && req.Location == nil && len(req.Contacts) == 0 {
+			http.Error(w, "Message, template, location, contacts, media path, media handle, media base64 or media URL is required", http.StatusBadRequest)
+			return
+		}
+		recipientJID, err := parseRecipientJID(req.Recipient)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid recipient: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// Only the media name is needed to pick the message type; inline media is not fetched
+		var mediaName string
+		switch {
+		case req.MediaPath != "":
+			mediaName = filepath.Base(req.MediaPath)
+		case req.MediaHandle != "":
+			path, err := resolveMediaHandle(messageStore, req.MediaHandle)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid media handle: %v", err), http.StatusBadRequest)
+				return
+			}
+			mediaName = filepath.Base(path)
+		case req.MediaBase64 != "" || req.MediaURL != "":
+			name := req.MediaFilename
+			if name == "" && req.MediaURL != "" {
+				if parsed, err := url.Parse(req.MediaURL); err == nil {
+					name = filepath.Base(parsed.Path)
+				}
+			}
+			mediaName = inlineMediaFilename(name, "")
+		}
+
+		msg, text, err := buildPreviewMessage(r.Context(), client, messageStore, recipientJID, req.Message, mediaName, req.sendOptions())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to encode message: %v", err),
+			})
+			return
+		}
+
+		// Links are sent as plain text: no preview card is generated, recipients only see them linkified
+		links := previewLinkPattern.FindAllString(text, -1)
+		if links == nil {
+			links = []string{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"recipient": recipientJID.String(),
+			"text":      text,
+			"payload":   json.RawMessage(payload),
+			"links":     links,
+		})
+	}))
+
+	// Handler for fabricating an inbound message through the normal pipeline (sandbox mode only),
+	// for end-to-end tests of storage and webhooks without a second phone
+	if sandboxMode {
+		mux.HandleFunc("/api/test/inject-message", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			// The pipeline resolves names and LIDs through the paired device's stores
+			if client.Store.ID == nil {
+				http.Error(w, "Session is not paired", http.StatusServiceUnavailable)
+				return
+			}
+
+			var req InjectMessageRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			if req.Sender == "" || req.Message == "" {
+				http.Error(w, "sender and message are required", http.StatusBadRequest)
+				return
+			}
+			sender, err := parseRecipientJID(req.Sender)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid sender: %v", err), http.StatusBadRequest)
+				return
+			}
+			chat := sender.ToNonAD()
+			if req.ChatJID != "" {
+				if chat, err = types.ParseJID(req.ChatJID); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			timestamp := time.Now()
+			if req.Timestamp != "" {
+				if timestamp, err = time.Parse(time.RFC3339, req.Timestamp); err != nil {
+					http.Error(w, "timestamp must be an RFC3339 timestamp", http.StatusBadRequest)
+					return
+				}
+			}
+			if req.MessageID == "" {
+				req.MessageID = client.GenerateMessageID()
+			}
+
+			injectInboundMessage(client, messageStore, chat, sender, req, timestamp)
+			if err := messageStore.FlushWrites(); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to store injected message: %v", err),
+				})
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":    true,
+				"message_id": req.MessageID,
+				"chat_jid":   chat.String(),
+			})
+		}))
+	}
+
+	// Handler for listing the companion devices linked to this account
+	mux.HandleFunc("/api/devices", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		queryCtx, queryCancel := context.WithTimeout(r.Context(), endpointTimeouts.Query)
+		defer queryCancel()
+		devices, err := listCompanionDevices(queryCtx, client, messageStore)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to list devices: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"devices": devices,
+			"count":   len(devices),
+		})
+	}))
+
+	// Handlers for the outbound approval queue (sends made with MCP_MODERATED_TOKENS).
+	// GET /api/approvals?status=pending|sent|failed|rejected|all&limit= lists queued sends (default pending).
+	mux.HandleFunc("/api/approvals", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = approvalPending
+		case "all":
+			status = ""
+		}
+		limit := 50
+		if lp := r.URL.Query().Get("limit"); lp != "" {
+			if parsed, err := strconv.Atoi(lp); err == nil && parsed > 0 && parsed <= 500 {
+				limit = parsed
+			}
+		}
+
+		sends, err := messageStore.GetPendingSends(status, limit)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"sends":   sends,
+			"count":   len(sends),
+		})
+	}))
+
+	// GET /api/outbox lists queued sends (?status=queued|sending|sent|failed, default all);
+	// ?id= or ?idempotency_key= returns one
+	mux.HandleFunc("/api/outbox", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		id, idempotencyKey := r.URL.Query().Get("id"), r.URL.Query().Get("idempotency_key")
+		if id != "" || idempotencyKey != "" {
+			send, err := messageStore.GetQueuedSend(id, idempotencyKey)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Queued send not found",
+				})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"send":    send,
+			})
+			return
+		}
+
+		limit := 50
+		if lp := r.URL.Query().Get("limit"); lp != "" {
+			if parsed, err := strconv.Atoi(lp); err == nil && parsed > 0 && parsed <= 500 {
+				limit = parsed
+			}
+		}
+		sends, err := messageStore.GetQueuedSends(r.URL.Query().Get("status"), limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"sends":   sends,
+			"count":   len(sends),
+		})
+	}))
+
+	// POST /api/approvals/approve {"id"} delivers a pending send;
+	// POST /api/approvals/reject {"id", "reason"?} discards it
+	approvalDecision := func(approve bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			var req struct {
+				ID     string `json:"id"`
+				Reason string `json:"reason"`
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: "id is required",
+				})
+				return
+			}
+
+			status := approvalRejected
+			if approve {
+				status = approvalSending
+			}
+			decided, err := messageStore.DecidePendingSend(req.ID, status, req.Reason)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Failed to record decision: %v", err),
+				})
+				return
+			}
+			pending, err := messageStore.GetPendingSend(req.ID)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: "Approval not found",
+				})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			if !decided {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Approval already %s", pending.Status),
+				})
+				return
+			}
+
+			if approve {
+				success, message := dispatchSendRequest(r.Context(), client, messageStore, pending.Request)
+				pending.Status, pending.Result = approvalSent, message
+				if !success {
+					pending.Status = approvalFailed
+				}
+				if err := messageStore.SetPendingSendResult(pending.ID, pending.Status, message); err != nil {
+					fmt.Printf("Warning: failed to record approval result: %v\n", err)
+				}
+			}
+			fmt.Printf("🛡️ Send %s %s\n", pending.ID, pending.Status)
+			go dispatchEventWebhooks(messageStore, "approval_decided", pending)
+
+			if pending.Status == approvalFailed {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  pending.Status != approvalFailed,
+				"approval": pending,
+			})
+		}
+	}
+	mux.HandleFunc("/api/approvals/approve", authMiddleware(drainGuard(rateLimited(messageStore, approvalDecision(true)))))
+	mux.HandleFunc("/api/approvals/reject", authMiddleware(approvalDecision(false)))
+
+	// Handler for re-running the current extractors over stored raw messages, e.g. after an
+	// upgrade adds derived columns. POST {"chat_jid"?} limits it to one chat.
+	mux.HandleFunc("/api/admin/reparse", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID string `json:"chat_jid"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid request format",
+				})
+				return
+			}
+		}
+
+		started := time.Now()
+		result, err := reparseStoredMessages(r.Context(), client, messageStore, req.ChatJID)
+		fmt.Printf("🔁 Re-parsed stored messages in %s: %+v (err=%v)\n", time.Since(started).Round(time.Millisecond), result, err)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Re-parse failed: %v", err),
+				"result":  result,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"result":  result,
+		})
+	}))
+
+	// Queue depths and oldest-item ages, as JSON and as OpenMetrics for scrapers
+	mux.HandleFunc("/api/queues", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		queues, err := collectQueueStats(messageStore)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"queues":  queues,
+		})
+	}))
+
+	// Row counts, file sizes, indexes and message time range of messages.db, for capacity planning
+	mux.HandleFunc("/api/admin/db-stats", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		stats, err := messageStore.WithContext(r.Context()).DBStats()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"stats":   stats,
+		})
+	}))
+
+	mux.HandleFunc("/metrics", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		queues, err := collectQueueStats(messageStore)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Database query failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		writeQueueMetrics(w, queues)
+	}))
+
+	// Presence policy: GET returns it, POST {policy} switches it until restart
+	mux.HandleFunc("/api/admin/presence", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req struct {
+				Policy string `json:"policy"`
+			}
+			policy := ""
+			if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
+				policy = strings.ToLower(strings.TrimSpace(req.Policy))
+			}
+			if !slices.Contains(presencePolicies, policy) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("policy must be one of %s", strings.Join(presencePolicies, ", ")),
+				})
+				return
+			}
+			presenceManager.SetPolicy(policy)
+			fmt.Printf("🟢 Presence policy changed to %s\n", policy)
+			if client.IsConnected() && client.IsLoggedIn() {
+				if err := presenceManager.Apply(client); err != nil {
+					fmt.Printf("Warning: failed to announce presence: %v\n", err)
+				}
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"policy":   presenceManager.Policy(),
+			"policies": presencePolicies,
+		})
+	}))
+
+	// Handler for graceful shutdown: POST stops accepting sends, waits for in-flight sends and
+	// webhook deliveries, checkpoints the WAL and reports whether the process can be terminated.
+	// GET reports the current drain status; POST {"resume": true} cancels a drain.
+	mux.HandleFunc("/api/admin/drain", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == http.MethodGet {
+			status := drainState.snapshot()
+			status["success"] = true
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			TimeoutSec int  `json:"timeout_sec"`
+			Resume     bool `json:"resume"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid request format",
+				})
+				return
+			}
+		}
+
+		if req.Resume {
+			drainState.resume()
+			fmt.Println("▶️ Drain cancelled, accepting sends again")
+			status := drainState.snapshot()
+			status["success"] = true
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+
+		timeout := 30 * time.Second
+		if req.TimeoutSec > 0 {
+			timeout = time.Duration(req.TimeoutSec) * time.Second
+		}
+
+		drainState.start()
+		fmt.Println("⏸️ Draining: refusing new sends, waiting for in-flight work")
+		drained := drainState.wait(r.Context(), timeout)
+
+		checkpointed := false
+		if drained {
+			if err := messageStore.FlushWrites(); err != nil {
+				fmt.Printf("Warning: failed to commit queued writes: %v\n", err)
+			}
+			if _, err := messageStore.writer.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+				fmt.Printf("Warning: drain WAL checkpoint failed: %v\n", err)
+			} else {
+				checkpointed = true
+			}
+		}
+
+		status := drainState.snapshot()
+		status["success"] = true
+		status["checkpointed"] = checkpointed
+		status["ready_to_terminate"] = drained && checkpointed
+		if drained && checkpointed {
+			fmt.Println("✓ Drain complete, ready to terminate")
+		} else {
+			fmt.Printf("⚠️ Drain incomplete after %s: %v sends, %v webhooks in flight\n",
+				timeout, status["inflight_sends"], status["inflight_webhooks"])
+		}
+		json.NewEncoder(w).Encode(status)
+	}))
+
+	// Handler for listing known broadcast lists; send to one via /api/send with its JID as recipient
+	mux.HandleFunc("/api/broadcast-lists", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		lists, err := messageStore.GetBroadcastLists()
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":         true,
+			"broadcast_lists": lists,
+			"count":           len(lists),
+		})
+	}))
+
+	// Health check endpoint with detailed session state (NO AUTH - Docker health checks)
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		reconnectState.mutex.RLock()
+		reconnectAttempts := reconnectState.reconnectAttempts
+		sessionState := reconnectState.state
+		stateReason := reconnectState.stateReason
+		stateChangedAt := reconnectState.stateChangedAt
+		needsReauth := reconnectState.needsReauthLocked()
+		lastActivity := reconnectState.lastActivityTime
+		sessionStart := reconnectState.sessionStartTime
+		reconnectState.mutex.RUnlock()
+
+		var stateSinceSec int64
+		if !stateChangedAt.IsZero() {
+			stateSinceSec = int64(time.Since(stateChangedAt).Seconds())
+		}
+
+		// Calculate session age
+		var sessionAgeSec int64
+		if !sessionStart.IsZero() {
+			sessionAgeSec = int64(time.Since(sessionStart).Seconds())
+		}
+
+		// Calculate time since last activity
+		var lastActivitySec int64
+		if !lastActivity.IsZero() {
+			lastActivitySec = int64(time.Since(lastActivity).Seconds())
+		}
+
+		// Use IsLoggedIn() to check actual authentication status, not just websocket connection
+		// IsConnected() only checks if websocket is open to WhatsApp servers
+		// IsLoggedIn() checks if we have a valid device session (QR code was scanned)
+		authenticated := client.IsLoggedIn()
+		connected := client.IsConnected()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":             "healthy",
+			"session_state":      sessionState,
+			"state_reason":       stateReason,
+			"state_since_sec":    stateSinceSec,
+			"connected":          connected,
+			"authenticated":      authenticated,
+			"needs_reauth":       needsReauth,
+			"is_reconnecting":    sessionState == SessionDegraded && !needsReauth,
+			"reconnect_attempts": reconnectAttempts,
+			"session_age_sec":    sessionAgeSec,
+			"last_activity_sec":  lastActivitySec,
+			"offline_sync":       offlineSyncState.snapshot(),
+			"draining":           drainState.snapshot()["draining"],
+			"presence_policy":    presenceManager.Policy(),
+		})
+	})
+
+	// QR code endpoint (returns base64-encoded PNG QR code)
+	mux.HandleFunc("/api/qr-code", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if client is truly authenticated (not just has stored credentials)
+		// The session leaves CONNECTED/DEGRADED when the user logs out from phone (events.LoggedOut)
+		sessionState := reconnectState.current()
+
+		// Only report "Already authenticated" if BOTH:
+		// 1. client.IsLoggedIn() returns true (has stored credentials)
+		// 2. the session is not waiting on a re-pair
+		if client.IsLoggedIn() && (sessionState == SessionConnected || sessionState == SessionDegraded) {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"qr_code": nil,
+				"message": "Already authenticated",
+			})
+			return
+		}
+
+		// Rendering parameters: ?format=png|svg|raw&size=<px>&level=low|medium|high|highest
+		query := r.URL.Query()
+		format := strings.ToLower(query.Get("format"))
+		if format == "" {
+			format = "png"
+		}
+		if format != "png" && format != "svg" && format != "raw" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"qr_code": nil,
+				"message": "Invalid format (use png, svg or raw)",
+			})
+			return
+		}
+		size := defaultQRSize
+		if sizeStr := query.Get("size"); sizeStr != "" {
+			parsed, err := strconv.Atoi(sizeStr)
+			if err != nil || parsed < minQRSize || parsed > maxQRSize {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"qr_code": nil,
+					"message": fmt.Sprintf("Invalid size (must be %d-%d)", minQRSize, maxQRSize),
+				})
+				return
+			}
+			size = parsed
+		}
+		level, err := parseQRLevel(query.Get("level"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"qr_code": nil,
+				"message": fmt.Sprintf("Invalid level: %v", err),
+			})
+			return
+		}
+
+		// Return stored QR code if available
+		qrCodeMutex.RLock()
+		qr := currentQRCode
+		raw := currentQRRaw
+		expiresAt := currentQRExpiresAt
+		qrCodeMutex.RUnlock()
+
+		if raw != "" {
+			// The default rendering is cached; anything else is drawn from the raw code
+			if format != "png" || size != defaultQRSize || level != qrcode.Medium {
+				switch format {
+				case "raw":
+					qr = raw
+				case "svg":
+					qr, err = renderQRSVG(raw, level, size)
+				default:
+					var qrPNG []byte
+					qrPNG, err = qrcode.Encode(raw, level, size)
+					qr = base64.StdEncoding.EncodeToString(qrPNG)
+				}
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"qr_code": nil,
+						"message": fmt.Sprintf("Failed to render QR code: %v", err),
+					})
+					return
+				}
+			}
+
+			expiresInSec := int64(time.Until(expiresAt).Seconds())
+			if expiresInSec < 0 {
+				expiresInSec = 0
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"qr_code":        qr,
+				"format":         format,
+				"size":           size,
+				"expires_at":     expiresAt.UTC().Format(time.RFC3339),
+				"expires_in_sec": expiresInSec,
+				"message":        "Scan QR code with WhatsApp",
+			})
+		} else {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"qr_code": nil,
+				"message": "QR code not available yet, container starting...",
+			})
+		}
+	}))
+
+	// Logout endpoint (unpairs device from WhatsApp account)
+	// Handler for pairing with a phone-number linking code instead of a QR scan (headless setups)
+	// POST {phone, show_push_notification?, client_name?} returns the 8-character code to enter on the phone
+	// under Linked devices > Link with phone number; GET reports the pending code and session state.
+	mux.HandleFunc("/api/pair-phone", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		pairing := phonePairingFor(messageStore)
+		primary := accounts.byStore(messageStore) == nil
+
+		switch r.Method {
+		case http.MethodGet:
+			response := pairing.snapshot()
+			response["success"] = true
+			response["logged_in"] = client.IsLoggedIn()
+			if primary {
+				response["state"] = reconnectState.current()
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Phone                string `json:"phone"`
+			ShowPushNotification *bool  `json:"show_push_notification"`
+			ClientName           string `json:"client_name"` // "Browser (OS)", e.g. "Chrome (Linux)"
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Invalid request format",
+			})
+			return
+		}
+		phone := normalizePhoneDigits(req.Phone)
+		if len(phone) < 7 || len(phone) > 15 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "phone must be a number in international format (7-15 digits)",
+			})
+			return
+		}
+		if client.Store.ID != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Already paired",
+			})
+			return
+		}
+		// The pairing websocket is opened by the QR loop; a code can only be requested while it is up
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Pairing connection is not ready yet, retry in a few seconds",
+			})
+			return
+		}
+		showPush := req.ShowPushNotification == nil || *req.ShowPushNotification
+		clientName := strings.TrimSpace(req.ClientName)
+		if clientName == "" {
+			clientName = "Chrome (Linux)"
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		code, err := client.PairPhone(ctx, phone, showPush, whatsmeow.PairClientChrome, clientName)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to request linking code: %v", err),
+			})
+			return
+		}
+
+		pairing.set(phone, code)
+		if primary {
+			reconnectState.transition(SessionPairing, "phone_code_issued")
+		}
+		fmt.Printf("🔢 Linking code issued for +%s\n", phone)
+		response := pairing.snapshot()
+		go dispatchEventWebhooks(messageStore, "pairing_code_issued", response)
+		response["success"] = true
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	mux.HandleFunc("/api/logout", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !client.IsLoggedIn() {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"message": "Already logged out",
+			})
+			return
+		}
+
+		err := client.Logout(context.Background())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Logout failed: %v", err),
+			})
+			return
+		}
+
+		clearQRCode()
+		reconnectState.transition(SessionLoggedOut, "api_logout")
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Device successfully unpaired from WhatsApp",
+		})
+	}))
+
+	// Handler for downloading media
+	mux.HandleFunc("/api/download", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the request body
+		var req DownloadMediaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		// Validate request
+		if req.MessageID == "" || req.ChatJID == "" {
+			http.Error(w, "Message ID and Chat JID are required", http.StatusBadRequest)
+			return
+		}
+
+		// Async mode: run the download in the background and report progress via the job API
+		if req.Async {
+			job := downloadJobs.Create(req.MessageID, req.ChatJID, "")
+			w.Header().Set("Content-Type", "application/json")
+			if err := downloadPoolFor(messageStore).Enqueue(job.ID); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"message": err.Error(),
+				})
+				return
+			}
+
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"job_id":  job.ID,
+				"status":  job.Status,
+			})
+			return
+		}
+
+		// Download the media
+		success, mediaType, filename, path, err := downloadMedia(r.Context(), client, messageStore, req.MessageID, req.ChatJID, nil)
+
+		// Set response headers
+		w.Header().Set("Content-Type", "application/json")
+
+		// Handle download result
+		if !success || err != nil {
+			errMsg := "Unknown error"
+			if err != nil {
+				errMsg = err.Error()
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(DownloadMediaResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to download media: %s", errMsg),
+			})
+			return
+		}
+
+		// Callers using the media file server don't need the content inlined
+		if req.SkipContent {
+			json.NewEncoder(w).Encode(DownloadMediaResponse{
+				Success:  true,
+				Message:  fmt.Sprintf("Successfully downloaded %s media", mediaType),
+				Filename: filename,
+				Path:     path,
+				FileURL:  mediaFileURL(path),
+			})
+			return
+		}
+
+		// Read the file content to send back to backend
+		// This is necessary because backend and MCP run in separate containers
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(DownloadMediaResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to read downloaded file: %s", err.Error()),
+			})
+			return
+		}
+
+		// Encode file content as base64 to send via JSON
+		fileBase64 := base64.StdEncoding.EncodeToString(fileData)
+
+		// Send successful response with file content
+		json.NewEncoder(w).Encode(DownloadMediaResponse{
+			Success:     true,
+			Message:     fmt.Sprintf("Successfully downloaded %s media", mediaType),
+			Filename:    filename,
+			Path:        path,
+			FileURL:     mediaFileURL(path),
+			FileContent: fileBase64, // Add base64-encoded file content
+		})
+	}))
+
+	// Chunked upload endpoints for large media
+	// Flow: POST /api/upload/initiate -> PUT /api/upload/chunk (repeat) -> POST /api/upload/complete
+	// The returned upload_id is passed to /api/send as media_handle
+	mux.HandleFunc("/api/upload/initiate", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Filename  string `json:"filename"`
+			MimeType  string `json:"mime_type"`
+			TotalSize int64  `json:"total_size"` // Optional, enables completeness check
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Filename == "" {
+			http.Error(w, "filename is required", http.StatusBadRequest)
+			return
+		}
+
+		// Fail before any bytes are uploaded if the file could never be sent
+		_, mimeType := mediaTypeForFile(req.Filename)
+		if req.MimeType != "" {
+			mimeType = req.MimeType
+		}
+		if err := mediaPolicy.Check(req.Filename, mimeType); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		session, err := initiateUpload(messageStore, req.Filename, req.MimeType, req.TotalSize)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":        true,
+			"upload_id":      session.ID,
+			"chunk_size":     uploadChunkSize,
+			"max_chunk_size": maxUploadChunk,
+			"expires_at":     session.CreatedAt.Add(uploadSessionTTL).UTC().Format(time.RFC3339),
+		})
+	}))
+
+	// PUT /api/upload/chunk?upload_id=...&offset=... with the raw chunk bytes as body
+	mux.HandleFunc("/api/upload/chunk", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		uploadID := r.URL.Query().Get("upload_id")
+		if uploadID == "" {
+			http.Error(w, "upload_id is required", http.StatusBadRequest)
+			return
+		}
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "offset is required and must be an integer", http.StatusBadRequest)
+			return
+		}
+
+		session, err := writeUploadChunk(messageStore, uploadID, offset, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			status := http.StatusBadRequest
+			if err.Error() == "upload not found" {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"upload_id":     session.ID,
+			"received_size": session.ReceivedSize,
+			"total_size":    session.TotalSize,
+		})
+	}))
+
+	// GET /api/upload/status?upload_id=... returns received_size so clients can resume
+	mux.HandleFunc("/api/upload/status", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := messageStore.GetUpload(r.URL.Query().Get("upload_id"))
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "upload not found",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"upload":  session,
+		})
+	}))
+
+	mux.HandleFunc("/api/upload/complete", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			UploadID string `json:"upload_id"`
+			SHA256   string `json:"sha256"` // Optional hex digest of the full file
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.UploadID == "" {
+			http.Error(w, "upload_id is required", http.StatusBadRequest)
+			return
+		}
+
+		session, err := finishUpload(messageStore, req.UploadID, req.SHA256)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			status := http.StatusBadRequest
+			if err.Error() == "upload not found" {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"media_handle": session.ID,
+			"filename":     session.Filename,
+			"size":         session.ReceivedSize,
+		})
+	}))
+
+	// Handler for polling download job progress
+	// GET /api/download/status?job_id=... (file content is fetched afterwards via /api/download)
+	mux.HandleFunc("/api/download/status", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		job, ok := downloadJobs.Get(r.URL.Query().Get("job_id"))
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "download job not found",
+			})
+			return
+		}
+
+		var percent float64
+		if job.TotalBytes > 0 {
+			percent = math.Round(float64(job.BytesDownloaded)*1000/float64(job.TotalBytes)) / 10
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"job":     job,
+			"percent": percent,
+		})
+	}))
+
+	// Handler for bulk downloading all media in a chat through the worker pool
+	// Returns a batch_id whose per-job status is available from /api/download/batch
+	mux.HandleFunc("/api/download/chat", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID    string   `json:"chat_jid"`
+			MediaTypes []string `json:"media_types,omitempty"` // e.g. ["image", "document"]; empty = all
+			Limit      int      `json:"limit,omitempty"`       // Default 100, max 1000
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" {
+			http.Error(w, "chat_jid is required", http.StatusBadRequest)
+			return
+		}
+		if req.Limit <= 0 {
+			req.Limit = 100
+		}
+		if req.Limit > 1000 {
+			req.Limit = 1000
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		messageIDs, err := messageStore.GetMediaMessageIDs(req.ChatJID, req.MediaTypes, req.Limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+
+		batchID := newRandomID(8)
+		queued := 0
+		rejected := 0
+		for _, messageID := range messageIDs {
+			job := downloadJobs.Create(messageID, req.ChatJID, batchID)
+			if err := downloadPoolFor(messageStore).Enqueue(job.ID); err != nil {
+				rejected++
+				continue
+			}
+			queued++
+		}
+
+		fmt.Printf("📥 Queued %d media downloads for %s (batch %s, %d rejected)\n", queued, req.ChatJID, batchID, rejected)
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"batch_id": batchID,
+			"queued":   queued,
+			"rejected": rejected,
+		})
+	}))
+
+	// GET /api/download/batch?batch_id=... returns per-job status for a bulk download
+	mux.HandleFunc("/api/download/batch", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jobs := downloadJobs.GetBatch(r.URL.Query().Get("batch_id"))
+		w.Header().Set("Content-Type", "application/json")
+		if len(jobs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "download batch not found",
+			})
+			return
+		}
+
+		counts := map[string]int{"queued": 0, "downloading": 0, "complete": 0, "failed": 0}
+		for _, job := range jobs {
+			counts[job.Status]++
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"total":       len(jobs),
+			"counts":      counts,
+			"done":        counts["complete"]+counts["failed"] == len(jobs),
+			"jobs":        jobs,
+			"queue_depth": downloadPoolFor(messageStore).QueueDepth(),
+		})
+	}))
+
+	// Webhook registration endpoints
+	// GET lists webhooks, POST registers {url, media_mode, inline_max_bytes}, DELETE ?id= removes one
+	mux.HandleFunc("/api/webhooks", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			webhooks, err := messageStore.GetWebhooks()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"webhooks": webhooks,
+				"count":    len(webhooks),
+			})
+
+		case http.MethodPost:
+			var req struct {
+				URL            string `json:"url"`
+				MediaMode      string `json:"media_mode"`       // "metadata" (default), "url" or "inline"
+				InlineMaxBytes int64  `json:"inline_max_bytes"` // Inline threshold (default 1MB)
+				Secret         string `json:"secret"`           // HMAC signing key (generated when omitted)
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			parsed, err := url.Parse(req.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				http.Error(w, "url must be an absolute http(s) URL", http.StatusBadRequest)
+				return
+			}
+			if err := checkPublicHost(r.Context(), "webhook", parsed.Hostname(), webhookAllowedHosts); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.MediaMode == "" {
+				req.MediaMode = webhookMediaMetadata
+			}
+			if req.MediaMode != webhookMediaMetadata && req.MediaMode != webhookMediaURL && req.MediaMode != webhookMediaInline {
+				http.Error(w, "media_mode must be 'metadata', 'url' or 'inline'", http.StatusBadRequest)
+				return
+			}
+			if req.InlineMaxBytes <= 0 {
+				req.InlineMaxBytes = defaultWebhookInlineMaxBytes
+			}
+
+			webhook := &Webhook{
+				ID:             newRandomID(8),
+				URL:            req.URL,
+				MediaMode:      req.MediaMode,
+				InlineMaxBytes: req.InlineMaxBytes,
+				CreatedAt:      time.Now().UTC(),
+				Secret:         req.Secret,
+			}
+			if webhook.Secret == "" {
+				webhook.Secret = newRandomID(32)
+			}
+			if err := messageStore.CreateWebhook(webhook); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to create webhook: %v", err),
+				})
+				return
+			}
+			// The secret is only ever shown here; payloads carry X-Webhook-Signature
+			// (HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"webhook": webhook,
+				"secret":  webhook.Secret,
+			})
+
+		case http.MethodDelete:
+			found, err := messageStore.DeleteWebhook(r.URL.Query().Get("id"))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to delete webhook: %v", err),
+				})
+				return
+			}
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"message": "webhook not found",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Dead-lettered webhook deliveries: GET lists (?webhook_id=&limit=&body=true),
+	// POST {id} requeues one for delivery, DELETE ?id= discards it
+	mux.HandleFunc("/api/webhooks/dead-letters", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			limit := 100
+			if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+				limit = min(l, 1000)
+			}
+			deadLetters, err := messageStore.GetWebhookDeadLetters(r.URL.Query().Get("webhook_id"), limit, r.URL.Query().Get("body") == "true")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":      true,
+				"dead_letters": deadLetters,
+				"count":        len(deadLetters),
+			})
+
+		case http.MethodPost, http.MethodDelete:
+			var id int64
+			if r.Method == http.MethodPost {
+				var req struct {
+					ID int64 `json:"id"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				id = req.ID
+			} else {
+				id, _ = strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			}
+			if id <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "id is required",
+				})
+				return
+			}
+
+			delivery, err := messageStore.TakeWebhookDeadLetter(id)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "dead letter not found",
+				})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			if r.Method == http.MethodDelete {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": true,
+				})
+				return
+			}
+
+			webhooks, err := messageStore.GetWebhooks()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			index := slices.IndexFunc(webhooks, func(webhook Webhook) bool { return webhook.ID == delivery.WebhookID })
+			if index < 0 {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "webhook no longer exists",
+				})
+				return
+			}
+			// A fresh delivery with a full retry schedule
+			deliveryErr := deliverWebhook(messageStore, webhooks[index], delivery.EventID, delivery.Body)
+			response := map[string]interface{}{
+				"success":   true,
+				"delivered": deliveryErr == nil,
+			}
+			if deliveryErr != nil {
+				response["error"] = deliveryErr.Error()
+				response["retrying"] = webhookRetry.MaxAttempts > 1
+			}
+			json.NewEncoder(w).Encode(response)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Handler for per-webhook delivery stats (success rate, last failure, pending retries)
+	mux.HandleFunc("/api/webhooks/stats", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats, err := messageStore.GetWebhookStats()
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"webhooks": stats,
+			"count":    len(stats),
+		})
+	}))
+
+	// Handler for manually redelivering a logged event: POST {"event_id", "webhook_id"?}
+	// sends it again to one webhook (or all) and reports each delivery's outcome
+	mux.HandleFunc("/api/webhooks/redeliver", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			EventID   int64  `json:"event_id"`
+			WebhookID string `json:"webhook_id"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.EventID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "event_id is required",
+			})
+			return
+		}
+
+		event, err := messageStore.GetStoredEvent(req.EventID)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Event not found (it may have been pruned)",
+			})
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+
+		webhooks, err := messageStore.GetWebhooks()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		var targets []Webhook
+		for _, webhook := range webhooks {
+			if req.WebhookID == "" || webhook.ID == req.WebhookID {
+				targets = append(targets, webhook)
+			}
+		}
+		if len(targets) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "webhook not found",
+			})
+			return
+		}
+
+		// Message events are rebuilt per webhook so each gets its media mode applied
+		var message WebhookMessage
+		if event.Type == "message" {
+			if err := json.Unmarshal(event.Payload, &message); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to decode event: %v", err),
+				})
+				return
+			}
+		}
+		body, err := eventWebhookBody(event.Type, event.ID, event.Payload)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to encode webhook payload: %v", err),
+			})
+			return
+		}
+
+		type redeliveryResult struct {
+			WebhookID string `json:"webhook_id"`
+			Delivered bool   `json:"delivered"`
+			Error     string `json:"error,omitempty"`
+		}
+		results := make([]redeliveryResult, 0, len(targets))
+		allDelivered := true
+		for _, webhook := range targets {
+			var deliveryErr error
+			if event.Type == "message" {
+				deliveryErr = deliverMessageWebhook(client, messageStore, webhook, event.ID, message)
+			} else {
+				deliveryErr = deliverWebhook(messageStore, webhook, event.ID, body)
+			}
+			result := redeliveryResult{WebhookID: webhook.ID, Delivered: deliveryErr == nil}
+			if deliveryErr != nil {
+				result.Error = deliveryErr.Error()
+				allDelivered = false
+			}
+			results = append(results, result)
+		}
+		fmt.Printf("♻️ Manual redelivery of event %d to %d webhook(s), all delivered=%v\n", event.ID, len(targets), allDelivered)
+
+		if !allDelivered {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    allDelivered,
+			"event_id":   event.ID,
+			"event_type": event.Type,
+			"results":    results,
+		})
+	}))
+
+	// Media streaming endpoint used by webhook "url" mode
+	// Accepts either a presigned URL (expires + sig) or the usual Bearer token
+	mux.HandleFunc("/api/media/stream", func(w http.ResponseWriter, r *http.Request) {
+		serve := func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			chatJID := r.URL.Query().Get("chat_jid")
+			messageID := r.URL.Query().Get("message_id")
+			if chatJID == "" || messageID == "" {
+				http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+				return
+			}
+
+			success, _, filename, path, err := downloadMedia(r.Context(), client, messageStore, messageID, chatJID, nil)
+			if !success || err != nil {
+				http.Error(w, "Media not available", http.StatusNotFound)
+				return
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				http.Error(w, "Media not available", http.StatusNotFound)
+				return
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				http.Error(w, "Media not available", http.StatusNotFound)
+				return
+			}
+
+			// ServeContent handles Range requests so large files can be streamed
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			http.ServeContent(w, r, filename, info.ModTime(), file)
+		}
+
+		query := r.URL.Query()
+		if query.Get("sig") != "" {
+			if !verifyMediaStreamSignature(query.Get("chat_jid"), query.Get("message_id"), query.Get("expires"), query.Get("sig")) {
+				http.Error(w, `{"error": "Invalid or expired media URL"}`, http.StatusForbidden)
+				return
+			}
+			serve(w, r)
+			return
+		}
+		authMiddleware(serve)(w, r)
+	})
+
+	// Handler for document previews
+	// GET /api/media/thumbnail?chat_jid=...&message_id=... returns the stored JPEG thumbnail
+	mux.HandleFunc("/api/media/thumbnail", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		chatJID := r.URL.Query().Get("chat_jid")
+		messageID := r.URL.Query().Get("message_id")
+		if chatJID == "" || messageID == "" {
+			http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		thumbnail, err := messageStore.GetThumbnail(messageID, chatJID)
+		if err != nil || len(thumbnail) == 0 {
+			http.Error(w, "Thumbnail not available", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(thumbnail)))
+		w.Write(thumbnail)
+	}))
+
+	// Authenticated static file server for downloaded media under store/
+	// GET /api/media/files/<chat_dir>/<filename> (see file_url in /api/download responses)
+	mux.HandleFunc(mediaFilesPrefix, authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path, err := resolveMediaFilePath(strings.TrimPrefix(r.URL.Path, mediaFilesPrefix))
+		if err != nil {
+			status := http.StatusBadRequest
+			if err.Error() == "file not found" {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	}))
+
+	// Handler for selecting an option from interactive menus (list/buttons)
+	mux.HandleFunc("/api/select-option", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the request body
+		var req struct {
+			Recipient    string `json:"recipient"`     // JID of the bot/chat
+			SelectedID   string `json:"selected_id"`   // The ID of the selected option
+			SelectedText string `json:"selected_text"` // Display text of selection (optional)
+			ResponseType string `json:"response_type"` // "list", "buttons", or "native_flow"
+			// Text is free text sent alongside the selection (as a follow-up for list/buttons)
+			Text string `json:"text"`
+			// QuotedMessageID quotes the menu message the selection answers
+			QuotedMessageID string `json:"quoted_message_id"`
+			// FallbackToText resends the selection as plain text if the structured reply is rejected (default true)
+			FallbackToText *bool `json:"fallback_to_text"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		// Validate request
+		if req.Recipient == "" {
+			http.Error(w, "Recipient is required", http.StatusBadRequest)
+			return
+		}
+		if req.SelectedID == "" {
+			http.Error(w, "Selected ID is required", http.StatusBadRequest)
+			return
+		}
+
+		// Default response type - native_flow works best with most business bots
+		// as it sends the selection as plain text which bots universally accept
+		if req.ResponseType == "" {
+			req.ResponseType = "native_flow"
+		}
+
+		// Parse recipient JID
+		var recipientJID types.JID
+		var err error
+
+		if strings.Contains(req.Recipient, "@") {
+			recipientJID, err = types.ParseJID(req.Recipient)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Invalid recipient JID: %v", err),
+				})
+				return
+			}
+		} else {
+			phoneNumber := strings.TrimPrefix(req.Recipient, "+")
+			recipientJID = types.JID{
+				User:   phoneNumber,
+				Server: "s.whatsapp.net",
+			}
+		}
+
+		var contextInfo *waProto.ContextInfo
+		if req.QuotedMessageID != "" {
+			contextInfo, err = buildQuoteContext(client, messageStore, recipientJID, req.QuotedMessageID)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: fmt.Sprintf("Cannot quote message: %v", err),
+				})
+				return
+			}
+		}
+
+		// selectionText is what a human would type to pick the option; it backs the
+		// native_flow reply and the plain-text fallback
+		selectionText := req.SelectedText
+		if selectionText == "" {
+			selectionText = req.SelectedID
+		}
+		textMessage := func(text string) *waProto.Message {
+			if req.Text != "" {
+				text = strings.TrimSpace(text + "\n" + req.Text)
+			}
+			if contextInfo == nil {
+				return &waProto.Message{Conversation: proto.String(text)}
+			}
+			return &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text:        proto.String(text),
+				ContextInfo: contextInfo,
+			}}
+		}
+
+		// Build the response message based on type
+		var msg *waProto.Message
+
+		switch req.ResponseType {
+		case "list":
+			// ListResponseMessage for list menu selections
+			msg = &waProto.Message{
+				ListResponseMessage: &waProto.ListResponseMessage{
+					Title:    proto.String(req.SelectedText),
 					ListType: waProto.ListResponseMessage_SINGLE_SELECT.Enum(),
 					SingleSelectReply: &waProto.ListResponseMessage_SingleSelectReply{
 						SelectedRowID: proto.String(req.SelectedID),
 					},
+					ContextInfo: contextInfo,
+				},
+			}
+
+		case "buttons":
+			// ButtonsResponseMessage for button selections
+			msg = &waProto.Message{
+				ButtonsResponseMessage: &waProto.ButtonsResponseMessage{
+					SelectedButtonID: proto.String(req.SelectedID),
+					Response: &waProto.ButtonsResponseMessage_SelectedDisplayText{
+						SelectedDisplayText: selectionText,
+					},
+					Type:        waProto.ButtonsResponseMessage_DISPLAY_TEXT.Enum(),
+					ContextInfo: contextInfo,
 				},
 			}
 
-		case "buttons":
-			// ButtonsResponseMessage for button selections
-			msg = &waProto.Message{
-				ButtonsResponseMessage: &waProto.ButtonsResponseMessage{
-					SelectedButtonID: proto.String(req.SelectedID),
-					Type:             waProto.ButtonsResponseMessage_DISPLAY_TEXT.Enum(),
-				},
-			}
+		case "native_flow":
+			// For native flow buttons, we typically just send the button text as a regular message
+			// Many bots accept the button text as a text reply
+			// (the free text rides in the same message)
+			msg = textMessage(req.SelectedID)
+
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Invalid response_type: %s (use 'list', 'buttons', or 'native_flow')", req.ResponseType),
+			})
+			return
+		}
+
+		// Send the response message
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+
+		strategy := req.ResponseType
+		var fallbackReason, followUpError string
+		presenceManager.BeforeSend(client)
+		resp, err := client.SendMessage(sendCtx, recipientJID, msg)
+		if err != nil && req.ResponseType != "native_flow" && sendCtx.Err() == nil &&
+			(req.FallbackToText == nil || *req.FallbackToText) {
+			// The server (or the bot's business rules) refused the structured reply; answer
+			// the way a person would, by typing the option
+			fallbackReason = err.Error()
+			fmt.Printf("⚠️ %s selection to %s rejected (%v), falling back to text\n", req.ResponseType, recipientJID, err)
+			strategy = "text_fallback"
+			msg = textMessage(selectionText)
+			resp, err = client.SendMessage(sendCtx, recipientJID, msg)
+		}
+		if err == nil {
+			storeSentMessage(client, messageStore, recipientJID, resp, msg)
+			// Free text accompanying a structured reply goes as its own follow-up message
+			if req.Text != "" && strategy != "native_flow" && strategy != "text_fallback" {
+				followUp := &waProto.Message{Conversation: proto.String(req.Text)}
+				if followResp, followErr := client.SendMessage(sendCtx, recipientJID, followUp); followErr == nil {
+					storeSentMessage(client, messageStore, recipientJID, followResp, followUp)
+				} else {
+					followUpError = followErr.Error()
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err != nil {
+			if msg := contextErrorMessage(sendCtx, "sending selection to WhatsApp", endpointTimeouts.Send); msg != "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(SendMessageResponse{
+					Success: false,
+					Message: msg,
+				})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending selection: %v", err),
+			})
+			return
+		}
+
+		response := map[string]interface{}{
+			"success":    true,
+			"message":    fmt.Sprintf("Selection '%s' sent to %s", req.SelectedID, req.Recipient),
+			"strategy":   strategy,
+			"message_id": resp.ID,
+		}
+		if fallbackReason != "" {
+			response["fallback_reason"] = fallbackReason
+		}
+		if followUpError != "" {
+			response["text_error"] = followUpError
+		}
+		json.NewEncoder(w).Encode(response)
+	}))))
+
+	// Handler for sending event (calendar) invites to groups
+	mux.HandleFunc("/api/events/send", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Recipient          string `json:"recipient"` // Group JID
+			Name               string `json:"name"`      // Event title
+			Description        string `json:"description,omitempty"`
+			StartTime          string `json:"start_time"`          // RFC3339
+			EndTime            string `json:"end_time,omitempty"`  // RFC3339
+			JoinLink           string `json:"join_link,omitempty"` // Call or meeting link
+			ExtraGuestsAllowed bool   `json:"extra_guests_allowed,omitempty"`
+			Location           *struct {
+				Name      string  `json:"name"`
+				Address   string  `json:"address,omitempty"`
+				Latitude  float64 `json:"latitude,omitempty"`
+				Longitude float64 `json:"longitude,omitempty"`
+			} `json:"location,omitempty"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		// Validate request
+		if req.Recipient == "" || req.Name == "" || req.StartTime == "" {
+			http.Error(w, "recipient, name and start_time are required", http.StatusBadRequest)
+			return
+		}
+		recipientJID, err := types.ParseJID(req.Recipient)
+		if err != nil || recipientJID.Server != types.GroupServer {
+			http.Error(w, "recipient must be a group JID (events are only supported in groups)", http.StatusBadRequest)
+			return
+		}
+		startTime, err := time.Parse(time.RFC3339, req.StartTime)
+		if err != nil {
+			http.Error(w, "start_time must be RFC3339", http.StatusBadRequest)
+			return
+		}
+
+		event := &waProto.EventMessage{
+			Name:               proto.String(req.Name),
+			StartTime:          proto.Int64(startTime.Unix()),
+			ExtraGuestsAllowed: proto.Bool(req.ExtraGuestsAllowed),
+			IsCanceled:         proto.Bool(false),
+		}
+		if req.Description != "" {
+			event.Description = proto.String(req.Description)
+		}
+		if req.EndTime != "" {
+			endTime, err := time.Parse(time.RFC3339, req.EndTime)
+			if err != nil || endTime.Before(startTime) {
+				http.Error(w, "end_time must be RFC3339 and not before start_time", http.StatusBadRequest)
+				return
+			}
+			event.EndTime = proto.Int64(endTime.Unix())
+		}
+		if req.JoinLink != "" {
+			event.JoinLink = proto.String(req.JoinLink)
+		}
+		if req.Location != nil {
+			event.Location = &waProto.LocationMessage{
+				Name:             proto.String(req.Location.Name),
+				Address:          proto.String(req.Location.Address),
+				DegreesLatitude:  proto.Float64(req.Location.Latitude),
+				DegreesLongitude: proto.Float64(req.Location.Longitude),
+			}
+		}
+
+		// The message secret lets us decrypt RSVPs sent back for this event
+		messageSecret := make([]byte, 32)
+		if _, err := cryptorand.Read(messageSecret); err != nil {
+			http.Error(w, "Failed to generate event secret", http.StatusInternalServerError)
+			return
+		}
+		msg := &waProto.Message{
+			EventMessage: event,
+			MessageContextInfo: &waProto.MessageContextInfo{
+				MessageSecret: messageSecret,
+			},
+		}
+
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		resp, err := client.SendMessage(sendCtx, recipientJID, msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Error sending event: %v", err),
+			})
+			return
+		}
+
+		pushCalendarEvent(messageStore, recipientJID.String(), resp.ID, event)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"message":    fmt.Sprintf("Event '%s' sent to %s", req.Name, req.Recipient),
+			"message_id": resp.ID,
+		})
+	}))))
+
+	// Handler for event RSVPs
+	// GET /api/events/responses?chat_jid=...&event_id=...
+	mux.HandleFunc("/api/events/responses", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		chatJID := r.URL.Query().Get("chat_jid")
+		eventID := r.URL.Query().Get("event_id")
+		if chatJID == "" || eventID == "" {
+			http.Error(w, "chat_jid and event_id are required", http.StatusBadRequest)
+			return
+		}
+
+		responses, err := messageStore.WithContext(r.Context()).GetEventResponses(eventID, chatJID)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+
+		counts := map[string]int{"going": 0, "not_going": 0, "maybe": 0}
+		for _, resp := range responses {
+			counts[resp.Response]++
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"responses": responses,
+			"counts":    counts,
+		})
+	}))
+
+	// Handler for sending polls: POST {recipient, question, options, multi_select?}.
+	// Votes come back as poll_vote messages (see formatPollVote).
+	mux.HandleFunc("/api/send-poll", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Recipient   string   `json:"recipient"` // Phone number or JID
+			Question    string   `json:"question"`
+			Options     []string `json:"options"`
+			MultiSelect bool     `json:"multi_select,omitempty"` // Allow voting for several options
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		req.Question = strings.TrimSpace(req.Question)
+		if req.Recipient == "" || req.Question == "" {
+			http.Error(w, "recipient and question are required", http.StatusBadRequest)
+			return
+		}
+		// Votes identify options by a hash of their name, so names have to be distinct
+		seen := make(map[string]bool)
+		for i, option := range req.Options {
+			option = strings.TrimSpace(option)
+			if option == "" || seen[option] {
+				http.Error(w, "options must be distinct and non-empty", http.StatusBadRequest)
+				return
+			}
+			seen[option] = true
+			req.Options[i] = option
+		}
+		if len(req.Options) < 2 || len(req.Options) > maxPollOptions {
+			http.Error(w, fmt.Sprintf("a poll needs between 2 and %d options", maxPollOptions), http.StatusBadRequest)
+			return
+		}
+		recipientJID, err := parseRecipientJID(req.Recipient)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid recipient: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		selectable := 1
+		if req.MultiSelect {
+			selectable = 0
+		}
+		// The poll carries a message secret, which votes are encrypted with
+		msg := client.BuildPollCreation(req.Question, req.Options, selectable)
+
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		resp, err := client.SendMessage(sendCtx, recipientJID, msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Error sending poll: %v", err),
+			})
+			return
+		}
+
+		// Stored right away so votes can be matched to the option names
+		storeSentMessage(client, messageStore, recipientJID, resp, msg)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"message":    fmt.Sprintf("Poll sent to %s", recipientJID),
+			"message_id": resp.ID,
+		})
+	}))))
+
+	// Handler for sending reply buttons, list menus and native flow messages. The body is the
+	// InteractiveMessageData that incoming interactive messages are parsed into, plus recipient.
+	mux.HandleFunc("/api/send-interactive", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Recipient string `json:"recipient"` // Phone number or JID
+			InteractiveMessageData
+			ButtonText string `json:"button_text,omitempty"` // List only: label of the button opening the menu (default "Menu")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Recipient == "" {
+			http.Error(w, "recipient is required", http.StatusBadRequest)
+			return
+		}
+		recipientJID, err := parseRecipientJID(req.Recipient)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid recipient: %v", err), http.StatusBadRequest)
+			return
+		}
+		msg, nodes, err := buildInteractiveMessage(req.InteractiveMessageData, req.ButtonText)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid interactive message: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var extra whatsmeow.SendRequestExtra
+		if nodes != nil {
+			extra.AdditionalNodes = &nodes
+		}
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		resp, err := client.SendMessage(sendCtx, recipientJID, msg, extra)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Error sending interactive message: %v", err),
+			})
+			return
+		}
+
+		// Stored right away so replies (list and button responses) can be matched to the menu
+		storeSentMessage(client, messageStore, recipientJID, resp, msg)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"message":    fmt.Sprintf("Interactive message sent to %s", recipientJID),
+			"message_id": resp.ID,
+		})
+	}))))
+
+	// Handler for pinning/unpinning messages
+	mux.HandleFunc("/api/pin", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID         string `json:"chat_jid"`
+			MessageID       string `json:"message_id"`
+			Sender          string `json:"sender,omitempty"`           // Only needed for messages not in local storage
+			Unpin           bool   `json:"unpin,omitempty"`            // true = unpin
+			DurationSeconds uint32 `json:"duration_seconds,omitempty"` // 86400, 604800 (default) or 2592000
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" {
+			http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+		if req.DurationSeconds == 0 {
+			req.DurationSeconds = defaultPinDuration
+		}
+		if !pinDurations[req.DurationSeconds] {
+			http.Error(w, "duration_seconds must be 86400 (24h), 604800 (7d) or 2592000 (30d)", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+			return
+		}
+		key, err := buildStoredMessageKey(client, messageStore, chatJID, req.MessageID, req.Sender)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pinType := waProto.PinInChatMessage_PIN_FOR_ALL
+		if req.Unpin {
+			pinType = waProto.PinInChatMessage_UNPIN_FOR_ALL
+		}
+		now := time.Now()
+		msg := &waProto.Message{
+			PinInChatMessage: &waProto.PinInChatMessage{
+				Key:               key,
+				Type:              pinType.Enum(),
+				SenderTimestampMS: proto.Int64(now.UnixMilli()),
+			},
+		}
+		if !req.Unpin {
+			msg.MessageContextInfo = &waProto.MessageContextInfo{
+				MessageAddOnDurationInSecs: proto.Uint32(req.DurationSeconds),
+			}
+		}
+
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		_, err = client.SendMessage(sendCtx, chatJID, msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending pin: %v", err),
+			})
+			return
+		}
+
+		// Mirror locally; the echo from our other devices is handled the same way
+		if req.Unpin {
+			err = messageStore.DeletePin(chatJID.String(), req.MessageID)
+		} else {
+			err = messageStore.StorePin(chatJID.String(), req.MessageID, client.Store.ID.User, now, time.Duration(req.DurationSeconds)*time.Second)
+		}
+		if err != nil {
+			fmt.Printf("⚠️ Failed to record pin locally: %v\n", err)
+		}
+
+		action := "pinned"
+		if req.Unpin {
+			action = "unpinned"
+		}
+		json.NewEncoder(w).Encode(SendMessageResponse{
+			Success: true,
+			Message: fmt.Sprintf("Message %s %s in %s", req.MessageID, action, req.ChatJID),
+		})
+	}))))
+
+	// Handler for chat state indicators: POST {chat_jid, state: composing|recording|paused}.
+	// WhatsApp clears the indicator on its own after a while or when a message arrives.
+	mux.HandleFunc("/api/chat-state", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID string `json:"chat_jid"`
+			State   string `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		state, media := types.ChatPresenceComposing, types.ChatPresenceMediaText
+		switch strings.ToLower(req.State) {
+		case "composing", "typing":
+		case "recording":
+			media = types.ChatPresenceMediaAudio
+		case "paused":
+			state = types.ChatPresencePaused
+		default:
+			http.Error(w, "state must be composing, recording or paused", http.StatusBadRequest)
+			return
+		}
+		chatJID, err := parseRecipientJID(req.ChatJID)
+		if err != nil || req.ChatJID == "" {
+			http.Error(w, "A valid chat_jid is required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: "Not connected to WhatsApp",
+			})
+			return
+		}
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		if err := client.SendChatPresence(sendCtx, chatJID, state, media); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending chat state: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(SendMessageResponse{
+			Success: true,
+			Message: fmt.Sprintf("Chat state %s sent to %s", strings.ToLower(req.State), chatJID),
+		})
+	}))
+
+	// Handler for sending read receipts: POST {chat_jid, message_ids, sender?}
+	mux.HandleFunc("/api/mark-read", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID    string   `json:"chat_jid"`
+			MessageIDs []string `json:"message_ids"`
+			Sender     string   `json:"sender,omitempty"` // Group author, only needed for messages not in local storage
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" || len(req.MessageIDs) == 0 {
+			http.Error(w, "chat_jid and message_ids are required", http.StatusBadRequest)
+			return
+		}
+		chatJID, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+			return
+		}
+		var sender types.JID
+		if req.Sender != "" {
+			if sender, err = parseRecipientJID(req.Sender); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid sender: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !client.IsConnected() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: "Not connected to WhatsApp",
+			})
+			return
+		}
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		marked, err := markMessagesRead(sendCtx, client, messageStore, chatJID, req.MessageIDs, sender)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending read receipts (%d marked): %v", marked, err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(SendMessageResponse{
+			Success: true,
+			Message: fmt.Sprintf("Marked %d messages read in %s", marked, chatJID),
+		})
+	}))
+
+	// Handler for reacting to messages; an empty emoji removes our reaction
+	mux.HandleFunc("/api/react", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+			Emoji     string `json:"emoji"`
+			Sender    string `json:"sender,omitempty"` // Only needed for messages not in local storage
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" {
+			http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+			return
+		}
+		key, err := buildStoredMessageKey(client, messageStore, chatJID, req.MessageID, req.Sender)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		msg := &waProto.Message{
+			ReactionMessage: &waProto.ReactionMessage{
+				Key:               key,
+				Text:              proto.String(req.Emoji),
+				SenderTimestampMS: proto.Int64(now.UnixMilli()),
+			},
+		}
+
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		_, err = client.SendMessage(sendCtx, chatJID, msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending reaction: %v", err),
+			})
+			return
+		}
+
+		// Mirror locally; the echo from our other devices is handled the same way
+		if err := messageStore.StoreReaction(chatJID.String(), req.MessageID, client.Store.ID.User, req.Emoji, now); err != nil {
+			fmt.Printf("⚠️ Failed to record reaction locally: %v\n", err)
+		}
+
+		message := fmt.Sprintf("Reacted %s to %s in %s", req.Emoji, req.MessageID, req.ChatJID)
+		if req.Emoji == "" {
+			message = fmt.Sprintf("Reaction removed from %s in %s", req.MessageID, req.ChatJID)
+		}
+		json.NewEncoder(w).Encode(SendMessageResponse{
+			Success: true,
+			Message: message,
+		})
+	}))))
+
+	// Handler for keeping messages in disappearing chats
+	mux.HandleFunc("/api/keep", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+			Sender    string `json:"sender,omitempty"` // Only needed for messages not in local storage
+			Unkeep    bool   `json:"unkeep,omitempty"` // true = let the message disappear again
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" {
+			http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+			return
+		}
+		key, err := buildStoredMessageKey(client, messageStore, chatJID, req.MessageID, req.Sender)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		keepType := waProto.KeepType_KEEP_FOR_ALL
+		if req.Unkeep {
+			keepType = waProto.KeepType_UNDO_KEEP_FOR_ALL
+		}
+		msg := &waProto.Message{
+			KeepInChatMessage: &waProto.KeepInChatMessage{
+				Key:         key,
+				KeepType:    keepType.Enum(),
+				TimestampMS: proto.Int64(time.Now().UnixMilli()),
+			},
+		}
+
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		_, err = client.SendMessage(sendCtx, chatJID, msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending keep: %v", err),
+			})
+			return
+		}
+
+		if err := messageStore.SetKept(req.MessageID, chatJID.String(), !req.Unkeep); err != nil {
+			fmt.Printf("⚠️ Failed to record kept state locally: %v\n", err)
+		}
+
+		action := "kept"
+		if req.Unkeep {
+			action = "unkept"
+		}
+		json.NewEncoder(w).Encode(SendMessageResponse{
+			Success: true,
+			Message: fmt.Sprintf("Message %s %s in %s", req.MessageID, action, req.ChatJID),
+		})
+	}))))
+
+	// Handler for editing a message we sent (WhatsApp only accepts edits within 15 minutes)
+	mux.HandleFunc("/api/edit", authMiddleware(drainGuard(rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID   string `json:"chat_jid"`
+			MessageID string `json:"message_id"`
+			Message   string `json:"message"` // New text
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" || req.Message == "" {
+			http.Error(w, "chat_jid, message_id and message are required", http.StatusBadRequest)
+			return
+		}
+
+		chatJID, err := parseRecipientJID(req.ChatJID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+			return
+		}
+		if _, isFromMe, err := messageStore.GetMessageSender(req.MessageID, chatJID.String()); err == nil && !isFromMe {
+			http.Error(w, "Only messages sent by this account can be edited", http.StatusBadRequest)
+			return
+		}
+
+		msg := client.BuildEdit(chatJID, req.MessageID, &waProto.Message{Conversation: proto.String(req.Message)})
+
+		sendCtx, sendCancel := context.WithTimeout(r.Context(), endpointTimeouts.Send)
+		defer sendCancel()
+		resp, err := client.SendMessage(sendCtx, chatJID, msg)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SendMessageResponse{
+				Success: false,
+				Message: fmt.Sprintf("Error sending edit: %v", err),
+			})
+			return
+		}
+
+		editedAt := resp.Timestamp
+		if editedAt.IsZero() {
+			editedAt = time.Now()
+		}
+		if _, _, err := messageStore.ApplyEdit(req.MessageID, chatJID.String(), "", true, req.Message, editedAt); err != nil {
+			fmt.Printf("⚠️ Failed to record edit locally: %v\n", err)
+		}
+
+		json.NewEncoder(w).Encode(SendMessageResponse{
+			Success: true,
+			Message: fmt.Sprintf("Message %s edited in %s", req.MessageID, req.ChatJID),
+		})
+	}))))
+
+	// Handler for profile pictures (cached; refreshed on picture change events)
+	// GET /api/avatar?jid=...&refresh=true
+	mux.HandleFunc("/api/avatar", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jidParam := r.URL.Query().Get("jid")
+		if jidParam == "" {
+			http.Error(w, "jid is required", http.StatusBadRequest)
+			return
+		}
+		jid, err := parseRecipientJID(jidParam)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid jid: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		avatar, err := getAvatar(client, messageStore, jid, r.URL.Query().Get("refresh") == "true")
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to get profile picture: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"avatar":  avatar,
+		})
+	}))
+
+	// Handler for replaying the event log
+	// GET /api/events?after_id=0&limit=100&types=message,receipt
+	// Consumers persist the last id they processed and resume from it after downtime.
+	mux.HandleFunc("/api/events", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var afterID int64
+		if param := r.URL.Query().Get("after_id"); param != "" {
+			parsed, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || parsed < 0 {
+				http.Error(w, "after_id must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			afterID = parsed
+		}
+		limit := 100
+		if param := r.URL.Query().Get("limit"); param != "" {
+			if parsed, err := strconv.Atoi(param); err == nil && parsed > 0 {
+				limit = parsed
+			}
+			if limit > 1000 {
+				limit = 1000
+			}
+		}
+		var eventTypes []string
+		if param := r.URL.Query().Get("types"); param != "" {
+			for _, t := range strings.Split(param, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					eventTypes = append(eventTypes, t)
+				}
+			}
+		}
+
+		// Fetch one extra row to report whether more are waiting
+		storedEvents, err := messageStore.WithContext(r.Context()).GetEvents(afterID, eventTypes, limit+1)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		hasMore := len(storedEvents) > limit
+		if hasMore {
+			storedEvents = storedEvents[:limit]
+		}
+		nextAfterID := afterID
+		if len(storedEvents) > 0 {
+			nextAfterID = storedEvents[len(storedEvents)-1].ID
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"events":        storedEvents,
+			"count":         len(storedEvents),
+			"next_after_id": nextAfterID,
+			"has_more":      hasMore,
+		})
+	}))
+
+	// Handler for listing pinned messages
+	// GET /api/pins?chat_jid=...
+	mux.HandleFunc("/api/pins", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			http.Error(w, "chat_jid is required", http.StatusBadRequest)
+			return
+		}
+
+		pins, err := messageStore.WithContext(r.Context()).GetPins(chatJID)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"pins":    pins,
+		})
+	}))
+
+	// POST /api/phone/normalize formats numbers as E.164 without contacting WhatsApp;
+	// default_country_code overrides MCP_DEFAULT_COUNTRY_CODE for national numbers
+	mux.HandleFunc("/api/phone/normalize", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Numbers            []string `json:"numbers"`
+			DefaultCountryCode string   `json:"default_country_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if len(req.Numbers) == 0 {
+			http.Error(w, "numbers array is required and must not be empty", http.StatusBadRequest)
+			return
+		}
+		if len(req.Numbers) > maxNormalizeNumbers {
+			http.Error(w, fmt.Sprintf("Maximum %d numbers per request", maxNormalizeNumbers), http.StatusBadRequest)
+			return
+		}
+		countryCode := defaultCountryCode
+		if req.DefaultCountryCode != "" {
+			countryCode = strings.TrimPrefix(req.DefaultCountryCode, "+")
+			if !isCountryCallingCode(countryCode) {
+				http.Error(w, "default_country_code is not a country calling code", http.StatusBadRequest)
+				return
+			}
+		}
+
+		type NormalizeResult struct {
+			PhoneNumber
+			Valid bool   `json:"valid"`
+			Error string `json:"error,omitempty"`
+		}
+		results := make([]NormalizeResult, len(req.Numbers))
+		invalid := 0
+		for i, input := range req.Numbers {
+			number, err := normalizePhoneNumber(input, countryCode)
+			if err != nil {
+				results[i] = NormalizeResult{PhoneNumber: PhoneNumber{Input: input}, Error: err.Error()}
+				invalid++
+				continue
+			}
+			results[i] = NormalizeResult{PhoneNumber: number, Valid: true}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"results": results,
+			"count":   len(results),
+			"invalid": invalid,
+		})
+	}))
+
+	// Handler for checking if phone numbers are registered on WhatsApp
+	// This endpoint uses the IsOnWhatsApp API to resolve phone numbers to WhatsApp JIDs
+	mux.HandleFunc("/api/check-numbers", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Check if client is connected and authenticated
+		if !client.IsLoggedIn() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "WhatsApp client not authenticated",
+			})
+			return
+		}
+
+		// Parse the request body
+		var req struct {
+			PhoneNumbers []string `json:"phone_numbers"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		// Validate request
+		if len(req.PhoneNumbers) == 0 {
+			http.Error(w, "phone_numbers array is required and must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		// Limit batch size to avoid rate limiting (max 50 numbers per call)
+		if len(req.PhoneNumbers) > 50 {
+			http.Error(w, "Maximum 50 phone numbers per request", http.StatusBadRequest)
+			return
+		}
+
+		fmt.Printf("Checking %d phone numbers on WhatsApp...\n", len(req.PhoneNumbers))
+
+		// Normalize phone numbers (remove + prefix, ensure only digits)
+		normalizedNumbers := make([]string, len(req.PhoneNumbers))
+		for i, phone := range req.PhoneNumbers {
+			normalizedNumbers[i] = normalizePhoneDigits(phone)
+		}
+
+		// Call IsOnWhatsApp to check if numbers are registered
+		results, err := client.IsOnWhatsApp(r.Context(), normalizedNumbers)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Failed to check numbers: %v", err),
+			})
+			return
+		}
+
+		// Build response with original phone numbers mapped to results
+		type CheckResult struct {
+			Phone        string `json:"phone"`
+			IsRegistered bool   `json:"is_registered"`
+			JID          string `json:"jid,omitempty"`
+		}
+
+		responseResults := make([]CheckResult, len(results))
+		for i, result := range results {
+			checkResult := CheckResult{
+				Phone:        req.PhoneNumbers[i], // Use original phone number from request
+				IsRegistered: result.IsIn,
+			}
+			if result.IsIn && result.JID.User != "" {
+				// Return the full JID string (e.g., "5500000000001@s.whatsapp.net")
+				checkResult.JID = result.JID.String()
+			}
+			responseResults[i] = checkResult
+
+			if result.IsIn {
+				fmt.Printf("  ✅ %s → %s\n", req.PhoneNumbers[i], result.JID.String())
+			} else {
+				fmt.Printf("  ❌ %s → not registered\n", req.PhoneNumbers[i])
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"results": responseResults,
+		})
+	}))
+
+	// Handler for getting new messages (bypasses filesystem sync issues)
+	// This endpoint allows the backend watcher to poll for new messages via HTTP
+	// instead of reading SQLite directly from bind-mounted volumes.
+	// ?cursor= (next_cursor of the previous poll) resumes exactly after the last message returned.
+	mux.HandleFunc("/api/messages", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Get 'since' parameter (timestamp string or Unix epoch)
+		sinceParam := r.URL.Query().Get("since")
+		limitParam := r.URL.Query().Get("limit")
+
+		// Default limit to 100
+		limit := 100
+		if limitParam != "" {
+			if parsed, err := fmt.Sscanf(limitParam, "%d", &limit); err != nil || parsed != 1 {
+				limit = 100
+			}
+			if limit > 500 {
+				limit = 500
+			}
+		}
+
+		// Parse 'since' timestamp
+		var sinceTime time.Time
+		if sinceParam != "" {
+			// Try parsing as RFC3339/ISO8601 first
+			if t, err := time.Parse(time.RFC3339, sinceParam); err == nil {
+				sinceTime = t
+			} else if t, err := time.Parse("2006-01-02 15:04:05", sinceParam); err == nil {
+				sinceTime = t
+			} else if t, err := time.Parse("2006-01-02 15:04:05+00:00", sinceParam); err == nil {
+				sinceTime = t
+			} else {
+				// Try as Unix timestamp
+				var epoch int64
+				if _, err := fmt.Sscanf(sinceParam, "%d", &epoch); err == nil {
+					sinceTime = time.Unix(epoch, 0)
+				} else {
+					sinceTime = time.Unix(0, 0) // Default to epoch
+				}
+			}
+		} else {
+			sinceTime = time.Unix(0, 0)
+		}
+
+		// Originals of PII-masked content are withheld from moderated tokens
+		includeUnmasked := r.URL.Query().Get("unmasked") == "true"
+		if _, moderated := moderatedSender(r); includeUnmasked && moderated {
+			http.Error(w, "unmasked content is not available to this token", http.StatusForbidden)
+			return
+		}
+
+		// Optional chat_type filter, e.g. ?chat_type=individual,group
+		chatTypeFilter, err := parseChatTypes(r.URL.Query().Get("chat_type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Optional content_type filter, e.g. ?content_type=list_response,buttons_response
+		var contentTypeFilter []string
+		for _, contentType := range strings.Split(r.URL.Query().Get("content_type"), ",") {
+			contentType = strings.ToLower(strings.TrimSpace(contentType))
+			if contentType == "" {
+				continue
+			}
+			if !slices.Contains(contentTypes, contentType) {
+				http.Error(w, fmt.Sprintf("unknown content_type %q (expected one of %s)", contentType, strings.Join(contentTypes, ", ")), http.StatusBadRequest)
+				return
+			}
+			contentTypeFilter = append(contentTypeFilter, contentType)
+		}
+
+		// Query messages from database
+		query := `SELECT ` + apiMessageColumns + `
+			FROM messages m
+			LEFT JOIN chats c ON m.chat_jid = c.jid
+			WHERE m.timestamp > ?
+		`
+		args := []interface{}{sinceTime.UTC()}
+		// The cursor replaces since, which loses messages sharing the second of the last one seen
+		cursor := r.URL.Query().Get("cursor")
+		if cursor != "" {
+			cursorTime, cursorID, err := decodeMessageCursor(cursor)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query = `SELECT ` + apiMessageColumns + `
+				FROM messages m
+				LEFT JOIN chats c ON m.chat_jid = c.jid
+				WHERE (m.timestamp > ? OR (m.timestamp = ? AND m.id > ?))
+			`
+			args = []interface{}{cursorTime, cursorTime, cursorID}
+		}
+		// Our own messages (with their delivery status) only on request, so pollers keep seeing inbound only
+		if r.URL.Query().Get("include_from_me") != "true" {
+			query += " AND m.is_from_me = 0"
+		}
+		if len(chatTypeFilter) > 0 {
+			query += " AND c.chat_type IN (?" + strings.Repeat(", ?", len(chatTypeFilter)-1) + ")"
+			for _, chatType := range chatTypeFilter {
+				args = append(args, chatType)
+			}
+		}
+		if len(contentTypeFilter) > 0 {
+			query += " AND m.content_type IN (?" + strings.Repeat(", ?", len(contentTypeFilter)-1) + ")"
+			for _, contentType := range contentTypeFilter {
+				args = append(args, contentType)
+			}
+		}
+		query += " ORDER BY m.timestamp ASC, m.id ASC LIMIT ?"
+		args = append(args, limit)
+
+		queryCtx, queryCancel := context.WithTimeout(r.Context(), endpointTimeouts.Query)
+		defer queryCancel()
+		rows, err := messageStore.db.QueryContext(queryCtx, query, args...)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		defer rows.Close()
+
+		messages := scanAPIMessages(rows, includeUnmasked)
+		rows.Close()
+		messageStore.WithContext(queryCtx).attachReactions(messages)
+
+		// Send read receipts for what the caller has now seen, in the background so polling isn't slowed
+		markRead := autoMarkRead
+		if mp := r.URL.Query().Get("mark_read"); mp != "" {
+			markRead = mp == "true" || mp == "1"
+		}
+		if markRead && client.IsConnected() {
+			unread := make(map[string][]string)
+			for _, msg := range messages {
+				if !msg.IsFromMe && msg.ReadAt == "" {
+					unread[msg.ChatJID] = append(unread[msg.ChatJID], msg.ID)
+				}
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), endpointTimeouts.Send)
+				defer cancel()
+				for chat, ids := range unread {
+					chatJID, err := types.ParseJID(chat)
+					if err != nil {
+						continue
+					}
+					if _, err := markMessagesRead(ctx, client, messageStore, chatJID, ids, types.JID{}); err != nil {
+						fmt.Printf("Warning: failed to auto-mark messages read in %s: %v\n", chat, err)
+					}
+				}
+			}()
+		}
+
+		// Pollers pass next_cursor back; it stays put when nothing new arrived
+		nextCursor := cursor
+		if len(messages) > 0 {
+			last := messages[len(messages)-1]
+			nextCursor = encodeMessageCursor(last.at, last.ID)
+		}
+
+		// Return messages
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"messages":    messages,
+			"count":       len(messages),
+			"next_cursor": nextCursor,
+		})
+	}))
+
+	// Handler for the inbox: chats with name, last message preview, unread count and archive/pin/mute state.
+	// GET ?q=&chat_type=individual,group&archived=true|false&unread=true&limit=&offset=
+	mux.HandleFunc("/api/chats", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		filter := ChatListFilter{
+			Query:      strings.TrimSpace(params.Get("q")),
+			UnreadOnly: params.Get("unread") == "true",
+			Limit:      100,
+		}
+		chatTypes, err := parseChatTypes(params.Get("chat_type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.ChatTypes = chatTypes
+		if archived := params.Get("archived"); archived != "" {
+			value, err := strconv.ParseBool(archived)
+			if err != nil {
+				http.Error(w, "archived must be true or false", http.StatusBadRequest)
+				return
+			}
+			filter.Archived = &value
+		}
+		if lp := params.Get("limit"); lp != "" {
+			if parsed, err := strconv.Atoi(lp); err == nil && parsed > 0 {
+				filter.Limit = min(parsed, 500)
+			}
+		}
+		if op := params.Get("offset"); op != "" {
+			if parsed, err := strconv.Atoi(op); err == nil && parsed > 0 {
+				filter.Offset = parsed
+			}
+		}
+
+		chats, err := messageStore.WithContext(r.Context()).GetChatList(filter)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to list chats: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"chats":   chats,
+			"count":   len(chats),
+		})
+	}))
+
+	// Handler for paging through a chat's history in (timestamp, id) order, our own messages included:
+	// GET /api/chats/{jid}/messages?limit=&before=<cursor>|after=<cursor>. Without a cursor it returns the
+	// latest page; before_cursor pages back from the oldest message returned, after_cursor forward from the newest.
+	mux.HandleFunc("/api/chats/", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		chat, found := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/chats/"), "/messages")
+		if !found || chat == "" || strings.Contains(chat, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		chatJID, err := types.ParseJID(chat)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat JID: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		params := r.URL.Query()
+		limit := 50
+		if lp := params.Get("limit"); lp != "" {
+			if parsed, err := strconv.Atoi(lp); err == nil && parsed > 0 {
+				limit = min(parsed, 500)
+			}
+		}
+		before, after := params.Get("before"), params.Get("after")
+		if before != "" && after != "" {
+			http.Error(w, "Only one of before or after may be set", http.StatusBadRequest)
+			return
+		}
+		includeUnmasked := params.Get("unmasked") == "true"
+		if _, moderated := moderatedSender(r); includeUnmasked && moderated {
+			http.Error(w, "unmasked content is not available to this token", http.StatusForbidden)
+			return
+		}
+
+		query := `SELECT ` + apiMessageColumns + `
+			FROM messages m
+			LEFT JOIN chats c ON m.chat_jid = c.jid
+			WHERE m.chat_jid = ?`
+		args := []interface{}{chatJID.String()}
+		forward := after != ""
+		if cursor := before + after; cursor != "" {
+			cursorTime, cursorID, err := decodeMessageCursor(cursor)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if forward {
+				query += " AND (m.timestamp > ? OR (m.timestamp = ? AND m.id > ?))"
+			} else {
+				query += " AND (m.timestamp < ? OR (m.timestamp = ? AND m.id < ?))"
+			}
+			args = append(args, cursorTime, cursorTime, cursorID)
+		}
+		// Walk away from the cursor; one extra row tells whether another page follows
+		if forward {
+			query += " ORDER BY m.timestamp ASC, m.id ASC LIMIT ?"
+		} else {
+			query += " ORDER BY m.timestamp DESC, m.id DESC LIMIT ?"
+		}
+		args = append(args, limit+1)
+
+		queryCtx, queryCancel := context.WithTimeout(r.Context(), endpointTimeouts.Query)
+		defer queryCancel()
+		rows, err := messageStore.db.QueryContext(queryCtx, query, args...)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		messages := scanAPIMessages(rows, includeUnmasked)
+		rows.Close()
+
+		hasMore := len(messages) > limit
+		if hasMore {
+			messages = messages[:limit]
+		}
+		if !forward {
+			slices.Reverse(messages)
+		}
+		if messages == nil {
+			messages = []APIMessage{}
+		}
+		messageStore.WithContext(queryCtx).attachReactions(messages)
+
+		response := map[string]interface{}{
+			"success":  true,
+			"chat_jid": chatJID.String(),
+			"messages": messages,
+			"count":    len(messages),
+			"has_more": hasMore,
+		}
+		if len(messages) > 0 {
+			first, last := messages[0], messages[len(messages)-1]
+			response["before_cursor"] = encodeMessageCursor(first.at, first.ID)
+			response["after_cursor"] = encodeMessageCursor(last.at, last.ID)
+		} else if forward {
+			response["after_cursor"] = after
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	// Handler for full-text search over message history, newest first:
+	// GET ?query=&chat_jid=&sender=&media_type=image,document&after=&before=&limit=&cursor=.
+	// Terms must all match (term* for a prefix); after/before are RFC3339 and pages continue from next_cursor.
+	mux.HandleFunc("/api/search", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		search := MessageSearch{
+			Query:   strings.TrimSpace(params.Get("query")),
+			ChatJID: params.Get("chat_jid"),
+			Cursor:  params.Get("cursor"),
+			Limit:   50,
+		}
+		if len(searchTerms(search.Query)) == 0 {
+			http.Error(w, "query is required", http.StatusBadRequest)
+			return
+		}
+		if sender := params.Get("sender"); sender != "" {
+			senderJID, err := parseRecipientJID(sender)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid sender: %v", err), http.StatusBadRequest)
+				return
+			}
+			search.Sender = senderJID.User
+		}
+		for _, mediaType := range strings.Split(params.Get("media_type"), ",") {
+			if mediaType = strings.ToLower(strings.TrimSpace(mediaType)); mediaType != "" {
+				search.MediaTypes = append(search.MediaTypes, mediaType)
+			}
+		}
+		for name, target := range map[string]*time.Time{"after": &search.After, "before": &search.Before} {
+			if value := params.Get(name); value != "" {
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s must be an RFC3339 timestamp", name), http.StatusBadRequest)
+					return
+				}
+				*target = parsed
+			}
+		}
+		if lp := params.Get("limit"); lp != "" {
+			if parsed, err := strconv.Atoi(lp); err == nil && parsed > 0 {
+				search.Limit = min(parsed, 200)
+			}
+		}
+		if search.Cursor != "" {
+			if _, _, err := decodeSearchCursor(search.Cursor); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		results, nextCursor, err := messageStore.WithContext(r.Context()).SearchMessages(search)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to search messages: %v", err),
+			})
+			return
+		}
+		response := map[string]interface{}{
+			"success":  true,
+			"results":  results,
+			"count":    len(results),
+			"has_more": nextCursor != "",
+		}
+		if nextCursor != "" {
+			response["next_cursor"] = nextCursor
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	// Handler for the delivery status of one of our messages: GET ?chat_jid=&message_id=.
+	// In groups status is the furthest any participant got; receipts has each participant.
+	mux.HandleFunc("/api/message-status", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		chatJID := r.URL.Query().Get("chat_jid")
+		messageID := r.URL.Query().Get("message_id")
+		if chatJID == "" || messageID == "" {
+			http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		status, receipts, found, err := messageStore.WithContext(r.Context()).GetMessageStatus(messageID, chatJID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("No message %s sent by us in %s", messageID, chatJID),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"message_id": messageID,
+			"chat_jid":   chatJID,
+			"status":     status,
+			"receipts":   receipts,
+		})
+	}))
+
+	// Handler for who was in a group when we sent a message to it: GET ?chat_jid=&message_id=
+	mux.HandleFunc("/api/message-members", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		chatJID := r.URL.Query().Get("chat_jid")
+		messageID := r.URL.Query().Get("message_id")
+		if chatJID == "" || messageID == "" {
+			http.Error(w, "chat_jid and message_id are required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		snapshot, found, err := messageStore.WithContext(r.Context()).GetMemberSnapshot(messageID, chatJID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("No member snapshot for message %s in %s", messageID, chatJID),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"snapshot": snapshot,
+		})
+	}))
+
+	// Handler for getting the latest message timestamp
+	// Used by the backend to determine starting point for polling
+	mux.HandleFunc("/api/messages/latest", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Query for the latest message timestamp
+		// (ORDER BY rather than MAX() so the column type is kept and the driver parses it)
+		var latestTimestamp sql.NullTime
+		queryCtx, queryCancel := context.WithTimeout(r.Context(), endpointTimeouts.Query)
+		defer queryCancel()
+		err := messageStore.db.QueryRowContext(queryCtx, `
+			SELECT timestamp FROM messages WHERE is_from_me = 0 ORDER BY timestamp DESC LIMIT 1
+		`).Scan(&latestTimestamp)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if latestTimestamp.Valid {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":          true,
+				"latest_timestamp": latestTimestamp.Time.UTC().Format(time.RFC3339),
+			})
+		} else {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":          true,
+				"latest_timestamp": nil,
+			})
+		}
+	}))
+
+	// Handler for local chat annotations (tags and notes; never synced to WhatsApp).
+	// GET ?chat_jid= returns one chat's metadata; without chat_jid it lists annotated chats,
+	// optionally filtered by ?tag=vip,escalated (any match).
+	// POST {"chat_jid", "tags"?, "add_tags"?, "remove_tags"?, "notes"?} updates them;
+	// "tags" replaces the whole set and "notes": "" clears the notes.
+	mux.HandleFunc("/api/chat-metadata", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			if chatJID := r.URL.Query().Get("chat_jid"); chatJID != "" {
+				metadata, err := messageStore.WithContext(r.Context()).GetChatMetadata(chatJID)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Database query failed: %v", err),
+					})
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success":  true,
+					"metadata": metadata,
+				})
+				return
+			}
+
+			tagFilter, err := normalizeChatTags(strings.Split(r.URL.Query().Get("tag"), ","))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   err.Error(),
+				})
+				return
+			}
+			chats, err := messageStore.WithContext(r.Context()).GetAnnotatedChats(tagFilter)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"chats":   chats,
+				"count":   len(chats),
+			})
+
+		case http.MethodPost:
+			var req struct {
+				ChatJID    string    `json:"chat_jid"`
+				Tags       *[]string `json:"tags"`
+				AddTags    []string  `json:"add_tags"`
+				RemoveTags []string  `json:"remove_tags"`
+				Notes      *string   `json:"notes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatJID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "chat_jid is required",
+				})
+				return
+			}
+
+			var replace *[]string
+			if req.Tags != nil {
+				tags, err := normalizeChatTags(*req.Tags)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   err.Error(),
+					})
+					return
+				}
+				replace = &tags
+			}
+			add, err := normalizeChatTags(req.AddTags)
+			if err == nil {
+				req.RemoveTags, err = normalizeChatTags(req.RemoveTags)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   err.Error(),
+				})
+				return
+			}
+
+			if replace != nil || len(add) > 0 || len(req.RemoveTags) > 0 {
+				if err := messageStore.UpdateChatTags(req.ChatJID, replace, add, req.RemoveTags); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Failed to update tags: %v", err),
+					})
+					return
+				}
+			}
+			if req.Notes != nil {
+				if err := messageStore.SetChatNotes(req.ChatJID, strings.TrimSpace(*req.Notes)); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Failed to update notes: %v", err),
+					})
+					return
+				}
+			}
+
+			metadata, err := messageStore.GetChatMetadata(req.ChatJID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"metadata": metadata,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Handler for conversation handoff: GET ?chat_jid= returns the chat's state and assignee;
+	// POST {"chat_jid", "state": "bot"|"human"|"closed", "assignee"?} updates them.
+	// The assignee is kept when omitted and cleared when the chat goes back to the bot.
+	// Each change emits a chat_assignment event.
+	// Channel (newsletter) analytics: per-channel totals, or per-post views and reactions with ?jid=
+	// (?refresh=true fetches the latest counts from WhatsApp first)
+	mux.HandleFunc("/api/newsletters/analytics", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		jidParam := r.URL.Query().Get("jid")
+		if jidParam == "" {
+			summaries, err := messageStore.WithContext(r.Context()).GetNewsletterSummaries()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":     true,
+				"newsletters": summaries,
+			})
+			return
+		}
+
+		jid, err := types.ParseJID(jidParam)
+		if err != nil || jid.Server != types.NewsletterServer {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "jid must be a channel JID (...@newsletter)",
+			})
+			return
+		}
+
+		if r.URL.Query().Get("refresh") == "true" {
+			if !client.IsConnected() || !client.IsLoggedIn() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Not connected to WhatsApp",
+				})
+				return
+			}
+			ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+			defer cancel()
+			if _, err := refreshNewsletterAnalytics(ctx, client, messageStore, jid); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to fetch channel posts: %v", err),
+				})
+				return
+			}
+		}
+
+		limit := newsletterAnalyticsPosts
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = min(l, 500)
+		}
+		posts, err := messageStore.WithContext(r.Context()).GetNewsletterPosts(jid.String(), limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"jid":     jid.String(),
+			"posts":   posts,
+			"count":   len(posts),
+		})
+	}))
+
+	// Localized message templates: GET lists (?name=), POST stores {name, locale, body},
+	// DELETE ?name=[&locale=] removes a translation or the whole template
+	mux.HandleFunc("/api/templates", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			templates, err := messageStore.GetTemplates(r.URL.Query().Get("name"))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":        true,
+				"templates":      templates,
+				"default_locale": defaultLocale,
+			})
+
+		case http.MethodPost:
+			var req struct {
+				Name   string `json:"name"`
+				Locale string `json:"locale"`
+				Body   string `json:"body"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" || req.Body == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "name and body are required",
+				})
+				return
+			}
+			if req.Locale == "" {
+				req.Locale = defaultLocale
+			}
+			if err := messageStore.SetTemplate(strings.TrimSpace(req.Name), req.Locale, req.Body); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to store template: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"name":    strings.TrimSpace(req.Name),
+				"locale":  normalizeLocale(req.Locale),
+			})
+
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if name == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "name is required",
+				})
+				return
+			}
+			found, err := messageStore.DeleteTemplate(name, r.URL.Query().Get("locale"))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to delete template: %v", err),
+				})
+				return
+			}
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "template not found",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Per-contact key/value attributes used for {key} substitution in personalized sends
+	mux.HandleFunc("/api/contact-attributes", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var contact string
+		var set map[string]*string
+		switch r.Method {
+		case http.MethodGet:
+			contact = r.URL.Query().Get("jid")
+		case http.MethodPost:
+			var req struct {
+				JID        string             `json:"jid"`
+				Attributes map[string]*string `json:"attributes"` // null removes the key
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid request format",
+				})
+				return
+			}
+			contact, set = req.JID, req.Attributes
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jid, err := contactAttributeJID(strings.TrimSpace(contact))
+		if contact == "" || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "jid must be a phone number or JID",
+			})
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			values := map[string]string{}
+			var remove []string
+			for key, value := range set {
+				key = strings.TrimSpace(key)
+				if key == "" || len(key) > maxContactAttributeKeyLength || strings.ContainsAny(key, "{}") {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("attribute keys must be 1-%d characters without braces", maxContactAttributeKeyLength),
+					})
+					return
+				}
+				if value == nil {
+					remove = append(remove, key)
+					continue
+				}
+				if len(*value) > maxContactAttributeValueLength {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("attribute %q exceeds %d characters", key, maxContactAttributeValueLength),
+					})
+					return
+				}
+				values[key] = *value
+			}
+			if err := messageStore.UpdateContactAttributes(jid, values, remove); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to update attributes: %v", err),
+				})
+				return
+			}
+		}
+
+		attributes, err := messageStore.GetContactAttributes(jid)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    true,
+			"jid":        jid,
+			"attributes": attributes,
+		})
+	}))
+
+	// Opt-out list: GET lists (or checks ?phone=), POST adds {phone, reason}, DELETE ?phone= removes
+	mux.HandleFunc("/api/opt-outs", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			if phone := r.URL.Query().Get("phone"); phone != "" {
+				optedOut, err := messageStore.IsOptedOut(phone)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Database query failed: %v", err),
+					})
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success":   true,
+					"phone":     optOutPhone(phone),
+					"opted_out": optedOut,
+				})
+				return
+			}
+			optOuts, err := messageStore.GetOptOuts()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"opt_outs": optOuts,
+				"count":    len(optOuts),
+			})
+
+		case http.MethodPost:
+			var req struct {
+				Phone  string `json:"phone"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || optOutPhone(req.Phone) == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "phone is required",
+				})
+				return
+			}
+			added, err := messageStore.AddOptOut(req.Phone, "api", "", req.Reason)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to add opt-out: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"phone":   optOutPhone(req.Phone),
+				"added":   added,
+			})
+
+		case http.MethodDelete:
+			removed, err := messageStore.RemoveOptOut(r.URL.Query().Get("phone"))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to remove opt-out: %v", err),
+				})
+				return
+			}
+			if !removed {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "phone is not on the opt-out list",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Flag review queue: GET lists flags (?status=pending|confirmed|dismissed|all, ?chat_jid=, ?limit=)
+	mux.HandleFunc("/api/flags", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = flagPending
+		case "all":
+			status = ""
+		}
+		limit := 50
+		if lp := r.URL.Query().Get("limit"); lp != "" {
+			if parsed, err := strconv.Atoi(lp); err == nil && parsed > 0 && parsed <= 500 {
+				limit = parsed
+			}
+		}
+
+		flags, err := messageStore.WithContext(r.Context()).GetFlags(status, r.URL.Query().Get("chat_jid"), limit)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"flags":   flags,
+			"count":   len(flags),
+		})
+	}))
+
+	// POST /api/flags/review {"id", "status": "confirmed"|"dismissed", "note"?} closes a pending flag
+	mux.HandleFunc("/api/flags/review", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ID     int64  `json:"id"`
+			Status string `json:"status"`
+			Note   string `json:"note"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID <= 0 ||
+			(req.Status != flagConfirmed && req.Status != flagDismissed) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "id and status (confirmed or dismissed) are required",
+			})
+			return
+		}
+
+		reviewed, err := messageStore.ReviewFlag(req.ID, req.Status, req.Note)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to record review: %v", err),
+			})
+			return
+		}
+		if !reviewed {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "flag not found or already reviewed",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"id":      req.ID,
+			"status":  req.Status,
+		})
+	}))
+
+	// GET /api/flags/rules lists the loaded flag rules (MCP_FLAG_RULES)
+	mux.HandleFunc("/api/flags/rules", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rules := flagRules
+		if rules == nil {
+			rules = []FlagRule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"rules":   rules,
+			"count":   len(rules),
+		})
+	}))
+
+	// Outbound campaigns: create/list, and pause/resume/cancel by ID
+	mux.HandleFunc("/api/campaigns", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			if id := r.URL.Query().Get("id"); id != "" {
+				campaign, err := messageStore.GetCampaign(id)
+				if err == sql.ErrNoRows {
+					w.WriteHeader(http.StatusNotFound)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   "Campaign not found",
+					})
+					return
+				}
+				var stats CampaignStats
+				var recipients []CampaignRecipient
+				if err == nil {
+					stats, err = messageStore.GetCampaignStats(id)
+				}
+				if err == nil && r.URL.Query().Get("recipients") == "true" {
+					recipients, err = messageStore.GetCampaignRecipients(id)
+				}
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Database query failed: %v", err),
+					})
+					return
+				}
+				campaign.Stats = &stats
+				response := map[string]interface{}{
+					"success":  true,
+					"campaign": campaign,
+				}
+				if recipients != nil {
+					response["recipients"] = recipients
+				}
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+
+			campaigns, err := messageStore.GetCampaigns(r.URL.Query().Get("status"))
+			if err == nil {
+				for i := range campaigns {
+					var stats CampaignStats
+					if stats, err = messageStore.GetCampaignStats(campaigns[i].ID); err != nil {
+						break
+					}
+					campaigns[i].Stats = &stats
+				}
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":   true,
+				"campaigns": campaigns,
+				"count":     len(campaigns),
+			})
+
+		case http.MethodPost:
+			var req struct {
+				Name         string `json:"name"`
+				Template     string `json:"template"`
+				TemplateName string `json:"template_name"`
+				MediaPath    string `json:"media_path"`
+				Recipients   []struct {
+					Recipient string            `json:"recipient"`
+					Variables map[string]string `json:"variables"`
+				} `json:"recipients"`
+				ValidateNumbers   bool   `json:"validate_numbers"`
+				MessagesPerMinute int    `json:"messages_per_minute"`
+				JitterSec         int    `json:"jitter_sec"`
+				StartAt           string `json:"start_at"` // RFC3339; empty starts immediately
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Invalid request format",
+				})
+				return
+			}
+
+			var problem string
+			switch {
+			case req.Template == "" && req.TemplateName == "" && req.MediaPath == "":
+				problem = "template, template_name or media_path is required"
+			case len(req.Recipients) == 0:
+				problem = "recipients is required"
+			case req.MessagesPerMinute < 0 || req.MessagesPerMinute > maxCampaignMessagesPerMinute:
+				problem = fmt.Sprintf("messages_per_minute must be between 1 and %d", maxCampaignMessagesPerMinute)
+			case req.JitterSec < 0 || req.JitterSec > maxCampaignJitterSec:
+				problem = fmt.Sprintf("jitter_sec must be between 0 and %d", maxCampaignJitterSec)
+			}
+			var startAt *time.Time
+			if problem == "" && req.StartAt != "" {
+				parsed, err := time.Parse(time.RFC3339, req.StartAt)
+				if err != nil {
+					problem = "start_at must be an RFC3339 timestamp"
+				} else {
+					startAt = &parsed
+				}
+			}
+			if problem == "" && req.TemplateName != "" {
+				if translations, err := messageStore.GetTemplates(req.TemplateName); err != nil || len(translations) == 0 {
+					problem = fmt.Sprintf("template %q is not defined", req.TemplateName)
+				}
+			}
+			if problem != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   problem,
+				})
+				return
+			}
+			if req.MessagesPerMinute == 0 {
+				req.MessagesPerMinute = defaultCampaignMessagesPerMinute
+			}
+
+			recipients := make([]CampaignRecipient, 0, len(req.Recipients))
+			for _, entry := range req.Recipients {
+				recipient := strings.TrimSpace(entry.Recipient)
+				if recipient == "" {
+					continue
+				}
+				recipients = append(recipients, CampaignRecipient{
+					Recipient: recipient,
+					Variables: entry.Variables,
+					Status:    recipientPending,
+				})
+			}
+			if req.ValidateNumbers {
+				if !client.IsConnected() || !client.IsLoggedIn() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   "Not connected to WhatsApp; cannot validate numbers",
+					})
+					return
+				}
+				if err := validateCampaignNumbers(r.Context(), client, recipients); err != nil {
+					w.WriteHeader(http.StatusBadGateway)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": false,
+						"error":   fmt.Sprintf("Number validation failed: %v", err),
+					})
+					return
+				}
+			}
+
+			campaign := Campaign{
+				ID:                newRandomID(8),
+				Name:              req.Name,
+				Template:          req.Template,
+				TemplateName:      req.TemplateName,
+				MediaPath:         req.MediaPath,
+				Status:            campaignRunning,
+				MessagesPerMinute: req.MessagesPerMinute,
+				JitterSec:         req.JitterSec,
+			}
+			if startAt != nil && startAt.After(time.Now()) {
+				campaign.Status = campaignScheduled
+			}
+			if err := messageStore.CreateCampaign(campaign, startAt, recipients); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to create campaign: %v", err),
+				})
+				return
+			}
+			if campaign.Status == campaignRunning {
+				campaignRunner.start(client, messageStore, campaign.ID)
+			}
+
+			created, err := messageStore.GetCampaign(campaign.ID)
+			if err == nil {
+				var stats CampaignStats
+				stats, err = messageStore.GetCampaignStats(campaign.ID)
+				created.Stats = &stats
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			fmt.Printf("📣 Created campaign %s (%s): %d recipients, status %s\n", created.ID, created.Name, created.Stats.Total, created.Status)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"campaign": created,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// campaignControl changes a campaign's status if it is currently in one of the from states
+	campaignControl := func(to string, from ...string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+
+			var req struct {
+				ID string `json:"id"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "id is required",
+				})
+				return
+			}
+
+			changed, err := messageStore.SetCampaignStatus(req.ID, to, from...)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			campaign, err := messageStore.GetCampaign(req.ID)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Campaign not found",
+				})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			if !changed {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Campaign is %s", campaign.Status),
+				})
+				return
+			}
+
+			if to == campaignRunning {
+				campaignRunner.start(client, messageStore, campaign.ID)
+			} else {
+				campaignRunner.stop(campaign.ID)
+			}
+			fmt.Printf("📣 Campaign %s is now %s\n", campaign.ID, campaign.Status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"campaign": campaign,
+			})
+		}
+	}
+	mux.HandleFunc("/api/campaigns/pause", authMiddleware(campaignControl(campaignPaused, campaignRunning, campaignScheduled)))
+	mux.HandleFunc("/api/campaigns/resume", authMiddleware(drainGuard(campaignControl(campaignRunning, campaignPaused))))
+	mux.HandleFunc("/api/campaigns/cancel", authMiddleware(campaignControl(campaignCancelled, campaignRunning, campaignScheduled, campaignPaused)))
+
+	// Broadcasts are one message to many recipients, started at once. Each is a campaign under
+	// the hood: the job ID works with /api/campaigns/pause, resume and cancel.
+	mux.HandleFunc("/api/broadcast", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.Error(w, "id is required", http.StatusBadRequest)
+				return
+			}
+			job, err := messageStore.GetCampaign(id)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "Broadcast not found",
+				})
+				return
+			}
+			var stats CampaignStats
+			var recipients []CampaignRecipient
+			if err == nil {
+				stats, err = messageStore.GetCampaignStats(id)
+			}
+			if err == nil {
+				recipients, err = messageStore.GetCampaignRecipients(id)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			job.Stats = &stats
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":    true,
+				"job":        job,
+				"recipients": recipients,
+			})
+
+		case http.MethodPost:
+			var req struct {
+				Name              string   `json:"name"`
+				Message           string   `json:"message"`
+				MediaPath         string   `json:"media_path"`
+				Recipients        []string `json:"recipients"`
+				MessagesPerMinute int      `json:"messages_per_minute"`
+				JitterSec         int      `json:"jitter_sec"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+
+			recipients := make([]CampaignRecipient, 0, len(req.Recipients))
+			for _, entry := range req.Recipients {
+				if recipient := strings.TrimSpace(entry); recipient != "" {
+					recipients = append(recipients, CampaignRecipient{Recipient: recipient, Status: recipientPending})
+				}
+			}
+			var problem string
+			switch {
+			case req.Message == "" && req.MediaPath == "":
+				problem = "message or media_path is required"
+			case len(recipients) == 0:
+				problem = "recipients is required"
+			case req.MessagesPerMinute < 0 || req.MessagesPerMinute > maxCampaignMessagesPerMinute:
+				problem = fmt.Sprintf("messages_per_minute must be between 1 and %d", maxCampaignMessagesPerMinute)
+			case req.JitterSec < 0 || req.JitterSec > maxCampaignJitterSec:
+				problem = fmt.Sprintf("jitter_sec must be between 0 and %d", maxCampaignJitterSec)
+			}
+			if problem != "" {
+				http.Error(w, problem, http.StatusBadRequest)
+				return
+			}
+			if req.MessagesPerMinute == 0 {
+				req.MessagesPerMinute = defaultCampaignMessagesPerMinute
+			}
+			if req.Name == "" {
+				req.Name = "broadcast"
+			}
+
+			job := Campaign{
+				ID:                newRandomID(8),
+				Name:              req.Name,
+				Template:          req.Message,
+				MediaPath:         req.MediaPath,
+				Status:            campaignRunning,
+				MessagesPerMinute: req.MessagesPerMinute,
+				JitterSec:         req.JitterSec,
+			}
+			if err := messageStore.CreateCampaign(job, nil, recipients); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to create broadcast: %v", err),
+				})
+				return
+			}
+			campaignRunner.start(client, messageStore, job.ID)
+
+			stats, err := messageStore.GetCampaignStats(job.ID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			fmt.Printf("📣 Queued broadcast %s: %d recipients at %d/min (+%ds jitter)\n", job.ID, stats.Total, job.MessagesPerMinute, job.JitterSec)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"job_id":  job.ID,
+				"status":  job.Status,
+				"stats":   stats,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	mux.HandleFunc("/api/chat-assignment", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			chatJID := r.URL.Query().Get("chat_jid")
+			if chatJID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "chat_jid is required",
+				})
+				return
+			}
+			assignment, err := messageStore.GetChatAssignment(chatJID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":    true,
+				"assignment": assignment,
+			})
+
+		case http.MethodPost:
+			var req struct {
+				ChatJID  string  `json:"chat_jid"`
+				State    string  `json:"state"`
+				Assignee *string `json:"assignee"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatJID == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   "chat_jid is required",
+				})
+				return
+			}
+			req.State = strings.ToLower(strings.TrimSpace(req.State))
+			if !slices.Contains(handoffStates, req.State) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("state must be one of %s", strings.Join(handoffStates, ", ")),
+				})
+				return
+			}
+
+			previous, err := messageStore.GetChatAssignment(req.ChatJID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+			assignee := previous.Assignee
+			if req.Assignee != nil {
+				assignee = strings.TrimSpace(*req.Assignee)
+			}
+			if req.State == handoffStateBot {
+				assignee = ""
+			}
+
+			if err := messageStore.SetChatAssignment(req.ChatJID, req.State, assignee); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to update assignment: %v", err),
+				})
+				return
+			}
+			assignment, err := messageStore.GetChatAssignment(req.ChatJID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Database query failed: %v", err),
+				})
+				return
+			}
+
+			if previous.State != assignment.State || previous.Assignee != assignment.Assignee {
+				fmt.Printf("🤝 Chat %s handoff %s -> %s (assignee %q)\n", req.ChatJID, previous.State, assignment.State, assignment.Assignee)
+				go dispatchEventWebhooks(messageStore, "chat_assignment", map[string]interface{}{
+					"chat_jid":          assignment.ChatJID,
+					"state":             assignment.State,
+					"assignee":          assignment.Assignee,
+					"previous_state":    previous.State,
+					"previous_assignee": previous.Assignee,
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":    true,
+				"assignment": assignment,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Handler for listing WhatsApp groups from the local chats store.
+	// Supports optional substring filter via ?q= and limit via ?limit= (default 50, max 200).
+	// ?chat_type=group or ?chat_type=community narrows the list to regular groups or community parents.
+	// ?tag=vip,escalated keeps groups carrying any of the given local tags.
+	// Used by the backend to power typeahead in Hub > Communications > WhatsApp filters.
+	mux.HandleFunc("/api/groups", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+		limit := 50
+		if lp := r.URL.Query().Get("limit"); lp != "" {
+			var parsed int
+			if _, err := fmt.Sscanf(lp, "%d", &parsed); err == nil && parsed > 0 {
+				limit = parsed
+			}
+			if limit > 200 {
+				limit = 200
+			}
+		}
+
+		chatTypeFilter, err := parseChatTypes(r.URL.Query().Get("chat_type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tagFilter, err := normalizeChatTags(strings.Split(r.URL.Query().Get("tag"), ","))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		groupsQuery := `
+			SELECT jid, name, is_muted, is_pinned, is_archived, chat_type FROM chats
+			WHERE jid LIKE '%@g.us' AND name IS NOT NULL AND name != ''`
+		var groupsArgs []interface{}
+		if len(tagFilter) > 0 {
+			groupsQuery += " AND jid IN (SELECT chat_jid FROM chat_tags WHERE tag IN (" +
+				strings.TrimSuffix(strings.Repeat("?,", len(tagFilter)), ",") + "))"
+			for _, tag := range tagFilter {
+				groupsArgs = append(groupsArgs, tag)
+			}
+		}
+		groupsQuery += " ORDER BY last_message_time DESC"
+
+		queryCtx, queryCancel := context.WithTimeout(r.Context(), endpointTimeouts.Query)
+		defer queryCancel()
+		rows, err := messageStore.db.QueryContext(queryCtx, groupsQuery, groupsArgs...)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Database query failed: %v", err),
+			})
+			return
+		}
+		defer rows.Close()
+
+		type GroupResponse struct {
+			JID      string   `json:"jid"`
+			Name     string   `json:"name"`
+			ChatType string   `json:"chat_type"`
+			Muted    bool     `json:"muted,omitempty"`
+			Pinned   bool     `json:"pinned,omitempty"`
+			Archived bool     `json:"archived,omitempty"`
+			Tags     []string `json:"tags,omitempty"`
+		}
+		groups := []GroupResponse{}
+		for rows.Next() {
+			var jid, name string
+			var muted, pinned, archived sql.NullBool
+			var chatType sql.NullString
+			if err := rows.Scan(&jid, &name, &muted, &pinned, &archived, &chatType); err != nil {
+				continue
+			}
+			if q != "" && !strings.Contains(strings.ToLower(name), q) {
+				continue
+			}
+			if chatType.String == "" {
+				chatType.String = chatTypeGroup
+			}
+			if len(chatTypeFilter) > 0 && !slices.Contains(chatTypeFilter, chatType.String) {
+				continue
+			}
+			groups = append(groups, GroupResponse{
+				JID:      jid,
+				Name:     name,
+				ChatType: chatType.String,
+				Muted:    muted.Bool,
+				Pinned:   pinned.Bool,
+				Archived: archived.Bool,
+			})
+			if len(groups) >= limit {
+				break
+			}
+		}
+		if err := rows.Err(); err != nil {
+			fmt.Printf("Warning: /api/groups rows iteration error: %v\n", err)
+		}
+		rows.Close()
+
+		groupJIDs := make([]string, len(groups))
+		for i, group := range groups {
+			groupJIDs[i] = group.JID
+		}
+		if tagsByChat, err := messageStore.GetChatTagsFor(groupJIDs); err == nil {
+			for i := range groups {
+				groups[i].Tags = tagsByChat[groups[i].JID]
+			}
+		} else {
+			fmt.Printf("Warning: failed to load group tags: %v\n", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"groups":  groups,
+			"count":   len(groups),
+		})
+	}))
+
+	// Group settings: GET ?jid= reads the current toggles from live group metadata,
+	// POST {jid, announce?, locked?, disappearing_timer?, member_add_mode?, join_approval_required?}
+	// changes only the fields present (requires admin) and returns the updated settings.
+	mux.HandleFunc("/api/groups/settings", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		var req struct {
+			JID                  string  `json:"jid"`
+			Announce             *bool   `json:"announce"`
+			Locked               *bool   `json:"locked"`
+			DisappearingTimer    *uint32 `json:"disappearing_timer"`
+			MemberAddMode        *string `json:"member_add_mode"`
+			JoinApprovalRequired *bool   `json:"join_approval_required"`
+		}
+		switch r.Method {
+		case http.MethodGet:
+			req.JID = r.URL.Query().Get("jid")
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(http.StatusBadRequest, "Invalid request format")
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jid, err := types.ParseJID(req.JID)
+		if err != nil || jid.Server != types.GroupServer {
+			writeError(http.StatusBadRequest, "jid must be a group JID (...@g.us)")
+			return
+		}
+		if req.MemberAddMode != nil {
+			switch types.GroupMemberAddMode(*req.MemberAddMode) {
+			case types.GroupMemberAddModeAdmin, types.GroupMemberAddModeAllMember:
+			default:
+				writeError(http.StatusBadRequest, "member_add_mode must be admin_add or all_member_add")
+				return
+			}
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+
+		// Apply each requested change in turn; stop at the first one WhatsApp rejects
+		type settingChange struct {
+			field string
+			apply func() error
+		}
+		var changes []settingChange
+		addChange := func(field string, apply func() error) {
+			changes = append(changes, settingChange{field, apply})
+		}
+		if req.Announce != nil {
+			addChange("announce", func() error { return client.SetGroupAnnounce(ctx, jid, *req.Announce) })
+		}
+		if req.Locked != nil {
+			addChange("locked", func() error { return client.SetGroupLocked(ctx, jid, *req.Locked) })
+		}
+		if req.DisappearingTimer != nil {
+			addChange("disappearing_timer", func() error {
+				return client.SetDisappearingTimer(ctx, jid, time.Duration(*req.DisappearingTimer)*time.Second, time.Now())
+			})
+		}
+		if req.MemberAddMode != nil {
+			addChange("member_add_mode", func() error {
+				return client.SetGroupMemberAddMode(ctx, jid, types.GroupMemberAddMode(*req.MemberAddMode))
+			})
+		}
+		if req.JoinApprovalRequired != nil {
+			addChange("join_approval_required", func() error {
+				return client.SetGroupJoinApprovalMode(ctx, jid, *req.JoinApprovalRequired)
+			})
+		}
+		if r.Method == http.MethodPost && len(changes) == 0 {
+			writeError(http.StatusBadRequest, "No settings to change")
+			return
+		}
+		var applied []string
+		for _, change := range changes {
+			if err := change.apply(); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": false,
+					"error":   fmt.Sprintf("Failed to change %s: %v", change.field, err),
+					"applied": applied,
+				})
+				return
+			}
+			applied = append(applied, change.field)
+		}
+
+		info, err := client.GetGroupInfo(ctx, jid)
+		if err != nil {
+			writeError(http.StatusBadGateway, fmt.Sprintf("Failed to get group info: %v", err))
+			return
+		}
+		if len(applied) > 0 {
+			fmt.Printf("⚙️ Updated group settings of %s: %s\n", jid, strings.Join(applied, ", "))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"settings": groupSettingsFromInfo(info),
+			"applied":  applied,
+		})
+	}))
+
+	// Create a group: POST {name, participants: [phone or JID...], parent_jid?} (parent_jid creates it inside a community)
+	mux.HandleFunc("/api/groups/create", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		var req struct {
+			Name         string   `json:"name"`
+			Participants []string `json:"participants"`
+			ParentJID    string   `json:"parent_jid,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(http.StatusBadRequest, "Invalid request format")
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			writeError(http.StatusBadRequest, "name is required")
+			return
+		}
+		participants, err := parseParticipantJIDs(req.Participants)
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error())
+			return
+		}
+		create := whatsmeow.ReqCreateGroup{Name: req.Name, Participants: participants}
+		if req.ParentJID != "" {
+			parent, err := types.ParseJID(req.ParentJID)
+			if err != nil || parent.Server != types.GroupServer {
+				writeError(http.StatusBadRequest, "parent_jid must be a community JID (...@g.us)")
+				return
+			}
+			create.LinkedParentJID = parent
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		info, err := client.CreateGroup(ctx, create)
+		if err != nil {
+			writeError(http.StatusBadGateway, fmt.Sprintf("Failed to create group: %v", err))
+			return
+		}
+		if err := messageStore.StoreChat(info.JID.String(), info.Name, time.Now()); err != nil {
+			fmt.Printf("Warning: failed to store new group %s: %v\n", info.JID, err)
+		}
+
+		fmt.Printf("👥 Created group %s with %d participant(s)\n", info.JID, len(participants))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"group":   groupDetailsFromInfo(info),
+		})
+	}))
+
+	// Group metadata: GET ?jid= returns live metadata and members,
+	// POST {jid, name?, topic?} renames the group and/or sets its description ("" clears it)
+	mux.HandleFunc("/api/groups/info", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		var req struct {
+			JID   string  `json:"jid"`
+			Name  *string `json:"name"`
+			Topic *string `json:"topic"`
+		}
+		switch r.Method {
+		case http.MethodGet:
+			req.JID = r.URL.Query().Get("jid")
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(http.StatusBadRequest, "Invalid request format")
+				return
+			}
+			if req.Name == nil && req.Topic == nil {
+				writeError(http.StatusBadRequest, "name or topic is required")
+				return
+			}
+			if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+				writeError(http.StatusBadRequest, "name cannot be empty")
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jid, err := types.ParseJID(req.JID)
+		if err != nil || jid.Server != types.GroupServer {
+			writeError(http.StatusBadRequest, "jid must be a group JID (...@g.us)")
+			return
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		info, err := client.GetGroupInfo(ctx, jid)
+		if err != nil {
+			writeError(http.StatusBadGateway, fmt.Sprintf("Failed to get group info: %v", err))
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if req.Name != nil {
+				name := strings.TrimSpace(*req.Name)
+				if err := client.SetGroupName(ctx, jid, name); err != nil {
+					writeError(http.StatusBadGateway, fmt.Sprintf("Failed to rename group: %v", err))
+					return
+				}
+				if err := messageStore.UpdateChatName(jid.String(), name); err != nil {
+					fmt.Printf("Warning: failed to store group name of %s: %v\n", jid, err)
+				}
+			}
+			if req.Topic != nil {
+				// The topic ID chains edits; an empty new ID lets whatsmeow generate one
+				if err := client.SetGroupTopic(ctx, jid, info.TopicID, "", *req.Topic); err != nil {
+					writeError(http.StatusBadGateway, fmt.Sprintf("Failed to set group topic: %v", err))
+					return
+				}
+			}
+			if info, err = client.GetGroupInfo(ctx, jid); err != nil {
+				writeError(http.StatusBadGateway, fmt.Sprintf("Failed to get group info: %v", err))
+				return
+			}
+			fmt.Printf("⚙️ Updated group info of %s\n", jid)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"group":   groupDetailsFromInfo(info),
+		})
+	}))
+
+	// Change members: POST {jid, action: add|remove|promote|demote, participants: [phone or JID...]}.
+	// WhatsApp reports failures per participant, so a 200 can still carry participant errors.
+	mux.HandleFunc("/api/groups/participants", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		var req struct {
+			JID          string   `json:"jid"`
+			Action       string   `json:"action"`
+			Participants []string `json:"participants"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(http.StatusBadRequest, "Invalid request format")
+			return
+		}
+		jid, err := types.ParseJID(req.JID)
+		if err != nil || jid.Server != types.GroupServer {
+			writeError(http.StatusBadRequest, "jid must be a group JID (...@g.us)")
+			return
+		}
+		action := whatsmeow.ParticipantChange(strings.ToLower(req.Action))
+		switch action {
+		case whatsmeow.ParticipantChangeAdd, whatsmeow.ParticipantChangeRemove,
+			whatsmeow.ParticipantChangePromote, whatsmeow.ParticipantChangeDemote:
+		default:
+			writeError(http.StatusBadRequest, "action must be add, remove, promote or demote")
+			return
+		}
+		if len(req.Participants) == 0 {
+			writeError(http.StatusBadRequest, "participants is required")
+			return
+		}
+		participants, err := parseParticipantJIDs(req.Participants)
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error())
+			return
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		results, err := client.UpdateGroupParticipants(ctx, jid, participants, action)
+		if err != nil {
+			writeError(http.StatusBadGateway, fmt.Sprintf("Failed to %s participants: %v", action, err))
+			return
+		}
+
+		failed := 0
+		for _, result := range results {
+			if result.Error != 0 {
+				failed++
+			}
+		}
+		fmt.Printf("👥 %s on %s: %d participant(s), %d failed\n", action, jid, len(results), failed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"action":       action,
+			"participants": groupParticipantInfos(results),
+			"failed":       failed,
+		})
+	}))
+
+	// Leave a group: POST {jid}
+	mux.HandleFunc("/api/groups/leave", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		var req struct {
+			JID string `json:"jid"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(http.StatusBadRequest, "Invalid request format")
+			return
+		}
+		jid, err := types.ParseJID(req.JID)
+		if err != nil || jid.Server != types.GroupServer {
+			writeError(http.StatusBadRequest, "jid must be a group JID (...@g.us)")
+			return
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		if err := client.LeaveGroup(ctx, jid); err != nil {
+			writeError(http.StatusBadGateway, fmt.Sprintf("Failed to leave group: %v", err))
+			return
+		}
+
+		fmt.Printf("👋 Left group %s\n", jid)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"jid":     jid.String(),
+		})
+	}))
+
+	// Preview a group from an invite link without joining: GET ?invite=<link or code>
+	mux.HandleFunc("/api/group/invite-info", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		code, err := parseInviteCode(r.URL.Query().Get("invite"))
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error())
+			return
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		info, err := client.GetGroupInfoFromLink(ctx, code)
+		if err != nil {
+			writeError(inviteErrorStatus(err), fmt.Sprintf("Failed to resolve invite: %v", err))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"group":   groupDetailsFromInfo(info),
+		})
+	}))
+
+	// Join a group through an invite link: POST {invite: <link or code>}. Groups requiring
+	// admin approval return the group JID too, but membership only starts once approved.
+	mux.HandleFunc("/api/group/join", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		var req struct {
+			Invite string `json:"invite"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(http.StatusBadRequest, "Invalid request format")
+			return
+		}
+		code, err := parseInviteCode(req.Invite)
+		if err != nil {
+			writeError(http.StatusBadRequest, err.Error())
+			return
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		jid, err := client.JoinGroupWithLink(ctx, code)
+		if err != nil {
+			writeError(inviteErrorStatus(err), fmt.Sprintf("Failed to join group: %v", err))
+			return
+		}
+
+		fmt.Printf("👥 Joined group %s through an invite link\n", jid)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"jid":     jid.String(),
+		})
+	}))
+
+	// Our invite link for a group (requires admin): GET ?jid= returns it,
+	// DELETE ?jid= revokes it and returns the replacement WhatsApp issues
+	mux.HandleFunc("/api/group/invite-link", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   message,
+			})
+		}
+
+		jid, err := types.ParseJID(r.URL.Query().Get("jid"))
+		if err != nil || jid.Server != types.GroupServer {
+			writeError(http.StatusBadRequest, "jid must be a group JID (...@g.us)")
+			return
+		}
+		if !client.IsConnected() || !client.IsLoggedIn() {
+			writeError(http.StatusServiceUnavailable, "Not connected to WhatsApp")
+			return
+		}
+
+		revoke := r.Method == http.MethodDelete
+		ctx, cancel := withOptionalTimeout(r.Context(), endpointTimeouts.Query)
+		defer cancel()
+		link, err := client.GetGroupInviteLink(ctx, jid, revoke)
+		if err != nil {
+			writeError(inviteErrorStatus(err), fmt.Sprintf("Failed to get invite link: %v", err))
+			return
+		}
+
+		if revoke {
+			fmt.Printf("🔗 Revoked invite link of %s\n", jid)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"jid":         jid.String(),
+			"invite_link": link,
+			"revoked":     revoke,
+		})
+	}))
+
+	// Handler for listing WhatsApp contacts from the whatsmeow address book,
+	// merged with DM chats the user has messaged.
+	// Supports ?q= (case-insensitive name substring OR phone-prefix match) and ?limit= (default 50, max 200).
+	mux.HandleFunc("/api/contacts", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+		qDigits := strings.TrimPrefix(q, "+")
+		// Strip non-digits from qDigits for phone-prefix matching
+		var digitsBuilder strings.Builder
+		for _, ch := range qDigits {
+			if ch >= '0' && ch <= '9' {
+				digitsBuilder.WriteRune(ch)
+			}
+		}
+		qDigits = digitsBuilder.String()
+
+		limit := 50
+		if lp := r.URL.Query().Get("limit"); lp != "" {
+			var parsed int
+			if _, err := fmt.Sscanf(lp, "%d", &parsed); err == nil && parsed > 0 {
+				limit = parsed
+			}
+			if limit > 200 {
+				limit = 200
+			}
+		}
+
+		if !client.IsLoggedIn() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"message": "WhatsApp client not authenticated",
+			})
+			return
+		}
+
+		type ContactResponse struct {
+			JID   string `json:"jid"`
+			Phone string `json:"phone"`
+			Name  string `json:"name"`
+		}
+		byJID := map[string]ContactResponse{}
+
+		// Source 1: whatsmeow address book
+		contacts, err := client.Store.Contacts.GetAllContacts(r.Context())
+		if err == nil {
+			for jid, info := range contacts {
+				if jid.Server != types.DefaultUserServer { // "s.whatsapp.net"
+					continue
+				}
+				name := info.FullName
+				if name == "" {
+					name = info.PushName
+				}
+				if name == "" {
+					name = info.FirstName
+				}
+				if name == "" {
+					name = info.BusinessName
+				}
+				byJID[jid.String()] = ContactResponse{
+					JID:   jid.String(),
+					Phone: jid.User,
+					Name:  name,
+				}
+			}
+		}
+
+		// Source 2: DM chats the user has messaged (fallback for contacts not in address book)
+		queryCtx, queryCancel := context.WithTimeout(r.Context(), endpointTimeouts.Query)
+		defer queryCancel()
+		dmRows, dmErr := messageStore.db.QueryContext(queryCtx, `
+			SELECT jid, name FROM chats
+			WHERE jid LIKE '%@s.whatsapp.net'
+			ORDER BY last_message_time DESC
+		`)
+		if dmErr == nil {
+			defer dmRows.Close()
+			for dmRows.Next() {
+				var jid, name string
+				if err := dmRows.Scan(&jid, &name); err != nil {
+					continue
+				}
+				existing, found := byJID[jid]
+				phone := jid
+				if at := strings.Index(jid, "@"); at > 0 {
+					phone = jid[:at]
+				}
+				if !found {
+					byJID[jid] = ContactResponse{JID: jid, Phone: phone, Name: name}
+				} else if existing.Name == "" && name != "" {
+					existing.Name = name
+					byJID[jid] = existing
+				}
+			}
+			if err := dmRows.Err(); err != nil {
+				fmt.Printf("Warning: /api/contacts DM rows iteration error: %v\n", err)
+			}
+		}
+
+		// Filter + sort
+		results := []ContactResponse{}
+		for _, c := range byJID {
+			if q == "" {
+				results = append(results, c)
+				continue
+			}
+			if strings.Contains(strings.ToLower(c.Name), q) {
+				results = append(results, c)
+				continue
+			}
+			if qDigits != "" && strings.HasPrefix(c.Phone, qDigits) {
+				results = append(results, c)
+				continue
+			}
+		}
+		sort.Slice(results, func(i, j int) bool {
+			// Named contacts first, then by name (case-insensitive), then by phone
+			ai, aj := results[i].Name != "", results[j].Name != ""
+			if ai != aj {
+				return ai
+			}
+			ln := strings.ToLower(results[i].Name)
+			rn := strings.ToLower(results[j].Name)
+			if ln != rn {
+				return ln < rn
+			}
+			return results[i].Phone < results[j].Phone
+		})
+		if len(results) > limit {
+			results = results[:limit]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"contacts": results,
+			"count":    len(results),
+		})
+	}))
+
+	// Handler for exporting chats (JSON) or a full database backup (SQLite), gzip-compressed and,
+	// with a passphrase, encrypted so the bundle can sit in shared object storage
+	mux.HandleFunc("/api/export", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			ChatJID    string `json:"chat_jid,omitempty"`
+			Since      string `json:"since,omitempty"`  // RFC3339; JSON exports only
+			Format     string `json:"format,omitempty"` // "json" (default) or "sqlite"
+			Passphrase string `json:"passphrase,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Passphrase != "" && len(req.Passphrase) < minExportPassphraseLen {
+			http.Error(w, fmt.Sprintf("passphrase must be at least %d characters", minExportPassphraseLen), http.StatusBadRequest)
+			return
+		}
+
+		var since time.Time
+		if req.Since != "" {
+			parsed, err := time.Parse(time.RFC3339, req.Since)
+			if err != nil {
+				http.Error(w, "since must be an RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			since = parsed
+		}
+
+		var write func(io.Writer) error
+		name := "export-" + time.Now().UTC().Format("20060102-150405")
+		switch req.Format {
+		case "", "json":
+			if req.ChatJID != "" {
+				if _, err := types.ParseJID(req.ChatJID); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			name += ".json.gz"
+			write = func(out io.Writer) error {
+				return messageStore.WithContext(r.Context()).ExportJSON(out, req.ChatJID, since)
+			}
+		case "sqlite":
+			if req.ChatJID != "" || req.Since != "" {
+				http.Error(w, "chat_jid and since only apply to json exports", http.StatusBadRequest)
+				return
+			}
+			// Snapshot first so a failure can still be reported as an error response
+			tmpDir, err := os.MkdirTemp(messageStore.dir, "backup-")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to create backup: %v", err), http.StatusInternalServerError)
+				return
+			}
+			defer os.RemoveAll(tmpDir)
+			snapshot := filepath.Join(tmpDir, "messages.db")
+			if err := messageStore.WithContext(r.Context()).Backup(snapshot); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to create backup: %v", err), http.StatusInternalServerError)
+				return
+			}
+			name += ".db.gz"
+			write = func(out io.Writer) error {
+				file, err := os.Open(snapshot)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				_, err = io.Copy(out, file)
+				return err
+			}
+		default:
+			http.Error(w, "format must be json or sqlite", http.StatusBadRequest)
+			return
+		}
+
+		var out io.Writer = w
+		var encrypter *exportEncrypter
+		if req.Passphrase != "" {
+			name += ".enc"
+			var err error
+			if encrypter, err = newExportEncrypter(w, req.Passphrase); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to encrypt export: %v", err), http.StatusInternalServerError)
+				return
+			}
+			out = encrypter
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		w.Header().Set("X-Export-Encrypted", strconv.FormatBool(encrypter != nil))
+
+		// Headers are sent by now, so a failure can only cut the stream short; gzip and the
+		// encrypted format both detect that on the receiving end
+		compressed := gzip.NewWriter(out)
+		err := write(compressed)
+		if err == nil {
+			err = compressed.Close()
+		}
+		if err == nil && encrypter != nil {
+			err = encrypter.Close()
+		}
+		if err != nil {
+			fmt.Printf("Export %s failed: %v\n", name, err)
+			return
+		}
+		fmt.Printf("📦 Exported %s\n", name)
+	}))
+
+	// Handler for packaging a chat's downloaded media into a ZIP (legal discovery):
+	// GET ?chat_jid=&since=&until= (RFC3339, optional). The archive ends with manifest.json
+	// listing each file's message, sender, timestamp and SHA-256, plus files missing from disk.
+	mux.HandleFunc("/api/export/media", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		chatParam := query.Get("chat_jid")
+		if chatParam == "" {
+			http.Error(w, "chat_jid is required", http.StatusBadRequest)
+			return
+		}
+		chatJID, err := parseRecipientJID(chatParam)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chat_jid: %v", err), http.StatusBadRequest)
+			return
+		}
+		var since, until time.Time
+		for name, target := range map[string]*time.Time{"since": &since, "until": &until} {
+			if value := query.Get(name); value != "" {
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					http.Error(w, name+" must be an RFC3339 timestamp", http.StatusBadRequest)
+					return
+				}
+				*target = parsed
+			}
+		}
+
+		media, err := messageStore.GetDownloadedMedia(chatJID.String(), since, until)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Database query failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		type manifestFile struct {
+			Path      string `json:"path,omitempty"`
+			MessageID string `json:"message_id"`
+			Sender    string `json:"sender"`
+			Timestamp string `json:"timestamp"`
+			MediaType string `json:"media_type"`
+			Size      int64  `json:"size,omitempty"`
+			SHA256    string `json:"sha256,omitempty"`
+			Error     string `json:"error,omitempty"` // Why the file is missing from the archive
+		}
+		manifest := map[string]interface{}{
+			"chat_jid":    chatJID.String(),
+			"exported_at": time.Now().UTC().Format(time.RFC3339),
+		}
+		if !since.IsZero() {
+			manifest["since"] = since.UTC().Format(time.RFC3339)
+		}
+		if !until.IsZero() {
+			manifest["until"] = until.UTC().Format(time.RFC3339)
+		}
+
+		name := fmt.Sprintf("media-%s-%s.zip", strings.NewReplacer("@", "_", ":", "_").Replace(chatJID.String()), time.Now().UTC().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+		// Headers are sent by now; a failure truncates the archive, which unzip reports as corrupt
+		archive := zip.NewWriter(w)
+		files, missing := []manifestFile{}, []manifestFile{}
+		for _, item := range media {
+			entry := manifestFile{
+				MessageID: item.MessageID,
+				Sender:    item.Sender,
+				Timestamp: item.Timestamp.UTC().Format(time.RFC3339),
+				MediaType: item.MediaType,
+			}
+			file, err := os.Open(item.LocalPath)
+			if err != nil {
+				entry.Error = "file not found"
+				missing = append(missing, entry)
+				continue
+			}
+
+			filename := sanitizeFilename(filepath.Base(item.LocalPath))
+			entry.Path = fmt.Sprintf("media/%s_%s_%s", item.Timestamp.UTC().Format("20060102-150405"), sanitizeFilename(item.MessageID), filename)
+			header := &zip.FileHeader{Name: entry.Path, Modified: item.Timestamp, Method: zip.Deflate}
+			if item.MediaType != "document" {
+				// Images, audio, video and stickers are already compressed
+				header.Method = zip.Store
+			}
+			out, err := archive.CreateHeader(header)
+			if err != nil {
+				file.Close()
+				fmt.Printf("Media export of %s failed: %v\n", chatJID, err)
+				return
+			}
+			hash := sha256.New()
+			entry.Size, err = io.Copy(io.MultiWriter(out, hash), file)
+			file.Close()
+			if err != nil {
+				fmt.Printf("Media export of %s failed: %v\n", chatJID, err)
+				return
+			}
+			entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+			files = append(files, entry)
+		}
+
+		manifest["files"] = files
+		manifest["missing"] = missing
+		out, err := archive.CreateHeader(&zip.FileHeader{Name: "manifest.json", Modified: time.Now(), Method: zip.Deflate})
+		if err == nil {
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(manifest)
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+		if err != nil {
+			fmt.Printf("Media export of %s failed: %v\n", chatJID, err)
+			return
+		}
+		fmt.Printf("📦 Exported %d media file(s) of %s (%d missing)\n", len(files), chatJID, len(missing))
+	}))
+
+	return mux
+}
+
+// Encrypted exports: exportMagic, a 16-byte salt, the uint32 PBKDF2-SHA256 iteration count and a
+// 7-byte nonce prefix, followed by AES-256-GCM chunks (uint32 length + ciphertext). Each chunk's
+// nonce ends with its counter and a final-chunk flag, so reordered or truncated files fail to decrypt.
+const (
+	exportMagic            = "TSXENC1\n"
+	exportKDFIterations    = 600000
+	exportChunkSize        = 64 * 1024
+	minExportPassphraseLen = 12
+)
+
+// exportEncrypter is an io.WriteCloser sealing everything written to it into the encrypted export format
+type exportEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte // Written ahead of the first chunk and authenticated with every chunk
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newExportAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newExportEncrypter(w io.Writer, passphrase string) (*exportEncrypter, error) {
+	header := make([]byte, len(exportMagic)+16+4+7)
+	copy(header, exportMagic)
+	salt := header[len(exportMagic) : len(exportMagic)+16]
+	prefix := header[len(exportMagic)+20:]
+	if _, err := cryptorand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := cryptorand.Read(prefix); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[len(exportMagic)+16:], exportKDFIterations)
+
+	aead, err := newExportAEAD(passphrase, salt, exportKDFIterations)
+	if err != nil {
+		return nil, err
+	}
+	return &exportEncrypter{w: w, aead: aead, header: header, prefix: prefix, buf: make([]byte, 0, exportChunkSize)}, nil
+}
+
+func exportNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Write buffers p, sealing full chunks; one chunk is always held back so Close can mark it final
+func (e *exportEncrypter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == exportChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):exportChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close seals the last (possibly empty) chunk; without it the output does not decrypt
+func (e *exportEncrypter) Close() error {
+	return e.seal(true)
+}
+
+func (e *exportEncrypter) seal(final bool) error {
+	if e.counter == math.MaxUint32 {
+		return errors.New("export too large to encrypt")
+	}
+	sealed := e.aead.Seal(make([]byte, 4, 4+len(e.buf)+e.aead.Overhead()), exportNonce(e.prefix, e.counter, final), e.buf, e.header)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	if e.counter == 0 {
+		sealed = append(slices.Clone(e.header), sealed...)
+	}
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptExport reverses exportEncrypter, writing the plaintext to w
+func decryptExport(r io.Reader, w io.Writer, passphrase string) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(exportMagic)+16+4+7)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(exportMagic)]) != exportMagic {
+		return errors.New("not an encrypted export")
+	}
+	iterations := binary.BigEndian.Uint32(header[len(exportMagic)+16:])
+	if iterations == 0 || iterations > 10*exportKDFIterations {
+		return fmt.Errorf("unsupported key derivation iterations: %d", iterations)
+	}
+	aead, err := newExportAEAD(passphrase, header[len(exportMagic):len(exportMagic)+16], int(iterations))
+	if err != nil {
+		return err
+	}
+	prefix := header[len(exportMagic)+20:]
+
+	lengthBuf := make([]byte, 4)
+	for counter := uint32(0); ; counter++ {
+		if _, err := io.ReadFull(reader, lengthBuf); err != nil {
+			return errors.New("export is truncated")
+		}
+		length := binary.BigEndian.Uint32(lengthBuf)
+		if length < uint32(aead.Overhead()) || length > uint32(exportChunkSize+aead.Overhead()) {
+			return errors.New("export is corrupted")
+		}
+		sealed := make([]byte, length)
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			return errors.New("export is truncated")
+		}
+
+		// A chunk only opens with the flag it was sealed with, which tells us whether more should follow
+		final := false
+		plain, err := aead.Open(nil, exportNonce(prefix, counter, false), sealed, header)
+		if err != nil {
+			if plain, err = aead.Open(nil, exportNonce(prefix, counter, true), sealed, header); err != nil {
+				return errors.New("wrong passphrase or corrupted export")
+			}
+			final = true
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			if _, err := reader.ReadByte(); err != io.EOF {
+				return errors.New("unexpected data after the final chunk")
+			}
+			return nil
+		}
+	}
+}
+
+// LoadDataConfig sizes a synthetic message store generated by -generate-load-data
+type LoadDataConfig struct {
+	Chats    int
+	Messages int
+	Seed     int64 // Same seed, same data (timestamps are relative to the current UTC day)
+	Days     int   // History window the messages are spread over, ending now
+}
+
+// LoadDataReport summarizes a generated store
+type LoadDataReport struct {
+	Chats, Groups, Messages, MediaMessages int
+	WriteDuration                          time.Duration
+	Searches                               []LoadDataSearch
+}
+
+// LoadDataSearch is the latency of a sample /api/search query over generated data
+type LoadDataSearch struct {
+	Query    string
+	Duration time.Duration
+}
+
+// loadDataWords is the vocabulary synthetic text is drawn from, most frequent first (Zipf-distributed)
+var loadDataWords = strings.Fields(`ok the you to and I is it thanks yes a of for on are this that
+	can we be what will have meeting tomorrow today please send order delivery where when price call
+	photo later sure good night morning invoice payment address update ticket problem fixed again soon
+	week friday monday report project client team lunch weekend home office traffic late sorry great`)
+
+// loadDataHourWeights skews message times towards waking hours (index = hour of day)
+var loadDataHourWeights = []int{1, 1, 1, 1, 1, 2, 4, 7, 10, 12, 12, 11, 12, 11, 10, 10, 10, 11, 12, 12, 11, 9, 6, 3}
+
+// generateLoadData fills a new message store in dir with synthetic chats and messages, written
+// through the same batched path as history sync. Chat activity is Zipf-distributed (a few chats
+// carry most traffic), a fifth of chats are groups, about 15% of messages carry media and text
+// lengths are skewed short, as in real history.
+func generateLoadData(dir string, config LoadDataConfig) (LoadDataReport, error) {
+	var report LoadDataReport
+	if config.Chats < 1 || config.Messages < 1 || config.Days < 1 {
+		return report, errors.New("chats, messages and days must be positive")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "messages.db")); err == nil {
+		return report, fmt.Errorf("%s already contains messages.db; load data goes into a fresh directory", dir)
+	}
+	store, err := NewMessageStore(dir)
+	if err != nil {
+		return report, err
+	}
+	defer store.Close()
+
+	random := rand.New(rand.NewSource(config.Seed))
+	type loadChat struct {
+		jid     string
+		name    string
+		members []string // Senders other than us
+		last    time.Time
+	}
+	chats := make([]loadChat, config.Chats)
+	for i := range chats {
+		if random.Intn(5) == 0 {
+			chat := loadChat{jid: fmt.Sprintf("1203630%011d@g.us", i), name: fmt.Sprintf("Load group %d", i)}
+			for j := 0; j < 3+random.Intn(28); j++ {
+				chat.members = append(chat.members, fmt.Sprintf("1555%07d", random.Intn(10000000)))
+			}
+			chats[i] = chat
+			report.Groups++
+		} else {
+			phone := fmt.Sprintf("1555%07d", i)
+			chats[i] = loadChat{jid: phone + "@" + types.DefaultUserServer, name: fmt.Sprintf("Load contact %d", i), members: []string{phone}}
+		}
+	}
+	report.Chats = len(chats)
+	// Chats go in first (messages reference them); last_message_time is set once known
+	for _, chat := range chats {
+		if err := store.QueueChat(chat.jid, chat.name, time.Time{}); err != nil {
+			return report, err
+		}
+	}
+
+	chatPicker := rand.NewZipf(random, 1.2, 1, uint64(len(chats)-1))
+	wordPicker := rand.NewZipf(random, 1.1, 1, uint64(len(loadDataWords)-1))
+	hourTotal := 0
+	for _, weight := range loadDataHourWeights {
+		hourTotal += weight
+	}
+	mediaTypes := []struct {
+		mediaType, extension string
+		weight               int
+	}{{"image", "jpg", 8}, {"audio", "ogg", 3}, {"video", "mp4", 2}, {"document", "pdf", 2}}
+
+	window := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -config.Days)
+	started := time.Now()
+	for i := 0; i < config.Messages; i++ {
+		chat := &chats[chatPicker.Uint64()]
+
+		hour, pick := 0, random.Intn(hourTotal)
+		for pick >= loadDataHourWeights[hour] {
+			pick -= loadDataHourWeights[hour]
+			hour++
+		}
+		timestamp := window.AddDate(0, 0, random.Intn(config.Days)).
+			Add(time.Duration(hour)*time.Hour + time.Duration(random.Int63n(int64(time.Hour))))
+		if timestamp.After(chat.last) {
+			chat.last = timestamp
+		}
+
+		isFromMe := random.Intn(10) < 3
+		sender := chat.members[random.Intn(len(chat.members))]
+		if isFromMe {
+			sender = "15550000000"
+		}
+
+		// Mostly a handful of words, occasionally a long message
+		words := 1 + int(random.ExpFloat64()*6)
+		text := make([]string, min(words, 120))
+		for w := range text {
+			text[w] = loadDataWords[wordPicker.Uint64()]
+		}
+		content, contentType := strings.Join(text, " "), "text"
+
+		var mediaType, filename string
+		var fileLength uint64
+		if pick := random.Intn(100); pick < 15 { // The media weights add up to 15
+			for _, media := range mediaTypes {
+				if pick < media.weight {
+					mediaType, filename = media.mediaType, fmt.Sprintf("load-%d.%s", i, media.extension)
+					break
+				}
+				pick -= media.weight
+			}
+			fileLength = uint64(10_000 + random.Int63n(5_000_000))
+			contentType = "media"
+			if random.Intn(2) == 0 {
+				content = "" // Most media is sent without a caption
+			}
+			report.MediaMessages++
+		}
+
+		id := fmt.Sprintf("LOAD%016X", i)
+		if err := store.QueueMessage(id, chat.jid, sender, content, contentType, timestamp, isFromMe,
+			mediaType, filename, "", nil, nil, nil, fileLength); err != nil {
+			return report, err
+		}
+		report.Messages++
+	}
+	for _, chat := range chats {
+		if err := store.QueueChat(chat.jid, chat.name, chat.last); err != nil {
+			return report, err
+		}
+	}
+	if err := store.FlushWrites(); err != nil {
+		return report, err
+	}
+	report.WriteDuration = time.Since(started)
+
+	// A rare, a common and a prefix query give a feel for search latency at this size
+	for _, query := range []string{loadDataWords[len(loadDataWords)-1], loadDataWords[0], "deliv*"} {
+		searchStarted := time.Now()
+		if _, _, err := store.SearchMessages(MessageSearch{Query: query, Limit: 50}); err != nil {
+			return report, err
+		}
+		report.Searches = append(report.Searches, LoadDataSearch{Query: query, Duration: time.Since(searchStarted)})
+	}
+	return report, nil
+}
+
+// primaryAccountID names the session the process was started with (store/whatsapp.db, store/messages.db)
+const primaryAccountID = "default"
+
+// accountHeader selects the hosted account a request is for (the ?account= query parameter works too)
+const accountHeader = "X-Account-ID"
+
+var accountIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Endpoints acting on one session's messages or media; they must name an account once more than one is hosted
+var accountScopedPaths = []string{"/api/send", "/api/select-option", "/api/download", "/api/messages", "/api/media/", "/api/export"}
+
+// Account is an additional WhatsApp session hosted by this process, with its own
+// device store and message database under store/accounts/<id>/
+type Account struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+
+	client    *whatsmeow.Client
+	container *sqlstore.Container
+	store     *MessageStore
+	downloads *DownloadWorkerPool
+	pairing   *PhonePairing
+	budget    *SendBudget     // Anti-ban pacing is per number, like the download pool
+	dedupe    *DuplicateGuard // So is duplicate suppression
+	mux       *http.ServeMux
+	logger    waLog.Logger
+	startedAt time.Time
+	stop      chan struct{}
+	recovered sync.Once
+
+	mutex        sync.Mutex
+	qrCode       string // Base64 PNG while the account waits to be paired
+	qrExpiresAt  time.Time
+	reconnecting bool
+}
+
+// AccountStatus is the API view of a hosted account
+type AccountStatus struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	Primary     bool   `json:"primary,omitempty"`
+	JID         string `json:"jid,omitempty"`
+	Connected   bool   `json:"connected"`
+	LoggedIn    bool   `json:"logged_in"`
+	QRCode      string `json:"qr_code,omitempty"`
+	QRExpiresAt string `json:"qr_expires_at,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+}
+
+// AccountRegistry holds the additional accounts; the list itself lives in the primary message store
+type AccountRegistry struct {
+	mutex    sync.RWMutex
+	accounts map[string]*Account
+}
+
+var accounts = &AccountRegistry{accounts: make(map[string]*Account)}
+
+// Store an account in the registry table (renames it when it exists)
+func (store *MessageStore) SaveAccount(id, name string) (time.Time, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	now := time.Now().UTC()
+	if _, err := store.writer.ExecContext(ctx,
+		`INSERT INTO accounts (id, name, created_at) VALUES (?, NULLIF(?, ''), ?)
+		ON CONFLICT(id) DO UPDATE SET name = excluded.name`,
+		id, name, now,
+	); err != nil {
+		return time.Time{}, err
+	}
+	var createdAt time.Time
+	err := store.db.QueryRowContext(ctx, "SELECT created_at FROM accounts WHERE id = ?", id).Scan(&createdAt)
+	return createdAt, err
+}
+
+// Remove an account from the registry table
+func (store *MessageStore) DeleteAccount(id string) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx, "DELETE FROM accounts WHERE id = ?", id)
+	return err
+}
+
+// Get the registered accounts
+func (store *MessageStore) GetAccounts() ([]*Account, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	rows, err := store.db.QueryContext(ctx, "SELECT id, COALESCE(name, ''), created_at FROM accounts ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Account
+	for rows.Next() {
+		account := &Account{}
+		if err := rows.Scan(&account.ID, &account.Name, &account.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, account)
+	}
+	return list, rows.Err()
+}
+
+// Get returns a hosted account by id
+func (registry *AccountRegistry) Get(id string) (*Account, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	account, ok := registry.accounts[id]
+	return account, ok
+}
+
+// Count reports how many additional accounts are hosted
+func (registry *AccountRegistry) Count() int {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return len(registry.accounts)
+}
+
+// List returns the hosted accounts sorted by id
+func (registry *AccountRegistry) List() []*Account {
+	registry.mutex.RLock()
+	list := make([]*Account, 0, len(registry.accounts))
+	for _, account := range registry.accounts {
+		list = append(list, account)
+	}
+	registry.mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// byStore finds the account owning a message store (nil for the primary one)
+func (registry *AccountRegistry) byStore(messageStore *MessageStore) *Account {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	for _, account := range registry.accounts {
+		if account.store == messageStore {
+			return account
+		}
+	}
+	return nil
+}
+
+// LoadAll starts every account registered in the primary store
+func (registry *AccountRegistry) LoadAll(primaryStore *MessageStore) {
+	list, err := primaryStore.GetAccounts()
+	if err != nil {
+		fmt.Printf("Warning: failed to load accounts: %v\n", err)
+		return
+	}
+	for _, entry := range list {
+		if _, err := registry.Open(entry.ID, entry.Name, entry.CreatedAt); err != nil {
+			fmt.Printf("Warning: failed to start account %s: %v\n", entry.ID, err)
+		}
+	}
+	if len(list) > 0 {
+		fmt.Printf("👥 Hosting %d additional account(s)\n", len(list))
+	}
+}
+
+// Open starts the session of an account, pairing it through QR codes when it has no stored credentials
+func (registry *AccountRegistry) Open(id, name string, createdAt time.Time) (*Account, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if account, ok := registry.accounts[id]; ok {
+		account.Name = name
+		return account, nil
+	}
+
+	dir := filepath.Join(storeDir, "accounts", id)
+	messageStore, err := NewMessageStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	dbLog := waLog.Stdout("Database/"+id, "INFO", true)
+	container, err := sqlstore.New(context.Background(), "sqlite3", sqliteURI(filepath.Join(dir, "whatsapp.db"))+"?_foreign_keys=on", dbLog)
+	if err != nil {
+		messageStore.Close()
+		return nil, fmt.Errorf("failed to open device store: %v", err)
+	}
+	deviceStore, err := container.GetFirstDevice(context.Background())
+	if err != nil {
+		container.Close()
+		messageStore.Close()
+		return nil, fmt.Errorf("failed to get device: %v", err)
+	}
+
+	logger := waLog.Stdout("Client/"+id, "INFO", true)
+	client := whatsmeow.NewClient(deviceStore, logger)
+	client.EnableAutoReconnect = false
+	client.AutomaticMessageRerequestFromPhone = true
+
+	account := &Account{
+		ID:        id,
+		Name:      name,
+		CreatedAt: createdAt,
+		client:    client,
+		container: container,
+		store:     messageStore,
+		downloads: NewDownloadWorkerPool(getEnvInt("MCP_DOWNLOAD_WORKERS", 3), getEnvInt("MCP_DOWNLOAD_QUEUE_SIZE", 500)),
+		pairing:   &PhonePairing{},
+		budget:    &SendBudget{limit: getEnvInt("MCP_SEND_RATE_LIMIT", 0), window: time.Minute},
+		dedupe:    loadDuplicateGuard(),
+		logger:    logger,
+		startedAt: time.Now(),
+		stop:      make(chan struct{}),
+	}
+	account.mux = newSessionMux(client, messageStore)
+	registry.accounts[id] = account
+
+	messageStore.StartCheckpointDaemon(account.stop)
+	messageStore.StartEventPruner(account.stop)
+	account.downloads.Start(client, messageStore, account.stop)
+	startCampaignScheduler(client, messageStore, account.stop)
+	startOutbox(client, messageStore, account.stop)
+	startWebhookRetries(messageStore, account.stop)
+	startNewsletterAnalytics(client, messageStore,
+		time.Duration(getEnvInt("MCP_NEWSLETTER_ANALYTICS_INTERVAL_SEC", 3600))*time.Second, account.stop)
+
+	client.AddEventHandler(account.handleEvent)
+	go account.connect()
+	fmt.Printf("👤 Account %s started\n", id)
+	return account, nil
+}
 
-		case "native_flow":
-			// For native flow buttons, we typically just send the button text as a regular message
-			// Many bots accept the button text as a text reply
-			msg = &waProto.Message{
-				Conversation: proto.String(req.SelectedID),
-			}
+// Close stops an account's session; purge also unlinks the device and deletes its stores
+func (registry *AccountRegistry) Close(id string, purge bool) error {
+	registry.mutex.Lock()
+	account, ok := registry.accounts[id]
+	delete(registry.accounts, id)
+	registry.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown account %s", id)
+	}
 
-		default:
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(SendMessageResponse{
-				Success: false,
-				Message: fmt.Sprintf("Invalid response_type: %s (use 'list', 'buttons', or 'native_flow')", req.ResponseType),
-			})
-			return
+	close(account.stop)
+	if purge && account.client.IsLoggedIn() {
+		ctx, cancel := context.WithTimeout(context.Background(), endpointTimeouts.Query)
+		if err := account.client.Logout(ctx); err != nil {
+			account.logger.Warnf("Failed to log out: %v", err)
 		}
+		cancel()
+	}
+	account.client.Disconnect()
+	account.container.Close()
+	account.store.Close()
+	if purge {
+		return os.RemoveAll(account.store.dir)
+	}
+	return nil
+}
 
-		// Send the response message
-		sendCtx, sendCancel := context.WithTimeout(context.Background(), 60*time.Second)
-		defer sendCancel()
+// CloseAll disconnects every hosted account (process shutdown)
+func (registry *AccountRegistry) CloseAll() {
+	for _, account := range registry.List() {
+		registry.Close(account.ID, false)
+	}
+}
 
-		_, err = client.SendMessage(sendCtx, recipientJID, msg)
+// status reports the account's connection and, while unpaired, its current QR code
+func (account *Account) status() AccountStatus {
+	status := AccountStatus{
+		ID:        account.ID,
+		Name:      account.Name,
+		Connected: account.client.IsConnected(),
+		LoggedIn:  account.client.IsLoggedIn(),
+		CreatedAt: account.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if account.client.Store.ID != nil {
+		status.JID = account.client.Store.ID.ToNonAD().String()
+	}
+	account.mutex.Lock()
+	if account.qrCode != "" && time.Now().Before(account.qrExpiresAt) {
+		status.QRCode = account.qrCode
+		status.QRExpiresAt = account.qrExpiresAt.UTC().Format(time.RFC3339)
+	}
+	account.mutex.Unlock()
+	return status
+}
 
-		w.Header().Set("Content-Type", "application/json")
+// setQRCode stores the pairing code to show (empty code clears it)
+func (account *Account) setQRCode(code string, timeout time.Duration) {
+	var encoded string
+	if code != "" {
+		qrPNG, err := qrcode.Encode(code, qrcode.Medium, defaultQRSize)
+		if err != nil {
+			account.logger.Warnf("Failed to render QR code: %v", err)
+			return
+		}
+		encoded = base64.StdEncoding.EncodeToString(qrPNG)
+	}
+	account.mutex.Lock()
+	account.qrCode = encoded
+	account.qrExpiresAt = time.Now().Add(timeout)
+	account.mutex.Unlock()
+}
+
+// stopped reports whether the account was closed
+func (account *Account) stopped() bool {
+	select {
+	case <-account.stop:
+		return true
+	default:
+		return false
+	}
+}
 
+// connect links the account, issuing QR codes until it is paired when there are no stored credentials
+func (account *Account) connect() {
+	client := account.client
+	if client.Store.ID != nil {
+		if err := client.Connect(); err != nil {
+			account.logger.Errorf("Failed to connect: %v", err)
+			go account.reconnect()
+		}
+		return
+	}
+
+	for !account.stopped() {
+		qrChan, err := client.GetQRChannel(context.Background())
+		if err == nil {
+			err = client.Connect()
+		}
 		if err != nil {
-			if sendCtx.Err() == context.DeadlineExceeded {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(SendMessageResponse{
-					Success: false,
-					Message: "Timeout sending selection to WhatsApp (60s exceeded)",
-				})
+			account.logger.Errorf("Failed to connect for QR: %v", err)
+			client.Disconnect()
+			select {
+			case <-time.After(5 * time.Second):
+				continue
+			case <-account.stop:
 				return
 			}
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(SendMessageResponse{
-				Success: false,
-				Message: fmt.Sprintf("Error sending selection: %v", err),
-			})
+		}
+
+		for evt := range qrChan {
+			switch evt.Event {
+			case "code":
+				account.setQRCode(evt.Code, evt.Timeout)
+				publishQRGenerated(account.store, evt.Code, evt.Timeout)
+			case "success":
+				account.setQRCode("", 0)
+				account.logger.Infof("QR code authentication successful")
+				return
+			case "timeout":
+				account.setQRCode("", 0)
+				go dispatchEventWebhooks(account.store, "pairing_timeout", map[string]interface{}{"reason": "qr_codes_exhausted"})
+			}
+		}
+		if client.IsLoggedIn() {
 			return
 		}
 
-		json.NewEncoder(w).Encode(SendMessageResponse{
-			Success: true,
-			Message: fmt.Sprintf("Selection '%s' sent to %s", req.SelectedID, req.Recipient),
+		// The batch of codes expired; start over with a new one
+		client.Disconnect()
+		select {
+		case <-time.After(2 * time.Second):
+		case <-account.stop:
+			return
+		}
+	}
+}
+
+// reconnect retries the connection with a growing delay until it is back or the account is closed
+func (account *Account) reconnect() {
+	account.mutex.Lock()
+	if account.reconnecting {
+		account.mutex.Unlock()
+		return
+	}
+	account.reconnecting = true
+	account.mutex.Unlock()
+	defer func() {
+		account.mutex.Lock()
+		account.reconnecting = false
+		account.mutex.Unlock()
+	}()
+
+	for attempt := 1; ; attempt++ {
+		delay := time.Duration(min(attempt*5, 60)) * time.Second
+		select {
+		case <-time.After(delay):
+		case <-account.stop:
+			return
+		}
+		if account.client.IsConnected() || account.client.Store.ID == nil {
+			return
+		}
+		if err := account.client.Connect(); err != nil {
+			account.logger.Warnf("Reconnect attempt %d failed: %v", attempt, err)
+			continue
+		}
+		return
+	}
+}
+
+// handleEvent processes the events of an additional account's session
+func (account *Account) handleEvent(evt interface{}) {
+	client, messageStore, logger := account.client, account.store, account.logger
+
+	if state, details := connectionEventState(evt); state != "" {
+		payload := map[string]interface{}{"state": state}
+		for k, v := range details {
+			payload[k] = v
+		}
+		recordEvent(messageStore, "connection", payload)
+	}
+	if handleSessionEvent(client, messageStore, evt, logger) {
+		return
+	}
+
+	switch v := evt.(type) {
+	case *events.Connected:
+		logger.Infof("✅ Connected to WhatsApp")
+		account.recovered.Do(func() {
+			go recoverPendingWork(client, messageStore, account.startedAt)
 		})
-	}))
+		go func() {
+			if err := presenceManager.Apply(client); err != nil {
+				logger.Warnf("Failed to announce presence: %v", err)
+			}
+		}()
 
-	// Handler for checking if phone numbers are registered on WhatsApp
-	// This endpoint uses the IsOnWhatsApp API to resolve phone numbers to WhatsApp JIDs
-	http.HandleFunc("/api/check-numbers", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// Only allow POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case *events.PairSuccess:
+		logger.Infof("🔗 Paired as %s (%s)", v.ID, v.Platform)
+		account.pairing.clear()
+		go dispatchEventWebhooks(messageStore, "pairing_success", map[string]interface{}{
+			"jid":           v.ID.String(),
+			"lid":           v.LID.String(),
+			"platform":      v.Platform,
+			"business_name": v.BusinessName,
+		})
+
+	case *events.Disconnected, *events.StreamError:
+		if !account.stopped() {
+			logger.Warnf("⚠️  Disconnected from WhatsApp")
+			go account.reconnect()
+		}
+
+	case *events.LoggedOut:
+		logger.Errorf("❌ Device logged out from WhatsApp (user unlinked from phone)")
+		go func() {
+			client.Disconnect()
+			if err := client.Store.Delete(context.Background()); err != nil {
+				logger.Errorf("Failed to delete device from store: %v", err)
+				return
+			}
+			account.connect()
+		}()
+	}
+}
+
+// accountRouter hands each request to the API of the account it names (X-Account-ID or ?account=);
+// requests without one go to the primary session
+func accountRouter(primary *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(accountHeader))
+		if id == "" {
+			id = strings.TrimSpace(r.URL.Query().Get("account"))
+		}
+
+		if id == "" || id == primaryAccountID {
+			if id == "" && accounts.Count() > 0 && slices.ContainsFunc(accountScopedPaths, func(path string) bool {
+				return strings.HasPrefix(r.URL.Path, path)
+			}) {
+				authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "account is required when several accounts are hosted (X-Account-ID header or ?account=)", http.StatusBadRequest)
+				})(w, r)
+				return
+			}
+			primary.ServeHTTP(w, r)
 			return
 		}
 
-		// Check if client is connected and authenticated
-		if !client.IsLoggedIn() {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusServiceUnavailable)
+		account, ok := accounts.Get(id)
+		if !ok {
+			authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, fmt.Sprintf("Unknown account %q", id), http.StatusNotFound)
+			})(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/qr-code", "/api/health":
+			// Pairing and connection state of added accounts are tracked per account
+			authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(account.status())
+			})(w, r)
+			return
+		}
+		account.mux.ServeHTTP(w, r)
+	})
+}
+
+// accountsHandler serves /api/accounts: GET lists the hosted accounts (?id= for one, including its QR code),
+// POST {id, name} adds (or renames) an account, DELETE ?id= stops it (&purge=true also unlinks and deletes it)
+func accountsHandler(client *whatsmeow.Client, messageStore *MessageStore) http.HandlerFunc {
+	primaryStatus := func() AccountStatus {
+		status := AccountStatus{
+			ID:        primaryAccountID,
+			Primary:   true,
+			Connected: client.IsConnected(),
+			LoggedIn:  client.IsLoggedIn(),
+		}
+		if client.Store.ID != nil {
+			status.JID = client.Store.ID.ToNonAD().String()
+		}
+		return status
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeError := func(status int, message string) {
+			w.WriteHeader(status)
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success": false,
-				"message": "WhatsApp client not authenticated",
+				"error":   message,
 			})
-			return
 		}
 
-		// Parse the request body
-		var req struct {
-			PhoneNumbers []string `json:"phone_numbers"`
+		switch r.Method {
+		case http.MethodGet:
+			if id := r.URL.Query().Get("id"); id != "" {
+				if id == primaryAccountID {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "account": primaryStatus()})
+					return
+				}
+				account, ok := accounts.Get(id)
+				if !ok {
+					writeError(http.StatusNotFound, fmt.Sprintf("Unknown account %q", id))
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "account": account.status()})
+				return
+			}
+
+			list := []AccountStatus{primaryStatus()}
+			for _, account := range accounts.List() {
+				status := account.status()
+				status.QRCode = ""
+				list = append(list, status)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"accounts": list,
+				"count":    len(list),
+			})
+
+		case http.MethodPost:
+			var req struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(http.StatusBadRequest, "Invalid request format")
+				return
+			}
+			req.ID = strings.ToLower(strings.TrimSpace(req.ID))
+			if !accountIDPattern.MatchString(req.ID) || req.ID == primaryAccountID {
+				writeError(http.StatusBadRequest, "id must be 1-32 lowercase letters, digits, '-' or '_' (and not \"default\")")
+				return
+			}
+			_, existed := accounts.Get(req.ID)
+			createdAt, err := messageStore.SaveAccount(req.ID, strings.TrimSpace(req.Name))
+			if err != nil {
+				writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to save account: %v", err))
+				return
+			}
+			account, err := accounts.Open(req.ID, strings.TrimSpace(req.Name), createdAt)
+			if err != nil {
+				writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to start account: %v", err))
+				return
+			}
+			if !existed {
+				w.WriteHeader(http.StatusCreated)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "account": account.status()})
+
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if _, ok := accounts.Get(id); !ok {
+				writeError(http.StatusNotFound, fmt.Sprintf("Unknown account %q", id))
+				return
+			}
+			purge := r.URL.Query().Get("purge") == "true"
+			if err := messageStore.DeleteAccount(id); err != nil {
+				writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to delete account: %v", err))
+				return
+			}
+			if err := accounts.Close(id, purge); err != nil {
+				writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to stop account: %v", err))
+				return
+			}
+			fmt.Printf("👤 Account %s removed (purge=%t)\n", id, purge)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": id, "purged": purge})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
+	}
+}
+
+// syncWAWebVersion fetches the latest WhatsApp Web client version from Meta
+// and applies it to whatsmeow's client payload. This prevents the server from
+// rejecting connections with code 405 (Client outdated) when the version
+// hardcoded in the pinned whatsmeow module falls behind WhatsApp's live version.
+// On failure, the built-in version is kept and a warning is logged.
+func syncWAWebVersion(logger waLog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	oldVer := store.GetWAVersion()
+	latestVer, err := whatsmeow.GetLatestVersion(ctx, nil)
+	if err != nil {
+		logger.Warnf("Failed to fetch latest WhatsApp Web version (using built-in %s): %v", oldVer, err)
+		return
+	}
+	if latestVer == nil || latestVer.IsZero() || *latestVer == oldVer {
+		logger.Infof("WhatsApp Web version is up-to-date: %s", oldVer)
+		return
+	}
+	store.SetWAVersion(*latestVer)
+	logger.Infof("Updated WhatsApp Web client version from %s to %s", oldVer, latestVer)
+}
+
+// updateActivityTime updates the last activity timestamp
+func updateActivityTime() {
+	reconnectState.mutex.Lock()
+	reconnectState.lastActivityTime = time.Now()
+	reconnectState.mutex.Unlock()
+}
+
+// calculateBackoffDuration calculates exponential backoff with jitter
+func calculateBackoffDuration(attempt int) time.Duration {
+	// Base: 1s, 2s, 4s, 8s, 16s, 32s, 60s (max)
+	maxDuration := 60 * time.Second
+	baseDuration := time.Duration(1<<uint(attempt)) * time.Second
+
+	if baseDuration > maxDuration {
+		baseDuration = maxDuration
+	}
+
+	// Add jitter (±25%)
+	jitter := time.Duration(rand.Int63n(int64(baseDuration) / 2))
+	return baseDuration + jitter
+}
+
+// attemptReconnect handles reconnection with exponential backoff
+func attemptReconnect(client *whatsmeow.Client, logger waLog.Logger) bool {
+	reconnectState.mutex.Lock()
+
+	// Check if we've exceeded max attempts
+	if reconnectState.reconnectAttempts >= reconnectState.maxReconnectAttempts {
+		logger.Errorf("Maximum reconnection attempts (%d) reached. Manual re-authentication required.", reconnectState.maxReconnectAttempts)
+		reconnectState.mutex.Unlock()
+		return false
+	}
+
+	// Check if we should throttle reconnection attempts
+	timeSinceLastAttempt := time.Since(reconnectState.lastReconnectTime)
+	requiredBackoff := calculateBackoffDuration(reconnectState.reconnectAttempts)
+
+	if timeSinceLastAttempt < requiredBackoff {
+		reconnectState.mutex.Unlock()
+		return false // Too soon to retry
+	}
+
+	reconnectState.reconnectAttempts++
+	reconnectState.lastReconnectTime = time.Now()
+	attempt := reconnectState.reconnectAttempts
+	reconnectState.mutex.Unlock()
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
-			return
-		}
+	logger.Infof("Attempting reconnection (attempt %d/%d) after %v backoff...",
+		attempt, reconnectState.maxReconnectAttempts, requiredBackoff)
 
-		// Validate request
-		if len(req.PhoneNumbers) == 0 {
-			http.Error(w, "phone_numbers array is required and must not be empty", http.StatusBadRequest)
-			return
-		}
+	// Attempt to reconnect
+	err := client.Connect()
+	if err != nil {
+		logger.Errorf("Reconnection attempt %d failed: %v", attempt, err)
+		return false
+	}
 
-		// Limit batch size to avoid rate limiting (max 50 numbers per call)
-		if len(req.PhoneNumbers) > 50 {
-			http.Error(w, "Maximum 50 phone numbers per request", http.StatusBadRequest)
-			return
-		}
+	// Wait a moment to verify connection
+	time.Sleep(2 * time.Second)
 
-		fmt.Printf("Checking %d phone numbers on WhatsApp...\n", len(req.PhoneNumbers))
+	if client.IsConnected() && client.IsLoggedIn() {
+		logger.Infof("✅ Reconnection successful on attempt %d", attempt)
+		reconnectState.mutex.Lock()
+		reconnectState.reconnectAttempts = 0
+		reconnectState.mutex.Unlock()
+		reconnectState.transition(SessionConnected, "reconnected")
+		updateActivityTime()
+		return true
+	}
 
-		// Normalize phone numbers (remove + prefix, ensure only digits)
-		normalizedNumbers := make([]string, len(req.PhoneNumbers))
-		for i, phone := range req.PhoneNumbers {
-			// Remove + prefix and any non-digit characters
-			normalized := strings.TrimPrefix(phone, "+")
-			// Keep only digits
-			var digits strings.Builder
-			for _, r := range normalized {
-				if r >= '0' && r <= '9' {
-					digits.WriteRune(r)
-				}
-			}
-			normalizedNumbers[i] = digits.String()
-		}
+	logger.Warnf("Reconnection attempt %d: connected but not authenticated", attempt)
+	return false
+}
 
-		// Call IsOnWhatsApp to check if numbers are registered
-		results, err := client.IsOnWhatsApp(r.Context(), normalizedNumbers)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"message": fmt.Sprintf("Failed to check numbers: %v", err),
-			})
+func scheduleReconnectLoop(client *whatsmeow.Client, logger waLog.Logger, initialDelay time.Duration, reason string) {
+	go func() {
+		// Only a degraded session is recovered by reconnecting; the other states need a
+		// re-pair, a ban to expire, or are already connected
+		reconnectState.mutex.Lock()
+		if reconnectState.reconnectLoopActive || reconnectState.state != SessionDegraded {
+			reconnectState.mutex.Unlock()
 			return
 		}
+		reconnectState.reconnectLoopActive = true
+		reconnectState.mutex.Unlock()
+		defer func() {
+			reconnectState.mutex.Lock()
+			reconnectState.reconnectLoopActive = false
+			reconnectState.mutex.Unlock()
+		}()
 
-		// Build response with original phone numbers mapped to results
-		type CheckResult struct {
-			Phone        string `json:"phone"`
-			IsRegistered bool   `json:"is_registered"`
-			JID          string `json:"jid,omitempty"`
+		if initialDelay > 0 {
+			time.Sleep(initialDelay)
 		}
 
-		responseResults := make([]CheckResult, len(results))
-		for i, result := range results {
-			checkResult := CheckResult{
-				Phone:        req.PhoneNumbers[i], // Use original phone number from request
-				IsRegistered: result.IsIn,
-			}
-			if result.IsIn && result.JID.User != "" {
-				// Return the full JID string (e.g., "5500000000001@s.whatsapp.net")
-				checkResult.JID = result.JID.String()
+		for {
+			if client.IsConnected() && client.IsLoggedIn() {
+				return
 			}
-			responseResults[i] = checkResult
 
-			if result.IsIn {
-				fmt.Printf("  ✅ %s → %s\n", req.PhoneNumbers[i], result.JID.String())
-			} else {
-				fmt.Printf("  ❌ %s → not registered\n", req.PhoneNumbers[i])
-			}
-		}
+			reconnectState.mutex.RLock()
+			state := reconnectState.state
+			attempts := reconnectState.reconnectAttempts
+			maxAttempts := reconnectState.maxReconnectAttempts
+			reconnectState.mutex.RUnlock()
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"results": responseResults,
-		})
-	}))
+			if state != SessionDegraded || attempts >= maxAttempts {
+				return
+			}
 
-	// Handler for getting new messages (bypasses filesystem sync issues)
-	// This endpoint allows the backend watcher to poll for new messages via HTTP
-	// instead of reading SQLite directly from bind-mounted volumes
-	http.HandleFunc("/api/messages", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+			if attemptReconnect(client, logger) {
+				return
+			}
 
-		// Get 'since' parameter (timestamp string or Unix epoch)
-		sinceParam := r.URL.Query().Get("since")
-		limitParam := r.URL.Query().Get("limit")
+			reconnectState.mutex.RLock()
+			state = reconnectState.state
+			attempts = reconnectState.reconnectAttempts
+			reconnectState.mutex.RUnlock()
 
-		// Default limit to 100
-		limit := 100
-		if limitParam != "" {
-			if parsed, err := fmt.Sscanf(limitParam, "%d", &limit); err != nil || parsed != 1 {
-				limit = 100
-			}
-			if limit > 500 {
-				limit = 500
+			if state != SessionDegraded || attempts >= maxAttempts {
+				return
 			}
-		}
 
-		// Parse 'since' timestamp
-		var sinceTime time.Time
-		if sinceParam != "" {
-			// Try parsing as RFC3339/ISO8601 first
-			if t, err := time.Parse(time.RFC3339, sinceParam); err == nil {
-				sinceTime = t
-			} else if t, err := time.Parse("2006-01-02 15:04:05", sinceParam); err == nil {
-				sinceTime = t
-			} else if t, err := time.Parse("2006-01-02 15:04:05+00:00", sinceParam); err == nil {
-				sinceTime = t
-			} else {
-				// Try as Unix timestamp
-				var epoch int64
-				if _, err := fmt.Sscanf(sinceParam, "%d", &epoch); err == nil {
-					sinceTime = time.Unix(epoch, 0)
-				} else {
-					sinceTime = time.Unix(0, 0) // Default to epoch
-				}
-			}
-		} else {
-			sinceTime = time.Unix(0, 0)
+			wait := calculateBackoffDuration(attempts)
+			logger.Warnf("Reconnect loop (%s) still recovering; retrying in %v", reason, wait)
+			time.Sleep(wait)
 		}
+	}()
+}
 
-		// Query messages from database
-		query := `
-			SELECT
-				m.id,
-				m.chat_jid,
-				c.name as chat_name,
-				m.sender,
-				m.content,
-				m.timestamp,
-				m.is_from_me,
-				m.media_type,
-				m.filename,
-				m.url
-			FROM messages m
-			LEFT JOIN chats c ON m.chat_jid = c.jid
-			WHERE m.timestamp > ? AND m.is_from_me = 0
-			ORDER BY m.timestamp ASC
-			LIMIT ?
-		`
+// Presence policies (MCP_PRESENCE_POLICY) controlling what contacts see as our availability
+const (
+	presenceAlwaysOnline = "always-online"            // Keepalive announces available (legacy behaviour)
+	presenceWhenSending  = "online-only-when-sending" // Available briefly around each send, unavailable otherwise
+	presenceInvisible    = "invisible"                // Always unavailable, even while sending
+)
 
-		rows, err := messageStore.db.Query(query, sinceTime.Format("2006-01-02 15:04:05+00:00"), limit)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"error":   fmt.Sprintf("Database query failed: %v", err),
-			})
-			return
-		}
-		defer rows.Close()
+var presencePolicies = []string{presenceAlwaysOnline, presenceWhenSending, presenceInvisible}
 
-		// Build response
-		type MessageResponse struct {
-			ID        string `json:"id"`
-			ChatJID   string `json:"chat_jid"`
-			ChatName  string `json:"chat_name,omitempty"`
-			Sender    string `json:"sender"`
-			Content   string `json:"content"`
-			Timestamp string `json:"timestamp"`
-			IsFromMe  bool   `json:"is_from_me"`
-			MediaType string `json:"media_type,omitempty"`
-			Filename  string `json:"filename,omitempty"`
-			MediaURL  string `json:"media_url,omitempty"`
-		}
+// How long we stay available after a send under online-only-when-sending
+const presenceSendWindow = 30 * time.Second
 
-		var messages []MessageResponse
-		for rows.Next() {
-			var msg MessageResponse
-			var chatName, mediaType, filename, mediaURL sql.NullString
-
-			err := rows.Scan(
-				&msg.ID,
-				&msg.ChatJID,
-				&chatName,
-				&msg.Sender,
-				&msg.Content,
-				&msg.Timestamp,
-				&msg.IsFromMe,
-				&mediaType,
-				&filename,
-				&mediaURL,
-			)
-			if err != nil {
-				continue
-			}
+// PresenceManager decides which presence the keepalive and sends announce
+type PresenceManager struct {
+	mutex       sync.Mutex
+	policy      string
+	onlineUntil time.Time
+	announced   types.Presence
+}
 
-			if chatName.Valid {
-				msg.ChatName = chatName.String
-			}
-			if mediaType.Valid {
-				msg.MediaType = mediaType.String
-			}
-			if filename.Valid {
-				msg.Filename = filename.String
-			}
-			if mediaURL.Valid {
-				msg.MediaURL = mediaURL.String
-			}
+var presenceManager = &PresenceManager{policy: presenceAlwaysOnline}
 
-			messages = append(messages, msg)
-		}
+// Policy returns the active presence policy
+func (pm *PresenceManager) Policy() string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	return pm.policy
+}
 
-		// Return messages
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":  true,
-			"messages": messages,
-			"count":    len(messages),
-		})
-	}))
+// SetPolicy switches the presence policy; the next keepalive applies it
+func (pm *PresenceManager) SetPolicy(policy string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	pm.policy = policy
+	pm.onlineUntil = time.Time{}
+	pm.announced = ""
+}
 
-	// Handler for getting the latest message timestamp
-	// Used by the backend to determine starting point for polling
-	http.HandleFunc("/api/messages/latest", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// desired returns the presence the policy calls for right now
+func (pm *PresenceManager) desired() types.Presence {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	if pm.policy == presenceAlwaysOnline || (pm.policy == presenceWhenSending && time.Now().Before(pm.onlineUntil)) {
+		return types.PresenceAvailable
+	}
+	return types.PresenceUnavailable
+}
 
-		// Query for the latest message timestamp
-		var latestTimestamp sql.NullString
-		err := messageStore.db.QueryRow(`
-			SELECT MAX(timestamp) FROM messages WHERE is_from_me = 0
-		`).Scan(&latestTimestamp)
+// announce sends presence when it differs from what was last announced (always for
+// available, which doubles as the session keepalive)
+func (pm *PresenceManager) announce(client *whatsmeow.Client, presence types.Presence) error {
+	pm.mutex.Lock()
+	unchanged := pm.announced == presence && presence != types.PresenceAvailable
+	pm.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+	if err := client.SendPresence(context.Background(), presence); err != nil {
+		return err
+	}
+	pm.mutex.Lock()
+	pm.announced = presence
+	pm.mutex.Unlock()
+	return nil
+}
 
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"error":   fmt.Sprintf("Database query failed: %v", err),
-			})
-			return
-		}
+// Apply announces whatever the policy currently calls for
+func (pm *PresenceManager) Apply(client *whatsmeow.Client) error {
+	return pm.announce(client, pm.desired())
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		if latestTimestamp.Valid && latestTimestamp.String != "" {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success":          true,
-				"latest_timestamp": latestTimestamp.String,
-			})
-		} else {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success":          true,
-				"latest_timestamp": nil,
-			})
-		}
-	}))
+// BeforeSend opens the availability window under online-only-when-sending
+func (pm *PresenceManager) BeforeSend(client *whatsmeow.Client) {
+	pm.mutex.Lock()
+	if pm.policy != presenceWhenSending {
+		pm.mutex.Unlock()
+		return
+	}
+	pm.onlineUntil = time.Now().Add(presenceSendWindow)
+	pm.mutex.Unlock()
+	if err := pm.announce(client, types.PresenceAvailable); err != nil {
+		fmt.Printf("Warning: failed to announce presence before send: %v\n", err)
+	}
+}
 
-	// Handler for listing WhatsApp groups from the local chats store.
-	// Supports optional substring filter via ?q= and limit via ?limit= (default 50, max 200).
-	// Used by the backend to power typeahead in Hub > Communications > WhatsApp filters.
-	http.HandleFunc("/api/groups", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// autoTypingDelay shows a typing indicator (recording, for voice notes) for this long before
+// each send so bot replies look natural (MCP_AUTO_TYPING_MS, 0 = disabled)
+var autoTypingDelay time.Duration
+
+// simulateTyping holds a send for autoTypingDelay behind a chat state indicator, returning
+// early if ctx ends. Skipped under the invisible presence policy, which typing would give away.
+func simulateTyping(ctx context.Context, client *whatsmeow.Client, chat types.JID, voiceNote bool) {
+	if autoTypingDelay <= 0 || presenceManager.Policy() == presenceInvisible {
+		return
+	}
+	if chat.Server != types.DefaultUserServer && chat.Server != types.HiddenUserServer && chat.Server != types.GroupServer {
+		return
+	}
+	media := types.ChatPresenceMediaText
+	if voiceNote {
+		media = types.ChatPresenceMediaAudio
+	}
+	if err := client.SendChatPresence(ctx, chat, types.ChatPresenceComposing, media); err != nil {
+		fmt.Printf("Warning: failed to send typing indicator: %v\n", err)
+		return
+	}
+	select {
+	case <-time.After(autoTypingDelay):
+	case <-ctx.Done():
+	}
+}
+
+// startKeepalive sends periodic presence updates to maintain session
+func startKeepalive(client *whatsmeow.Client, logger waLog.Logger, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
 
-		q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
-		limit := 50
-		if lp := r.URL.Query().Get("limit"); lp != "" {
-			var parsed int
-			if _, err := fmt.Sscanf(lp, "%d", &parsed); err == nil && parsed > 0 {
-				limit = parsed
-			}
-			if limit > 200 {
-				limit = 200
+	for {
+		select {
+		case <-ticker.C:
+			if client.IsConnected() && client.IsLoggedIn() {
+				// Announce presence per MCP_PRESENCE_POLICY to keep the session alive
+				err := presenceManager.Apply(client)
+				if err != nil {
+					logger.Warnf("Failed to send keepalive presence: %v", err)
+				} else {
+					logger.Debugf("Keepalive sent successfully")
+					updateActivityTime()
+				}
 			}
-		}
-
-		rows, err := messageStore.db.Query(`
-			SELECT jid, name FROM chats
-			WHERE jid LIKE '%@g.us' AND name IS NOT NULL AND name != ''
-			ORDER BY last_message_time DESC
-		`)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"error":   fmt.Sprintf("Database query failed: %v", err),
-			})
+		case <-stopChan:
+			logger.Infof("Keepalive goroutine stopped")
 			return
 		}
-		defer rows.Close()
+	}
+}
 
-		type GroupResponse struct {
-			JID  string `json:"jid"`
-			Name string `json:"name"`
-		}
-		groups := []GroupResponse{}
-		for rows.Next() {
-			var jid, name string
-			if err := rows.Scan(&jid, &name); err != nil {
-				continue
-			}
-			if q != "" && !strings.Contains(strings.ToLower(name), q) {
-				continue
-			}
-			groups = append(groups, GroupResponse{JID: jid, Name: name})
-			if len(groups) >= limit {
-				break
-			}
-		}
-		if err := rows.Err(); err != nil {
-			fmt.Printf("Warning: /api/groups rows iteration error: %v\n", err)
-		}
+// MCP protocol revision implemented by the stdio server (newer clients negotiate down to it)
+const mcpProtocolVersion = "2024-11-05"
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"groups":  groups,
-			"count":   len(groups),
-		})
-	}))
+// mcpRequest is a JSON-RPC 2.0 request or notification (no ID) from an MCP client
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
 
-	// Handler for listing WhatsApp contacts from the whatsmeow address book,
-	// merged with DM chats the user has messaged.
-	// Supports ?q= (case-insensitive name substring OR phone-prefix match) and ?limit= (default 50, max 200).
-	http.HandleFunc("/api/contacts", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
 
-		q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
-		qDigits := strings.TrimPrefix(q, "+")
-		// Strip non-digits from qDigits for phone-prefix matching
-		var digitsBuilder strings.Builder
-		for _, ch := range qDigits {
-			if ch >= '0' && ch <= '9' {
-				digitsBuilder.WriteRune(ch)
-			}
-		}
-		qDigits = digitsBuilder.String()
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
 
-		limit := 50
-		if lp := r.URL.Query().Get("limit"); lp != "" {
-			var parsed int
-			if _, err := fmt.Sscanf(lp, "%d", &parsed); err == nil && parsed > 0 {
-				limit = parsed
-			}
-			if limit > 200 {
-				limit = 200
-			}
-		}
+// JSON-RPC error codes
+const (
+	mcpParseError     = -32700
+	mcpMethodNotFound = -32601
+	mcpInvalidParams  = -32602
+)
 
-		if !client.IsLoggedIn() {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"message": "WhatsApp client not authenticated",
-			})
-			return
-		}
+// mcpTool describes a tool in tools/list; call runs it and returns its text result
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+	call        func(ctx context.Context, args json.RawMessage) (string, error)
+}
 
-		type ContactResponse struct {
-			JID   string `json:"jid"`
-			Phone string `json:"phone"`
-			Name  string `json:"name"`
-		}
-		byJID := map[string]ContactResponse{}
+// mcpSchema builds a JSON object schema from property descriptions ("name": "type: description")
+func mcpSchema(required []string, properties map[string]string) map[string]interface{} {
+	props := map[string]interface{}{}
+	for name, spec := range properties {
+		kind, description, _ := strings.Cut(spec, ": ")
+		props[name] = map[string]interface{}{"type": kind, "description": description}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
 
-		// Source 1: whatsmeow address book
-		contacts, err := client.Store.Contacts.GetAllContacts(r.Context())
-		if err == nil {
-			for jid, info := range contacts {
-				if jid.Server != types.DefaultUserServer { // "s.whatsapp.net"
-					continue
+// mcpTools exposes the core REST operations as MCP tools
+func mcpTools(client *whatsmeow.Client, messageStore *MessageStore) []mcpTool {
+	return []mcpTool{
+		{
+			Name:        "send_message",
+			Description: "Send a WhatsApp text or media message to a phone number, user/group JID or broadcast list.",
+			InputSchema: mcpSchema([]string{"recipient"}, map[string]string{
+				"recipient":         "string: Phone number with country code (no +) or a JID",
+				"message":           "string: Message text (caption when media_path is set)",
+				"media_path":        "string: Absolute path of a file to send as media",
+				"media_url":         "string: Public http(s) URL of a file to send as media",
+				"media_base64":      "string: Base64 contents (or a data: URI) of a file to send as media",
+				"media_filename":    "string: File name for media_url or media_base64; its extension picks the media type",
+				"quoted_message_id": "string: ID of a message in the same chat to reply to",
+			}),
+			call: func(ctx context.Context, args json.RawMessage) (string, error) {
+				var req SendMessageRequest
+				if err := json.Unmarshal(args, &req); err != nil {
+					return "", err
 				}
-				name := info.FullName
-				if name == "" {
-					name = info.PushName
+				if req.Recipient == "" || (req.Message == "" && req.MediaPath == "" && req.MediaURL == "" && req.MediaBase64 == "") {
+					return "", fmt.Errorf("recipient and message, media_path, media_url or media_base64 are required")
 				}
-				if name == "" {
-					name = info.FirstName
+				if err := resolveInlineMedia(ctx, messageStore, &req); err != nil {
+					return "", err
 				}
-				if name == "" {
-					name = info.BusinessName
+				if !drainState.beginSend() {
+					return "", fmt.Errorf("server is draining for shutdown")
 				}
-				byJID[jid.String()] = ContactResponse{
-					JID:   jid.String(),
-					Phone: jid.User,
-					Name:  name,
+				defer drainState.endSend()
+				success, result := dispatchSendRequest(ctx, client, messageStore, req)
+				if !success {
+					return "", errors.New(result)
 				}
-			}
-		}
-
-		// Source 2: DM chats the user has messaged (fallback for contacts not in address book)
-		dmRows, dmErr := messageStore.db.Query(`
-			SELECT jid, name FROM chats
-			WHERE jid LIKE '%@s.whatsapp.net'
-			ORDER BY last_message_time DESC
-		`)
-		if dmErr == nil {
-			defer dmRows.Close()
-			for dmRows.Next() {
-				var jid, name string
-				if err := dmRows.Scan(&jid, &name); err != nil {
-					continue
+				return result, nil
+			},
+		},
+		{
+			Name:        "list_chats",
+			Description: "List chats, most recently active first.",
+			InputSchema: mcpSchema(nil, map[string]string{
+				"query": "string: Only chats whose name or JID contains this text",
+				"limit": "integer: Maximum chats to return (default 20, max 200)",
+			}),
+			call: func(ctx context.Context, args json.RawMessage) (string, error) {
+				var req struct {
+					Query string `json:"query"`
+					Limit int    `json:"limit"`
 				}
-				existing, found := byJID[jid]
-				phone := jid
-				if at := strings.Index(jid, "@"); at > 0 {
-					phone = jid[:at]
+				if len(args) > 0 {
+					if err := json.Unmarshal(args, &req); err != nil {
+						return "", err
+					}
 				}
-				if !found {
-					byJID[jid] = ContactResponse{JID: jid, Phone: phone, Name: name}
-				} else if existing.Name == "" && name != "" {
-					existing.Name = name
-					byJID[jid] = existing
+				if req.Limit <= 0 {
+					req.Limit = 20
 				}
-			}
-			if err := dmRows.Err(); err != nil {
-				fmt.Printf("Warning: /api/contacts DM rows iteration error: %v\n", err)
-			}
+				queryCtx, cancel := withOptionalTimeout(ctx, endpointTimeouts.Query)
+				defer cancel()
+				rows, err := messageStore.db.QueryContext(queryCtx,
+					`SELECT jid, COALESCE(name, ''), last_message_time FROM chats
+					WHERE ? = '' OR jid LIKE '%' || ? || '%' OR name LIKE '%' || ? || '%'
+					ORDER BY last_message_time DESC LIMIT ?`,
+					req.Query, req.Query, req.Query, min(req.Limit, 200),
+				)
+				if err != nil {
+					return "", err
+				}
+				defer rows.Close()
+				var lines []string
+				for rows.Next() {
+					var jid, name string
+					var lastMessage sql.NullTime
+					if err := rows.Scan(&jid, &name, &lastMessage); err != nil {
+						return "", err
+					}
+					line := jid
+					if name != "" {
+						line = fmt.Sprintf("%s (%s)", name, jid)
+					}
+					if lastMessage.Valid {
+						line += " - last message " + lastMessage.Time.UTC().Format(time.RFC3339)
+					}
+					lines = append(lines, line)
+				}
+				if err := rows.Err(); err != nil {
+					return "", err
+				}
+				if len(lines) == 0 {
+					return "No chats found", nil
+				}
+				return strings.Join(lines, "\n"), nil
+			},
+		},
+		{
+			Name:        "get_messages",
+			Description: "Get the latest messages of a chat, newest first.",
+			InputSchema: mcpSchema([]string{"chat_jid"}, map[string]string{
+				"chat_jid": "string: Chat JID (from list_chats)",
+				"limit":    "integer: Maximum messages to return (default 20, max 200)",
+			}),
+			call: func(ctx context.Context, args json.RawMessage) (string, error) {
+				var req struct {
+					ChatJID string `json:"chat_jid"`
+					Limit   int    `json:"limit"`
+				}
+				if err := json.Unmarshal(args, &req); err != nil {
+					return "", err
+				}
+				if req.ChatJID == "" {
+					return "", fmt.Errorf("chat_jid is required")
+				}
+				if req.Limit <= 0 {
+					req.Limit = 20
+				}
+				messages, err := messageStore.GetMessages(req.ChatJID, min(req.Limit, 200))
+				if err != nil {
+					return "", err
+				}
+				if len(messages) == 0 {
+					return "No messages found", nil
+				}
+				lines := make([]string, 0, len(messages))
+				for _, msg := range messages {
+					sender := msg.Sender
+					if msg.IsFromMe {
+						sender = "me"
+					}
+					line := fmt.Sprintf("[%s] %s (id %s): %s", msg.Time.UTC().Format(time.RFC3339), sender, msg.ID, msg.Content)
+					if msg.MediaType != "" {
+						line += fmt.Sprintf(" [%s %s]", msg.MediaType, msg.Filename)
+					}
+					lines = append(lines, line)
+				}
+				return strings.Join(lines, "\n"), nil
+			},
+		},
+		{
+			Name:        "download_media",
+			Description: "Download the media of a message and return the local file path.",
+			InputSchema: mcpSchema([]string{"message_id", "chat_jid"}, map[string]string{
+				"message_id": "string: Message ID (from get_messages)",
+				"chat_jid":   "string: Chat JID of the message",
+			}),
+			call: func(ctx context.Context, args json.RawMessage) (string, error) {
+				var req struct {
+					MessageID string `json:"message_id"`
+					ChatJID   string `json:"chat_jid"`
+				}
+				if err := json.Unmarshal(args, &req); err != nil {
+					return "", err
+				}
+				if req.MessageID == "" || req.ChatJID == "" {
+					return "", fmt.Errorf("message_id and chat_jid are required")
+				}
+				success, mediaType, filename, path, err := downloadMedia(ctx, client, messageStore, req.MessageID, req.ChatJID, nil)
+				if err != nil {
+					return "", err
+				}
+				if !success {
+					return "", fmt.Errorf("failed to download media")
+				}
+				return fmt.Sprintf("Downloaded %s %s to %s", mediaType, filename, path), nil
+			},
+		},
+	}
+}
+
+// serveMCPStdio runs a Model Context Protocol server over newline-delimited JSON-RPC
+// on in/out until in is closed. Tool calls run concurrently; writes are serialized.
+func serveMCPStdio(client *whatsmeow.Client, messageStore *MessageStore, in io.Reader, out io.Writer) {
+	tools := mcpTools(client, messageStore)
+	var writeMutex sync.Mutex
+	encoder := json.NewEncoder(out)
+	respond := func(id json.RawMessage, result interface{}, rpcErr *mcpError) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		if err := encoder.Encode(mcpResponse{JSONRPC: "2.0", ID: id, Result: result, Error: rpcErr}); err != nil {
+			fmt.Printf("Warning: failed to write MCP response: %v\n", err)
 		}
+	}
 
-		// Filter + sort
-		results := []ContactResponse{}
-		for _, c := range byJID {
-			if q == "" {
-				results = append(results, c)
-				continue
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var req mcpRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			respond(json.RawMessage("null"), nil, &mcpError{Code: mcpParseError, Message: err.Error()})
+			continue
+		}
+		if len(req.ID) == 0 {
+			// Notifications (notifications/initialized, cancellations) need no reply
+			continue
+		}
+
+		switch req.Method {
+		case "initialize":
+			var params struct {
+				ProtocolVersion string `json:"protocolVersion"`
 			}
-			if strings.Contains(strings.ToLower(c.Name), q) {
-				results = append(results, c)
-				continue
+			json.Unmarshal(req.Params, &params)
+			version := mcpProtocolVersion
+			if params.ProtocolVersion != "" && params.ProtocolVersion < mcpProtocolVersion {
+				version = params.ProtocolVersion
 			}
-			if qDigits != "" && strings.HasPrefix(c.Phone, qDigits) {
-				results = append(results, c)
-				continue
+			respond(req.ID, map[string]interface{}{
+				"protocolVersion": version,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]interface{}{"name": "whatsapp-mcp", "version": "1.0.0"},
+			}, nil)
+
+		case "ping":
+			respond(req.ID, map[string]interface{}{}, nil)
+
+		case "tools/list":
+			respond(req.ID, map[string]interface{}{"tools": tools}, nil)
+
+		case "tools/call":
+			var params struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
 			}
-		}
-		sort.Slice(results, func(i, j int) bool {
-			// Named contacts first, then by name (case-insensitive), then by phone
-			ai, aj := results[i].Name != "", results[j].Name != ""
-			if ai != aj {
-				return ai
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				respond(req.ID, nil, &mcpError{Code: mcpInvalidParams, Message: err.Error()})
+				continue
 			}
-			ln := strings.ToLower(results[i].Name)
-			rn := strings.ToLower(results[j].Name)
-			if ln != rn {
-				return ln < rn
+			index := slices.IndexFunc(tools, func(t mcpTool) bool { return t.Name == params.Name })
+			if index < 0 {
+				respond(req.ID, nil, &mcpError{Code: mcpInvalidParams, Message: fmt.Sprintf("unknown tool %q", params.Name)})
+				continue
 			}
-			return results[i].Phone < results[j].Phone
-		})
-		if len(results) > limit {
-			results = results[:limit]
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":  true,
-			"contacts": results,
-			"count":    len(results),
-		})
-	}))
-
-	// Start the server
-	serverAddr := fmt.Sprintf(":%d", port)
-	fmt.Printf("Starting REST API server on %s...\n", serverAddr)
+			go func(id json.RawMessage, tool mcpTool, args json.RawMessage) {
+				// Sends and downloads apply their own MCP_*_TIMEOUT_SEC bounds
+				text, err := tool.call(context.Background(), args)
+				isError := err != nil
+				if isError {
+					text = err.Error()
+				}
+				respond(id, map[string]interface{}{
+					"content": []map[string]interface{}{{"type": "text", "text": text}},
+					"isError": isError,
+				}, nil)
+			}(req.ID, tools[index], params.Arguments)
 
-	// Run server in a goroutine so it doesn't block
-	go func() {
-		if err := http.ListenAndServe(serverAddr, nil); err != nil {
-			fmt.Printf("REST API server error: %v\n", err)
+		default:
+			respond(req.ID, nil, &mcpError{Code: mcpMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)})
 		}
-	}()
-}
-
-// syncWAWebVersion fetches the latest WhatsApp Web client version from Meta
-// and applies it to whatsmeow's client payload. This prevents the server from
-// rejecting connections with code 405 (Client outdated) when the version
-// hardcoded in the pinned whatsmeow module falls behind WhatsApp's live version.
-// On failure, the built-in version is kept and a warning is logged.
-func syncWAWebVersion(logger waLog.Logger) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	oldVer := store.GetWAVersion()
-	latestVer, err := whatsmeow.GetLatestVersion(ctx, nil)
-	if err != nil {
-		logger.Warnf("Failed to fetch latest WhatsApp Web version (using built-in %s): %v", oldVer, err)
-		return
 	}
-	if latestVer == nil || latestVer.IsZero() || *latestVer == oldVer {
-		logger.Infof("WhatsApp Web version is up-to-date: %s", oldVer)
-		return
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("Warning: MCP stdio input failed: %v\n", err)
 	}
-	store.SetWAVersion(*latestVer)
-	logger.Infof("Updated WhatsApp Web client version from %s to %s", oldVer, latestVer)
 }
 
-// updateActivityTime updates the last activity timestamp
-func updateActivityTime() {
-	reconnectState.mutex.Lock()
-	reconnectState.lastActivityTime = time.Now()
-	reconnectState.mutex.Unlock()
-}
+// handleSessionEvent stores what an event tells about one session's chats and messages.
+// Returns false for events it does not handle (connection and pairing state).
+func handleSessionEvent(client *whatsmeow.Client, messageStore *MessageStore, evt interface{}, logger waLog.Logger) bool {
+	switch v := evt.(type) {
+	case *events.Message:
+		// Process regular messages
+		handleMessage(client, messageStore, v, logger)
+
+	case *events.Receipt:
+		// Delivery/read receipts (recorded for replay)
+		handleReceipt(client, messageStore, v, logger)
+
+	case *events.Mute, *events.Pin, *events.Archive, *events.Contact:
+		// Chat organization changed on the phone
+		handleAppStateChange(client, messageStore, v, logger)
+
+	case *events.JoinedGroup:
+		// Group info is available here, so community parents can be classified
+		if v.IsParent {
+			if err := messageStore.SetChatType(v.JID.String(), chatTypeCommunity); err != nil {
+				logger.Warnf("Failed to mark %s as a community: %v", v.JID, err)
+			}
+		}
+		handleGroupMembership(client, messageStore, v, logger)
 
-// calculateBackoffDuration calculates exponential backoff with jitter
-func calculateBackoffDuration(attempt int) time.Duration {
-	// Base: 1s, 2s, 4s, 8s, 16s, 32s, 60s (max)
-	maxDuration := 60 * time.Second
-	baseDuration := time.Duration(1<<uint(attempt)) * time.Second
+	case *events.GroupInfo:
+		// Membership changes; only our own are reported
+		handleGroupMembership(client, messageStore, v, logger)
 
-	if baseDuration > maxDuration {
-		baseDuration = maxDuration
-	}
+	case *events.NewsletterLiveUpdate:
+		// View and reaction counts of channel posts changed
+		if err := messageStore.StoreNewsletterPosts(client, v.JID.String(), v.Messages); err != nil {
+			logger.Warnf("Failed to store channel analytics for %s: %v", v.JID, err)
+		}
 
-	// Add jitter (±25%)
-	jitter := time.Duration(rand.Int63n(int64(baseDuration) / 2))
-	return baseDuration + jitter
-}
+	case *events.Picture:
+		// Contact or group picture changed
+		handlePictureEvent(client, messageStore, v, logger)
 
-// attemptReconnect handles reconnection with exponential backoff
-func attemptReconnect(client *whatsmeow.Client, logger waLog.Logger) bool {
-	reconnectState.mutex.Lock()
+	case *events.UndecryptableMessage:
+		// Record a visible gap until the retried message arrives
+		handleUndecryptableMessage(client, messageStore, v, logger)
 
-	// Check if we've exceeded max attempts
-	if reconnectState.reconnectAttempts >= reconnectState.maxReconnectAttempts {
-		logger.Errorf("Maximum reconnection attempts (%d) reached. Manual re-authentication required.", reconnectState.maxReconnectAttempts)
-		reconnectState.needsReauth = true
-		reconnectState.isReconnecting = false
-		reconnectState.mutex.Unlock()
+	case *events.HistorySync:
+		// Process history sync events
+		handleHistorySync(client, messageStore, v, logger)
+
+	default:
 		return false
 	}
+	return true
+}
 
-	// Check if we should throttle reconnection attempts
-	timeSinceLastAttempt := time.Since(reconnectState.lastReconnectTime)
-	requiredBackoff := calculateBackoffDuration(reconnectState.reconnectAttempts)
-
-	if timeSinceLastAttempt < requiredBackoff {
-		reconnectState.mutex.Unlock()
-		return false // Too soon to retry
-	}
+// Log privacy modes (MCP_LOG_PRIVACY): phone numbers and JIDs are rewritten in every log line,
+// message content and contact names at the call sites that log them (see redactLogContent)
+const (
+	logPrivacyOff      = "off"
+	logPrivacyHash     = "hash"     // Keyed hashes, so one number always maps to the same token
+	logPrivacyTruncate = "truncate" // Last 4 digits of numbers, first characters of content
+)
 
-	reconnectState.reconnectAttempts++
-	reconnectState.lastReconnectTime = time.Now()
-	reconnectState.isReconnecting = true
-	attempt := reconnectState.reconnectAttempts
-	reconnectState.mutex.Unlock()
+var logPrivacy = logPrivacyOff
 
-	logger.Infof("Attempting reconnection (attempt %d/%d) after %v backoff...",
-		attempt, reconnectState.maxReconnectAttempts, requiredBackoff)
+// logRedactionKey keys the hashes (MCP_LOG_REDACTION_KEY; random per process when unset)
+var logRedactionKey []byte
 
-	// Attempt to reconnect
-	err := client.Connect()
-	if err != nil {
-		logger.Errorf("Reconnection attempt %d failed: %v", attempt, err)
-		reconnectState.mutex.Lock()
-		reconnectState.isReconnecting = false
-		reconnectState.mutex.Unlock()
-		return false
-	}
+// JIDs (user part only; the server stays readable) and bare phone numbers. Letters next to the
+// digits keep message and job IDs out of it, so correlation IDs survive.
+var logIdentifierPattern = regexp.MustCompile(`\b(\d[\d-]{4,19})((?::\d+)?@(?:s\.whatsapp\.net|lid|g\.us|c\.us|newsletter|broadcast|hosted|hosted\.lid))|\+?\b\d{7,15}\b`)
 
-	// Wait a moment to verify connection
-	time.Sleep(2 * time.Second)
+func logHash(value string) string {
+	mac := hmac.New(sha256.New, logRedactionKey)
+	mac.Write([]byte(value))
+	return "#" + hex.EncodeToString(mac.Sum(nil))[:10]
+}
 
-	if client.IsConnected() && client.IsLoggedIn() {
-		logger.Infof("✅ Reconnection successful on attempt %d", attempt)
-		reconnectState.mutex.Lock()
-		reconnectState.reconnectAttempts = 0
-		reconnectState.isReconnecting = false
-		reconnectState.needsReauth = false
-		reconnectState.mutex.Unlock()
-		updateActivityTime()
-		return true
+// redactLogIdentifier hides a phone number or JID user part according to logPrivacy
+func redactLogIdentifier(digits string) string {
+	if logPrivacy == logPrivacyHash {
+		return logHash(digits)
 	}
-
-	logger.Warnf("Reconnection attempt %d: connected but not authenticated", attempt)
-	reconnectState.mutex.Lock()
-	reconnectState.isReconnecting = false
-	reconnectState.mutex.Unlock()
-	return false
+	if len(digits) <= 4 {
+		return "***"
+	}
+	return "***" + digits[len(digits)-4:]
 }
 
-func scheduleReconnectLoop(client *whatsmeow.Client, logger waLog.Logger, initialDelay time.Duration, reason string) {
-	go func() {
-		reconnectState.mutex.Lock()
-		if reconnectState.reconnectLoopActive || reconnectState.needsReauth {
-			reconnectState.mutex.Unlock()
-			return
+// redactLogLine rewrites the phone numbers and JIDs in one line of log output
+func redactLogLine(line string) string {
+	return logIdentifierPattern.ReplaceAllStringFunc(line, func(match string) string {
+		if at := strings.IndexAny(match, ":@"); at > 0 && strings.Contains(match, "@") {
+			return redactLogIdentifier(match[:at]) + match[at:]
 		}
-		reconnectState.reconnectLoopActive = true
-		reconnectState.mutex.Unlock()
-		defer func() {
-			reconnectState.mutex.Lock()
-			reconnectState.reconnectLoopActive = false
-			reconnectState.mutex.Unlock()
-		}()
+		return redactLogIdentifier(strings.TrimPrefix(match, "+"))
+	})
+}
 
-		if initialDelay > 0 {
-			time.Sleep(initialDelay)
+// redactLogContent hides free text (message content, contact names) in privacy mode
+func redactLogContent(text string) string {
+	switch logPrivacy {
+	case logPrivacyHash:
+		if text == "" {
+			return ""
 		}
-
-		for {
-			if client.IsConnected() && client.IsLoggedIn() {
-				return
-			}
-
-			reconnectState.mutex.RLock()
-			needsReauth := reconnectState.needsReauth
-			attempts := reconnectState.reconnectAttempts
-			maxAttempts := reconnectState.maxReconnectAttempts
-			reconnectState.mutex.RUnlock()
-
-			if needsReauth || attempts >= maxAttempts {
-				return
-			}
-
-			if attemptReconnect(client, logger) {
-				return
-			}
-
-			reconnectState.mutex.RLock()
-			needsReauth = reconnectState.needsReauth
-			attempts = reconnectState.reconnectAttempts
-			reconnectState.mutex.RUnlock()
-
-			if needsReauth || attempts >= maxAttempts {
-				return
-			}
-
-			wait := calculateBackoffDuration(attempts)
-			logger.Warnf("Reconnect loop (%s) still recovering; retrying in %v", reason, wait)
-			time.Sleep(wait)
+		return fmt.Sprintf("[%d chars %s]", utf8.RuneCountInString(text), logHash(text))
+	case logPrivacyTruncate:
+		if runes := []rune(text); len(runes) > 10 {
+			return string(runes[:10]) + "…"
 		}
-	}()
+	}
+	return text
 }
 
-// startKeepalive sends periodic presence updates to maintain session
-func startKeepalive(client *whatsmeow.Client, logger waLog.Logger, stopChan <-chan struct{}) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			if client.IsConnected() && client.IsLoggedIn() {
-				// Send presence available to keep session alive
-				err := client.SendPresence(context.Background(), types.PresenceAvailable)
-				if err != nil {
-					logger.Warnf("Failed to send keepalive presence: %v", err)
-				} else {
-					logger.Debugf("Keepalive sent successfully")
-					updateActivityTime()
-				}
-			}
-		case <-stopChan:
-			logger.Infof("Keepalive goroutine stopped")
-			return
+// startLogRedaction routes everything written to os.Stdout through redactLogLine.
+// The returned function flushes what is still buffered.
+func startLogRedaction() func() {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		fmt.Printf("Warning: log redaction unavailable: %v\n", err)
+		return func() {}
+	}
+	out := os.Stdout
+	os.Stdout = writer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			fmt.Fprintln(out, redactLogLine(scanner.Text()))
 		}
+	}()
+	return func() {
+		os.Stdout = out
+		writer.Close()
+		<-done
 	}
 }
 
 func main() {
+	startedAt := time.Now()
+
 	// Parse command-line flags
 	var port int
 	flag.IntVar(&port, "port", 8080, "Port for REST API server (default: 8080)")
+	var mcpStdio bool
+	flag.BoolVar(&mcpStdio, "mcp-stdio", false, "Also serve the Model Context Protocol over stdin/stdout")
+	if dir := strings.TrimSpace(os.Getenv("MCP_STORE_DIR")); dir != "" {
+		storeDir = dir
+	}
+	flag.StringVar(&storeDir, "store-dir", storeDir, "Directory for session databases and media (default: MCP_STORE_DIR or ./store)")
+	var decryptPath string
+	flag.StringVar(&decryptPath, "decrypt-export", "", "Decrypt an encrypted /api/export bundle to stdout (passphrase from MCP_EXPORT_PASSPHRASE) and exit")
+	var loadDataDir string
+	loadData := LoadDataConfig{}
+	flag.StringVar(&loadDataDir, "generate-load-data", "", "Write a synthetic message store to this directory for load testing (serve it with -store-dir) and exit")
+	flag.IntVar(&loadData.Chats, "load-chats", 200, "Chats to generate with -generate-load-data")
+	flag.IntVar(&loadData.Messages, "load-messages", 100000, "Messages to generate with -generate-load-data")
+	flag.Int64Var(&loadData.Seed, "load-seed", 1, "Random seed for -generate-load-data (same seed, same data)")
+	flag.IntVar(&loadData.Days, "load-days", 90, "Days of history -generate-load-data spreads messages over")
 	flag.Parse()
 
+	if loadDataDir != "" {
+		report, err := generateLoadData(loadDataDir, loadData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate load data: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Generated %d messages (%d with media) in %d chats (%d groups) in %s: %.0f messages/sec\n",
+			report.Messages, report.MediaMessages, report.Chats, report.Groups, report.WriteDuration.Round(time.Millisecond),
+			float64(report.Messages)/report.WriteDuration.Seconds())
+		for _, search := range report.Searches {
+			fmt.Printf("Search %q: %s\n", search.Query, search.Duration.Round(time.Microsecond))
+		}
+		return
+	}
+
+	if decryptPath != "" {
+		file, err := os.Open(decryptPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open export: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out := bufio.NewWriter(os.Stdout)
+		if err := decryptExport(file, out, os.Getenv("MCP_EXPORT_PASSPHRASE")); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to decrypt export: %v\n", err)
+			os.Exit(1)
+		}
+		if err := out.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write export: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// In MCP stdio mode stdout carries the protocol, so all logging moves to stderr
+	mcpOut := os.Stdout
+	if mcpStdio {
+		os.Stdout = os.Stderr
+	}
+
+	// Keep phone numbers, JIDs and message content out of shipped logs (MCP_LOG_PRIVACY)
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("MCP_LOG_PRIVACY"))); mode {
+	case "", logPrivacyOff:
+	case logPrivacyHash, logPrivacyTruncate:
+		logPrivacy = mode
+		if key := os.Getenv("MCP_LOG_REDACTION_KEY"); key != "" {
+			logRedactionKey = []byte(key)
+		} else {
+			logRedactionKey = []byte(newRandomID(32))
+		}
+		stopRedaction := startLogRedaction()
+		onShutdown("log redaction", func(ctx context.Context) error {
+			stopRedaction()
+			return nil
+		})
+		fmt.Printf("🕶️ Log privacy mode: %s\n", logPrivacy)
+	default:
+		fmt.Printf("Warning: unknown MCP_LOG_PRIVACY %q, logging unredacted\n", mode)
+	}
+
 	// Set up logger
 	logger := waLog.Stdout("Client", "INFO", true)
 	logger.Infof("Starting WhatsApp client...")
@@ -2315,15 +20036,19 @@ func main() {
 	dbLog := waLog.Stdout("Database", "INFO", true)
 
 	// Create directory for database if it doesn't exist
-	if err := os.MkdirAll("store", 0755); err != nil {
+	if port < 1 || port > 65535 {
+		logger.Errorf("Invalid -port %d", port)
+		shutdown(exitConfigInvalid, "invalid port")
+	}
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
 		logger.Errorf("Failed to create store directory: %v", err)
-		return
+		shutdown(exitConfigInvalid, "store directory unavailable")
 	}
 
-	container, err := sqlstore.New(context.Background(), "sqlite3", "file:store/whatsapp.db?_foreign_keys=on", dbLog)
+	container, err := sqlstore.New(context.Background(), "sqlite3", sqliteURI(filepath.Join(storeDir, "whatsapp.db"))+"?_foreign_keys=on", dbLog)
 	if err != nil {
 		logger.Errorf("Failed to connect to database: %v", err)
-		return
+		shutdown(exitCodeForStoreError(err), "device store unavailable")
 	}
 
 	// Get device store - This contains session information
@@ -2335,79 +20060,324 @@ func main() {
 			logger.Infof("Created new device")
 		} else {
 			logger.Errorf("Failed to get device: %v", err)
-			return
+			shutdown(exitCodeForStoreError(err), "device store unreadable")
+		}
+	}
+
+	// Sync WhatsApp Web client version with Meta before creating the client.
+	// Fixes 405 "Client outdated" errors when the pinned whatsmeow version falls behind.
+	syncWAWebVersion(logger)
+
+	// Create client instance
+	client := whatsmeow.NewClient(deviceStore, logger)
+	if client == nil {
+		logger.Errorf("Failed to create WhatsApp client")
+		shutdown(exitError, "client creation failed")
+	}
+
+	// Disable whatsmeow's internal auto-reconnect — we manage reconnects ourselves
+	// via attemptReconnect(). Leaving both active causes "websocket is already
+	// connected" races between the lib's reconnector and our goroutine.
+	client.EnableAutoReconnect = false
+
+	// If a sender's retransmission doesn't arrive, ask our phone for undecryptable messages
+	client.AutomaticMessageRerequestFromPhone = true
+
+	// Initialize message store
+	messageStore, err := NewMessageStore(storeDir)
+	if err != nil {
+		logger.Errorf("Failed to initialize message store: %v", err)
+		shutdown(exitCodeForStoreError(err), "message store unavailable")
+	}
+
+	// Start WAL checkpoint daemon for Docker filesystem sync
+	// This ensures messages are synced to disk even when Docker Desktop gRPC-FUSE has issues
+	checkpointStopChan := make(chan struct{})
+	messageStore.StartCheckpointDaemon(checkpointStopChan)
+
+	// Last to run: stop background workers, commit queued writes and leave a checkpointed database
+	onShutdown("message store", func(ctx context.Context) error {
+		close(checkpointStopChan)
+		if err := messageStore.FlushWrites(); err != nil {
+			fmt.Printf("Warning: failed to commit queued writes: %v\n", err)
+		}
+		if _, err := messageStore.writer.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			fmt.Printf("Warning: final WAL checkpoint failed: %v\n", err)
+		}
+		return messageStore.Close()
+	})
+
+	// Per-endpoint timeouts (MCP_*_TIMEOUT_SEC)
+	endpointTimeouts = loadEndpointTimeouts()
+
+	// Remove expired chunked upload sessions
+	messageStore.StartUploadJanitor(checkpointStopChan)
+
+	// Keep the replay event log bounded
+	messageStore.StartEventPruner(checkpointStopChan)
+
+	// Start bounded media download worker pool
+	downloadPool = NewDownloadWorkerPool(getEnvInt("MCP_DOWNLOAD_WORKERS", 3), getEnvInt("MCP_DOWNLOAD_QUEUE_SIZE", 500))
+	downloadPool.Start(client, messageStore, checkpointStopChan)
+
+	// Anti-ban send budget (MCP_SEND_RATE_LIMIT sends per minute)
+	sendBudget.limit = getEnvInt("MCP_SEND_RATE_LIMIT", 0)
+	if sendBudget.limit > 0 {
+		fmt.Printf("🚦 Send budget: %d per minute\n", sendBudget.limit)
+	}
+
+	// Duplicate outbound suppression (MCP_DUPLICATE_WINDOW_SEC, MCP_DUPLICATE_MODE)
+	duplicateGuard = loadDuplicateGuard()
+	if duplicateGuard.window > 0 {
+		fmt.Printf("🔁 Duplicate suppression enabled (%s window, mode=%s)\n", duplicateGuard.window, duplicateGuard.mode)
+	}
+
+	// Auto-download inbound attachments (MCP_AUTO_DOWNLOAD_TYPES)
+	mediaPolicy = loadMediaPolicy()
+	autoDownloadConfig = loadAutoDownloadConfig()
+	if autoDownloadConfig.Enabled() {
+		fmt.Println("📥 Auto-download enabled for inbound media")
+	}
+
+	// Check numbers on incoming contact cards (MCP_VCARD_CHECK_NUMBERS)
+	vcardCheckNumbers = getEnvBool("MCP_VCARD_CHECK_NUMBERS", false)
+
+	// Keep raw message protos for re-parsing (MCP_STORE_RAW_MESSAGES)
+	storeRawMessages = getEnvBool("MCP_STORE_RAW_MESSAGES", false)
+
+	// Last locale in every template fallback chain (MCP_DEFAULT_LOCALE)
+	if locale := normalizeLocale(os.Getenv("MCP_DEFAULT_LOCALE")); locale != "" {
+		defaultLocale = locale
+	}
+
+	// What contacts see as our availability (MCP_PRESENCE_POLICY)
+	if policy := strings.ToLower(strings.TrimSpace(os.Getenv("MCP_PRESENCE_POLICY"))); policy != "" {
+		if slices.Contains(presencePolicies, policy) {
+			presenceManager.SetPolicy(policy)
+		} else {
+			fmt.Printf("Warning: unknown MCP_PRESENCE_POLICY %q, using %s\n", policy, presenceAlwaysOnline)
+		}
+	}
+	fmt.Printf("🟢 Presence policy: %s\n", presenceManager.Policy())
+	autoMarkRead = getEnvBool("MCP_AUTO_MARK_READ", false)
+	sandboxMode = getEnvBool("MCP_SANDBOX_MODE", false)
+	if sandboxMode {
+		fmt.Println("🧪 Sandbox mode: /api/test/inject-message is enabled")
+	}
+	piiMasking = getEnvBool("MCP_PII_MASKING", false)
+	autoTypingDelay = time.Duration(max(getEnvInt("MCP_AUTO_TYPING_MS", 0), 0)) * time.Millisecond
+
+	// Webhook retry schedule before deliveries are dead-lettered
+	webhookRetry.MaxAttempts = max(getEnvInt("MCP_WEBHOOK_MAX_ATTEMPTS", webhookRetry.MaxAttempts), 1)
+	webhookRetry.BaseDelay = time.Duration(max(getEnvInt("MCP_WEBHOOK_RETRY_BASE_SEC", int(webhookRetry.BaseDelay/time.Second)), 1)) * time.Second
+
+	// Outbox retry schedule before queued sends fail
+	outboxRetry.MaxAttempts = max(getEnvInt("MCP_OUTBOX_MAX_ATTEMPTS", outboxRetry.MaxAttempts), 1)
+	outboxRetry.BaseDelay = time.Duration(max(getEnvInt("MCP_OUTBOX_RETRY_BASE_SEC", int(outboxRetry.BaseDelay/time.Second)), 1)) * time.Second
+
+	// Webhook targets allowed on private addresses (MCP_WEBHOOK_ALLOWED_HOSTS)
+	for _, host := range strings.Split(os.Getenv("MCP_WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			webhookAllowedHosts[host] = true
+		}
+	}
+
+	// Where undeliverable sends are rerouted (MCP_FALLBACK_WEBHOOK_URL)
+	if fallbackURL := strings.TrimSpace(os.Getenv("MCP_FALLBACK_WEBHOOK_URL")); fallbackURL != "" {
+		fallbackWebhook = &Webhook{
+			ID:     fallbackWebhookID,
+			URL:    fallbackURL,
+			Secret: os.Getenv("MCP_FALLBACK_WEBHOOK_SECRET"),
+		}
+		if parsed, err := url.Parse(fallbackURL); err == nil {
+			webhookAllowedHosts[strings.ToLower(parsed.Hostname())] = true
+		}
+		fmt.Printf("↪️ Undeliverable sends are rerouted to %s\n", fallbackURL)
+	}
+
+	// Country assumed for national numbers (MCP_DEFAULT_COUNTRY_CODE)
+	if code := strings.TrimPrefix(strings.TrimSpace(os.Getenv("MCP_DEFAULT_COUNTRY_CODE")), "+"); code != "" {
+		if !isCountryCallingCode(code) {
+			fmt.Printf("Warning: ignoring MCP_DEFAULT_COUNTRY_CODE %q: not a country calling code\n", code)
+		} else {
+			defaultCountryCode = code
+			fmt.Printf("☎️ National phone numbers are taken as +%s\n", code)
+		}
+	}
+
+	// Opt-out keywords (MCP_OPT_OUT_KEYWORDS)
+	keywords, set := os.LookupEnv("MCP_OPT_OUT_KEYWORDS")
+	if !set {
+		keywords = defaultOptOutKeywords
+	}
+	for _, keyword := range strings.Split(keywords, ",") {
+		if keyword = strings.ToUpper(strings.TrimSpace(keyword)); keyword != "" {
+			optOutKeywords[keyword] = true
+		}
+	}
+
+	// Rules that queue inbound messages for review (MCP_FLAG_RULES)
+	if raw := strings.TrimSpace(os.Getenv("MCP_FLAG_RULES")); raw != "" {
+		rules, err := parseFlagRules(raw)
+		if err != nil {
+			logger.Errorf("%v", err)
+			shutdown(exitConfigInvalid, "invalid flag rules")
+		}
+		flagRules = rules
+		fmt.Printf("🚩 %d message flag rules loaded\n", len(flagRules))
+	}
+
+	// Limits for media sent inline or by URL (MCP_INLINE_MEDIA_MAX_MB, MCP_MEDIA_URL_ALLOWED_HOSTS)
+	inlineMediaMaxBytes = int64(max(getEnvInt("MCP_INLINE_MEDIA_MAX_MB", int(inlineMediaMaxBytes>>20)), 1)) << 20
+	for _, host := range strings.Split(os.Getenv("MCP_MEDIA_URL_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			mediaURLAllowedHosts[host] = true
+		}
+	}
+
+	// Push event invites to a CalDAV calendar (MCP_CALDAV_*)
+	calendarSync = CalendarSync{
+		URL:         strings.TrimSpace(os.Getenv("MCP_CALDAV_URL")),
+		Username:    os.Getenv("MCP_CALDAV_USERNAME"),
+		Password:    os.Getenv("MCP_CALDAV_PASSWORD"),
+		BearerToken: os.Getenv("MCP_CALDAV_BEARER_TOKEN"),
+	}
+	if calendarSync.URL != "" {
+		parsed, err := url.Parse(calendarSync.URL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			logger.Errorf("MCP_CALDAV_URL must be an http(s) URL")
+			shutdown(exitConfigInvalid, "invalid calendar URL")
+		}
+		fmt.Printf("📅 Event invites are pushed to a calendar on %s\n", parsed.Host)
+	}
+
+	// Forward matching inbound messages to email (MCP_EMAIL_BRIDGE_RULES, MCP_SMTP_*)
+	if raw := strings.TrimSpace(os.Getenv("MCP_EMAIL_BRIDGE_RULES")); raw != "" {
+		emailBridge.smtp = SMTPConfig{
+			Host:     os.Getenv("MCP_SMTP_HOST"),
+			Port:     getEnvInt("MCP_SMTP_PORT", 587),
+			Username: os.Getenv("MCP_SMTP_USERNAME"),
+			Password: os.Getenv("MCP_SMTP_PASSWORD"),
+			From:     os.Getenv("MCP_SMTP_FROM"),
+		}
+		for _, address := range strings.Split(os.Getenv("MCP_SMTP_TO"), ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				emailBridge.smtp.To = append(emailBridge.smtp.To, address)
+			}
+		}
+		rules, err := parseEmailBridgeRules(raw, emailBridge.smtp)
+		if err != nil {
+			logger.Errorf("%v", err)
+			shutdown(exitConfigInvalid, "invalid email bridge configuration")
 		}
+		emailBridge.rules = rules
+		emailBridge.maxAttachment = int64(max(getEnvInt("MCP_EMAIL_MAX_ATTACHMENT_MB", 20), 1)) << 20
+		fmt.Printf("📧 Email bridge: %d rules via %s:%d\n", len(rules), emailBridge.smtp.Host, emailBridge.smtp.Port)
 	}
 
-	// Sync WhatsApp Web client version with Meta before creating the client.
-	// Fixes 405 "Client outdated" errors when the pinned whatsmeow version falls behind.
-	syncWAWebVersion(logger)
-
-	// Create client instance
-	client := whatsmeow.NewClient(deviceStore, logger)
-	if client == nil {
-		logger.Errorf("Failed to create WhatsApp client")
-		return
+	// Introduce the account in groups it is added to (MCP_GROUP_INTRO_MESSAGE)
+	groupIntroMessage = strings.TrimSpace(os.Getenv("MCP_GROUP_INTRO_MESSAGE"))
+	groupIntroFetchInfo = getEnvBool("MCP_GROUP_INTRO_FETCH_INFO", false)
+	if groupIntroMessage != "" {
+		fmt.Println("👋 Introduction message enabled for new groups")
 	}
 
-	// Disable whatsmeow's internal auto-reconnect — we manage reconnects ourselves
-	// via attemptReconnect(). Leaving both active causes "websocket is already
-	// connected" races between the lib's reconnector and our goroutine.
-	client.EnableAutoReconnect = false
+	// Exit instead of waiting for re-pairing or a ban to lift, so a supervisor can alert (MCP_EXIT_ON_LOGOUT, MCP_EXIT_ON_BAN)
+	exitOnLogout := getEnvBool("MCP_EXIT_ON_LOGOUT", false)
+	exitOnBan := getEnvBool("MCP_EXIT_ON_BAN", false)
 
-	// Initialize message store
-	messageStore, err := NewMessageStore()
-	if err != nil {
-		logger.Errorf("Failed to initialize message store: %v", err)
-		return
+	// Greet first-time contacts (MCP_WELCOME_MESSAGE)
+	welcomeMessage = strings.TrimSpace(os.Getenv("MCP_WELCOME_MESSAGE"))
+	if welcomeMessage != "" {
+		fmt.Println("👋 Welcome message enabled for first-time contacts")
 	}
-	defer messageStore.Close()
 
-	// Start WAL checkpoint daemon for Docker filesystem sync
-	// This ensures messages are synced to disk even when Docker Desktop gRPC-FUSE has issues
-	checkpointStopChan := make(chan struct{})
-	defer close(checkpointStopChan)
-	messageStore.StartCheckpointDaemon(checkpointStopChan)
+	// Session state starts UNPAIRED without stored credentials, DEGRADED until the first connect otherwise;
+	// every transition is published as a session_state event
+	reconnectState.mutex.Lock()
+	if client.Store.ID != nil {
+		reconnectState.state = SessionDegraded
+		reconnectState.stateReason = "starting"
+	}
+	reconnectState.stateChangedAt = time.Now()
+	reconnectState.onTransition = func(from, to SessionState, reason string) {
+		go dispatchEventWebhooks(messageStore, "session_state", map[string]interface{}{
+			"from":   from,
+			"to":     to,
+			"reason": reason,
+		})
+		switch {
+		case to == SessionLoggedOut && exitOnLogout:
+			go shutdown(exitAuthRequired, reason)
+		case to == SessionBanned && exitOnBan:
+			go shutdown(exitBanned, reason)
+		}
+	}
+	reconnectState.mutex.Unlock()
 
 	// Setup event handling for messages and history sync
 	client.AddEventHandler(func(evt interface{}) {
-		switch v := evt.(type) {
-		case *events.Message:
-			// Process regular messages
-			handleMessage(client, messageStore, v, logger)
-			updateActivityTime()
+		// Connection changes go to the durable event log for replay
+		if state, details := connectionEventState(evt); state != "" {
+			payload := map[string]interface{}{"state": state}
+			for k, v := range details {
+				payload[k] = v
+			}
+			recordEvent(messageStore, "connection", payload)
+		}
 
-		case *events.HistorySync:
-			// Process history sync events
-			handleHistorySync(client, messageStore, v, logger)
-			updateActivityTime()
+		// Messages, receipts and chat metadata
+		if handleSessionEvent(client, messageStore, evt, logger) {
+			switch evt.(type) {
+			case *events.Message, *events.HistorySync:
+				updateActivityTime()
+			}
+			return
+		}
 
+		switch v := evt.(type) {
 		case *events.Connected:
 			logger.Infof("✅ Connected to WhatsApp")
+			offlineSyncState.reset()
 			reconnectState.mutex.Lock()
 			reconnectState.reconnectAttempts = 0
-			reconnectState.needsReauth = false
 			if reconnectState.sessionStartTime.IsZero() {
 				reconnectState.sessionStartTime = time.Now()
 			}
 			reconnectState.mutex.Unlock()
+			reconnectState.transition(SessionConnected, "connected")
 			updateActivityTime()
+			// Announce presence right away so invisible sessions never show as online
+			go func() {
+				if err := presenceManager.Apply(client); err != nil {
+					logger.Warnf("Failed to announce presence: %v", err)
+				}
+			}()
+
+		case *events.OfflineSyncPreview:
+			logger.Infof("📬 Offline sync starting: %d events (%d messages, %d receipts, %d notifications)",
+				v.Total, v.Messages, v.Receipts, v.Notifications)
+			offlineSyncState.setPreview(*v)
+
+		case *events.OfflineSyncCompleted:
+			logger.Infof("📬 Offline sync completed: %d events delivered", v.Count)
+			offlineSyncState.complete(v.Count)
+			go dispatchEventWebhooks(messageStore, "offline_sync_completed", offlineSyncState.snapshot())
 
 		case *events.Disconnected:
 			logger.Warnf("⚠️  Disconnected from WhatsApp")
+			reconnectState.transition(SessionDegraded, "disconnected")
 			scheduleReconnectLoop(client, logger, 2*time.Second, "disconnect")
 
 		case *events.LoggedOut:
 			logger.Errorf("❌ Device logged out from WhatsApp (user unlinked from phone)")
 			reconnectState.mutex.Lock()
-			reconnectState.needsReauth = true
 			reconnectState.reconnectAttempts = 0
 			reconnectState.mutex.Unlock()
+			reconnectState.transition(SessionLoggedOut, "logged_out: "+v.Reason.String())
 
 			// Clear QR code to force regeneration
-			qrCodeMutex.Lock()
-			currentQRCode = ""
-			qrCodeMutex.Unlock()
+			clearQRCode()
 
 			// Trigger QR regeneration by deleting device and reconnecting
 			// This is required because client.Store.ID remains set after logout
@@ -2424,9 +20394,10 @@ func main() {
 				logger.Infof("Deleting device from store to allow re-pairing...")
 				if err := client.Store.Delete(context.Background()); err != nil {
 					logger.Errorf("Failed to delete device from store: %v", err)
-					// Continue anyway - the needsReauth flag will prevent false positives
+					// Continue anyway - the LOGGED_OUT state will prevent false positives
 				} else {
 					logger.Infof("Device deleted from store successfully")
+					reconnectState.transition(SessionUnpaired, "device_deleted")
 				}
 
 				// Get a new QR channel and connect
@@ -2443,35 +20414,49 @@ func main() {
 				// Process QR events
 				for evt := range qrChan {
 					if evt.Event == "code" {
-						qrPNG, err := qrcode.Encode(evt.Code, qrcode.Medium, 256)
-						if err == nil {
-							qrCodeMutex.Lock()
-							currentQRCode = base64.StdEncoding.EncodeToString(qrPNG)
-							qrCodeMutex.Unlock()
+						if err := storeQRCode(evt.Code, evt.Timeout); err == nil {
+							reconnectState.transition(SessionPairing, "qr_code_issued")
+							publishQRGenerated(messageStore, evt.Code, evt.Timeout)
 							logger.Infof("✅ New QR code generated after logout")
 						}
 					} else if evt.Event == "success" {
 						// User scanned the new QR code
-						qrCodeMutex.Lock()
-						currentQRCode = ""
-						qrCodeMutex.Unlock()
-						reconnectState.mutex.Lock()
-						reconnectState.needsReauth = false
-						reconnectState.mutex.Unlock()
+						clearQRCode()
+						reconnectState.transition(SessionConnected, "paired")
 						logger.Infof("✅ Successfully re-authenticated after logout")
 						break
+					} else if evt.Event == "timeout" {
+						clearQRCode()
+						go dispatchEventWebhooks(messageStore, "pairing_timeout", map[string]interface{}{"reason": "qr_codes_exhausted"})
+						logger.Warnf("QR codes after logout expired without a scan")
 					}
 				}
 			}()
 
+		case *events.PairSuccess:
+			logger.Infof("🔗 Paired as %s (%s)", v.ID, v.Platform)
+			phonePairing.clear()
+			go dispatchEventWebhooks(messageStore, "pairing_success", map[string]interface{}{
+				"jid":           v.ID.String(),
+				"lid":           v.LID.String(),
+				"platform":      v.Platform,
+				"business_name": v.BusinessName,
+			})
+
+		case *events.PairError:
+			logger.Errorf("❌ Pairing failed: %v", v.Error)
+			go dispatchEventWebhooks(messageStore, "pairing_error", map[string]interface{}{
+				"jid":   v.ID.String(),
+				"error": v.Error.Error(),
+			})
+
 		case *events.StreamReplaced:
 			logger.Warnf("⚠️  Stream replaced - another device logged in with same session")
-			reconnectState.mutex.Lock()
-			reconnectState.needsReauth = true
-			reconnectState.mutex.Unlock()
+			reconnectState.transition(SessionLoggedOut, "stream_replaced")
 
 		case *events.StreamError:
 			logger.Errorf("❌ Stream error: %v", v)
+			reconnectState.transition(SessionDegraded, "stream_error")
 			scheduleReconnectLoop(client, logger, 5*time.Second, "stream_error")
 
 		case *events.TemporaryBan:
@@ -2479,6 +20464,7 @@ func main() {
 			reconnectState.mutex.Lock()
 			reconnectState.reconnectAttempts = reconnectState.maxReconnectAttempts // Stop trying
 			reconnectState.mutex.Unlock()
+			reconnectState.transition(SessionBanned, "temporary_ban: "+v.Code.String())
 
 		case *events.ClientOutdated:
 			// WhatsApp rejected this client with 405 because the advertised web
@@ -2487,13 +20473,13 @@ func main() {
 			// needs to be bumped (protocol/protobuf changes may be required).
 			logger.Errorf("❌ ClientOutdated (405) from WhatsApp — re-syncing version and reconnecting")
 			syncWAWebVersion(logger)
+			reconnectState.transition(SessionDegraded, "client_outdated")
 			scheduleReconnectLoop(client, logger, 2*time.Second, "client_outdated")
 		}
 	})
 
 	// Create channels for keepalive management
 	keepaliveStopChan := make(chan struct{})
-	defer close(keepaliveStopChan)
 
 	// Create channel to track connection success
 	connected := make(chan bool, 1)
@@ -2502,6 +20488,45 @@ func main() {
 	startRESTServer(client, messageStore, port)
 	fmt.Println("REST server started on port", port)
 
+	// Additional accounts hosted by this process (added via /api/accounts)
+	accounts.LoadAll(messageStore)
+	onShutdown("accounts", func(ctx context.Context) error {
+		accounts.CloseAll()
+		return nil
+	})
+	onShutdown("whatsapp client", func(ctx context.Context) error {
+		close(keepaliveStopChan)
+		client.Disconnect()
+		return nil
+	})
+
+	// First to run: refuse new sends, announce the shutdown and let in-flight work finish
+	onShutdown("drain", func(ctx context.Context) error {
+		return announceShutdown(ctx, messageStore)
+	})
+
+	// MCP clients talk to us over stdio; closing stdin shuts the server down
+	stdioClosed := make(chan struct{})
+	if mcpStdio {
+		go func() {
+			serveMCPStdio(client, messageStore, os.Stdin, mcpOut)
+			close(stdioClosed)
+		}()
+		fmt.Println("MCP stdio server started")
+	}
+
+	// Wait for termination signal (or the MCP client going away), also while still pairing
+	exitChan := make(chan os.Signal, 1)
+	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-exitChan:
+			shutdown(exitOK, "signal: "+sig.String())
+		case <-stdioClosed:
+			shutdown(exitOK, "mcp stdio closed")
+		}
+	}()
+
 	// Connect to WhatsApp
 	if client.Store.ID == nil {
 		// No ID stored, this is a new client, need to pair with phone
@@ -2528,24 +20553,21 @@ func main() {
 						qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
 
 						// Store QR code as base64 PNG for API access
-						qrPNG, err := qrcode.Encode(evt.Code, qrcode.Medium, 256)
-						if err == nil {
-							qrCodeMutex.Lock()
-							currentQRCode = base64.StdEncoding.EncodeToString(qrPNG)
-							qrCodeMutex.Unlock()
+						if err := storeQRCode(evt.Code, evt.Timeout); err == nil {
+							reconnectState.transition(SessionPairing, "qr_code_issued")
+							publishQRGenerated(messageStore, evt.Code, evt.Timeout)
 							logger.Infof("QR code updated (new code available for scanning)")
 						}
 					} else if evt.Event == "success" {
 						// Clear QR code on success
-						qrCodeMutex.Lock()
-						currentQRCode = ""
-						qrCodeMutex.Unlock()
+						clearQRCode()
 						connected <- true
 						logger.Infof("QR code authentication successful")
 						return
 					} else if evt.Event == "timeout" {
 						// QR batch expired - will get new channel in outer loop
 						logger.Infof("QR code batch expired, regenerating new codes...")
+						go dispatchEventWebhooks(messageStore, "pairing_timeout", map[string]interface{}{"reason": "qr_codes_exhausted"})
 						qrExpired = true
 					}
 				}
@@ -2584,7 +20606,7 @@ func main() {
 		err = client.Connect()
 		if err != nil {
 			logger.Errorf("Failed to connect: %v", err)
-			return
+			shutdown(exitError, "connect failed")
 		}
 		connected <- true
 	}
@@ -2594,37 +20616,44 @@ func main() {
 
 	if !client.IsConnected() {
 		logger.Errorf("Failed to establish stable connection")
-		return
+		shutdown(exitError, "connection unstable")
 	}
 
 	// Initialize session start time
 	reconnectState.mutex.Lock()
 	reconnectState.sessionStartTime = time.Now()
 	reconnectState.reconnectAttempts = 0
-	reconnectState.needsReauth = false
 	reconnectState.mutex.Unlock()
 	updateActivityTime()
 
 	fmt.Println("\n✓ Connected to WhatsApp! Type 'help' for commands.")
 
+	// Resume downloads and webhook deliveries interrupted by the last shutdown
+	go recoverPendingWork(client, messageStore, startedAt)
+
+	// Resume running campaigns and start scheduled ones when due
+	startCampaignScheduler(client, messageStore, keepaliveStopChan)
+
+	// Deliver queued sends, retrying them across disconnects
+	startOutbox(client, messageStore, keepaliveStopChan)
+
+	// Retry failed webhook deliveries as their backoff runs out
+	startWebhookRetries(messageStore, keepaliveStopChan)
+
+	// Periodically refresh followed channels' post analytics
+	startNewsletterAnalytics(client, messageStore,
+		time.Duration(getEnvInt("MCP_NEWSLETTER_ANALYTICS_INTERVAL_SEC", 3600))*time.Second, keepaliveStopChan)
+
 	// Start keepalive goroutine to maintain session
 	go startKeepalive(client, logger, keepaliveStopChan)
 	logger.Infof("✅ Keepalive mechanism started (30s interval)")
 
 	// REST API server already started earlier (before authentication)
 
-	// Create a channel to keep the main goroutine alive
-	exitChan := make(chan os.Signal, 1)
-	signal.Notify(exitChan, syscall.SIGINT, syscall.SIGTERM)
-
 	fmt.Println("REST server is running. Press Ctrl+C to disconnect and exit.")
 
-	// Wait for termination signal
-	<-exitChan
-
-	fmt.Println("Disconnecting...")
-	// Disconnect client
-	client.Disconnect()
+	// Keep the main goroutine alive; the process exits through shutdown
+	select {}
 }
 
 func looksLikeRawIdentifier(value string) bool {
@@ -2729,11 +20758,11 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 	if err == nil && existingName != "" && existingName != chatJID && !looksLikeRawIdentifier(existingName) {
 		if jid.Server == "g.us" {
 			// Group names are stable enough to reuse without a refresh.
-			logger.Infof("Using existing group name for %s: %s", chatJID, existingName)
+			logger.Infof("Using existing group name for %s: %s", chatJID, redactLogContent(existingName))
 			return existingName
 		}
 
-		logger.Infof("Refreshing DM chat name for %s (existing=%s)", chatJID, existingName)
+		logger.Infof("Refreshing DM chat name for %s (existing=%s)", chatJID, redactLogContent(existingName))
 	}
 
 	// Need to determine chat name
@@ -2777,6 +20806,11 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 		// If we didn't get a name, try group info
 		if name == "" {
 			groupInfo, err := client.GetGroupInfo(context.Background(), jid)
+			if err == nil && groupInfo.IsParent {
+				if err := messageStore.SetChatType(chatJID, chatTypeCommunity); err != nil {
+					logger.Warnf("Failed to mark %s as a community: %v", chatJID, err)
+				}
+			}
 			if err == nil && groupInfo.Name != "" {
 				name = groupInfo.Name
 			} else {
@@ -2785,7 +20819,7 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 			}
 		}
 
-		logger.Infof("Using group name: %s", name)
+		logger.Infof("Using group name: %s", redactLogContent(name))
 	} else {
 		// This is an individual contact
 		logger.Infof("Getting name for contact: %s", chatJID)
@@ -2812,17 +20846,73 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 			name = jid.User
 		}
 
-		logger.Infof("Using contact name: %s", name)
+		logger.Infof("Using contact name: %s", redactLogContent(name))
 	}
 
 	return name
 }
 
+// SyncCheckpoint is the contiguous range of message timestamps already stored for a chat by history sync
+type SyncCheckpoint struct {
+	Oldest time.Time
+	Newest time.Time
+}
+
+// Covers reports whether a message timestamp falls inside the synced range
+func (c SyncCheckpoint) Covers(ts time.Time) bool {
+	return !c.Oldest.IsZero() && !ts.Before(c.Oldest) && !ts.After(c.Newest)
+}
+
+// Get the history sync checkpoint for a chat
+func (store *MessageStore) GetSyncCheckpoint(chatJID string) (SyncCheckpoint, error) {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	var checkpoint SyncCheckpoint
+	err := store.db.QueryRowContext(ctx,
+		"SELECT oldest_synced, newest_synced FROM sync_checkpoints WHERE chat_jid = ?",
+		chatJID,
+	).Scan(&checkpoint.Oldest, &checkpoint.Newest)
+	if err == sql.ErrNoRows {
+		return SyncCheckpoint{}, nil
+	}
+	return checkpoint, err
+}
+
+// Store the history sync checkpoint for a chat
+func (store *MessageStore) StoreSyncCheckpoint(chatJID string, checkpoint SyncCheckpoint) error {
+	ctx, cancel := store.dbContext()
+	defer cancel()
+	_, err := store.writer.ExecContext(ctx,
+		`INSERT INTO sync_checkpoints (chat_jid, oldest_synced, newest_synced, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(chat_jid) DO UPDATE SET oldest_synced = excluded.oldest_synced,
+			newest_synced = excluded.newest_synced, updated_at = excluded.updated_at`,
+		chatJID, checkpoint.Oldest.UTC(), checkpoint.Newest.UTC(), time.Now().UTC(),
+	)
+	return err
+}
+
+// mergeSyncCheckpoint extends the stored range with a newly synced batch. Ranges are only
+// merged when they overlap; otherwise the batch replaces the checkpoint so a gap between
+// the two is never treated as synced.
+func mergeSyncCheckpoint(current, batch SyncCheckpoint) SyncCheckpoint {
+	if current.Oldest.IsZero() || batch.Oldest.After(current.Newest) || batch.Newest.Before(current.Oldest) {
+		return batch
+	}
+	if batch.Oldest.Before(current.Oldest) {
+		current.Oldest = batch.Oldest
+	}
+	if batch.Newest.After(current.Newest) {
+		current.Newest = batch.Newest
+	}
+	return current
+}
+
 // Handle history sync events
 func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, historySync *events.HistorySync, logger waLog.Logger) {
 	fmt.Printf("Received history sync event with %d conversations\n", len(historySync.Data.Conversations))
 
 	syncedCount := 0
+	skippedCount := 0
 	for _, conversation := range historySync.Data.Conversations {
 		// Parse JID from the conversation
 		if conversation.ID == nil {
@@ -2847,6 +20937,18 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 		// Get appropriate chat name by passing the history sync conversation directly
 		name := GetChatName(client, messageStore, canonicalChat, canonicalChatJID, conversation, "", "", logger)
 
+		if jid.IsBroadcastList() {
+			var recipients []string
+			for _, participant := range conversation.GetParticipant() {
+				if participant.GetUserJID() != "" {
+					recipients = append(recipients, participant.GetUserJID())
+				}
+			}
+			if err := messageStore.StoreBroadcastList(chatJID, conversation.GetName(), recipients); err != nil {
+				logger.Warnf("Failed to store broadcast list %s: %v", chatJID, err)
+			}
+		}
+
 		// Process messages
 		messages := conversation.Messages
 		if len(messages) > 0 {
@@ -2864,7 +20966,15 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 				continue
 			}
 
-			messageStore.StoreChat(canonicalChatJID, name, timestamp)
+			messageStore.QueueChat(canonicalChatJID, name, timestamp)
+
+			// Messages inside the range stored by an earlier sync are skipped instead of re-upserted
+			checkpoint, err := messageStore.GetSyncCheckpoint(canonicalChatJID)
+			if err != nil {
+				logger.Warnf("Failed to load sync checkpoint for %s: %v", canonicalChatJID, err)
+			}
+			var batch SyncCheckpoint
+			storeFailed := false
 
 			// Store messages
 			for _, msg := range messages {
@@ -2872,6 +20982,20 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					continue
 				}
 
+				if ts := msg.Message.GetMessageTimestamp(); ts != 0 {
+					msgTime := time.Unix(int64(ts), 0)
+					if batch.Oldest.IsZero() || msgTime.Before(batch.Oldest) {
+						batch.Oldest = msgTime
+					}
+					if msgTime.After(batch.Newest) {
+						batch.Newest = msgTime
+					}
+					if checkpoint.Covers(msgTime) {
+						skippedCount++
+						continue
+					}
+				}
+
 				// Extract text content
 				var content string
 				if msg.Message.Message != nil {
@@ -2892,7 +21016,7 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 				}
 
 				// Log the message content for debugging
-				logger.Infof("Message content: %v, Media Type: %v", content, mediaType)
+				logger.Infof("Message content: %v, Media Type: %v", redactLogContent(content), mediaType)
 
 				// Skip messages with no content and no media
 				if content == "" && mediaType == "" {
@@ -2937,11 +21061,12 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					continue
 				}
 
-				err = messageStore.StoreMessage(
+				err = messageStore.QueueMessage(
 					msgID,
 					canonicalChatJID,
 					sender,
 					content,
+					extractContentType(msg.Message.Message),
 					timestamp,
 					isFromMe,
 					mediaType,
@@ -2953,23 +21078,60 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					fileLength,
 				)
 				if err != nil {
+					storeFailed = true
 					logger.Warnf("Failed to store history message: %v", err)
 				} else {
 					syncedCount++
+					// The upsert is only queued, so its follow-up updates are queued behind it
+					if err := messageStore.QueueRawMessage(msgID, canonicalChatJID, msg.Message.Message); err != nil {
+						logger.Warnf("Failed to store raw history message: %v", err)
+					}
+					if mentionAll, groupMentions := extractGroupMentions(msg.Message.Message); mentionAll || len(groupMentions) > 0 {
+						if err := messageStore.QueueGroupMentions(msgID, canonicalChatJID, mentionAll, groupMentions); err != nil {
+							logger.Warnf("Failed to store group mentions: %v", err)
+						}
+					}
+					if quotedID, quotedSender := extractQuotedMessage(msg.Message.Message); quotedID != "" {
+						if err := messageStore.QueueQuotedMessage(msgID, canonicalChatJID, quotedID, quotedSender); err != nil {
+							logger.Warnf("Failed to store quoted message reference: %v", err)
+						}
+					}
 					// Log successful message storage
 					if mediaType != "" {
+						if err := messageStore.QueueMediaAttributes(msgID, canonicalChatJID, extractMediaAttributes(msg.Message.Message)); err != nil {
+							logger.Warnf("Failed to store media attributes: %v", err)
+						}
 						logger.Infof("Stored message: [%s] %s -> %s: [%s: %s] %s",
-							timestamp.Format("2006-01-02 15:04:05"), sender, canonicalChatJID, mediaType, filename, content)
+							timestamp.Format("2006-01-02 15:04:05"), sender, canonicalChatJID, mediaType, filename, redactLogContent(content))
 					} else {
 						logger.Infof("Stored message: [%s] %s -> %s: %s",
-							timestamp.Format("2006-01-02 15:04:05"), sender, canonicalChatJID, content)
+							timestamp.Format("2006-01-02 15:04:05"), sender, canonicalChatJID, redactLogContent(content))
 					}
 				}
 			}
+
+			// Queued writes have to be committed before the checkpoint may move past them
+			if err := messageStore.FlushWrites(); err != nil {
+				storeFailed = true
+				logger.Warnf("Failed to store history messages for %s: %v", canonicalChatJID, err)
+			}
+			// Imported messages were counted as they were inserted; the phone knows which are actually unread
+			if conversation.UnreadCount != nil {
+				if err := messageStore.SetUnreadCount(canonicalChatJID, int(conversation.GetUnreadCount())); err != nil {
+					logger.Warnf("Failed to store unread count for %s: %v", canonicalChatJID, err)
+				}
+			}
+
+			// Only advance the checkpoint when the whole batch made it into the store
+			if !storeFailed && !batch.Oldest.IsZero() {
+				if err := messageStore.StoreSyncCheckpoint(canonicalChatJID, mergeSyncCheckpoint(checkpoint, batch)); err != nil {
+					logger.Warnf("Failed to store sync checkpoint for %s: %v", canonicalChatJID, err)
+				}
+			}
 		}
 	}
 
-	fmt.Printf("History sync complete. Stored %d messages.\n", syncedCount)
+	fmt.Printf("History sync complete. Stored %d messages, skipped %d already synced.\n", syncedCount, skippedCount)
 }
 
 // Request history sync from the server
@@ -3171,3 +21333,388 @@ func placeholderWaveform(duration uint32) []byte {
 
 	return waveform
 }
+
+// PDF preview limits
+const (
+	pdfScanMaxBytes     = 64 * 1024 * 1024 // Page counting reads at most this much of the file
+	pdfScanChunk        = 1024 * 1024      // ...a chunk at a time
+	pdfScanOverlap      = 4096             // Carried into the next chunk so objects across a boundary still match
+	pdfThumbnailWidth   = 480
+	pdfThumbnailTimeout = 15 * time.Second
+)
+
+var (
+	pdfCountPattern = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+	pdfPagePattern  = regexp.MustCompile(`/Type\s*/Page\b`)
+)
+
+// pdfPageCount reads the page count from a PDF's page tree. The root /Pages node
+// carries the total, so the largest /Count wins; if the page tree is inside a
+// compressed object stream, fall back to counting /Type /Page objects.
+// Returns 0 when the count can't be determined.
+func pdfPageCount(path string) uint32 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	reader := io.LimitReader(file, pdfScanMaxBytes)
+	buf := make([]byte, pdfScanChunk+pdfScanOverlap)
+	var count, pages uint64
+	for carried := 0; ; {
+		n, err := io.ReadFull(reader, buf[carried:])
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0
+		}
+		data := buf[:carried+n]
+		if carried == 0 && !bytes.HasPrefix(data, []byte("%PDF-")) {
+			return 0
+		}
+
+		// Matches starting in the overlap are left to the next chunk, which sees them whole
+		end := len(data)
+		if !last {
+			end -= pdfScanOverlap
+		}
+		for _, match := range pdfCountPattern.FindAllSubmatchIndex(data, -1) {
+			if match[0] >= end {
+				continue
+			}
+			start, stop := match[2], match[3]
+			if start < 0 {
+				start, stop = match[4], match[5]
+			}
+			value := data[start:stop]
+			if n, err := strconv.ParseUint(string(value), 10, 32); err == nil && n > count {
+				count = n
+			}
+		}
+		for _, match := range pdfPagePattern.FindAllIndex(data, -1) {
+			if match[0] < end {
+				pages++
+			}
+		}
+		if last {
+			break
+		}
+		carried = copy(buf, data[end:])
+	}
+	if count == 0 {
+		count = pages
+	}
+	return uint32(count)
+}
+
+// renderPDFThumbnail renders the first page of a PDF to a JPEG using poppler's
+// pdftoppm. Returns an error when pdftoppm isn't installed or rendering fails.
+func renderPDFThumbnail(ctx context.Context, path string) (thumbnail []byte, width, height uint32, err error) {
+	bin, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("pdftoppm not available: %v", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "pdfthumb")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	outRoot := filepath.Join(tmpDir, "thumb")
+	cmd := exec.CommandContext(ctx, bin, "-jpeg", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to", strconv.Itoa(pdfThumbnailWidth), path, outRoot)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, 0, 0, fmt.Errorf("pdftoppm failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	thumbnail, err = os.ReadFile(outRoot + ".jpg")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid thumbnail: %v", err)
+	}
+	return thumbnail, uint32(cfg.Width), uint32(cfg.Height), nil
+}
+
+// Sticker conversion limits. WhatsApp shows stickers at 512x512 and rejects larger files.
+const (
+	stickerSize             = 512
+	stickerMaxBytes         = 100 * 1024
+	animatedStickerMaxBytes = 500 * 1024
+	stickerConvertTimeout   = 60 * time.Second
+
+	// Source limits, checked before decoding so a small file can't declare a huge image
+	stickerMaxPixels    = 4096 * 4096
+	stickerMaxFrames    = 120
+	stickerMaxGIFPixels = 128 << 20 // Frames × frame area: a GIF decodes all its frames at once
+)
+
+// stickerQualities are the WebP qualities tried in turn until the sticker fits its size limit
+var stickerQualities = []int{80, 60, 40}
+
+// convertToSticker converts a PNG, JPEG or GIF to a 512x512 WebP sticker with libwebp's cwebp
+// (img2webp for animated GIFs), fitting the image inside the square on a transparent
+// background. Returns an error when the tools aren't installed or the result is too large.
+func convertToSticker(ctx context.Context, path string) (sticker []byte, animated bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, false, fmt.Errorf("sticker must be a PNG, JPEG or GIF image: %v", err)
+	}
+	pixels := config.Width * config.Height
+	if pixels > stickerMaxPixels {
+		return nil, false, fmt.Errorf("sticker image is %dx%d; at most %d pixels are accepted", config.Width, config.Height, stickerMaxPixels)
+	}
+	if format == "gif" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		count, err := countGIFFrames(bufio.NewReader(file))
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid gif image: %v", err)
+		}
+		if count > stickerMaxFrames || count*pixels > stickerMaxGIFPixels {
+			return nil, false, fmt.Errorf("animated sticker has %d frames of %dx%d; at most %d frames and %d pixels in total are accepted",
+				count, config.Width, config.Height, stickerMaxFrames, stickerMaxGIFPixels)
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	// Frames are decoded, fitted and written out as PNGs for the encoder
+	var frames []*image.RGBA
+	var delays []int // Milliseconds, animated only
+	switch format {
+	case "png", "jpeg":
+		img, _, err := image.Decode(file)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s image: %v", format, err)
+		}
+		frames = append(frames, fitSticker(img))
+	case "gif":
+		animation, err := gif.DecodeAll(file)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid gif image: %v", err)
+		}
+		frames, delays = composeGIFFrames(animation)
+	default:
+		return nil, false, fmt.Errorf("sticker must be a PNG, JPEG or GIF image (got %s)", format)
+	}
+	animated = len(frames) > 1
+
+	tool, maxBytes := "cwebp", stickerMaxBytes
+	if animated {
+		tool, maxBytes = "img2webp", animatedStickerMaxBytes
+	}
+	bin, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s not available: %v", tool, err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "sticker")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.RemoveAll(tmpDir)
+	framePaths := make([]string, len(frames))
+	for i, frame := range frames {
+		framePaths[i] = filepath.Join(tmpDir, fmt.Sprintf("frame%04d.png", i))
+		out, err := os.Create(framePaths[i])
+		if err != nil {
+			return nil, false, err
+		}
+		err = png.Encode(out, frame)
+		out.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	outPath := filepath.Join(tmpDir, "sticker.webp")
+	for _, quality := range stickerQualities {
+		var args []string
+		if animated {
+			args = []string{"-loop", "0", "-lossy", "-q", strconv.Itoa(quality)}
+			for i, framePath := range framePaths {
+				args = append(args, "-d", strconv.Itoa(delays[i]), framePath)
+			}
+			args = append(args, "-o", outPath)
+		} else {
+			args = []string{"-quiet", "-q", strconv.Itoa(quality), framePaths[0], "-o", outPath}
+		}
+		cmd := exec.CommandContext(ctx, bin, args...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, false, fmt.Errorf("%s failed: %v: %s", tool, err, strings.TrimSpace(string(output)))
+		}
+		sticker, err = os.ReadFile(outPath)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(sticker) <= maxBytes {
+			return sticker, animated, nil
+		}
+	}
+	return nil, false, fmt.Errorf("sticker is %d KB after conversion, WhatsApp allows %d KB", len(sticker)/1024, maxBytes/1024)
+}
+
+// checkStickerSource rejects what can't become a sticker: anything but PNG, JPEG or GIF, and captions
+func checkStickerSource(mimeType, caption string) error {
+	if mimeType != "image/png" && mimeType != "image/jpeg" && mimeType != "image/gif" {
+		return fmt.Errorf("sticker requires a PNG, JPEG or GIF image (got %s)", mimeType)
+	}
+	if caption != "" {
+		return errors.New("stickers cannot have a caption")
+	}
+	return nil
+}
+
+// composeGIFFrames renders each GIF frame over the ones before it (honouring disposal) and fits
+// it into the sticker square. Delays are in milliseconds; GIFs that leave them at 0 play at 10 fps.
+// countGIFFrames walks a GIF's blocks without decompressing them and counts the frames,
+// giving up once there are more than stickerMaxFrames
+func countGIFFrames(r *bufio.Reader) (int, error) {
+	header := make([]byte, 13) // Signature and logical screen descriptor
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	skipColorTable := func(flags byte) error {
+		if flags&0x80 == 0 {
+			return nil
+		}
+		_, err := r.Discard(3 << ((flags & 0x07) + 1))
+		return err
+	}
+	skipSubBlocks := func() error {
+		for {
+			size, err := r.ReadByte()
+			if err != nil || size == 0 {
+				return err
+			}
+			if _, err := r.Discard(int(size)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := skipColorTable(header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for frames <= stickerMaxFrames {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch introducer {
+		case 0x21: // Extension: label, then data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // Image descriptor, optional local color table, LZW code size, then image data
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return 0, err
+			}
+			if err := skipColorTable(descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // Trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unexpected block 0x%02x", introducer)
+		}
+		if err := skipSubBlocks(); err != nil {
+			return 0, err
+		}
+	}
+	return frames, nil
+}
+
+func composeGIFFrames(animation *gif.GIF) ([]*image.RGBA, []int) {
+	images := animation.Image
+	if len(images) > stickerMaxFrames {
+		images = images[:stickerMaxFrames]
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, animation.Config.Width, animation.Config.Height))
+	frames := make([]*image.RGBA, 0, len(images))
+	delays := make([]int, 0, len(images))
+	for i, frame := range images {
+		var previous *image.RGBA
+		disposal := byte(0)
+		if i < len(animation.Disposal) {
+			disposal = animation.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, fitSticker(canvas))
+
+		delay := 100
+		if i < len(animation.Delay) && animation.Delay[i] > 1 {
+			delay = animation.Delay[i] * 10
+		}
+		delays = append(delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, delays
+}
+
+// fitSticker scales img to fit the sticker square, centered on a transparent background. Each
+// output pixel averages the source pixels it covers, so large images don't alias.
+func fitSticker(img image.Image) *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	sticker := image.NewRGBA(image.Rect(0, 0, stickerSize, stickerSize))
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return sticker
+	}
+
+	scale := math.Min(float64(stickerSize)/float64(width), float64(stickerSize)/float64(height))
+	outWidth := max(1, int(math.Round(float64(width)*scale)))
+	outHeight := max(1, int(math.Round(float64(height)*scale)))
+	offsetX, offsetY := (stickerSize-outWidth)/2, (stickerSize-outHeight)/2
+	for y := 0; y < outHeight; y++ {
+		y0 := min(height-1, int(float64(y)/scale))
+		y1 := max(y0+1, min(height, int(float64(y+1)/scale)))
+		for x := 0; x < outWidth; x++ {
+			x0 := min(width-1, int(float64(x)/scale))
+			x1 := max(x0+1, min(width, int(float64(x+1)/scale)))
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			out := sticker.PixOffset(offsetX+x, offsetY+y)
+			for c := 0; c < 4; c++ {
+				sticker.Pix[out+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return sticker
+}
@@ -0,0 +1,1755 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waAdv"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Performance budget for the write and polling paths. The budget tests fail when a change
+// brings throughput below these on the reference machine. They measure wall-clock time, so
+// they only run when asked, as the CI workflow does: MCP_PERF_BUDGET=1 go test -run Budget
+// (benchmarks: go test -bench .)
+const (
+	// historyImportBudget is the minimum history sync import rate, in messages per second
+	historyImportBudget = 1000
+	// pollPageBudget is the longest a 100-message /api/messages page over loadPollMessages may take
+	pollPageBudget = 50 * time.Millisecond
+
+	loadPollMessages = 20000
+)
+
+// skipUnlessBudget skips wall-clock budget tests unless MCP_PERF_BUDGET is set
+func skipUnlessBudget(t *testing.T) {
+	if os.Getenv("MCP_PERF_BUDGET") == "" {
+		t.Skip("performance budget; set MCP_PERF_BUDGET=1 to run")
+	}
+}
+
+// newBenchStore opens an empty message store that is closed when the test ends
+func newBenchStore(tb testing.TB) *MessageStore {
+	tb.Helper()
+	store, err := NewMessageStore(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newBenchClient returns a client for a fake paired device, enough for the paths that resolve
+// names and LIDs through the device stores; it never connects
+func newBenchClient(tb testing.TB) *whatsmeow.Client {
+	tb.Helper()
+	container, err := sqlstore.New(context.Background(), "sqlite3", "file:"+tb.TempDir()+"/whatsapp.db?_foreign_keys=on", waLog.Noop)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { container.Close() })
+	device := container.NewDevice()
+	device.ID = &types.JID{User: "15550000000", Server: types.DefaultUserServer}
+	device.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{0},
+		AccountSignature:    make([]byte, 64),
+		AccountSignatureKey: make([]byte, 32),
+		DeviceSignature:     make([]byte, 64),
+	}
+	if err := device.Save(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return whatsmeow.NewClient(device, waLog.Noop)
+}
+
+// benchHistorySync builds a history sync blob of chats conversations with perChat text messages
+// each. Chat numbers start at firstChat so repeated imports don't hit earlier sync checkpoints.
+func benchHistorySync(firstChat, chats, perChat int) *events.HistorySync {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := &waProto.HistorySync{SyncType: waProto.HistorySync_INITIAL_BOOTSTRAP.Enum()}
+	for c := firstChat; c < firstChat+chats; c++ {
+		chatJID := fmt.Sprintf("1555%07d@s.whatsapp.net", c)
+		conversation := &waProto.Conversation{ID: proto.String(chatJID)}
+		// Newest first, as WhatsApp sends them
+		for m := perChat - 1; m >= 0; m-- {
+			conversation.Messages = append(conversation.Messages, &waProto.HistorySyncMsg{
+				Message: &waProto.WebMessageInfo{
+					Key: &waProto.MessageKey{
+						RemoteJID: proto.String(chatJID),
+						FromMe:    proto.Bool(m%3 == 0),
+						ID:        proto.String(fmt.Sprintf("HIST%08X%08X", c, m)),
+					},
+					Message:          &waProto.Message{Conversation: proto.String(fmt.Sprintf("history message %d in chat %d", m, c))},
+					MessageTimestamp: proto.Uint64(uint64(base.Add(time.Duration(m) * time.Minute).Unix())),
+				},
+			})
+		}
+		data.Conversations = append(data.Conversations, conversation)
+	}
+	return &events.HistorySync{Data: data}
+}
+
+func BenchmarkStoreMessage(b *testing.B) {
+	store := newBenchStore(b)
+	if err := store.StoreChat("15550000001@s.whatsapp.net", "Bench", time.Now()); err != nil {
+		b.Fatal(err)
+	}
+	timestamp := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := store.StoreMessage(fmt.Sprintf("BENCH%016X", i), "15550000001@s.whatsapp.net", "15550000001",
+			"benchmark message content", "text", timestamp, false, "", "", "", nil, nil, nil, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+func BenchmarkHistorySyncImport(b *testing.B) {
+	const chats, perChat = 10, 100
+	client := newBenchClient(b)
+	store := newBenchStore(b)
+	syncs := make([]*events.HistorySync, b.N)
+	for i := range syncs {
+		syncs[i] = benchHistorySync(i*chats, chats, perChat)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handleHistorySync(client, store, syncs[i], waLog.Noop)
+	}
+	b.ReportMetric(float64(b.N*chats*perChat)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+// newPollStore fills a store with loadPollMessages generated messages and serves it
+func newPollStore(tb testing.TB) *MessageStore {
+	tb.Helper()
+	dir := tb.TempDir()
+	if _, err := generateLoadData(dir, LoadDataConfig{Chats: 200, Messages: loadPollMessages, Seed: 1, Days: 90}); err != nil {
+		tb.Fatal(err)
+	}
+	store, err := NewMessageStore(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+// pollMessages fetches one page the way the backend watcher does and returns its next_cursor
+func pollMessages(tb testing.TB, mux http.Handler, cursor string) string {
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/messages?limit=100&include_from_me=true&cursor="+cursor, nil))
+	if recorder.Code != 200 {
+		tb.Fatalf("/api/messages returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var response struct {
+		NextCursor string `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		tb.Fatal(err)
+	}
+	return response.NextCursor
+}
+
+func BenchmarkAPIMessages(b *testing.B) {
+	store := newPollStore(b)
+	mux := newSessionMux(nil, store)
+	b.ResetTimer()
+	cursor := ""
+	for i := 0; i < b.N; i++ {
+		cursor = pollMessages(b, mux, cursor)
+		if i%(loadPollMessages/100) == loadPollMessages/100-1 {
+			cursor = "" // Start over instead of polling past the end
+		}
+	}
+}
+
+func BenchmarkChatHistory(b *testing.B) {
+	store := newPollStore(b)
+	mux := newSessionMux(nil, store)
+	var chatJID string
+	if err := store.db.QueryRow("SELECT chat_jid FROM messages GROUP BY chat_jid ORDER BY COUNT(*) DESC LIMIT 1").Scan(&chatJID); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/chats/"+chatJID+"/messages?limit=100", nil))
+		if recorder.Code != 200 {
+			b.Fatalf("/api/chats/{jid}/messages returned %d: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestHistorySyncImportBudget(t *testing.T) {
+	skipUnlessBudget(t)
+	const chats, perChat = 20, 250
+	client := newBenchClient(t)
+	store := newBenchStore(t)
+	historySync := benchHistorySync(0, chats, perChat)
+
+	started := time.Now()
+	handleHistorySync(client, store, historySync, waLog.Noop)
+	rate := float64(chats*perChat) / time.Since(started).Seconds()
+
+	var stored int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != chats*perChat {
+		t.Fatalf("imported %d messages, want %d", stored, chats*perChat)
+	}
+	if rate < historyImportBudget {
+		t.Fatalf("history import ran at %.0f msgs/s, budget is %d msgs/s", rate, historyImportBudget)
+	}
+	t.Logf("history import: %.0f msgs/s (budget %d)", rate, historyImportBudget)
+}
+
+func TestPollPageBudget(t *testing.T) {
+	skipUnlessBudget(t)
+	store := newPollStore(t)
+	mux := newSessionMux(nil, store)
+
+	// Page through the whole store; the slowest page has to stay within budget
+	var slowest time.Duration
+	pages := 0
+	for cursor := ""; pages < loadPollMessages/100; pages++ {
+		started := time.Now()
+		cursor = pollMessages(t, mux, cursor)
+		slowest = max(slowest, time.Since(started))
+	}
+	if slowest > pollPageBudget {
+		t.Fatalf("slowest /api/messages page took %s, budget is %s", slowest, pollPageBudget)
+	}
+	t.Logf("/api/messages: slowest of %d pages %s (budget %s)", pages, slowest, pollPageBudget)
+}
+
+func TestHistorySyncKeepsMessageDetails(t *testing.T) {
+	storeRawMessages = true
+	t.Cleanup(func() { storeRawMessages = false })
+	client := newBenchClient(t)
+	store := newBenchStore(t)
+	const chatJID = "15550000001@s.whatsapp.net"
+	historySync := &events.HistorySync{Data: &waProto.HistorySync{
+		SyncType: waProto.HistorySync_INITIAL_BOOTSTRAP.Enum(),
+		Conversations: []*waProto.Conversation{{
+			ID: proto.String(chatJID),
+			Messages: []*waProto.HistorySyncMsg{{Message: &waProto.WebMessageInfo{
+				Key: &waProto.MessageKey{RemoteJID: proto.String(chatJID), FromMe: proto.Bool(false), ID: proto.String("HISTREPLY")},
+				Message: &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+					Text:        proto.String("a reply"),
+					ContextInfo: &waProto.ContextInfo{StanzaID: proto.String("HISTQUOTED"), Participant: proto.String(chatJID)},
+				}},
+				MessageTimestamp: proto.Uint64(uint64(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Unix())),
+			}}},
+		}},
+	}}
+	handleHistorySync(client, store, historySync, waLog.Noop)
+
+	// The upsert is batched; the updates that follow it must not run before it exists
+	var quotedID string
+	var raw []byte
+	err := store.db.QueryRow("SELECT COALESCE(quoted_message_id, ''), raw_message FROM messages WHERE id = ?", "HISTREPLY").Scan(&quotedID, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotedID != "HISTQUOTED" {
+		t.Errorf("quoted_message_id = %q, want HISTQUOTED", quotedID)
+	}
+	if len(raw) == 0 {
+		t.Error("raw_message was not stored")
+	}
+}
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := []struct {
+		input, countryCode    string
+		e164, kind, alternate string
+		wantErr               bool
+	}{
+		{input: "+1 (415) 555-0100", e164: "+14155550100"},
+		{input: "00351 912 345 678", e164: "+351912345678"},
+		{input: "+44 020 7946 0958", e164: "+442079460958"},
+		{input: "+39 06 6982 1234", e164: "+390669821234"}, // Italy keeps its leading 0
+		{input: "415-555-0100", countryCode: "1", e164: "+14155550100"},
+		{input: "912345678", countryCode: "351", e164: "+351912345678"},
+		{input: "442079460958", countryCode: "55", e164: "+442079460958"}, // Too long to be national
+		{input: "+55 (11) 98765-4321", e164: "+5511987654321", kind: "mobile", alternate: "+551187654321"},
+		{input: "+55 11 8765-4321", e164: "+5511987654321", kind: "mobile", alternate: "+551187654321"},
+		{input: "(11) 98765-4321", countryCode: "55", e164: "+5511987654321", kind: "mobile", alternate: "+551187654321"},
+		{input: "011 98765-4321", countryCode: "55", e164: "+5511987654321", kind: "mobile", alternate: "+551187654321"},
+		{input: "0 21 11 98765 4321", countryCode: "55", e164: "+5511987654321", kind: "mobile", alternate: "+551187654321"},
+		{input: "11 3456-7890", countryCode: "55", e164: "+551134567890", kind: "landline"},
+		{input: "+55 20 98765-4321", wantErr: true},  // No such area code
+		{input: "+55 11 1234-5678", wantErr: true},   // Neither mobile nor landline
+		{input: "+1 415 555 010", wantErr: true},     // Too short for North America
+		{input: "+12345678901234567", wantErr: true}, // Longer than E.164 allows
+		{input: "555-CALL", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "+", wantErr: true},
+	}
+	for _, test := range tests {
+		number, err := normalizePhoneNumber(test.input, test.countryCode)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("normalizePhoneNumber(%q, %q) = %s, want an error", test.input, test.countryCode, number.E164)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizePhoneNumber(%q, %q): %v", test.input, test.countryCode, err)
+			continue
+		}
+		if number.E164 != test.e164 || number.Type != test.kind || number.Alternate != test.alternate {
+			t.Errorf("normalizePhoneNumber(%q, %q) = %s (%q, alternate %q), want %s (%q, alternate %q)", test.input, test.countryCode,
+				number.E164, number.Type, number.Alternate, test.e164, test.kind, test.alternate)
+		}
+	}
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	for _, count := range []int{1, 3, stickerMaxFrames + 5} {
+		animation := &gif.GIF{}
+		for i := 0; i < count; i++ {
+			animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+			animation.Delay = append(animation.Delay, 10)
+		}
+		var data bytes.Buffer
+		if err := gif.EncodeAll(&data, animation); err != nil {
+			t.Fatal(err)
+		}
+		frames, err := countGIFFrames(bufio.NewReader(&data))
+		if err != nil {
+			t.Fatalf("%d frames: %v", count, err)
+		}
+		// Counting stops once past the limit
+		if want := min(count, stickerMaxFrames+1); frames != want {
+			t.Errorf("counted %d frames in a %d-frame GIF, want %d", frames, count, want)
+		}
+	}
+}
+
+func TestConvertToStickerRejectsHugeImage(t *testing.T) {
+	// A PNG header declaring 50000x50000; decoding it would need gigabytes
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 50000)
+	binary.BigEndian.PutUint32(ihdr[4:], 50000)
+	ihdr[8], ihdr[9] = 8, 6 // 8-bit RGBA
+	var data bytes.Buffer
+	data.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&data, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	data.Write(chunk)
+	binary.Write(&data, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	path := filepath.Join(t.TempDir(), "huge.png")
+	if err := os.WriteFile(path, data.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := convertToSticker(context.Background(), path)
+	if err == nil || !strings.Contains(err.Error(), "50000x50000") {
+		t.Fatalf("convertToSticker accepted a 50000x50000 image (err %v)", err)
+	}
+}
+
+func TestWriteBatcher(t *testing.T) {
+	store := newBenchStore(t)
+	batcher := store.writes
+	const insert = "INSERT INTO chats (jid, name, last_message_time) VALUES (?, ?, ?)"
+	for i := 0; i < writeBatchSize+10; i++ {
+		if err := batcher.Queue(insert, []interface{}{fmt.Sprintf("%d@s.whatsapp.net", i), "queued", time.Now().UTC()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Queued writes commit in order, so an update queued after its insert sees the row
+	if err := batcher.Queue("UPDATE chats SET name = ? WHERE jid = ?", []interface{}{"updated", "0@s.whatsapp.net"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := batcher.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	var count int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM chats").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != writeBatchSize+10 {
+		t.Errorf("%d chats after Flush, want %d", count, writeBatchSize+10)
+	}
+	var name string
+	if err := store.db.QueryRow("SELECT name FROM chats WHERE jid = ?", "0@s.whatsapp.net").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "updated" {
+		t.Errorf("name = %q, want updated", name)
+	}
+
+	// A failing queued write is reported once by the next Flush and doesn't take its batch down
+	batcher.Queue("INSERT INTO no_such_table VALUES (1)", nil)
+	batcher.Queue(insert, []interface{}{"after@s.whatsapp.net", "after", time.Now().UTC()})
+	if err := batcher.Flush(); err == nil {
+		t.Error("Flush did not report the failed write")
+	}
+	if err := batcher.Flush(); err != nil {
+		t.Errorf("second Flush reported %v, want nil", err)
+	}
+	if err := store.db.QueryRow("SELECT name FROM chats WHERE jid = ?", "after@s.whatsapp.net").Scan(&name); err != nil {
+		t.Errorf("write batched with a failure was lost: %v", err)
+	}
+
+	// Exec waits for its own commit, and reports its own error
+	if err := batcher.Exec(context.Background(), "INSERT INTO no_such_table VALUES (1)", nil); err == nil {
+		t.Error("Exec did not report the failed write")
+	}
+}
+
+func TestMessageCursorPaging(t *testing.T) {
+	store := newBenchStore(t)
+	// Messages sharing a second are what broke since-based polling
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	const total = 250
+	if err := store.StoreChat("15550000001@s.whatsapp.net", "Alice", base); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < total; i++ {
+		timestamp := base.Add(time.Duration(i/40) * time.Second)
+		if err := store.StoreMessage(fmt.Sprintf("MSG%03d", i), "15550000001@s.whatsapp.net", "15550000001", "hello", "text",
+			timestamp, false, "", "", "", nil, nil, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := newSessionMux(nil, store)
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/messages?limit=100&cursor="+cursor, nil))
+		if recorder.Code != 200 {
+			t.Fatalf("/api/messages returned %d: %s", recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Messages   []APIMessage `json:"messages"`
+			NextCursor string       `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range response.Messages {
+			if seen[message.ID] {
+				t.Fatalf("message %s returned twice", message.ID)
+			}
+			seen[message.ID] = true
+		}
+		if len(response.Messages) == 0 {
+			if response.NextCursor != cursor {
+				t.Errorf("next_cursor moved on an empty page")
+			}
+			break
+		}
+		cursor = response.NextCursor
+	}
+	if len(seen) != total {
+		t.Errorf("paged through %d messages, want %d", len(seen), total)
+	}
+
+	timestamp, id, err := decodeMessageCursor(encodeMessageCursor(base.Add(time.Nanosecond), "A:B"))
+	if err != nil || !timestamp.Equal(base.Add(time.Nanosecond)) || id != "A:B" {
+		t.Errorf("message cursor round-trip gave %v %q %v", timestamp, id, err)
+	}
+	for _, invalid := range []string{"!!", "MTIz", "eDph"} {
+		if _, _, err := decodeMessageCursor(invalid); err == nil {
+			t.Errorf("decodeMessageCursor(%q) accepted an invalid cursor", invalid)
+		}
+	}
+	rowTime, rowID, err := decodeSearchCursor(encodeSearchCursor(base, 42))
+	if err != nil || !rowTime.Equal(base) || rowID != 42 {
+		t.Errorf("search cursor round-trip gave %v %d %v", rowTime, rowID, err)
+	}
+}
+
+func TestExportEncryptionRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 10, exportChunkSize, 2*exportChunkSize + 123} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 7)
+		}
+		var sealed bytes.Buffer
+		encrypter, err := newExportEncrypter(&sealed, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypter.Write(plain)
+		if err := encrypter.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var opened bytes.Buffer
+		if err := decryptExport(bytes.NewReader(sealed.Bytes()), &opened, "correct horse"); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(opened.Bytes(), plain) {
+			t.Errorf("%d bytes: decrypted export differs from the original", size)
+		}
+		if err := decryptExport(bytes.NewReader(sealed.Bytes()), io.Discard, "wrong"); err == nil {
+			t.Errorf("%d bytes: decrypted with the wrong passphrase", size)
+		}
+		// Dropping the final chunk must not pass for a complete export
+		if size > exportChunkSize {
+			truncated := sealed.Bytes()[:sealed.Len()-(size%exportChunkSize)-16-4]
+			if err := decryptExport(bytes.NewReader(truncated), io.Discard, "correct horse"); err == nil {
+				t.Errorf("%d bytes: accepted an export missing its final chunk", size)
+			}
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":         true,
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"100.127.255.255": false,
+		"100.128.0.1":     true,
+		"0.0.0.0":         false,
+		"0.1.2.3":         false,
+		"224.0.0.1":       false,
+		"::1":             false,
+		"::":              false,
+		"fe80::1":         false,
+		"fc00::1":         false,
+		"::ffff:10.0.0.1": false,
+	}
+	for address, want := range tests {
+		if got := isPublicIP(net.ParseIP(address)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestMergeSyncCheckpoint(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name           string
+		current, batch SyncCheckpoint
+		want           SyncCheckpoint
+	}{
+		{"first batch", SyncCheckpoint{}, SyncCheckpoint{day(3), day(5)}, SyncCheckpoint{day(3), day(5)}},
+		{"older overlapping", SyncCheckpoint{day(3), day(5)}, SyncCheckpoint{day(1), day(4)}, SyncCheckpoint{day(1), day(5)}},
+		{"newer overlapping", SyncCheckpoint{day(3), day(5)}, SyncCheckpoint{day(4), day(8)}, SyncCheckpoint{day(3), day(8)}},
+		{"touching", SyncCheckpoint{day(3), day(5)}, SyncCheckpoint{day(5), day(6)}, SyncCheckpoint{day(3), day(6)}},
+		{"inside", SyncCheckpoint{day(1), day(9)}, SyncCheckpoint{day(3), day(4)}, SyncCheckpoint{day(1), day(9)}},
+		{"gap after", SyncCheckpoint{day(1), day(3)}, SyncCheckpoint{day(6), day(8)}, SyncCheckpoint{day(6), day(8)}},
+		{"gap before", SyncCheckpoint{day(6), day(8)}, SyncCheckpoint{day(1), day(3)}, SyncCheckpoint{day(1), day(3)}},
+	}
+	for _, tt := range tests {
+		got := mergeSyncCheckpoint(tt.current, tt.batch)
+		if !got.Oldest.Equal(tt.want.Oldest) || !got.Newest.Equal(tt.want.Newest) {
+			t.Errorf("%s: got %v..%v, want %v..%v", tt.name, got.Oldest, got.Newest, tt.want.Oldest, tt.want.Newest)
+		}
+	}
+	if (SyncCheckpoint{}).Covers(day(1)) {
+		t.Error("an empty checkpoint covers nothing")
+	}
+	if checkpoint := (SyncCheckpoint{day(2), day(4)}); !checkpoint.Covers(day(2)) || !checkpoint.Covers(day(4)) || checkpoint.Covers(day(5)) {
+		t.Error("Covers should include both ends of the range and nothing past them")
+	}
+}
+
+func TestPDFPageCount(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, parts ...string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Join(parts, "")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	padding := strings.Repeat("%", pdfScanChunk)
+	pages := strings.Repeat("<< /Type /Page >>\n", 3)
+	tests := []struct {
+		name string
+		path string
+		want uint32
+	}{
+		{"page tree", write("tree.pdf", "%PDF-1.7\n<< /Type /Pages /Kids [] /Count 3 >>\n<< /Count 12 /Type /Pages >>\n"), 12},
+		{"tree past the first chunk", write("late.pdf", "%PDF-1.7\n", padding, "<< /Type /Pages /Count 7 >>"), 7},
+		// Right at a chunk boundary the overlap must neither split nor double count it
+		{"page objects across a chunk boundary", write("boundary.pdf", "%PDF-1.7\n", padding[:pdfScanChunk-20], pages, padding, pages), 6},
+		{"not a PDF", write("text.pdf", "hello /Type /Pages /Count 3"), 0},
+	}
+	for _, tt := range tests {
+		if got := pdfPageCount(tt.path); got != tt.want {
+			t.Errorf("%s: pdfPageCount = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAutoDownloadConfig(t *testing.T) {
+	t.Setenv("MCP_AUTO_DOWNLOAD_MAX_BYTES", "1000")
+	tests := []struct {
+		types     string
+		mediaType string
+		size      uint64
+		want      bool
+	}{
+		{"", "image", 1, false},
+		{"image,audio", "image", 1000, true},
+		{"image,audio", "image", 1001, false},
+		{"image,audio", "video", 1, false},
+		{"image,document:5000", "document", 5000, true},
+		{"image,document:5000", "document", 5001, false},
+		{"all", "video", 1000, true},
+		{"all", "video", 1001, false},
+		{"all:50", "video", 50, true},
+		{"all:50", "video", 51, false},
+		{"all:50,image:2000", "image", 2000, true},
+		{"all:50,image", "image", 1000, true},
+		{"all", "", 1, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("MCP_AUTO_DOWNLOAD_TYPES", tt.types)
+		if got := loadAutoDownloadConfig().ShouldDownload(tt.mediaType, tt.size); got != tt.want {
+			t.Errorf("MCP_AUTO_DOWNLOAD_TYPES=%q: ShouldDownload(%q, %d) = %v, want %v", tt.types, tt.mediaType, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookRegistrationRejectsPrivateTargets(t *testing.T) {
+	store := newBenchStore(t)
+	mux := newSessionMux(nil, store)
+	register := func(target string) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/webhooks", strings.NewReader(`{"url":"`+target+`"}`)))
+		return recorder.Code
+	}
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://169.254.169.254/latest/meta-data", "http://[::1]/hook", "http://localhost/hook"} {
+		if code := register(target); code != http.StatusBadRequest {
+			t.Errorf("registering %s returned %d, want 400", target, code)
+		}
+	}
+
+	webhookAllowedHosts["127.0.0.1"] = true
+	t.Cleanup(func() { delete(webhookAllowedHosts, "127.0.0.1") })
+	if code := register("http://127.0.0.1:8080/hook"); code != http.StatusOK {
+		t.Errorf("registering an allowed host returned %d, want 200", code)
+	}
+}
+
+func TestQueuedSendKeepsUploadMedia(t *testing.T) {
+	store := newBenchStore(t)
+	old := time.Now().Add(-2 * uploadSessionTTL)
+	for _, id := range []string{"0123456789abcdef", "fedcba9876543210"} {
+		if err := store.CreateUpload(&UploadSession{ID: id, Filename: "photo.jpg", Status: "complete",
+			Path: filepath.Join(storeDir, "uploads", id, "photo.jpg"), CreatedAt: old}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send, _, err := store.EnqueueSend(QueuedSend{ID: "send1", Request: SendMessageRequest{
+		Recipient: "15550000001", MediaPath: filepath.Join(storeDir, "uploads", "0123456789abcdef", "photo.jpg"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := store.GetExpiredUploads(time.Now().Add(-uploadSessionTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expired, []string{"fedcba9876543210"}) {
+		t.Errorf("expired uploads while queued = %v, want only the unreferenced one", expired)
+	}
+
+	if err := store.SetQueuedSendResult(send.ID, outboxSent, "", "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	expired, err = store.GetExpiredUploads(time.Now().Add(-uploadSessionTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 2 {
+		t.Errorf("expired uploads once sent = %v, want both", expired)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	store := newBenchStore(t)
+	var failures atomic.Int32
+	failures.Store(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	webhookAllowedHosts["127.0.0.1"] = true
+	saved := webhookRetry
+	webhookRetry = WebhookRetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() {
+		delete(webhookAllowedHosts, "127.0.0.1")
+		webhookRetry = saved
+	})
+	webhook := &Webhook{ID: "hook", URL: server.URL, MediaMode: webhookMediaMetadata, CreatedAt: time.Now()}
+	if err := store.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	pending := func() int {
+		var count int
+		if err := store.db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// A failed delivery waits for its backoff, then the worker delivers it
+	if err := deliverWebhook(store, *webhook, 1, []byte(`{"event":"test"}`)); err == nil {
+		t.Fatal("first delivery should have failed")
+	}
+	if retryDueWebhookDelivery(store) {
+		t.Error("retried before the backoff ran out")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !retryDueWebhookDelivery(store) {
+		t.Fatal("no retry was due after the backoff")
+	}
+	if n := pending(); n != 0 {
+		t.Errorf("%d deliveries pending after a successful retry, want 0", n)
+	}
+
+	// One that keeps failing is dead-lettered after MaxAttempts
+	failures.Store(100)
+	deliverWebhook(store, *webhook, 2, []byte(`{"event":"test"}`))
+	for attempt := 0; attempt < 10 && pending() > 0; attempt++ {
+		time.Sleep(20 * time.Millisecond)
+		retryDueWebhookDelivery(store)
+	}
+	deadLetters, err := store.GetWebhookDeadLetters("", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != webhookRetry.MaxAttempts {
+		t.Fatalf("dead letters = %+v, want one after %d attempts", deadLetters, webhookRetry.MaxAttempts)
+	}
+
+	// Taking a dead letter removes it, so it can only be taken once
+	if _, err := store.TakeWebhookDeadLetter(deadLetters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TakeWebhookDeadLetter(deadLetters[0].ID); err != sql.ErrNoRows {
+		t.Errorf("second take returned %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestReparseKeepsMaskingAndEdits(t *testing.T) {
+	storeRawMessages, piiMasking = true, true
+	t.Cleanup(func() { storeRawMessages, piiMasking = false, false })
+	client := newBenchClient(t)
+	store := newBenchStore(t)
+	const chatJID = "15550000001@s.whatsapp.net"
+	timestamp := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.StoreChat(chatJID, "Alice", timestamp); err != nil {
+		t.Fatal(err)
+	}
+	for id, text := range map[string]string{"MASKED": "mail me at alice@example.com", "EDITED": "first draft"} {
+		message := &waProto.Message{Conversation: proto.String(text)}
+		if err := store.StoreMessage(id, chatJID, "15550000001", text, "text", timestamp, false, "", "", "", nil, nil, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreRawMessage(id, chatJID, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.ApplyEdit("EDITED", chatJID, "15550000001", false, "final text", timestamp.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reparseStoredMessages(context.Background(), client, store, ""); err != nil {
+		t.Fatal(err)
+	}
+	var content, unmasked string
+	if err := store.db.QueryRow("SELECT content, COALESCE(content_unmasked, '') FROM messages WHERE id = 'MASKED'").Scan(&content, &unmasked); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(content, "alice@example.com") || unmasked != "mail me at alice@example.com" {
+		t.Errorf("reparsed content = %q (unmasked %q), want the email masked and the original kept aside", content, unmasked)
+	}
+	if err := store.db.QueryRow("SELECT content FROM messages WHERE id = 'EDITED'").Scan(&content); err != nil {
+		t.Fatal(err)
+	}
+	if content != "final text" {
+		t.Errorf("reparse reverted an edit: content = %q", content)
+	}
+}
+
+func TestApprovalsAndCampaignsKeepUploadMedia(t *testing.T) {
+	store := newBenchStore(t)
+	old := time.Now().Add(-2 * uploadSessionTTL)
+	uploadPath := func(id string) string { return filepath.Join(storeDir, "uploads", id, "photo.jpg") }
+	for _, id := range []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc"} {
+		if err := store.CreateUpload(&UploadSession{ID: id, Filename: "photo.jpg", Status: "complete", Path: uploadPath(id), CreatedAt: old}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AddPendingSend(PendingSend{ID: "approval1", RequestedBy: "token", Status: approvalPending,
+		Request: SendMessageRequest{Recipient: "15550000001", MediaPath: uploadPath("aaaaaaaaaaaaaaaa")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateCampaign(Campaign{ID: "campaign1", Name: "promo", Template: "hi", MediaPath: uploadPath("bbbbbbbbbbbbbbbb"),
+		Status: campaignRunning, MessagesPerMinute: 10}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := store.GetExpiredUploads(time.Now().Add(-uploadSessionTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expired, []string{"cccccccccccccccc"}) {
+		t.Errorf("expired uploads = %v, want only the unreferenced one", expired)
+	}
+
+	store.SetPendingSendResult("approval1", approvalSent, "sent")
+	store.SetCampaignStatus("campaign1", campaignCompleted)
+	if expired, _ = store.GetExpiredUploads(time.Now().Add(-uploadSessionTTL)); len(expired) != 3 {
+		t.Errorf("expired uploads once done = %v, want all three", expired)
+	}
+}
+
+func TestFailInterruptedApprovals(t *testing.T) {
+	store := newBenchStore(t)
+	for _, id := range []string{"interrupted", "waiting"} {
+		if err := store.AddPendingSend(PendingSend{ID: id, RequestedBy: "token", Status: approvalPending,
+			Request: SendMessageRequest{Recipient: "15550000001", Message: "hi"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.DecidePendingSend("interrupted", approvalSending, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := store.FailInterruptedApprovals(time.Now().Add(time.Second))
+	if err != nil || failed != 1 {
+		t.Fatalf("FailInterruptedApprovals = %d, %v; want 1", failed, err)
+	}
+	for id, want := range map[string]string{"interrupted": approvalFailed, "waiting": approvalPending} {
+		pending, err := store.GetPendingSend(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending.Status != want {
+			t.Errorf("%s: status %q, want %q", id, pending.Status, want)
+		}
+	}
+}
+
+func TestModeratedTokenAllowlist(t *testing.T) {
+	moderatedTokens["moderated-token"] = true
+	t.Cleanup(func() { delete(moderatedTokens, "moderated-token") })
+	store := newBenchStore(t)
+	mux := newSessionMux(nil, store)
+	tests := []struct {
+		method, path string
+		allowed      bool
+	}{
+		{"GET", "/api/messages", true},
+		{"GET", "/api/chats", true},
+		{"POST", "/api/chat-state", true},
+		{"POST", "/api/chat-metadata", false},
+		{"GET", "/api/webhooks", false},
+		{"GET", "/api/approvals", false},
+		{"POST", "/api/groups/create", false},
+		{"POST", "/api/send-poll", false},
+		{"GET", "/api/qr-code", false},
+		{"GET", "/api/messages-export", false}, // Neither listed nor under a listed subtree
+		{"POST", "/api/some-future-endpoint", false},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(tt.method, tt.path, nil)
+		request.Header.Set("Authorization", "Bearer moderated-token")
+		if got := moderatedAllowed(request); got != tt.allowed {
+			t.Errorf("%s %s: allowed = %v, want %v", tt.method, tt.path, got, tt.allowed)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/api/groups/leave", strings.NewReader(`{}`))
+	request.Header.Set("Authorization", "Bearer moderated-token")
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("moderated POST /api/groups/leave returned %d, want 403", recorder.Code)
+	}
+}
+
+func TestSendBudgetAndDuplicatesArePerAccount(t *testing.T) {
+	storeA, storeB := newBenchStore(t), newBenchStore(t)
+	accounts.mutex.Lock()
+	for _, account := range []*Account{{ID: "a", store: storeA}, {ID: "b", store: storeB}} {
+		account.budget = &SendBudget{limit: 1, window: time.Minute}
+		account.dedupe = &DuplicateGuard{window: time.Minute, mode: duplicateModeReject, recent: make(map[string]time.Time)}
+		accounts.accounts[account.ID] = account
+	}
+	accounts.mutex.Unlock()
+	t.Cleanup(func() {
+		accounts.mutex.Lock()
+		delete(accounts.accounts, "a")
+		delete(accounts.accounts, "b")
+		accounts.mutex.Unlock()
+	})
+
+	send := func(messageStore *MessageStore) int {
+		recorder := httptest.NewRecorder()
+		rateLimited(messageStore, func(w http.ResponseWriter, r *http.Request) {})(recorder, httptest.NewRequest("POST", "/api/send", nil))
+		return recorder.Code
+	}
+	if code := send(storeA); code != http.StatusOK {
+		t.Fatalf("first send on account a returned %d", code)
+	}
+	if code := send(storeA); code != http.StatusTooManyRequests {
+		t.Errorf("second send on account a returned %d, want 429", code)
+	}
+	if code := send(storeB); code != http.StatusOK {
+		t.Errorf("account b was throttled by account a's budget (%d)", code)
+	}
+
+	key := duplicateKey(SendMessageRequest{Recipient: "15550001111", Message: "hello"})
+	if _, duplicate := duplicateGuardFor(storeA).reserve(key); duplicate {
+		t.Fatal("first reservation on account a reported a duplicate")
+	}
+	if _, duplicate := duplicateGuardFor(storeA).reserve(key); !duplicate {
+		t.Error("repeat on account a wasn't flagged as a duplicate")
+	}
+	if _, duplicate := duplicateGuardFor(storeB).reserve(key); duplicate {
+		t.Error("the same message on account b was flagged as a duplicate of account a's")
+	}
+}
+
+func TestDuplicateKeyCoversContent(t *testing.T) {
+	base := SendMessageRequest{Recipient: "15550001111", Message: "hello"}
+	variants := map[string]func(*SendMessageRequest){
+		"template":  func(r *SendMessageRequest) { r.Template = "welcome" },
+		"variables": func(r *SendMessageRequest) { r.Variables = map[string]string{"name": "Ana"} },
+		"sticker":   func(r *SendMessageRequest) { r.MediaPath, r.Sticker = "/tmp/a.png", true },
+		"quoted":    func(r *SendMessageRequest) { r.QuotedMessageID = "ABC123" },
+		"location name": func(r *SendMessageRequest) {
+			r.Location = &SendLocation{Latitude: 1, Longitude: 2, Name: "Office"}
+		},
+		"location address": func(r *SendMessageRequest) {
+			r.Location = &SendLocation{Latitude: 1, Longitude: 2, Address: "Main St"}
+		},
+	}
+	seen := map[string]string{duplicateKey(base): "base"}
+	for name, change := range variants {
+		req := base
+		change(&req)
+		key := duplicateKey(req)
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s hashes the same as %s", name, other)
+		}
+		seen[key] = name
+	}
+
+	same := base
+	same.Recipient = "+" + base.Recipient
+	same.AllowDuplicate, same.Queue, same.IdempotencyKey = true, true, "retry-1"
+	if duplicateKey(same) != duplicateKey(base) {
+		t.Error("delivery flags or a leading + changed the key of an identical message")
+	}
+}
+
+func TestFallbackRerouteOnlyForUnreachableRecipients(t *testing.T) {
+	for result, want := range map[string]string{
+		"Error sending message: server returned error 403": sendErrRecipientBlocked,
+		"Error sending message: server returned error 400": sendErrRejected,
+		"Recipient 15550001111 is not on WhatsApp":         sendErrRecipientNotOnWhatsApp,
+	} {
+		if got := classifySendFailure(result); got != want {
+			t.Errorf("classifySendFailure(%q) = %s, want %s", result, got, want)
+		}
+	}
+
+	store := newBenchStore(t)
+	received := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Event struct {
+				ErrorCode string `json:"error_code"`
+			} `json:"send_undeliverable"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body.Event.ErrorCode
+	}))
+	defer server.Close()
+	webhookAllowedHosts["127.0.0.1"] = true
+	fallbackWebhook = &Webhook{ID: fallbackWebhookID, URL: server.URL, MediaMode: webhookMediaMetadata}
+	t.Cleanup(func() {
+		delete(webhookAllowedHosts, "127.0.0.1")
+		fallbackWebhook = nil
+	})
+
+	req := SendMessageRequest{Recipient: "15550001111", Message: "hello"}
+	rerouteIfUndeliverable(store, req, sendErrRejected, "Error sending message: server returned error 400")
+	rerouteIfUndeliverable(store, req, sendErrRecipientBlocked, "Error sending message: server returned error 403")
+	select {
+	case code := <-received:
+		if code != sendErrRecipientBlocked {
+			t.Errorf("fallback webhook received %q, want only the blocked send", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocked send never reached the fallback webhook")
+	}
+	select {
+	case code := <-received:
+		t.Errorf("fallback webhook also received %q", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQueueStatsIncludeOutbox(t *testing.T) {
+	store := newBenchStore(t)
+	for _, id := range []string{"q1", "q2"} {
+		if _, _, err := store.EnqueueSend(QueuedSend{ID: id, Request: SendMessageRequest{Recipient: "15550001111", Message: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queues, err := collectQueueStats(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, queue := range queues {
+		if queue.Name == "outbox" {
+			if queue.Depth != 2 {
+				t.Errorf("outbox depth = %d, want 2", queue.Depth)
+			}
+			return
+		}
+	}
+	t.Error("collectQueueStats has no outbox queue")
+}
+
+func TestBroadcastListSkipsOptedOutMembers(t *testing.T) {
+	store := newBenchStore(t)
+	list, _ := types.ParseJID("1700000000@broadcast")
+	if err := store.StoreBroadcastList(list.String(), "Customers", []string{"15550001111@s.whatsapp.net", "15550002222@s.whatsapp.net"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddOptOut("15550001111", "api", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The opted-out member is skipped, not counted as a failed send
+	_, result := dispatchSendRequest(context.Background(), nil, store, SendMessageRequest{Recipient: list.String(), Message: "hello"})
+	if strings.Contains(result, "15550001111") || !strings.Contains(result, "failed for all 1 recipients; 1 opted out skipped") {
+		t.Errorf("result = %q, want only 15550002222 attempted", result)
+	}
+
+	if _, err := store.AddOptOut("15550002222", "api", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if ok, result := dispatchSendRequest(context.Background(), nil, store, SendMessageRequest{Recipient: list.String(), Message: "hello"}); ok || !strings.Contains(result, "opted out") {
+		t.Errorf("list where everyone opted out returned %v, %q", ok, result)
+	}
+}
+
+func TestMediaDownloadLocksAreReleased(t *testing.T) {
+	unlock := lockMediaDownload("/media/a.jpg")
+	acquired := make(chan func())
+	go func() { acquired <- lockMediaDownload("/media/a.jpg") }()
+	select {
+	case <-acquired:
+		t.Fatal("a second download of the same file didn't wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	(<-acquired)()
+
+	mediaDownloadLocks.Lock()
+	defer mediaDownloadLocks.Unlock()
+	if n := len(mediaDownloadLocks.byPath); n != 0 {
+		t.Errorf("%d download locks left after every download finished", n)
+	}
+}
+
+func TestDownloadPoolQueueIsBounded(t *testing.T) {
+	store := newBenchStore(t)
+	pool := NewDownloadWorkerPool(0, 0) // Clamped to one worker and a queue of one
+	pool.store = store
+
+	first := downloadJobs.Create("MSG1", "15550001111@s.whatsapp.net", "")
+	second := downloadJobs.Create("MSG2", "15550001111@s.whatsapp.net", "")
+	if err := pool.Enqueue(first.ID); err != nil {
+		t.Fatalf("first job: %v", err)
+	}
+	if err := pool.Enqueue(second.ID); err != errDownloadQueueFull {
+		t.Fatalf("second job returned %v, want errDownloadQueueFull", err)
+	}
+	if job, _ := downloadJobs.Get(second.ID); job.Status != "failed" {
+		t.Errorf("rejected job status = %q, want failed", job.Status)
+	}
+
+	// Only the accepted job is kept for restart recovery
+	pending, err := store.GetPendingDownloads(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].JobID != first.ID {
+		t.Errorf("pending downloads = %+v, want only %s", pending, first.ID)
+	}
+}
+
+func TestWebhookMediaModes(t *testing.T) {
+	store := newBenchStore(t)
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	message := WebhookMessage{ID: "MSG1", ChatJID: "15550001111@s.whatsapp.net", MediaType: "image", FileLength: 10, LocalPath: path}
+
+	if media := buildWebhookMedia(nil, store, Webhook{MediaMode: webhookMediaMetadata}, message); media.URL != "" || media.Base64 != "" {
+		t.Errorf("metadata mode carried the file: %+v", media)
+	}
+	if media := buildWebhookMedia(nil, store, Webhook{MediaMode: webhookMediaURL}, message); media.Mode != webhookMediaURL || media.URL == "" {
+		t.Errorf("url mode = %+v, want a stream URL", media)
+	}
+	media := buildWebhookMedia(nil, store, Webhook{MediaMode: webhookMediaInline, InlineMaxBytes: 10}, message)
+	if decoded, _ := base64.StdEncoding.DecodeString(media.Base64); media.Mode != webhookMediaInline || string(decoded) != "0123456789" {
+		t.Errorf("inline mode = %+v, want the file inline", media)
+	}
+	// Over the threshold, inline falls back to a stream URL
+	if media := buildWebhookMedia(nil, store, Webhook{MediaMode: webhookMediaInline, InlineMaxBytes: 5}, message); media.Mode != webhookMediaURL || media.Base64 != "" {
+		t.Errorf("oversized inline = %+v, want a stream URL", media)
+	}
+}
+
+func TestEventInvitesAndResponses(t *testing.T) {
+	event := &waProto.EventMessage{
+		Name:       proto.String("Planning, Q3"),
+		StartTime:  proto.Int64(1760000000),
+		IsCanceled: proto.Bool(true),
+		Location:   &waProto.LocationMessage{Name: proto.String("Office")},
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(formatEventMessage(event)), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed["type"] != "event" || parsed["name"] != "Planning, Q3" || parsed["start_time"] != "2025-10-09T08:53:20Z" {
+		t.Errorf("formatEventMessage = %v", parsed)
+	}
+	ics := buildEventICS("MSG1@whatsapp", "Team", event)
+	for _, want := range []string{"SUMMARY:Planning\\, Q3", "DTSTART:20251009T085320Z", "LOCATION:Office", "STATUS:CANCELLED"} {
+		if !strings.Contains(ics, want) {
+			t.Errorf("ICS is missing %q:\n%s", want, ics)
+		}
+	}
+
+	// A new RSVP from the same participant replaces the old one
+	store := newBenchStore(t)
+	chat := "120363000000000000@g.us"
+	now := time.Now()
+	store.StoreEventResponse("MSG1", chat, "15550001111", "maybe", 0, now)
+	store.StoreEventResponse("MSG1", chat, "15550001111", "going", 2, now.Add(time.Second))
+	store.StoreEventResponse("MSG1", chat, "15550002222", "not_going", 0, now)
+	responses, err := store.GetEventResponses("MSG1", chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 || responses[1].Responder != "15550001111" || responses[1].Response != "going" || responses[1].ExtraGuests != 2 {
+		t.Errorf("responses = %+v, want the latest answer per participant", responses)
+	}
+}
+
+func TestChatTypeClassification(t *testing.T) {
+	store := newBenchStore(t)
+	chats := map[string]string{
+		"15550001111@s.whatsapp.net":    chatTypeIndividual,
+		"120363000000000001@g.us":       chatTypeGroup,
+		"1700000000@broadcast":          chatTypeBroadcast,
+		"status@broadcast":              chatTypeStatus,
+		"120363000000000002@newsletter": chatTypeNewsletter,
+	}
+	for jid := range chats {
+		if err := store.StoreChat(jid, "", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A community parent keeps its type when new messages upsert the chat
+	community := "120363000000000003@g.us"
+	if err := store.SetChatType(community, chatTypeCommunity); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreChat(community, "Neighbours", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	chats[community] = chatTypeCommunity
+
+	for jid, want := range chats {
+		var got string
+		if err := store.db.QueryRow("SELECT chat_type FROM chats WHERE jid = ?", jid).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("chat_type of %s = %q, want %q", jid, got, want)
+		}
+	}
+
+	if filter, err := parseChatTypes(" Group, individual ,"); err != nil || !slices.Equal(filter, []string{chatTypeGroup, chatTypeIndividual}) {
+		t.Errorf("parseChatTypes = %v, %v", filter, err)
+	}
+	if _, err := parseChatTypes("channel"); err == nil {
+		t.Error("parseChatTypes accepted an unknown type")
+	}
+}
+
+func TestBroadcastListStorage(t *testing.T) {
+	store := newBenchStore(t)
+	list := "1700000000@broadcast"
+	if err := store.StoreBroadcastList(list, "Customers", []string{"15550001111@s.whatsapp.net", "15550002222@s.whatsapp.net"}); err != nil {
+		t.Fatal(err)
+	}
+	// A send seen without a name or recipients keeps what history sync learned
+	if err := store.StoreBroadcastList(list, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	lists, err := store.GetBroadcastLists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 1 || lists[0].Name != "Customers" || len(lists[0].Recipients) != 2 {
+		t.Fatalf("lists = %+v, want Customers with 2 recipients", lists)
+	}
+
+	// New recipients replace the old ones
+	if err := store.StoreBroadcastList(list, "", []string{"15550003333@s.whatsapp.net"}); err != nil {
+		t.Fatal(err)
+	}
+	recipients, err := store.GetBroadcastRecipients(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(recipients, []string{"15550003333@s.whatsapp.net"}) {
+		t.Errorf("recipients = %v, want only the latest", recipients)
+	}
+}
+
+func TestGroupMentions(t *testing.T) {
+	if _, err := buildGroupMentionContext(context.Background(), nil, SendOptions{GroupMentions: []string{"15550001111@s.whatsapp.net"}}); err == nil {
+		t.Error("a user JID was accepted as a group mention")
+	}
+	contextInfo, err := buildGroupMentionContext(context.Background(), nil, SendOptions{MentionAll: true})
+	if err != nil || contextInfo.GetNonJIDMentions() != nonJIDMentionAll {
+		t.Errorf("@all context = %v, %v", contextInfo, err)
+	}
+
+	store := newBenchStore(t)
+	const chatJID = "120363000000000001@g.us"
+	timestamp := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.StoreChat(chatJID, "Team", timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreMessage("MSG1", chatJID, "15550001111", "@all standup", "text", timestamp, false, "", "", "", nil, nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	mentions := []GroupMentionInfo{{GroupJID: "120363000000000002@g.us", Subject: "Announcements"}}
+	if err := store.StoreGroupMentions("MSG1", chatJID, true, mentions); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := store.db.Query("SELECT "+apiMessageColumns+" FROM messages m LEFT JOIN chats c ON c.jid = m.chat_jid WHERE m.id = ?", "MSG1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	messages := scanAPIMessages(rows, false)
+	if len(messages) != 1 || !messages[0].MentionsAll || !slices.Equal(messages[0].GroupMentions, mentions) {
+		t.Errorf("stored mentions = %+v", messages)
+	}
+}
+
+func TestCompanionDeviceActivity(t *testing.T) {
+	for id, want := range map[string]string{
+		"3EB0C431C26A1916E7B1A3":           "web",
+		"3A1B2C3D4E5F60718293":             "ios",
+		"ABCDEF0123456789ABCDEF0123456789": "android",
+		"3F0123456789ABCD":                 "desktop",
+		"X":                                "unknown",
+	} {
+		if got := platformFromMessageID(id); got != want {
+			t.Errorf("platformFromMessageID(%q) = %s, want %s", id, got, want)
+		}
+	}
+
+	store := newBenchStore(t)
+	seen := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.StoreDeviceActivity(3, "ios", seen)
+	// A receipt (platform unknown) that arrives late neither hides the platform nor moves last_seen back
+	store.StoreDeviceActivity(3, "unknown", seen.Add(-time.Hour))
+	activity, err := store.GetDeviceActivity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := activity[3]; device.Platform != "ios" || device.LastSeen != "2026-01-01T12:00:00Z" {
+		t.Errorf("device 3 = %+v, want ios last seen at 12:00", device)
+	}
+}
+
+func TestRecoverPendingWork(t *testing.T) {
+	store := newBenchStore(t)
+	webhook := &Webhook{ID: "hook", URL: "https://hooks.example.com/in", MediaMode: webhookMediaMetadata, CreatedAt: time.Now()}
+	if err := store.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := store.AddWebhookDelivery("hook", 1, []byte(`{"event":"test"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddWebhookDelivery("deleted-hook", 2, []byte(`{"event":"test"}`)); err != nil {
+		t.Fatal(err)
+	}
+	job := downloadJobs.Create("MSG1", "15550001111@s.whatsapp.net", "")
+	if err := store.AddPendingDownload(*job); err != nil {
+		t.Fatal(err)
+	}
+
+	recoverPendingWork(nil, store, time.Now().Add(time.Second))
+
+	// The delivery is handed to the retry worker; the one for a removed webhook is dropped
+	deliveries, err := store.GetWebhookDeliveries(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].ID != kept {
+		t.Errorf("deliveries after recovery = %+v, want only %d", deliveries, kept)
+	}
+	// Without download workers the interrupted download can't resume, so it isn't kept around
+	if pending, _ := store.GetPendingDownloads(time.Now().Add(time.Minute)); len(pending) != 0 {
+		t.Errorf("pending downloads after recovery = %+v, want none", pending)
+	}
+}
+
+func TestDrainRefusesNewSendsAndWaitsForInflight(t *testing.T) {
+	t.Cleanup(drainState.resume)
+	release := make(chan struct{})
+	handler := drainGuard(func(w http.ResponseWriter, r *http.Request) { <-release })
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/send", nil))
+		close(done)
+	}()
+	for drainState.snapshot()["inflight_sends"].(int) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	drainState.start()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/api/send", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("send while draining returned %d, want 503 with Retry-After", recorder.Code)
+	}
+	if drainState.wait(context.Background(), 50*time.Millisecond) {
+		t.Error("drain reported idle with a send still in flight")
+	}
+	close(release)
+	<-done
+	if !drainState.wait(context.Background(), time.Second) {
+		t.Error("drain didn't finish once the in-flight send returned")
+	}
+}
+
+func TestSessionStateMachine(t *testing.T) {
+	var seen []string
+	state := &ReconnectionState{state: SessionUnpaired, maxReconnectAttempts: 2}
+	state.onTransition = func(from, to SessionState, reason string) {
+		seen = append(seen, string(from)+">"+string(to))
+	}
+
+	if !state.transition(SessionPairing, "qr issued") || !state.transition(SessionConnected, "paired") {
+		t.Fatal("pairing transitions were refused")
+	}
+	if state.transition(SessionPairing, "stray qr") {
+		t.Error("CONNECTED -> PAIRING is not a defined transition but was taken")
+	}
+	if state.transition(SessionConnected, "again") {
+		t.Error("a transition to the current state reported a change")
+	}
+	state.transition(SessionDegraded, "disconnected")
+	if state.current() != SessionDegraded || !slices.Equal(seen, []string{"UNPAIRED>PAIRING", "PAIRING>CONNECTED", "CONNECTED>DEGRADED"}) {
+		t.Errorf("state = %s, transitions = %v", state.current(), seen)
+	}
+
+	// A degraded session needs a QR scan only once reconnecting has given up
+	if state.needsReauthLocked() {
+		t.Error("degraded session reported needing re-auth before reconnect attempts ran out")
+	}
+	state.reconnectAttempts = 2
+	if !state.needsReauthLocked() {
+		t.Error("degraded session with no reconnect attempts left didn't report needing re-auth")
+	}
+}
+
+func TestQRCodeRendering(t *testing.T) {
+	const raw = "2@pairing-ref,noise-key,identity-key,adv-secret"
+	if err := storeQRCode(raw, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(clearQRCode)
+	mux := newSessionMux(nil, newBenchStore(t))
+	get := func(query string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/qr-code"+query, nil))
+		var body map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &body)
+		return recorder.Code, body
+	}
+
+	if code, body := get("?format=raw"); code != http.StatusOK || body["qr_code"] != raw {
+		t.Errorf("raw format = %d %v", code, body)
+	}
+	if code, body := get("?format=svg&size=512&level=highest"); code != http.StatusOK || !strings.HasPrefix(fmt.Sprint(body["qr_code"]), `<svg xmlns="http://www.w3.org/2000/svg" width="512"`) {
+		t.Errorf("svg format = %d %v", code, body)
+	}
+	code, body := get("?size=128&level=low")
+	qrPNG, _ := base64.StdEncoding.DecodeString(fmt.Sprint(body["qr_code"]))
+	if img, err := png.DecodeConfig(bytes.NewReader(qrPNG)); code != http.StatusOK || err != nil || img.Width != 128 {
+		t.Errorf("png at size 128 = %d, %v, %v", code, img, err)
+	}
+	for _, query := range []string{"?format=gif", "?size=10", "?level=extreme"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s returned %d, want 400", query, code)
+		}
+	}
+}
+
+func TestQRGeneratedWebhook(t *testing.T) {
+	store := newBenchStore(t)
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer server.Close()
+	webhookAllowedHosts["127.0.0.1"] = true
+	t.Cleanup(func() { delete(webhookAllowedHosts, "127.0.0.1") })
+	if err := store.CreateWebhook(&Webhook{ID: "onboarding", URL: server.URL, MediaMode: webhookMediaMetadata, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	publishQRGenerated(store, "2@pairing-ref", 20*time.Second)
+	select {
+	case body := <-received:
+		event, _ := body["qr_generated"].(map[string]interface{})
+		if body["event"] != "qr_generated" || event["code"] != "2@pairing-ref" || event["timeout_sec"] != float64(20) {
+			t.Errorf("webhook body = %v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("qr_generated never reached the webhook")
+	}
+}
+
+func TestChatTagsAndNotes(t *testing.T) {
+	store := newBenchStore(t)
+	const vip, lead = "15550001111@s.whatsapp.net", "15550002222@s.whatsapp.net"
+	for _, jid := range []string{vip, lead, "15550003333@s.whatsapp.net"} {
+		if err := store.StoreChat(jid, "", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags, err := normalizeChatTags([]string{" VIP ", "vip", "", "billing"})
+	if err != nil || !slices.Equal(tags, []string{"VIP", "billing"}) {
+		t.Fatalf("normalizeChatTags = %v, %v", tags, err)
+	}
+	if _, err := normalizeChatTags([]string{"a,b"}); err == nil {
+		t.Error("a tag with a comma was accepted")
+	}
+	if err := store.UpdateChatTags(vip, &tags, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateChatTags(vip, nil, []string{"renewal"}, []string{"billing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetChatNotes(lead, "Call back on Monday"); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := store.GetChatMetadata(vip)
+	if err != nil || !slices.Equal(metadata.Tags, []string{"VIP", "renewal"}) {
+		t.Errorf("metadata = %+v, %v; want tags VIP and renewal", metadata, err)
+	}
+	// Only annotated chats are listed, narrowed by tag when asked
+	annotated, err := store.GetAnnotatedChats(nil)
+	if err != nil || len(annotated) != 2 {
+		t.Errorf("annotated chats = %+v, %v; want the two with tags or notes", annotated, err)
+	}
+	tagged, err := store.GetAnnotatedChats([]string{"renewal"})
+	if err != nil || len(tagged) != 1 || tagged[0].ChatJID != vip {
+		t.Errorf("chats tagged renewal = %+v, %v", tagged, err)
+	}
+
+	// Clearing the notes drops the chat from the list
+	if err := store.SetChatNotes(lead, ""); err != nil {
+		t.Fatal(err)
+	}
+	if annotated, _ := store.GetAnnotatedChats(nil); len(annotated) != 1 {
+		t.Errorf("annotated chats after clearing notes = %+v", annotated)
+	}
+}
+
+func TestChatAssignmentHandoff(t *testing.T) {
+	store := newBenchStore(t)
+	mux := newSessionMux(nil, store)
+	const chat = "15550001111@s.whatsapp.net"
+	assign := func(body string) (int, ChatAssignment) {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/chat-assignment", strings.NewReader(body)))
+		var response struct {
+			Assignment ChatAssignment `json:"assignment"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response.Assignment
+	}
+
+	if assignment, err := store.GetChatAssignment(chat); err != nil || assignment.State != handoffStateBot {
+		t.Errorf("unassigned chat = %+v, %v; want the bot", assignment, err)
+	}
+	if _, assignment := assign(`{"chat_jid":"` + chat + `","state":"Human","assignee":"maria"}`); assignment.State != handoffStateHuman || assignment.Assignee != "maria" {
+		t.Errorf("handoff to a human = %+v", assignment)
+	}
+	// Closing keeps the assignee unless another is given; handing back to the bot clears it
+	if _, assignment := assign(`{"chat_jid":"` + chat + `","state":"closed"}`); assignment.Assignee != "maria" {
+		t.Errorf("closed chat = %+v, want maria kept", assignment)
+	}
+	if _, assignment := assign(`{"chat_jid":"` + chat + `","state":"bot","assignee":"maria"}`); assignment.State != handoffStateBot || assignment.Assignee != "" {
+		t.Errorf("chat handed back = %+v, want no assignee", assignment)
+	}
+	if code, _ := assign(`{"chat_jid":"` + chat + `","state":"escalated"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown state returned %d, want 400", code)
+	}
+}
+
+func TestWelcomeOnlyOnFirstContact(t *testing.T) {
+	store := newBenchStore(t)
+	const newContact, knownContact = "15550001111@s.whatsapp.net", "15550002222@s.whatsapp.net"
+	if err := store.StoreChat(knownContact, "Known", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed, err := store.ClaimWelcome(newContact); err != nil || !claimed {
+		t.Errorf("first message from a new contact: claimed = %v, %v", claimed, err)
+	}
+	if claimed, _ := store.ClaimWelcome(newContact); claimed {
+		t.Error("the welcome was claimed twice for the same contact")
+	}
+	if claimed, _ := store.ClaimWelcome(knownContact); claimed {
+		t.Error("a contact with earlier messages was welcomed")
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	for _, tt := range []struct {
+		msg  *waProto.Message
+		want string
+	}{
+		{&waProto.Message{Conversation: proto.String("hi")}, contentTypeText},
+		{&waProto.Message{ImageMessage: &waProto.ImageMessage{}}, contentTypeMedia},
+		{&waProto.Message{LocationMessage: &waProto.LocationMessage{}}, contentTypeLocation},
+		{&waProto.Message{ListResponseMessage: &waProto.ListResponseMessage{}}, contentTypeListResponse},
+		{&waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{}}, contentTypeContact},
+		{&waProto.Message{EventMessage: &waProto.EventMessage{}}, contentTypeEvent},
+	} {
+		if got := extractContentType(tt.msg); got != tt.want {
+			t.Errorf("extractContentType(%v) = %s, want %s", tt.msg, got, tt.want)
+		}
+	}
+
+	store := newBenchStore(t)
+	const chatJID = "15550001111@s.whatsapp.net"
+	now := time.Now()
+	if err := store.StoreChat(chatJID, "Alice", now); err != nil {
+		t.Fatal(err)
+	}
+	for id, contentType := range map[string]string{"TEXT": contentTypeText, "PICK": contentTypeListResponse} {
+		if err := store.StoreMessage(id, chatJID, "15550001111", id, contentType, now, false, "", "", "", nil, nil, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := newSessionMux(nil, store)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/messages?content_type=list_response&since="+url.QueryEscape(now.Add(-time.Minute).Format(time.RFC3339)), nil))
+	var response struct {
+		Messages []APIMessage `json:"messages"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if len(response.Messages) != 1 || response.Messages[0].ID != "PICK" || response.Messages[0].ContentType != contentTypeListResponse {
+		t.Errorf("content_type=list_response returned %s", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/messages?content_type=sticker_pack", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("unknown content_type returned %d, want 400", recorder.Code)
+	}
+}
+
+func TestWebhookStatsAndRedelivery(t *testing.T) {
+	store := newBenchStore(t)
+	var failures atomic.Int32
+	failures.Store(1)
+	received := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+	webhookAllowedHosts["127.0.0.1"] = true
+	t.Cleanup(func() { delete(webhookAllowedHosts, "127.0.0.1") })
+	webhook := &Webhook{ID: "hook", URL: server.URL, MediaMode: webhookMediaMetadata, CreatedAt: time.Now()}
+	if err := store.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	eventID := recordEvent(store, "chat_assigned", map[string]interface{}{"chat_jid": "15550001111@s.whatsapp.net"})
+	body, _ := eventWebhookBody("chat_assigned", eventID, map[string]interface{}{"chat_jid": "15550001111@s.whatsapp.net"})
+	if err := deliverWebhook(store, *webhook, eventID, body); err == nil {
+		t.Fatal("first delivery should have failed")
+	}
+
+	// Redelivering the recorded event by ID reaches the endpoint again
+	mux := newSessionMux(nil, store)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/webhooks/redeliver", strings.NewReader(fmt.Sprintf(`{"event_id":%d}`, eventID))))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("redeliver returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if delivered := <-received; !strings.Contains(delivered, `"chat_assigned"`) {
+		t.Errorf("redelivered body = %s", delivered)
+	}
+
+	stats, err := store.GetWebhookStats()
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("stats = %+v, %v", stats, err)
+	}
+	if stat := stats[0]; stat.Delivered != 1 || stat.Failed != 1 || stat.SuccessRate != 0.5 || stat.LastError == "" || stat.PendingRetries != 1 {
+		t.Errorf("stats = %+v, want one success, one failure and the failed delivery awaiting retry", stat)
+	}
+}
+
+func TestCampaignLifecycle(t *testing.T) {
+	if got := renderTemplate("Hi {name}, your code is {code}", map[string]string{"name": "Ana"}); got != "Hi Ana, your code is {code}" {
+		t.Errorf("renderTemplate = %q", got)
+	}
+
+	store := newBenchStore(t)
+	recipients := []CampaignRecipient{
+		{Recipient: "15550001111", Variables: map[string]string{"name": "Ana"}, Status: recipientPending},
+		{Recipient: "15550002222", Status: recipientPending},
+		{Recipient: "15550003333", Status: recipientInvalid, Error: "Not on WhatsApp"},
+	}
+	if err := store.CreateCampaign(Campaign{ID: "c1", Name: "launch", Template: "Hi {name}", Status: campaignRunning, MessagesPerMinute: 10}, nil, recipients); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients go out in order; a sent one stops being next
+	next, found, err := store.NextCampaignRecipient("c1")
+	if err != nil || !found || next.Recipient != "15550001111" || next.Variables["name"] != "Ana" {
+		t.Fatalf("first recipient = %+v, %v, %v", next, found, err)
+	}
+	if err := store.SetCampaignRecipientResult("c1", next.Recipient, recipientSent, "MSG1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if next, _, _ := store.NextCampaignRecipient("c1"); next.Recipient != "15550002222" {
+		t.Errorf("second recipient = %+v", next)
+	}
+	if err := store.MarkCampaignReceipt([]types.MessageID{"MSG1"}, true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.GetCampaignStats("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 3 || stats.Sent != 1 || stats.Delivered != 1 || stats.Read != 1 || stats.Pending != 1 || stats.Invalid != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Status changes only apply from the listed states, so a finished campaign can't be resumed
+	if ok, _ := store.SetCampaignStatus("c1", campaignCompleted, campaignRunning); !ok {
+		t.Error("running campaign couldn't complete")
+	}
+	if ok, _ := store.SetCampaignStatus("c1", campaignRunning, campaignPaused); ok {
+		t.Error("completed campaign was resumed")
+	}
+}
+
+func TestTimestampMigrationRunsOnceAndKeepsFractions(t *testing.T) {
+	store := newBenchStore(t)
+	stored := func(jid string) string {
+		var value string
+		if err := store.writer.QueryRow("SELECT CAST(last_message_time AS TEXT) FROM chats WHERE jid = ?", jid).Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	insert := func(jid, value string) {
+		if _, err := store.writer.Exec("INSERT INTO chats (jid, last_message_time) VALUES (?, ?)", jid, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	columns := []timestampColumn{{"chats", "last_message_time"}}
+
+	// Opening the store ran it; clear the marker to run it against rows from an older build
+	if _, err := store.writer.Exec("DELETE FROM schema_markers WHERE name = ?", utcTimestampsMarker); err != nil {
+		t.Fatal(err)
+	}
+	insert("local@s.whatsapp.net", "2026-01-01 09:30:15.123456789+02:00")
+	if err := migrateTimestampsToUTC(store.writer, columns); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored("local@s.whatsapp.net"); got != "2026-01-01 07:30:15.123456789+00:00" {
+		t.Errorf("migrated timestamp = %q, want the same instant in UTC with its nanoseconds", got)
+	}
+
+	// Once marked, later starts leave rows alone
+	insert("later@s.whatsapp.net", "2026-01-01 09:30:15+02:00")
+	if err := migrateTimestampsToUTC(store.writer, columns); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored("later@s.whatsapp.net"); got != "2026-01-01 09:30:15+02:00" {
+		t.Errorf("second run rewrote %q", got)
+	}
+}